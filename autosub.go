@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	autoSubClientID = "%c" // replaced with the client id in an auto subscription filter
+	autoSubUsername = "%u" // replaced with the username in an auto subscription filter
+)
+
+// AutoSubscription is a subscription which the server adds on behalf of a client when its
+// session is established. The %c and %u placeholders in the filter are replaced with the
+// client id and username.
+type AutoSubscription struct {
+	Filter            string `yaml:"filter" json:"filter"`                           // the topic filter, which may contain placeholders
+	Qos               byte   `yaml:"qos" json:"qos"`                                 // the maximum qos of the subscription
+	NoLocal           bool   `yaml:"no_local" json:"no_local"`                       // don't receive messages published by the client
+	RetainAsPublished bool   `yaml:"retain_as_published" json:"retain_as_published"` // keep the retain flag of forwarded messages
+	RetainHandling    byte   `yaml:"retain_handling" json:"retain_handling"`         // 0 send retained, 1 send retained if new, 2 don't send retained
+	Identifier        int    `yaml:"identifier" json:"identifier"`                   // an optional subscription identifier
+}
+
+// filter returns the filter of the auto subscription with the placeholders replaced for a
+// client. ok is false if the client id or username would produce a filter which overlaps
+// with those of other clients, or the filter needs a username and the client has none.
+func (a AutoSubscription) filter(cl *Client) (string, bool) {
+	username := string(cl.Properties.Username)
+	if strings.Contains(a.Filter, autoSubClientID) && strings.ContainsAny(cl.ID, "/+#") {
+		return "", false
+	}
+
+	if strings.Contains(a.Filter, autoSubUsername) && (username == "" || strings.ContainsAny(username, "/+#")) {
+		return "", false
+	}
+
+	return strings.NewReplacer(
+		autoSubClientID, cl.ID,
+		autoSubUsername, username,
+	).Replace(a.Filter), true
+}
+
+// autoSubscribe subscribes a client to the global auto subscriptions and any selected by
+// hooks, as if the client had sent a subscribe packet, but without sending a suback.
+func (s *Server) autoSubscribe(cl *Client) {
+	subs := make([]AutoSubscription, len(s.Options.AutoSubscriptions))
+	copy(subs, s.Options.AutoSubscriptions)
+	subs = s.hooks.OnAutoSubscribe(cl, subs)
+	if len(subs) == 0 {
+		return
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Filters:         make(packets.Subscriptions, 0, len(subs)),
+	}
+
+	for _, v := range subs {
+		filter, ok := v.filter(cl)
+		if !ok {
+			s.Log.Warn("skipped auto subscription", "filter", v.Filter, "client", cl.ID)
+			continue
+		}
+
+		pk.Filters = append(pk.Filters, packets.Subscription{
+			Filter:            filter,
+			Qos:               v.Qos,
+			NoLocal:           v.NoLocal,
+			RetainAsPublished: v.RetainAsPublished,
+			RetainHandling:    v.RetainHandling,
+			Identifier:        v.Identifier,
+		})
+	}
+
+	pk = s.hooks.OnSubscribe(cl, pk)
+	if len(pk.Filters) == 0 {
+		return
+	}
+
+	reasonCodes, filterExisted := s.subscribeFilters(cl, pk, packets.CodeSuccess)
+	s.hooks.OnSubscribed(cl, pk, reasonCodes)
+
+	for i, sub := range pk.Filters {
+		if reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			s.Log.Warn("auto subscription refused", "filter", sub.Filter, "client", cl.ID, "code", reasonCodes[i])
+			continue
+		}
+
+		s.publishRetainedToClient(cl, sub, filterExisted[i])
+	}
+}
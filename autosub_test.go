@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+type autoSubHook struct {
+	HookBase
+	sync.Mutex
+	add        []AutoSubscription
+	subscribed []packets.Subscription
+	codes      []byte
+	sent       []byte
+}
+
+func (h *autoSubHook) ID() string {
+	return "auto-sub"
+}
+
+func (h *autoSubHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnAutoSubscribe, OnSubscribed, OnPacketSent}, []byte{b})
+}
+
+func (h *autoSubHook) OnAutoSubscribe(cl *Client, subs []AutoSubscription) []AutoSubscription {
+	return append(subs, h.add...)
+}
+
+func (h *autoSubHook) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.subscribed = append(h.subscribed, pk.Filters...)
+	h.codes = append(h.codes, reasonCodes...)
+}
+
+func (h *autoSubHook) OnPacketSent(cl *Client, pk packets.Packet, b []byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.sent = append(h.sent, pk.FixedHeader.Type)
+}
+
+func TestAutoSubscriptionFilter(t *testing.T) {
+	cl := &Client{ID: "dev-1", Properties: ClientProperties{Username: []byte("fleet")}}
+	tt := []struct {
+		cl     *Client
+		filter string
+		out    string
+		ok     bool
+	}{
+		{cl: cl, filter: "cmd/%c/#", out: "cmd/dev-1/#", ok: true},
+		{cl: cl, filter: "users/%u/%c", out: "users/fleet/dev-1", ok: true},
+		{cl: cl, filter: "broadcast/#", out: "broadcast/#", ok: true},
+		{cl: &Client{ID: "dev/1"}, filter: "cmd/%c/#"},
+		{cl: &Client{ID: "dev+1"}, filter: "cmd/%c/#"},
+		{cl: &Client{ID: "dev#1"}, filter: "broadcast/#", out: "broadcast/#", ok: true},
+		{cl: &Client{ID: "dev-1"}, filter: "users/%u"},
+		{cl: &Client{ID: "dev-1", Properties: ClientProperties{Username: []byte("a/b")}}, filter: "users/%u"},
+	}
+
+	for _, tx := range tt {
+		out, ok := AutoSubscription{Filter: tx.filter}.filter(tx.cl)
+		require.Equal(t, tx.out, out, tx.filter)
+		require.Equal(t, tx.ok, ok, tx.filter)
+	}
+}
+
+func TestHooksOnAutoSubscribe(t *testing.T) {
+	h := new(Hooks)
+	require.NoError(t, h.Add(&autoSubHook{add: []AutoSubscription{{Filter: "a/#"}}}, nil))
+	require.NoError(t, h.Add(new(HookBase), nil))
+	require.NoError(t, h.Add(&autoSubHook{add: []AutoSubscription{{Filter: "b/#", Qos: 1}}}, nil))
+
+	subs := h.OnAutoSubscribe(new(Client), []AutoSubscription{{Filter: "x"}})
+	require.Equal(t, []AutoSubscription{{Filter: "x"}, {Filter: "a/#"}, {Filter: "b/#", Qos: 1}}, subs)
+}
+
+func TestServerAutoSubscribe(t *testing.T) {
+	hook := new(autoSubHook)
+	_, l := newMemoryTestServer(t, &Options{
+		AutoSubscriptions: []AutoSubscription{
+			{Filter: "cmd/%c/#", Qos: 1},
+			{Filter: "broadcast/#"},
+		},
+	}, new(AllowHook), hook)
+
+	got := make(chan packets.Packet, 2)
+	connectMemoryTestClient(t, l, "dev-1", "", func(c *client.Client, pk packets.Packet) {
+		got <- pk
+	})
+	require.Eventually(t, func() bool {
+		hook.Lock()
+		defer hook.Unlock()
+		return len(hook.subscribed) == 2
+	}, time.Second, time.Millisecond) // subscriptions are added after the connack is sent.
+
+	pub := connectMemoryTestClient(t, l, "ops", "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, pub.Publish(ctx, "cmd/dev-1/reboot", []byte("now"), 1, false))
+	require.NoError(t, pub.Publish(ctx, "broadcast/all", []byte("hello"), 0, false))
+
+	for _, want := range []string{"cmd/dev-1/reboot", "broadcast/all"} {
+		select {
+		case pk := <-got:
+			require.Equal(t, want, pk.TopicName)
+		case <-ctx.Done():
+			t.Fatal("message not received")
+		}
+	}
+
+	hook.Lock()
+	defer hook.Unlock()
+	require.Len(t, hook.subscribed, 4) // both clients are auto subscribed.
+	require.Equal(t, "cmd/dev-1/#", hook.subscribed[0].Filter)
+	require.Equal(t, byte(1), hook.subscribed[0].Qos)
+	require.Equal(t, "broadcast/#", hook.subscribed[1].Filter)
+	require.Equal(t, []byte{1, 0, 1, 0}, hook.codes)
+	require.NotContains(t, hook.sent, packets.Suback)
+}
+
+func TestServerAutoSubscribeState(t *testing.T) {
+	s, l := newMemoryTestServer(t, &Options{
+		AutoSubscriptions: []AutoSubscription{
+			{Filter: "cmd/%c/#", Qos: 1, NoLocal: true},
+			{Filter: "users/%u/#"}, // skipped, as the client has no username
+		},
+	}, new(AllowHook), &autoSubHook{add: []AutoSubscription{{Filter: "extra/%c"}}})
+
+	connectMemoryTestClient(t, l, "dev-1", "", nil)
+
+	cl, ok := s.Clients.Get("dev-1")
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		return cl.State.Subscriptions.Len() == 2
+	}, time.Second, time.Millisecond)
+
+	sub, ok := cl.State.Subscriptions.Get("cmd/dev-1/#")
+	require.True(t, ok)
+	require.Equal(t, byte(1), sub.Qos)
+	require.True(t, sub.NoLocal)
+
+	_, ok = cl.State.Subscriptions.Get("extra/dev-1")
+	require.True(t, ok)
+	require.Len(t, s.Topics.Subscribers("cmd/dev-1/a").Subscriptions, 1)
+}
+
+func TestServerAutoSubscribeACL(t *testing.T) {
+	s, l := newMemoryTestServer(t, &Options{}, new(UsernameHook)) // only topics beneath the username are allowed
+	s.Options.AutoSubscriptions = []AutoSubscription{
+		{Filter: "%u/cmd/%c/#"},
+		{Filter: "broadcast/#"},
+	}
+	hook := new(autoSubHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	connectMemoryTestClient(t, l, "dev-1", "fleet", nil)
+	require.Eventually(t, func() bool {
+		hook.Lock()
+		defer hook.Unlock()
+		return len(hook.codes) == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []byte{0, packets.ErrNotAuthorized.Code}, hook.codes)
+
+	cl, ok := s.Clients.Get("dev-1")
+	require.True(t, ok)
+	require.Equal(t, 1, cl.State.Subscriptions.Len())
+	_, ok = cl.State.Subscriptions.Get("fleet/cmd/dev-1/#")
+	require.True(t, ok)
+	require.Empty(t, s.Topics.Subscribers("broadcast/a").Subscriptions)
+}
+
+func TestServerAutoSubscribeRetained(t *testing.T) {
+	s, l := newMemoryTestServer(t, &Options{}, new(UsernameHook))
+	s.Options.AutoSubscriptions = []AutoSubscription{{Filter: "%u/state"}}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "fleet/state",
+		Payload:     []byte("on"),
+	}
+	s.Topics.RetainMessage(pk)
+
+	got := make(chan packets.Packet, 1)
+	connectMemoryTestClient(t, l, "dev-1", "fleet", func(c *client.Client, pk packets.Packet) {
+		got <- pk
+	})
+
+	select {
+	case pk := <-got:
+		require.Equal(t, "fleet/state", pk.TopicName)
+		require.Equal(t, []byte("on"), pk.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("retained message not received")
+	}
+}
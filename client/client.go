@@ -0,0 +1,1101 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+// Package client is an mqtt v3.1.1 and v5 client built on the broker's own
+// packet encoders. It supports qos 0, 1 and 2 flows, subscription callbacks,
+// and automatic reconnection with session resume over tcp, tls, websocket
+// and unix socket connections.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	defaultConnectTimeout    = 10 * time.Second       // default time allowed to dial and receive a connack
+	defaultMinReconnectDelay = 100 * time.Millisecond // default delay before the first reconnect attempt
+	defaultMaxReconnectDelay = 30 * time.Second       // default maximum delay between reconnect attempts
+	defaultMessageBuffer     = 256                    // default initial capacity of the inbound message queue
+	maxPacketID              = 65535                  // the largest available packet id
+)
+
+var (
+	// ErrNotConnected indicates the client has no active connection to the broker.
+	ErrNotConnected = errors.New("client not connected")
+
+	// ErrAlreadyConnected indicates Connect was called on a client which was already started.
+	ErrAlreadyConnected = errors.New("client already connected")
+
+	// ErrClientClosed indicates the client was disconnected before the operation completed.
+	ErrClientClosed = errors.New("client closed")
+
+	// ErrConnectionLost indicates the connection dropped before the operation completed.
+	ErrConnectionLost = errors.New("connection lost")
+
+	// ErrKeepaliveTimeout indicates the broker did not answer a ping request in time.
+	ErrKeepaliveTimeout = errors.New("keepalive timeout")
+
+	// ErrInflightFull indicates all packet ids are in use.
+	ErrInflightFull = errors.New("no free packet ids")
+
+	// ErrUnsupportedScheme indicates the broker url scheme is not supported by Dial.
+	ErrUnsupportedScheme = errors.New("unsupported url scheme")
+)
+
+// Will contains the last will message sent by the broker if the client disconnects unexpectedly.
+type Will struct {
+	Properties packets.Properties // v5 will properties, eg. WillDelayInterval
+	Payload    []byte             // the will message payload
+	Topic      string             // the topic the will is published to
+	Qos        byte               // the qos of the will message
+	Retain     bool               // retain the will message
+}
+
+// Options contains configurable options for the client.
+type Options struct {
+	// Dial overrides the dialer used to connect to the broker. If nil, Server is
+	// dialed using Dial.
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	// OnConnect is called in a new goroutine each time a connection is established,
+	// including after a reconnect, with the connack packet received from the broker.
+	OnConnect func(c *Client, connack packets.Packet)
+
+	// OnConnectionLost is called when an established connection drops.
+	OnConnectionLost func(c *Client, err error)
+
+	// DefaultHandler receives messages which do not match any subscription handler.
+	DefaultHandler MessageHandler
+
+	TLSConfig         *tls.Config        // tls configuration for tls:// and wss:// servers
+	Will              *Will              // an optional last will message
+	Logger            *slog.Logger       // a logger, defaults to slog.Default
+	Server            string             // the broker url, eg. tcp://127.0.0.1:1883
+	ClientID          string             // the client id, may be empty for clean sessions
+	Username          string             // the username to connect with
+	Password          []byte             // the password to connect with
+	Properties        packets.Properties // v5 connect properties, eg. SessionExpiryInterval
+	ConnectTimeout    time.Duration      // time allowed to dial and receive a connack
+	MinReconnectDelay time.Duration      // delay before the first reconnect attempt
+	MaxReconnectDelay time.Duration      // maximum delay between reconnect attempts
+	MessageBuffer     int                // initial capacity of the inbound message queue, which grows as needed
+	Keepalive         uint16             // keepalive in seconds, 0 to disable
+	ProtocolVersion   byte               // 4 (v3.1.1) or 5, defaults to 4
+	Clean             bool               // CleanSession in v3.1.1, CleanStart on first connect in v5
+	AutoReconnect     bool               // reconnect and resume the session when the connection drops
+}
+
+// pending is an outbound packet awaiting acknowledgement.
+type pending struct {
+	pk       packets.Packet // the outbound packet
+	ack      chan result    // receives the acknowledgement, buffered 1
+	sent     bool           // the packet has been written at least once
+	released bool           // a qos 2 publish has been pubrec'd and is awaiting pubcomp
+}
+
+// result is the outcome of a pending packet.
+type result struct {
+	pk  packets.Packet
+	err error
+}
+
+// Client is an mqtt client.
+type Client struct {
+	opts     Options
+	log      *slog.Logger
+	router   router
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conn     *conn                     // the current connection, nil while disconnected
+	inflight map[uint16]*pending       // outbound packets awaiting acknowledgement
+	subs     map[string]packets.Packet // subscribe packets by filter, for resubscribing
+	received map[uint16]struct{}       // inbound qos 2 packet ids awaiting pubrel
+	messages *inbox                    // inbound messages for the dispatcher
+	done     chan struct{}             // closed when the client has stopped
+	err      error                     // the error which stopped the client
+	mu       sync.Mutex                // guards the connection, session and id state
+	clientID string                    // the client id, possibly assigned by the broker
+	packetID uint16                    // the last packet id issued
+	started  bool                      // Connect has succeeded
+}
+
+// New returns a new instance of a client. Call Connect to connect to the broker.
+func New(opts *Options) *Client {
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	o := *opts
+	if o.ProtocolVersion != 5 {
+		o.ProtocolVersion = 4
+	}
+
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = defaultConnectTimeout
+	}
+
+	if o.MinReconnectDelay <= 0 {
+		o.MinReconnectDelay = defaultMinReconnectDelay
+	}
+
+	if o.MaxReconnectDelay < o.MinReconnectDelay {
+		o.MaxReconnectDelay = defaultMaxReconnectDelay
+	}
+
+	if o.MessageBuffer <= 0 {
+		o.MessageBuffer = defaultMessageBuffer
+	}
+
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		opts:     o,
+		log:      o.Logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		inflight: map[uint16]*pending{},
+		subs:     map[string]packets.Packet{},
+		received: map[uint16]struct{}{},
+		messages: newInbox(o.MessageBuffer),
+		done:     make(chan struct{}),
+		clientID: o.ClientID,
+	}
+}
+
+// ClientID returns the client id, which may have been assigned by the broker.
+func (c *Client) ClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientID
+}
+
+// IsConnected returns true if the client has an active connection.
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Inflight returns the number of outbound packets awaiting acknowledgement.
+func (c *Client) Inflight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.inflight)
+}
+
+// Done returns a channel which is closed when the client has stopped, either
+// because Disconnect was called or because the connection dropped and
+// AutoReconnect is disabled.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error which stopped the client.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Connect connects to the broker. It returns an error if the broker cannot be
+// reached or refuses the connection; automatic reconnection only applies to
+// connections which have been established at least once.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+
+	if c.started {
+		c.mu.Unlock()
+		return ErrAlreadyConnected
+	}
+	c.started = true
+	c.mu.Unlock()
+
+	cn, ack, err := c.handshake(ctx, c.opts.Clean)
+	if err == nil && !c.establish(cn, ack) {
+		err = ErrClientClosed
+	}
+
+	if err != nil {
+		c.mu.Lock()
+		c.started = false
+		if c.ctx.Err() != nil {
+			close(c.done) // release a concurrent Disconnect
+		}
+		c.mu.Unlock()
+		return err
+	}
+
+	go c.dispatch()
+	go c.run(cn)
+
+	return nil
+}
+
+// Disconnect sends a disconnect packet to the broker, closes the connection and
+// stops reconnection. Packets still awaiting acknowledgement fail with
+// ErrClientClosed.
+func (c *Client) Disconnect() error {
+	c.cancel()
+
+	c.mu.Lock()
+	cn := c.conn
+	started := c.started
+	c.mu.Unlock()
+
+	if cn != nil {
+		_ = cn.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+		cn.close(ErrClientClosed)
+	}
+
+	if started {
+		<-c.done
+	}
+
+	return nil
+}
+
+// Publish publishes a message. For qos 1 and 2 it blocks until the broker has
+// acknowledged the message, the context is done, or the client stops. While
+// AutoReconnect is enabled, unacknowledged messages are resent on reconnect.
+func (c *Client) Publish(ctx context.Context, topic string, payload []byte, qos byte, retain bool) error {
+	return c.PublishPacket(ctx, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: qos, Retain: retain},
+		TopicName:   topic,
+		Payload:     payload,
+	})
+}
+
+// PublishPacket publishes a message packet, allowing v5 properties to be set.
+func (c *Client) PublishPacket(ctx context.Context, pk packets.Packet) error {
+	pk.FixedHeader.Type = packets.Publish
+	pk.FixedHeader.Dup = false
+	if pk.FixedHeader.Qos > 2 {
+		return packets.ErrProtocolViolationQosOutOfRange
+	}
+
+	if pk.FixedHeader.Qos == 0 {
+		pk.PacketID = 0
+		cn := c.current()
+		if cn == nil {
+			return ErrNotConnected
+		}
+		return cn.write(pk)
+	}
+
+	res, err := c.request(ctx, pk)
+	if err != nil {
+		return err
+	}
+
+	if res.ReasonCode >= packets.ErrUnspecifiedError.Code {
+		return reasonError(res.ReasonCode, res.Properties.ReasonString)
+	}
+
+	return nil
+}
+
+// Subscribe subscribes to one or more topic filters and binds the handler to
+// them, returning the reason codes granted by the broker. If the handler is
+// nil, messages are delivered to the DefaultHandler. Subscriptions are restored
+// automatically after reconnecting to a broker which did not keep the session.
+func (c *Client) Subscribe(ctx context.Context, handler MessageHandler, subs ...packets.Subscription) ([]byte, error) {
+	if len(subs) == 0 {
+		return nil, packets.ErrProtocolViolationNoFilters
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		Filters:     subs,
+	}
+	if c.opts.ProtocolVersion == 5 && subs[0].Identifier > 0 {
+		pk.Properties.SubscriptionIdentifier = []int{subs[0].Identifier}
+	}
+
+	for _, sub := range subs {
+		c.router.add(sub.Filter, handler) // bound early so retained messages are not missed
+	}
+
+	res, err := c.request(ctx, pk)
+	if err != nil {
+		for _, sub := range subs {
+			c.router.remove(sub.Filter)
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, sub := range subs {
+		if i < len(res.ReasonCodes) && res.ReasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			c.router.remove(sub.Filter)
+			err = errors.Join(err, fmt.Errorf("subscribe %s: %w", sub.Filter, reasonError(res.ReasonCodes[i], res.Properties.ReasonString)))
+			continue
+		}
+
+		c.subs[sub.Filter] = packets.Packet{
+			FixedHeader: pk.FixedHeader,
+			Filters:     packets.Subscriptions{sub},
+			Properties:  packets.Properties{SubscriptionIdentifier: pk.Properties.SubscriptionIdentifier},
+		}
+	}
+
+	return res.ReasonCodes, err
+}
+
+// Unsubscribe unsubscribes from one or more topic filters and unbinds their
+// handlers, returning the reason codes from the broker.
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) ([]byte, error) {
+	if len(filters) == 0 {
+		return nil, packets.ErrProtocolViolationNoFilters
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe, Qos: 1},
+	}
+	for _, f := range filters {
+		pk.Filters = append(pk.Filters, packets.Subscription{Filter: f})
+	}
+
+	res, err := c.request(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range filters {
+		c.router.remove(f)
+		delete(c.subs, f)
+	}
+
+	return res.ReasonCodes, nil
+}
+
+// current returns the active connection, or nil if disconnected.
+func (c *Client) current() *conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// request sends a packet which requires a packet id and waits for its acknowledgement.
+func (c *Client) request(ctx context.Context, pk packets.Packet) (packets.Packet, error) {
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return pk, ErrClientClosed
+	}
+
+	cn := c.conn
+	if cn == nil && (!c.started || !c.opts.AutoReconnect || pk.FixedHeader.Type != packets.Publish) {
+		c.mu.Unlock()
+		return pk, ErrNotConnected
+	}
+
+	p, err := c.register(pk)
+	if err != nil {
+		c.mu.Unlock()
+		return pk, err
+	}
+	p.sent = cn != nil
+	pk = p.pk
+	c.mu.Unlock()
+
+	if cn != nil {
+		if err := cn.write(pk); err != nil {
+			cn.close(err) // the packet is resent or failed when the connection ends
+		}
+	}
+
+	select {
+	case res := <-p.ack:
+		return res.pk, res.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.inflight, pk.PacketID)
+		c.mu.Unlock()
+		return pk, ctx.Err()
+	}
+}
+
+// register assigns a free packet id to a packet and tracks it as inflight.
+// The client mutex must be held.
+func (c *Client) register(pk packets.Packet) (*pending, error) {
+	if len(c.inflight) >= maxPacketID {
+		return nil, ErrInflightFull
+	}
+
+	for {
+		c.packetID++
+		if c.packetID == 0 {
+			continue
+		}
+
+		if _, ok := c.inflight[c.packetID]; !ok {
+			break
+		}
+	}
+
+	pk.PacketID = c.packetID
+	p := &pending{pk: pk, ack: make(chan result, 1)}
+	c.inflight[pk.PacketID] = p
+	return p, nil
+}
+
+// resolve completes an inflight packet with an acknowledgement.
+func (c *Client) resolve(pk packets.Packet) {
+	c.mu.Lock()
+	p, ok := c.inflight[pk.PacketID]
+	if ok {
+		delete(c.inflight, pk.PacketID)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		p.ack <- result{pk: pk}
+	}
+}
+
+// failPending fails inflight packets with an error. Publish packets are only
+// failed if all is true, otherwise they are kept to be resent on reconnect.
+// The client mutex must be held.
+func (c *Client) failPending(err error, all bool) {
+	for id, p := range c.inflight {
+		if !all && p.pk.FixedHeader.Type == packets.Publish {
+			continue
+		}
+		delete(c.inflight, id)
+		p.ack <- result{pk: p.pk, err: err}
+	}
+}
+
+// handshake dials the broker and completes the connect flow.
+func (c *Client) handshake(ctx context.Context, clean bool) (*conn, packets.Packet, error) {
+	var ack packets.Packet
+	ctx, cancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+	defer cancel()
+
+	var nc net.Conn
+	var err error
+	if c.opts.Dial != nil {
+		nc, err = c.opts.Dial(ctx)
+	} else {
+		nc, err = Dial(ctx, c.opts.Server, c.opts.TLSConfig)
+	}
+	if err != nil {
+		return nil, ack, err
+	}
+
+	cn := newConn(nc, c.opts.ProtocolVersion)
+	if dl, ok := ctx.Deadline(); ok {
+		_ = nc.SetDeadline(dl)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = nc.SetDeadline(time.Now()) // unblock the handshake if the context ends
+	})
+	defer stop()
+
+	if err = cn.write(c.connectPacket(clean)); err == nil {
+		ack, err = cn.read()
+	}
+
+	if err == nil && ack.FixedHeader.Type != packets.Connack {
+		err = packets.ErrProtocolViolationRequireFirstConnect
+	}
+
+	if err == nil && ack.ReasonCode >= packets.ErrUnspecifiedError.Code {
+		err = fmt.Errorf("connection refused: %w", reasonError(ack.ReasonCode, ack.Properties.ReasonString))
+	}
+
+	if err == nil && !stop() {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		_ = nc.Close()
+		return nil, ack, err
+	}
+
+	_ = nc.SetDeadline(time.Time{})
+	return cn, ack, nil
+}
+
+// connectPacket returns the connect packet for the client options.
+func (c *Client) connectPacket(clean bool) packets.Packet {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Properties:  c.opts.Properties,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: c.ClientID(),
+			Keepalive:        c.opts.Keepalive,
+			Clean:            clean,
+		},
+	}
+
+	if c.opts.Username != "" {
+		pk.Connect.UsernameFlag = true
+		pk.Connect.Username = []byte(c.opts.Username)
+	}
+
+	if len(c.opts.Password) > 0 {
+		pk.Connect.PasswordFlag = true
+		pk.Connect.Password = c.opts.Password
+	}
+
+	if w := c.opts.Will; w != nil {
+		pk.Connect.WillFlag = true
+		pk.Connect.WillTopic = w.Topic
+		pk.Connect.WillPayload = w.Payload
+		pk.Connect.WillQos = w.Qos
+		pk.Connect.WillRetain = w.Retain
+		pk.Connect.WillProperties = w.Properties
+	}
+
+	return pk
+}
+
+// establish makes a connection current and resumes the session on it, resending
+// unacknowledged packets and restoring subscriptions if the broker did not keep
+// the session. It returns false if the client has been disconnected.
+func (c *Client) establish(cn *conn, ack packets.Packet) bool {
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		cn.close(ErrClientClosed)
+		return false
+	}
+
+	if ack.Properties.AssignedClientID != "" {
+		c.clientID = ack.Properties.AssignedClientID
+	}
+
+	cn.keepalive = c.opts.Keepalive
+	if ack.Properties.ServerKeepAliveFlag {
+		cn.keepalive = ack.Properties.ServerKeepAlive
+	}
+
+	cn.wmu.Lock() // hold writes until the session has been resumed
+	c.conn = cn
+
+	var queue []packets.Packet
+	if !ack.SessionPresent {
+		c.received = map[uint16]struct{}{}
+		filters := make([]string, 0, len(c.subs))
+		for f := range c.subs {
+			filters = append(filters, f)
+		}
+		sort.Strings(filters)
+		for _, f := range filters {
+			if p, err := c.register(c.subs[f]); err == nil {
+				p.sent = true
+				queue = append(queue, p.pk)
+			}
+		}
+	}
+
+	ids := make([]uint16, 0, len(c.inflight))
+	for id, p := range c.inflight {
+		if p.pk.FixedHeader.Type == packets.Publish {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		p := c.inflight[id]
+		if p.released {
+			queue = append(queue, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1},
+				PacketID:    id,
+			})
+			continue
+		}
+
+		p.pk.FixedHeader.Dup = p.sent // [MQTT-4.4.0-1]
+		p.sent = true
+		queue = append(queue, p.pk)
+	}
+	c.mu.Unlock()
+
+	var err error
+	for _, pk := range queue {
+		if err = cn.writeLocked(pk); err != nil {
+			break
+		}
+	}
+	cn.wmu.Unlock()
+
+	if err != nil {
+		cn.close(err)
+	}
+
+	c.log.Debug("client connected", "client", c.ClientID(), "server", c.opts.Server, "session_present", ack.SessionPresent, "resent", len(queue))
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c, ack) // the callback may subscribe, which needs the read loop
+	}
+
+	return true
+}
+
+// run reads from the connection until it drops, then reconnects if enabled.
+func (c *Client) run(cn *conn) {
+	defer close(c.done)
+	defer c.messages.close()
+
+	for {
+		go c.keepalive(cn)
+		c.readLoop(cn)
+
+		err := cn.error()
+		c.mu.Lock()
+		c.conn = nil
+		c.failPending(ErrConnectionLost, false)
+		if c.ctx.Err() != nil || !c.opts.AutoReconnect {
+			if c.ctx.Err() != nil {
+				err = ErrClientClosed
+			}
+			c.err = err
+			c.failPending(err, true)
+			c.mu.Unlock()
+			if !errors.Is(err, ErrClientClosed) && c.opts.OnConnectionLost != nil {
+				c.opts.OnConnectionLost(c, err)
+			}
+			return
+		}
+		c.mu.Unlock()
+
+		c.log.Warn("client connection lost", "client", c.ClientID(), "server", c.opts.Server, "error", err)
+		if c.opts.OnConnectionLost != nil {
+			c.opts.OnConnectionLost(c, err)
+		}
+
+		cn = c.reconnect()
+		if cn == nil {
+			c.mu.Lock()
+			c.err = ErrClientClosed
+			c.failPending(ErrClientClosed, true)
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// reconnect dials the broker with exponential backoff until a connection is
+// established or the client is disconnected, in which case it returns nil.
+func (c *Client) reconnect() *conn {
+	clean := c.opts.Clean
+	if c.opts.ProtocolVersion == 5 {
+		clean = false // resume the session if the broker still holds it
+	}
+
+	delay := c.opts.MinReconnectDelay
+	for {
+		t := time.NewTimer(delay)
+		select {
+		case <-c.ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+
+		cn, ack, err := c.handshake(c.ctx, clean)
+		if err == nil {
+			if !c.establish(cn, ack) {
+				return nil
+			}
+			return cn
+		}
+
+		c.log.Debug("client reconnect failed", "client", c.ClientID(), "server", c.opts.Server, "error", err)
+		delay = min(delay*2, c.opts.MaxReconnectDelay)
+	}
+}
+
+// readLoop processes inbound packets until the connection ends.
+func (c *Client) readLoop(cn *conn) {
+	defer close(cn.done)
+	for {
+		pk, err := cn.read()
+		if err != nil {
+			cn.close(err)
+			return
+		}
+
+		switch pk.FixedHeader.Type {
+		case packets.Publish:
+			if err = cn.topicAlias(&pk, c.opts.Properties.TopicAliasMaximum); err != nil {
+				_ = cn.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}, ReasonCode: packets.ErrTopicAliasInvalid.Code})
+				break
+			}
+			c.receive(cn, pk)
+		case packets.Pubrel:
+			c.mu.Lock()
+			delete(c.received, pk.PacketID)
+			c.mu.Unlock()
+			err = cn.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubcomp}, PacketID: pk.PacketID})
+		case packets.Pubrec:
+			c.mu.Lock()
+			p, ok := c.inflight[pk.PacketID]
+			if ok && pk.ReasonCode < packets.ErrUnspecifiedError.Code {
+				p.released = true
+			}
+			c.mu.Unlock()
+
+			if ok && !p.released {
+				c.resolve(pk) // refused by the broker, the flow ends here
+				continue
+			}
+			err = cn.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: pk.PacketID})
+		case packets.Puback, packets.Pubcomp, packets.Suback, packets.Unsuback:
+			c.resolve(pk)
+		case packets.Pingresp:
+			cn.pinging.Store(false)
+		case packets.Disconnect:
+			cn.close(fmt.Errorf("disconnected by broker: %w", reasonError(pk.ReasonCode, pk.Properties.ReasonString)))
+			return
+		}
+
+		if err != nil {
+			cn.close(err)
+			return
+		}
+	}
+}
+
+// receive acknowledges an inbound publish and queues it for the handlers.
+// Duplicate qos 2 deliveries are acknowledged but not redelivered.
+func (c *Client) receive(cn *conn, pk packets.Packet) {
+	deliver := true
+	switch pk.FixedHeader.Qos {
+	case 1:
+		_ = cn.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: pk.PacketID})
+	case 2:
+		c.mu.Lock()
+		_, deliver = c.received[pk.PacketID]
+		deliver = !deliver
+		c.received[pk.PacketID] = struct{}{}
+		c.mu.Unlock()
+		_ = cn.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrec}, PacketID: pk.PacketID})
+	}
+
+	if deliver {
+		c.messages.push(pk)
+	}
+}
+
+// dispatch calls the handlers for inbound messages in the order they arrived.
+func (c *Client) dispatch() {
+	for {
+		pks, ok := c.messages.pop()
+		if !ok {
+			return
+		}
+
+		for _, pk := range pks {
+			hs := c.router.match(pk.TopicName)
+			if len(hs) == 0 && c.opts.DefaultHandler != nil {
+				hs = append(hs, c.opts.DefaultHandler)
+			}
+
+			for _, h := range hs {
+				h(c, pk)
+			}
+		}
+	}
+}
+
+// inbox is an unbounded queue of inbound messages awaiting the handlers. The read loop
+// never waits for the handlers, so a handler may publish at qos 1 or 2 and wait for the
+// acknowledgement, which only the read loop can receive.
+type inbox struct {
+	mu     sync.Mutex
+	queue  []packets.Packet
+	size   int           // the initial capacity of the queue
+	ready  chan struct{} // signalled when messages are queued or the inbox is closed
+	closed bool
+}
+
+// newInbox returns an inbox with an initial capacity of size messages.
+func newInbox(size int) *inbox {
+	return &inbox{
+		queue: make([]packets.Packet, 0, size),
+		size:  size,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push queues a message for the handlers.
+func (b *inbox) push(pk packets.Packet) {
+	b.mu.Lock()
+	if !b.closed {
+		b.queue = append(b.queue, pk)
+	}
+	b.mu.Unlock()
+	b.signal()
+}
+
+// close stops the inbox once the queued messages have been taken.
+func (b *inbox) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+// signal wakes the dispatcher.
+func (b *inbox) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for queued messages and returns all of them, or false once the inbox is
+// closed and empty.
+func (b *inbox) pop() ([]packets.Packet, bool) {
+	for {
+		b.mu.Lock()
+		if len(b.queue) > 0 {
+			pks := b.queue
+			b.queue = make([]packets.Packet, 0, b.size)
+			b.mu.Unlock()
+			return pks, true
+		}
+
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+
+		<-b.ready
+	}
+}
+
+// len returns the number of queued messages.
+func (b *inbox) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queue)
+}
+
+// keepalive sends ping requests on a connection within the keepalive interval, and
+// closes the connection if the previous ping was not answered.
+func (c *Client) keepalive(cn *conn) {
+	if cn.keepalive == 0 {
+		return
+	}
+
+	t := time.NewTicker(time.Duration(cn.keepalive) * time.Second * 3 / 4) // within the keepalive, allowing for latency
+	defer t.Stop()
+	for {
+		select {
+		case <-cn.done:
+			return
+		case <-t.C:
+			if cn.pinging.Swap(true) {
+				cn.close(ErrKeepaliveTimeout)
+				return
+			}
+
+			if err := cn.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}}); err != nil {
+				cn.close(err)
+				return
+			}
+		}
+	}
+}
+
+// reasonError returns an error for a failure reason code.
+func reasonError(code byte, reason string) error {
+	if reason == "" {
+		reason = fmt.Sprintf("reason code %#02x", code)
+	}
+	return packets.Code{Code: code, Reason: reason}
+}
+
+// conn is a single network connection to the broker.
+type conn struct {
+	net.Conn
+	r         *bufio.Reader
+	done      chan struct{}     // closed when the read loop ends
+	err       error             // the error which ended the connection
+	once      sync.Once         // ensures the connection is closed once
+	wmu       sync.Mutex        // serialises writes to the connection
+	pinging   atomic.Bool       // a ping request is awaiting a response
+	keepalive uint16            // the negotiated keepalive in seconds
+	version   byte              // the protocol version of the connection
+	aliases   map[uint16]string // inbound topic aliases, used only by the read loop
+}
+
+// newConn wraps a network connection.
+func newConn(nc net.Conn, version byte) *conn {
+	return &conn{
+		Conn:    nc,
+		r:       bufio.NewReader(nc),
+		done:    make(chan struct{}),
+		version: version,
+	}
+}
+
+// topicAlias resolves the topic alias of an inbound publish, recording the topic when the
+// broker sets an alias and filling it in when the broker sends only the alias. Aliases are
+// only valid for the connection, up to the Topic Alias Maximum sent on connect.
+func (cn *conn) topicAlias(pk *packets.Packet, maximum uint16) error {
+	alias := pk.Properties.TopicAlias
+	if alias == 0 {
+		return nil
+	}
+
+	if alias > maximum {
+		return packets.ErrTopicAliasInvalid // [MQTT-3.3.2-9]
+	}
+
+	if pk.TopicName != "" {
+		if cn.aliases == nil {
+			cn.aliases = map[uint16]string{}
+		}
+		cn.aliases[alias] = pk.TopicName
+		return nil
+	}
+
+	topic, ok := cn.aliases[alias]
+	if !ok {
+		return packets.ErrTopicAliasInvalid
+	}
+	pk.TopicName = topic
+	return nil
+}
+
+// close closes the connection, recording the first error which caused it.
+func (cn *conn) close(err error) {
+	cn.once.Do(func() {
+		cn.err = err
+		_ = cn.Conn.Close()
+	})
+}
+
+// error waits for the read loop to end and returns the error which ended the connection.
+func (cn *conn) error() error {
+	<-cn.done
+	return cn.err
+}
+
+// write encodes and writes a packet to the connection.
+func (cn *conn) write(pk packets.Packet) error {
+	cn.wmu.Lock()
+	defer cn.wmu.Unlock()
+	return cn.writeLocked(pk)
+}
+
+// writeLocked encodes and writes a packet; the write mutex must be held.
+func (cn *conn) writeLocked(pk packets.Packet) error {
+	pk.ProtocolVersion = cn.version
+	pk.Mods.AllowResponseInfo = true // the client decides which properties it sends
+	buf := new(bytes.Buffer)
+
+	var err error
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(buf)
+	case packets.Publish:
+		err = pk.PublishEncode(buf)
+	case packets.Puback:
+		err = pk.PubackEncode(buf)
+	case packets.Pubrec:
+		err = pk.PubrecEncode(buf)
+	case packets.Pubrel:
+		err = pk.PubrelEncode(buf)
+	case packets.Pubcomp:
+		err = pk.PubcompEncode(buf)
+	case packets.Subscribe:
+		err = pk.SubscribeEncode(buf)
+	case packets.Unsubscribe:
+		err = pk.UnsubscribeEncode(buf)
+	case packets.Pingreq:
+		err = pk.PingreqEncode(buf)
+	case packets.Disconnect:
+		err = pk.DisconnectEncode(buf)
+	default:
+		err = fmt.Errorf("%w: %v", packets.ErrNoValidPacketAvailable, pk.FixedHeader.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = buf.WriteTo(cn.Conn)
+	return err
+}
+
+// read reads and decodes the next packet from the connection.
+func (cn *conn) read() (pk packets.Packet, err error) {
+	b, err := cn.r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+
+	if err = pk.FixedHeader.Decode(b); err != nil {
+		return pk, err
+	}
+
+	pk.FixedHeader.Remaining, _, err = packets.DecodeLength(cn.r)
+	if err != nil {
+		return pk, err
+	}
+
+	pk.ProtocolVersion = cn.version
+	p := make([]byte, pk.FixedHeader.Remaining)
+	if _, err = io.ReadFull(cn.r, p); err != nil {
+		return pk, err
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(p)
+	case packets.Publish:
+		err = pk.PublishDecode(p)
+	case packets.Puback:
+		err = pk.PubackDecode(p)
+	case packets.Pubrec:
+		err = pk.PubrecDecode(p)
+	case packets.Pubrel:
+		err = pk.PubrelDecode(p)
+	case packets.Pubcomp:
+		err = pk.PubcompDecode(p)
+	case packets.Suback:
+		err = pk.SubackDecode(p)
+	case packets.Unsuback:
+		err = pk.UnsubackDecode(p)
+	case packets.Pingresp:
+	case packets.Disconnect:
+		err = pk.DisconnectDecode(p)
+	case packets.Auth:
+		err = pk.AuthDecode(p)
+	default:
+		err = fmt.Errorf("%w: %v", packets.ErrNoValidPacketAvailable, pk.FixedHeader.Type)
+	}
+
+	return pk, err
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Dial opens a network connection to a broker url. Supported schemes are
+// tcp:// (or mqtt://), tls:// (or ssl://, mqtts://), ws://, wss:// and unix://.
+// The tls config is used for the tls and wss schemes, and may be nil.
+func Dial(ctx context.Context, server string, tlsConfig *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(net.Dialer)
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt":
+		return d.DialContext(ctx, "tcp", u.Host)
+	case "tls", "ssl", "mqtts":
+		tc := secureConfig(tlsConfig, u.Hostname())
+		return (&tls.Dialer{NetDialer: d, Config: tc}).DialContext(ctx, "tcp", u.Host)
+	case "unix":
+		addr := u.Path
+		if addr == "" {
+			addr = u.Opaque
+		}
+		return d.DialContext(ctx, "unix", addr)
+	case "ws", "wss":
+		wd := &websocket.Dialer{
+			Subprotocols:   []string{"mqtt"},
+			NetDialContext: d.DialContext,
+		}
+		if strings.EqualFold(u.Scheme, "wss") {
+			wd.TLSClientConfig = secureConfig(tlsConfig, u.Hostname())
+		}
+		c, _, err := wd.DialContext(ctx, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return &wsConn{Conn: c.UnderlyingConn(), c: c}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, u.Scheme)
+	}
+}
+
+// secureConfig returns a copy of the tls config with the server name set.
+func secureConfig(c *tls.Config, host string) *tls.Config {
+	if c == nil {
+		c = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		c = c.Clone()
+	}
+
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+
+	return c
+}
+
+// wsConn is a websocket connection which satisfies the net.Conn interface.
+type wsConn struct {
+	net.Conn
+	c *websocket.Conn
+	r io.Reader // reader for the current message (can be nil)
+}
+
+// Read reads the next span of bytes from the websocket connection.
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for {
+		if ws.r == nil {
+			op, r, err := ws.c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if op != websocket.BinaryMessage {
+				continue
+			}
+			ws.r = r
+		}
+
+		n, err := ws.r.Read(p)
+		if errors.Is(err, io.EOF) {
+			ws.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write writes bytes to the websocket connection as a single binary message.
+func (ws *wsConn) Write(p []byte) (int, error) {
+	if err := ws.c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
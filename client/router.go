@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package client
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const sharePrefix = "$share/"
+
+// MessageHandler is called for each message received on a matching subscription.
+// Handlers are called in order on a single goroutine, so a slow handler delays
+// the delivery of subsequent messages.
+type MessageHandler func(c *Client, pk packets.Packet)
+
+// route binds a message handler to a topic filter.
+type route struct {
+	filter  string
+	handler MessageHandler
+}
+
+// router matches inbound topics against subscribed filters.
+type router struct {
+	sync.RWMutex
+	routes []route
+}
+
+// add binds a handler to a filter, replacing any existing handler for the filter.
+func (r *router) add(filter string, handler MessageHandler) {
+	r.Lock()
+	defer r.Unlock()
+	filter = unshare(filter)
+	for i := range r.routes {
+		if r.routes[i].filter == filter {
+			r.routes[i].handler = handler
+			return
+		}
+	}
+	r.routes = append(r.routes, route{filter: filter, handler: handler})
+}
+
+// remove unbinds the handler for a filter.
+func (r *router) remove(filter string) {
+	r.Lock()
+	defer r.Unlock()
+	filter = unshare(filter)
+	for i := range r.routes {
+		if r.routes[i].filter == filter {
+			r.routes = append(r.routes[:i], r.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+// match returns the handlers of all filters which match a topic.
+func (r *router) match(topic string) []MessageHandler {
+	r.RLock()
+	defer r.RUnlock()
+	var hs []MessageHandler
+	for _, rt := range r.routes {
+		if rt.handler != nil && MatchTopic(rt.filter, topic) {
+			hs = append(hs, rt.handler)
+		}
+	}
+	return hs
+}
+
+// unshare strips the $share/{group}/ prefix from a shared subscription filter.
+func unshare(filter string) string {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return filter
+	}
+
+	if i := strings.IndexByte(filter[len(sharePrefix):], '/'); i >= 0 {
+		return filter[len(sharePrefix)+i+1:]
+	}
+
+	return filter
+}
+
+// MatchTopic returns true if a topic name matches a topic filter, as packets.MatchTopic,
+// ignoring the $share/{group}/ prefix of a shared subscription filter.
+func MatchTopic(filter, topic string) bool {
+	return packets.MatchTopic(unshare(filter), topic)
+}
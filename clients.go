@@ -52,6 +52,18 @@ func (cl *Clients) Add(val *Client) {
 	cl.internal[val.ID] = val
 }
 
+// AddNew adds a new client to the clients map if no client with the same id
+// exists, returning false if the id is already in use.
+func (cl *Clients) AddNew(val *Client) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	if _, ok := cl.internal[val.ID]; ok {
+		return false
+	}
+	cl.internal[val.ID] = val
+	return true
+}
+
 // GetAll returns all the clients.
 func (cl *Clients) GetAll() map[string]*Client {
 	cl.RLock()
@@ -111,12 +123,13 @@ type Client struct {
 
 // ClientConnection contains the connection transport and metadata for the client.
 type ClientConnection struct {
-	Conn     net.Conn      // the net.Conn used to establish the connection
-	bconn    *bufio.Reader // a buffered net.Conn for reading packets
-	outbuf   *bytes.Buffer // a buffer for writing packets
-	Remote   string        // the remote address of the client
-	Listener string        // listener id of the client
-	Inline   bool          // if true, the client is the built-in 'inline' embedded client
+	Conn      net.Conn      // the net.Conn used to establish the connection
+	bconn     *bufio.Reader // a buffered net.Conn for reading packets
+	outbuf    *bytes.Buffer // a buffer for writing packets
+	Remote    string        // the remote address of the client
+	Listener  string        // listener id of the client
+	Inline    bool          // if true, the client is the built-in 'inline' embedded client
+	InlineACL bool          // if true, the inline client is subject to acl and topic validity checks
 }
 
 // ClientProperties contains the properties which define the client behaviour.
@@ -141,20 +154,26 @@ type Will struct {
 
 // ClientState tracks the state of the client.
 type ClientState struct {
-	TopicAliases    TopicAliases         // a map of topic aliases
-	stopCause       atomic.Value         // reason for stopping
-	Inflight        *Inflight            // a map of in-flight qos messages
-	Subscriptions   *Subscriptions       // a map of the subscription filters a client maintains
-	disconnected    int64                // the time the client disconnected in unix time, for calculating expiry
-	outbound        chan *packets.Packet // queue for pending outbound packets
-	endOnce         sync.Once            // only end once
-	isTakenOver     atomic.Bool          // used to identify orphaned clients
-	packetID        uint32               // the current highest packetID
-	open            context.Context      // indicate that the client is open for packet exchange
-	cancelOpen      context.CancelFunc   // cancel function for open context
-	outboundQty     int32                // number of messages currently in the outbound queue
-	Keepalive       uint16               // the number of seconds the connection can wait
-	ServerKeepalive bool                 // keepalive was set by the server
+	TopicAliases    TopicAliases       // a map of topic aliases
+	stopCause       atomic.Value       // reason for stopping
+	Inflight        *Inflight          // a map of in-flight qos messages
+	Subscriptions   *Subscriptions     // a map of the subscription filters a client maintains
+	disconnected    int64              // the time the client disconnected in unix time, for calculating expiry
+	outbound        *outboundQueue     // queue for pending outbound packets
+	endOnce         sync.Once          // only end once
+	isTakenOver     atomic.Bool        // used to identify orphaned clients
+	packetID        uint32             // the current highest packetID
+	open            context.Context    // indicate that the client is open for packet exchange
+	cancelOpen      context.CancelFunc // cancel function for open context
+	outboundBytes   int64              // memory size of the messages currently in the outbound queue
+	Keepalive       uint16             // the number of seconds the connection can wait
+	ServerKeepalive bool               // keepalive was set by the server
+	responseGrants  responseGrants     // response topic prefixes the client may publish to
+	rateLimiter     *rateLimiter       // the publish rate limit of the client, if any
+	slow            slowStats          // outbound drops and write latency, for detecting slow subscribers
+	spoolLock       sync.Mutex         // orders the qos messages written to and drained from the spool
+	offline         *offlineQueue      // qos 0 messages buffered while the client is disconnected
+	parked          parkedMessages     // qos messages kept inflight unsent while over the memory hard limit
 }
 
 // newClient returns a new instance of Client. This is almost exclusively used by Server
@@ -168,8 +187,9 @@ func newClient(c net.Conn, o *ops) *Client {
 			TopicAliases:  NewTopicAliases(o.options.Capabilities.TopicAliasMaximum),
 			open:          ctx,
 			cancelOpen:    cancel,
+			offline:       new(offlineQueue),
 			Keepalive:     defaultKeepalive,
-			outbound:      make(chan *packets.Packet, o.options.Capabilities.MaximumClientWritesPending),
+			outbound:      newOutboundQueue(int(o.options.Capabilities.MaximumClientWritesPending)),
 		},
 		Properties: ClientProperties{
 			ProtocolVersion: defaultClientProtocolVersion, // default protocol version
@@ -191,16 +211,24 @@ func newClient(c net.Conn, o *ops) *Client {
 // WriteLoop ranges over pending outbound messages and writes them to the client connection.
 func (cl *Client) WriteLoop() {
 	for {
-		select {
-		case pk := <-cl.State.outbound:
-			if err := cl.WritePacket(*pk); err != nil {
-				// TODO : Figure out what to do with error
-				cl.ops.log.Debug("failed publishing packet", "error", err, "client", cl.ID, "packet", pk)
+		pk, ok := cl.State.outbound.pop()
+		if !ok {
+			select {
+			case <-cl.State.outbound.ready:
+				continue
+			case <-cl.State.open.Done():
+				return
 			}
-			atomic.AddInt32(&cl.State.outboundQty, -1)
-		case <-cl.State.open.Done():
-			return
 		}
+
+		cl.State.slow.startWrite(time.Now())
+		err := cl.WritePacket(*pk)
+		cl.State.slow.endWrite(time.Now())
+		if err != nil {
+			// TODO : Figure out what to do with error
+			cl.ops.log.Debug("failed publishing packet", "error", err, "client", cl.ID, "packet", pk)
+		}
+		atomic.AddInt64(&cl.State.outboundBytes, -pk.MemorySize())
 	}
 }
 
@@ -424,6 +452,11 @@ func (cl *Client) Closed() bool {
 	return cl.State.open == nil || cl.State.open.Err() != nil
 }
 
+// trusted returns true if the client is an inline client which bypasses acl and topic validity checks.
+func (cl *Client) trusted() bool {
+	return cl.Net.Inline && !cl.Net.InlineACL
+}
+
 func (cl *Client) IsTakenOver() bool {
 	return cl.State.isTakenOver.Load()
 }
@@ -599,7 +632,7 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 	n, err := func() (int64, error) {
 		cl.Lock()
 		defer cl.Unlock()
-		if len(cl.State.outbound) == 0 {
+		if cl.State.outbound.Len() == 0 {
 			if cl.Net.outbuf == nil {
 				return buf.WriteTo(cl.Net.Conn)
 			}
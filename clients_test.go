@@ -73,6 +73,13 @@ func TestClientsAdd(t *testing.T) {
 	require.Contains(t, cl.internal, "t1")
 }
 
+func TestClientsAddNew(t *testing.T) {
+	cl := NewClients()
+	require.True(t, cl.AddNew(&Client{ID: "t1"}))
+	require.False(t, cl.AddNew(&Client{ID: "t1", Net: ClientConnection{Remote: "other"}}))
+	require.Equal(t, "", cl.internal["t1"].Net.Remote)
+}
+
 func TestClientsGet(t *testing.T) {
 	cl := NewClients()
 	cl.Add(&Client{ID: "t1"})
@@ -789,7 +796,7 @@ func TestClientWritePacketBuffer(t *testing.T) {
 	small := packets.TPacketData[packets.Publish].Get(packets.TPublishNoPayload).Packet
 	large := packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
 
-	cl.State.outbound <- small
+	cl.State.outbound.push(small, 0)
 
 	tt := []struct {
 		pks  []*packets.Packet
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// benchConfig contains the load values for a benchmark run.
+type benchConfig struct {
+	Topic       string        // the topic prefix, each publisher uses {topic}/{n}
+	Duration    time.Duration // how long the publishers run for
+	Clients     int           // the number of simulated publishing clients
+	Subscribers int           // the number of subscribing clients
+	Rate        int           // the target number of messages per second across all publishers
+	Size        int           // the payload size in bytes, at least 8
+	Qos         byte          // the qos of publishes and subscriptions
+}
+
+// benchResult contains the outcome of a benchmark run.
+type benchResult struct {
+	latencies []time.Duration // publish to receive latency of every received message
+	Elapsed   time.Duration   // the time spent publishing
+	Sent      int64           // messages successfully published
+	Errors    int64           // publishes which failed
+	Received  int64           // messages received across all subscribers
+	Expected  int64           // messages which should have been received
+}
+
+// Throughput returns the number of messages published per second.
+func (r *benchResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the publish to receive latency at percentile p (0-100).
+func (r *benchResult) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p / 100)
+	return r.latencies[i]
+}
+
+// String returns a human readable report of the result.
+func (r *benchResult) String() string {
+	loss := 0.0
+	if r.Expected > 0 {
+		loss = 100 - float64(r.Received)/float64(r.Expected)*100
+	}
+	return fmt.Sprintf("sent: %d msgs in %s (%.1f msg/s), errors: %d\n"+
+		"received: %d of %d msgs (%.2f%% lost)\n"+
+		"latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		r.Sent, r.Elapsed.Round(time.Millisecond), r.Throughput(), r.Errors,
+		r.Received, r.Expected, loss,
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100),
+	)
+}
+
+// runBench drives simulated clients and reports throughput and latency.
+func runBench(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	o := new(connOptions)
+	c := new(benchConfig)
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	o.bind(fs)
+	fs.StringVar(&c.Topic, "t", "mqttc/bench", "topic prefix")
+	fs.DurationVar(&c.Duration, "d", 10*time.Second, "publishing duration")
+	fs.IntVar(&c.Clients, "clients", 10, "number of publishing clients")
+	fs.IntVar(&c.Subscribers, "subs", 1, "number of subscribing clients")
+	fs.IntVar(&c.Rate, "rate", 1000, "target messages per second across all publishers, 0 for unlimited")
+	fs.IntVar(&c.Size, "size", 64, "payload size in bytes")
+	qos := fs.Int("q", 0, "qos level, 0, 1 or 2")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if c.Clients < 1 || *qos < 0 || *qos > 2 {
+		fs.Usage()
+		return 2
+	}
+	c.Qos = byte(*qos)
+
+	res, err := bench(ctx, o, c)
+	if err != nil {
+		fmt.Fprintln(stderr, "bench:", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "clients: %d, subscribers: %d, qos: %d, size: %d bytes, rate: %d msg/s\n",
+		c.Clients, c.Subscribers, c.Qos, c.Size, c.Rate)
+	fmt.Fprint(stdout, res.String())
+	return 0
+}
+
+// bench runs a benchmark against the broker described by o.
+func bench(ctx context.Context, o *connOptions, c *benchConfig) (*benchResult, error) {
+	if c.Size < 8 {
+		c.Size = 8 // room for the send timestamp
+	}
+
+	res := new(benchResult)
+	var mu sync.Mutex
+	var received atomic.Int64
+	onMessage := func(pk packets.Packet) {
+		if len(pk.Payload) < 8 {
+			return
+		}
+		sent := int64(binary.BigEndian.Uint64(pk.Payload))
+		lat := time.Duration(time.Now().UnixNano() - sent)
+		received.Add(1)
+		mu.Lock()
+		res.latencies = append(res.latencies, lat)
+		mu.Unlock()
+	}
+
+	prefix := o.ClientID
+	if prefix == "" {
+		prefix = "mqttc-bench"
+	}
+
+	subs := make([]*session, 0, c.Subscribers)
+	defer func() {
+		for _, s := range subs {
+			_ = s.Close()
+		}
+	}()
+	for i := 0; i < c.Subscribers; i++ {
+		so := *o
+		so.ClientID = prefix + "-sub-" + strconv.Itoa(i)
+		s, err := connect(ctx, &so, onMessage)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+		subs = append(subs, s)
+		if _, err := s.Subscribe(ctx, c.Qos, c.Topic+"/#"); err != nil {
+			return nil, fmt.Errorf("subscriber %d: %w", i, err)
+		}
+	}
+
+	pubs := make([]*session, 0, c.Clients)
+	defer func() {
+		for _, s := range pubs {
+			_ = s.Close()
+		}
+	}()
+	for i := 0; i < c.Clients; i++ {
+		po := *o
+		po.ClientID = prefix + "-pub-" + strconv.Itoa(i)
+		s, err := connect(ctx, &po, nil)
+		if err != nil {
+			return nil, fmt.Errorf("publisher %d: %w", i, err)
+		}
+		pubs = append(pubs, s)
+	}
+
+	var interval time.Duration
+	if c.Rate > 0 {
+		interval = time.Second * time.Duration(c.Clients) / time.Duration(c.Rate)
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, c.Duration)
+	defer cancel()
+
+	var sent, failed atomic.Int64
+	var wg sync.WaitGroup
+	started := time.Now()
+	for i, s := range pubs {
+		wg.Add(1)
+		go func(i int, s *session) {
+			defer wg.Done()
+			topic := c.Topic + "/" + strconv.Itoa(i)
+			payload := make([]byte, c.Size)
+
+			var tick <-chan time.Time
+			if interval > 0 {
+				t := time.NewTicker(interval)
+				defer t.Stop()
+				tick = t.C
+			}
+
+			for {
+				if tick != nil {
+					select {
+					case <-pctx.Done():
+						return
+					case <-tick:
+					}
+				} else if pctx.Err() != nil {
+					return
+				}
+
+				binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+				err := s.Publish(pctx, topic, payload, c.Qos, false)
+				switch {
+				case err == nil:
+					sent.Add(1)
+				case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+					return
+				default:
+					failed.Add(1)
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(started)
+	res.Sent = sent.Load()
+	res.Errors = failed.Load()
+	res.Expected = res.Sent * int64(c.Subscribers)
+
+	// allow in-flight messages to drain before counting.
+	drain := time.NewTimer(o.Timeout)
+	defer drain.Stop()
+	tk := time.NewTicker(10 * time.Millisecond)
+	defer tk.Stop()
+	for received.Load() < res.Expected {
+		select {
+		case <-ctx.Done():
+		case <-drain.C:
+		case <-tk.C:
+			continue
+		}
+		break
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	res.Received = received.Load()
+	res.latencies = append([]time.Duration(nil), res.latencies...)
+	sort.Slice(res.latencies, func(i, j int) bool {
+		return res.latencies[i] < res.latencies[j]
+	})
+
+	return res, nil
+}
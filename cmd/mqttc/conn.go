@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// connOptions contains the connection values shared by all commands.
+type connOptions struct {
+	URL       string        // the broker url, eg. tcp://127.0.0.1:1883, tls://, ws://, wss://, unix://
+	ClientID  string        // the client id, generated if empty
+	Username  string        // the username, if any
+	Password  string        // the password, if any
+	CAFile    string        // a root ca file used to verify the broker certificate
+	CertFile  string        // a client certificate file presented to the broker
+	KeyFile   string        // the private key file of the client certificate
+	Version   int           // the mqtt protocol version, 4 (v3.1.1) or 5
+	Keepalive int           // the keepalive in seconds
+	Timeout   time.Duration // the dial and ack timeout
+	Clean     bool          // request a clean session
+	Insecure  bool          // skip tls certificate verification
+}
+
+// bind registers the connection flags on a flagset.
+func (o *connOptions) bind(fs *flag.FlagSet) {
+	fs.StringVar(&o.URL, "url", "tcp://127.0.0.1:1883", "broker url, tcp://, tls://, ws://, wss:// or unix://")
+	fs.StringVar(&o.ClientID, "id", "", "client id, generated if empty")
+	fs.StringVar(&o.Username, "u", "", "username")
+	fs.StringVar(&o.Password, "P", "", "password")
+	fs.StringVar(&o.CAFile, "cafile", "", "root ca file used to verify the broker certificate")
+	fs.StringVar(&o.CertFile, "cert", "", "client certificate file presented to the broker")
+	fs.StringVar(&o.KeyFile, "key", "", "private key file of the client certificate")
+	fs.IntVar(&o.Version, "V", 4, "mqtt protocol version, 4 (v3.1.1) or 5")
+	fs.IntVar(&o.Keepalive, "k", 30, "keepalive in seconds")
+	fs.DurationVar(&o.Timeout, "timeout", 5*time.Second, "dial and ack timeout")
+	fs.BoolVar(&o.Clean, "clean", true, "request a clean session")
+	fs.BoolVar(&o.Insecure, "insecure", false, "skip tls certificate verification")
+}
+
+// tlsConfig returns the tls configuration for secure schemes.
+func (o *connOptions) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: o.Insecure, // #nosec G402 -- opt-in for self-signed test brokers
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if o.CAFile != "" {
+		b, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("both -cert and -key are required for a client certificate")
+		}
+
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// session is a connected client used by the pub, sub and bench commands.
+type session struct {
+	*client.Client
+	opts *connOptions
+}
+
+// connect dials the broker and completes the connect handshake. Inbound
+// messages for any subscription are passed to onMessage.
+func connect(ctx context.Context, o *connOptions, onMessage func(pk packets.Packet)) (*session, error) {
+	if o.ClientID == "" {
+		o.ClientID = "mqttc-" + xid.New().String()
+	}
+
+	tc, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &client.Options{
+		Server:          o.URL,
+		ClientID:        o.ClientID,
+		Username:        o.Username,
+		Password:        []byte(o.Password),
+		ProtocolVersion: byte(o.Version),
+		Keepalive:       uint16(o.Keepalive),
+		Clean:           o.Clean,
+		ConnectTimeout:  o.Timeout,
+		TLSConfig:       tc,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if onMessage != nil {
+		opts.DefaultHandler = func(_ *client.Client, pk packets.Packet) {
+			onMessage(pk)
+		}
+	}
+	if opts.ProtocolVersion == 5 && !o.Clean {
+		opts.Properties.SessionExpiryInterval = 3600
+		opts.Properties.SessionExpiryIntervalFlag = true
+	}
+
+	c := client.New(opts)
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &session{Client: c, opts: o}, nil
+}
+
+// Publish publishes a message and waits up to the ack timeout for the qos flow to complete.
+func (s *session) Publish(ctx context.Context, topic string, payload []byte, qos byte, retain bool) error {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	return s.Client.Publish(ctx, topic, payload, qos, retain)
+}
+
+// Subscribe subscribes to the filters and returns the granted reason codes.
+func (s *session) Subscribe(ctx context.Context, qos byte, filters ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	subs := make([]packets.Subscription, 0, len(filters))
+	for _, f := range filters {
+		subs = append(subs, packets.Subscription{Filter: f, Qos: qos})
+	}
+	return s.Client.Subscribe(ctx, nil, subs...)
+}
+
+// Close disconnects from the broker.
+func (s *session) Close() error {
+	return s.Disconnect()
+}
@@ -0,0 +1,63 @@
+// Command mqttc is a small command line client for publishing, subscribing and
+// load testing against an mqtt broker over tcp, tls, websocket and unix sockets,
+// using either MQTT v3.1.1 or v5.
+//
+//	mqttc pub -url tcp://127.0.0.1:1883 -t a/b -m hello -q 1
+//	mqttc sub -url ws://127.0.0.1:1882 -t a/# -V 5
+//	mqttc bench -url tcp://127.0.0.1:1883 -clients 100 -rate 5000 -d 30s
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// command is a mqttc subcommand.
+type command struct {
+	run      func(ctx context.Context, args []string, stdout, stderr io.Writer) int
+	name     string
+	descript string
+}
+
+var commands = []command{
+	{name: "pub", descript: "publish one or more messages to a topic", run: runPub},
+	{name: "sub", descript: "subscribe to topic filters and print received messages", run: runSub},
+	{name: "bench", descript: "drive simulated clients and report throughput and latency", run: runBench},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run dispatches the arguments to a subcommand and returns the exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(ctx, args[1:], stdout, stderr)
+		}
+	}
+
+	usage(stderr)
+	return 2
+}
+
+// usage prints the available subcommands.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage:\n    mqttc <command> [flags]\n\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "    %-7s%s\n", c.name, c.descript)
+	}
+	fmt.Fprintln(w, "\nUse \"mqttc <command> -h\" for the flags of a command.")
+}
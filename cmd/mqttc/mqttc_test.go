@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/hooks/auth"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// newTestServer starts an in-process broker with tcp and websocket listeners.
+func newTestServer(t *testing.T) (s *mqtt.Server, tcpURL, wsURL string) {
+	t.Helper()
+	s = mqtt.New(&mqtt.Options{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		InlineClient: true,
+	})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "t1", Address: "127.0.0.1:0"})
+	require.NoError(t, s.AddListener(tcp))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	wsAddr := l.Addr().String()
+	require.NoError(t, l.Close())
+	require.NoError(t, s.AddListener(listeners.NewWebsocket(listeners.Config{ID: "ws1", Address: wsAddr})))
+
+	require.NoError(t, s.Serve())
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	return s, "tcp://" + tcp.Address(), "ws://" + wsAddr
+}
+
+// testPKI contains the files of a test certificate authority, and a client certificate
+// and server certificate for 127.0.0.1 signed by it.
+type testPKI struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	server   tls.Certificate
+	pool     *x509.CertPool
+}
+
+// issueTestCert returns a certificate and key signed by parent, or self-signed if parent is nil.
+func issueTestCert(t *testing.T, tpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	kb, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+// newTestPKI writes a test certificate authority and client certificate to a temporary directory.
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	now := time.Now()
+	ca, caKey, caPEM, _ := issueTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mqttc test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	_, _, serverPEM, serverKeyPEM := issueTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	_, _, clientPEM, clientKeyPEM := issueTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "mqttc"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	server, err := tls.X509KeyPair(serverPEM, serverKeyPEM)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	p := &testPKI{
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "client.pem"),
+		keyFile:  filepath.Join(dir, "client.key"),
+		server:   server,
+		pool:     x509.NewCertPool(),
+	}
+	p.pool.AddCert(ca)
+	require.NoError(t, os.WriteFile(p.caFile, caPEM, 0o600))
+	require.NoError(t, os.WriteFile(p.certFile, clientPEM, 0o600))
+	require.NoError(t, os.WriteFile(p.keyFile, clientKeyPEM, 0o600))
+
+	return p
+}
+
+// newTLSTestServer starts an in-process broker with a tls listener which requires
+// client certificates signed by the test certificate authority.
+func newTLSTestServer(t *testing.T, p *testPKI) (s *mqtt.Server, tlsURL string) {
+	t.Helper()
+	s = mqtt.New(&mqtt.Options{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		InlineClient: true,
+	})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+
+	tl := listeners.NewTCP(listeners.Config{ID: "tls1", Address: "127.0.0.1:0", TLSConfig: &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{p.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.pool,
+	}})
+	require.NoError(t, s.AddListener(tl))
+
+	require.NoError(t, s.Serve())
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	return s, "tls://" + tl.Address()
+}
+
+// waitSubscribed waits until a client subscription matches the topic.
+func waitSubscribed(t *testing.T, s *mqtt.Server, topic string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Subscribers(topic).Subscriptions) > 0
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestRunUsage(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	require.Equal(t, 2, run(context.Background(), nil, io.Discard, stderr))
+	require.Contains(t, stderr.String(), "bench")
+
+	require.Equal(t, 2, run(context.Background(), []string{"nope"}, io.Discard, io.Discard))
+	require.Equal(t, 2, run(context.Background(), []string{"pub"}, io.Discard, io.Discard))
+	require.Equal(t, 2, run(context.Background(), []string{"sub", "-t", "a", "-q", "3"}, io.Discard, io.Discard))
+}
+
+func TestPub(t *testing.T) {
+	s, tcpURL, wsURL := newTestServer(t)
+
+	got := make(chan packets.Packet, 16)
+	require.NoError(t, s.Subscribe("mqttc/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	tt := []struct {
+		desc string
+		url  string
+		v    string
+		qos  string
+	}{
+		{desc: "tcp v3.1.1 qos 0", url: tcpURL, v: "4", qos: "0"},
+		{desc: "tcp v3.1.1 qos 1", url: tcpURL, v: "4", qos: "1"},
+		{desc: "tcp v5 qos 2", url: tcpURL, v: "5", qos: "2"},
+		{desc: "ws v5 qos 1", url: wsURL, v: "5", qos: "1"},
+		{desc: "ws v3.1.1 qos 2", url: wsURL, v: "4", qos: "2"},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			stderr := new(bytes.Buffer)
+			code := run(context.Background(), []string{"pub", "-url", tx.url, "-V", tx.v, "-q", tx.qos, "-t", "mqttc/pub", "-m", tx.desc}, io.Discard, stderr)
+			require.Equal(t, 0, code, stderr.String())
+
+			select {
+			case pk := <-got:
+				require.Equal(t, "mqttc/pub", pk.TopicName)
+				require.Equal(t, tx.desc, string(pk.Payload))
+			case <-time.After(5 * time.Second):
+				t.Fatal("message not received")
+			}
+		})
+	}
+}
+
+func TestPubConnectError(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	code := run(context.Background(), []string{"pub", "-url", "tcp://127.0.0.1:1", "-t", "a", "-timeout", "100ms"}, io.Discard, stderr)
+	require.Equal(t, 1, code)
+	require.Contains(t, stderr.String(), "connect")
+
+	code = run(context.Background(), []string{"pub", "-url", "quic://127.0.0.1:1", "-t", "a"}, io.Discard, stderr)
+	require.Equal(t, 1, code)
+	require.Contains(t, stderr.String(), client.ErrUnsupportedScheme.Error())
+}
+
+func TestPubTLS(t *testing.T) {
+	p := newTestPKI(t)
+	s, tlsURL := newTLSTestServer(t, p)
+
+	got := make(chan packets.Packet, 16)
+	require.NoError(t, s.Subscribe("mqttc/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	tt := []struct {
+		desc string
+		args []string
+		ok   bool
+		err  string
+	}{
+		{desc: "cafile and client certificate", args: []string{"-cafile", p.caFile, "-cert", p.certFile, "-key", p.keyFile}, ok: true},
+		{desc: "insecure and client certificate", args: []string{"-insecure", "-cert", p.certFile, "-key", p.keyFile}, ok: true},
+		{desc: "unknown authority", args: []string{"-cert", p.certFile, "-key", p.keyFile}, err: "unknown authority"},
+		{desc: "no client certificate", args: []string{"-cafile", p.caFile}},
+		{desc: "cert without key", args: []string{"-cafile", p.caFile, "-cert", p.certFile}, err: "-key"},
+		{desc: "missing cafile", args: []string{"-cafile", filepath.Join(t.TempDir(), "none.pem")}, err: "none.pem"},
+		{desc: "cafile without certificates", args: []string{"-cafile", p.keyFile}, err: "no certificates"},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			stderr := new(bytes.Buffer)
+			args := append([]string{"pub", "-url", tlsURL, "-q", "1", "-t", "mqttc/tls", "-m", tx.desc, "-timeout", "2s"}, tx.args...)
+			code := run(context.Background(), args, io.Discard, stderr)
+			if !tx.ok {
+				require.Equal(t, 1, code)
+				require.Contains(t, stderr.String(), tx.err)
+				return
+			}
+
+			require.Equal(t, 0, code, stderr.String())
+			select {
+			case pk := <-got:
+				require.Equal(t, tx.desc, string(pk.Payload))
+			case <-time.After(5 * time.Second):
+				t.Fatal("message not received")
+			}
+		})
+	}
+}
+
+func TestSub(t *testing.T) {
+	s, tcpURL, wsURL := newTestServer(t)
+
+	for _, u := range []string{tcpURL, wsURL} {
+		t.Run(u, func(t *testing.T) {
+			stdout := new(bytes.Buffer)
+			stderr := new(bytes.Buffer)
+			code := make(chan int, 1)
+			go func() {
+				code <- run(context.Background(), []string{"sub", "-url", u, "-V", "5", "-q", "2", "-t", "mqttc/sub/+", "-n", "2", "-v"}, stdout, stderr)
+			}()
+
+			waitSubscribed(t, s, "mqttc/sub/a")
+			require.NoError(t, s.Publish("mqttc/sub/a", []byte("one"), false, 2))
+			require.NoError(t, s.Publish("mqttc/sub/b", []byte("two"), false, 1))
+
+			select {
+			case c := <-code:
+				require.Equal(t, 0, c, stderr.String())
+			case <-time.After(5 * time.Second):
+				t.Fatal("sub did not exit")
+			}
+			require.Equal(t, "mqttc/sub/a one\nmqttc/sub/b two\n", stdout.String())
+		})
+	}
+}
+
+func TestSubCancel(t *testing.T) {
+	s, tcpURL, _ := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	code := make(chan int, 1)
+	go func() {
+		code <- run(ctx, []string{"sub", "-url", tcpURL, "-t", "mqttc/cancel"}, io.Discard, io.Discard)
+	}()
+
+	waitSubscribed(t, s, "mqttc/cancel")
+	cancel()
+	select {
+	case c := <-code:
+		require.Equal(t, 0, c)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sub did not exit")
+	}
+}
+
+func TestBench(t *testing.T) {
+	_, tcpURL, _ := newTestServer(t)
+
+	res, err := bench(context.Background(), &connOptions{
+		URL:     tcpURL,
+		Version: 5,
+		Timeout: 2 * time.Second,
+		Clean:   true,
+	}, &benchConfig{
+		Topic:       "mqttc/bench",
+		Duration:    300 * time.Millisecond,
+		Clients:     4,
+		Subscribers: 2,
+		Rate:        200,
+		Size:        32,
+		Qos:         1,
+	})
+	require.NoError(t, err)
+	require.Greater(t, res.Sent, int64(0))
+	require.Equal(t, int64(0), res.Errors)
+	require.Equal(t, res.Sent*2, res.Expected)
+	require.Equal(t, res.Expected, res.Received)
+	require.Greater(t, res.Throughput(), 0.0)
+	require.Greater(t, res.Percentile(50), time.Duration(0))
+	require.LessOrEqual(t, res.Percentile(50), res.Percentile(99))
+	require.Contains(t, res.String(), "latency: p50")
+}
+
+func TestRunBench(t *testing.T) {
+	_, tcpURL, _ := newTestServer(t)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	code := run(context.Background(), []string{"bench", "-url", tcpURL, "-clients", "2", "-rate", "0", "-d", "100ms", "-q", "0"}, stdout, stderr)
+	require.Equal(t, 0, code, stderr.String())
+	require.Contains(t, stdout.String(), "clients: 2, subscribers: 1, qos: 0")
+	require.Contains(t, stdout.String(), "msg/s")
+}
+
+func TestBenchResultPercentile(t *testing.T) {
+	r := new(benchResult)
+	require.Equal(t, time.Duration(0), r.Percentile(50))
+	require.Equal(t, 0.0, r.Throughput())
+
+	for i := 1; i <= 100; i++ {
+		r.latencies = append(r.latencies, time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, 50*time.Millisecond, r.Percentile(50))
+	require.Equal(t, 99*time.Millisecond, r.Percentile(99))
+	require.Equal(t, 100*time.Millisecond, r.Percentile(100))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// runPub publishes one or more messages to a topic.
+func runPub(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	o := new(connOptions)
+	fs := flag.NewFlagSet("pub", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	o.bind(fs)
+	topic := fs.String("t", "", "topic to publish to")
+	message := fs.String("m", "", "message payload")
+	file := fs.String("f", "", "read the message payload from a file")
+	qos := fs.Int("q", 0, "qos level, 0, 1 or 2")
+	retain := fs.Bool("r", false, "retain the message")
+	count := fs.Int("n", 1, "number of messages to publish")
+	interval := fs.Duration("i", 0, "interval between messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *topic == "" || *qos < 0 || *qos > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	payload := []byte(*message)
+	if *file != "" {
+		b, err := os.ReadFile(*file)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		payload = b
+	}
+
+	s, err := connect(ctx, o, nil)
+	if err != nil {
+		fmt.Fprintln(stderr, "connect:", err)
+		return 1
+	}
+	defer s.Close()
+
+	for i := 0; i < *count; i++ {
+		if i > 0 && *interval > 0 {
+			select {
+			case <-ctx.Done():
+				return 0
+			case <-time.After(*interval):
+			}
+		}
+
+		if err := s.Publish(ctx, *topic, payload, byte(*qos), *retain); err != nil {
+			fmt.Fprintln(stderr, "publish:", err)
+			return 1
+		}
+	}
+
+	return 0
+}
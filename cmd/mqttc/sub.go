@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// filters is a repeatable string flag.
+type filters []string
+
+func (f *filters) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *filters) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// runSub subscribes to topic filters and prints received messages.
+func runSub(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	o := new(connOptions)
+	fs := flag.NewFlagSet("sub", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	o.bind(fs)
+	var topics filters
+	fs.Var(&topics, "t", "topic filter to subscribe to, may be repeated")
+	qos := fs.Int("q", 0, "maximum qos level, 0, 1 or 2")
+	count := fs.Int("n", 0, "exit after receiving this many messages, 0 to run until interrupted")
+	verbose := fs.Bool("v", false, "print the topic before each payload")
+	ready := fs.Bool("ready", false, "print a line once the subscription is active")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if len(topics) == 0 || *qos < 0 || *qos > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var mu sync.Mutex
+	received := 0
+	done := make(chan struct{})
+	s, err := connect(ctx, o, func(pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		if *count > 0 && received >= *count {
+			return
+		}
+
+		if *verbose {
+			fmt.Fprintf(stdout, "%s %s\n", pk.TopicName, pk.Payload)
+		} else {
+			fmt.Fprintf(stdout, "%s\n", pk.Payload)
+		}
+
+		received++
+		if *count > 0 && received == *count {
+			close(done)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, "connect:", err)
+		return 1
+	}
+	defer s.Close()
+
+	if _, err := s.Subscribe(ctx, byte(*qos), topics...); err != nil {
+		fmt.Fprintln(stderr, "subscribe:", err)
+		return 1
+	}
+
+	if *ready {
+		fmt.Fprintln(stderr, "subscribed")
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-done:
+	case <-s.Done():
+		fmt.Fprintln(stderr, s.Err())
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage/bolt"
+	"github.com/xyzj/mqtt-server/hooks/storage/migrate"
+	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/mqtt-server/system"
+)
+
+// writeConfig writes a broker config file to a temporary directory.
+func writeConfig(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	return path
+}
+
+// newBoltConfig writes a config file for a bolt storage hook holding some records.
+func newBoltConfig(t *testing.T, dir string) string {
+	t.Helper()
+	db := filepath.Join(dir, "bolt.db")
+
+	h := new(bolt.Hook)
+	h.SetOpts(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	require.NoError(t, h.Init(&bolt.Options{Path: db}))
+	cl := &mqtt.Client{ID: "cl1"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b"}}}, []byte{0})
+	h.OnRetainMessage(cl, packets.Packet{TopicName: "a/b", Payload: []byte("kept")}, 1)
+	h.OnSysInfoTick(&system.Info{Version: "2.7.9"})
+	require.NoError(t, h.Stop())
+
+	return writeConfig(t, dir, "bolt.yml", "hooks:\n  storage:\n    bolt:\n      path: "+db+"\n")
+}
+
+// newPebbleConfig writes a config file for an empty pebble storage hook.
+func newPebbleConfig(t *testing.T, dir, name string) string {
+	t.Helper()
+	return writeConfig(t, dir, name+".yml", "hooks:\n  storage:\n    pebble:\n      path: "+filepath.Join(dir, name)+"\n")
+}
+
+var stored = migrate.Counts{Clients: 1, Subscriptions: 1, Retained: 1, SysInfo: 1}
+
+func TestRunUsage(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	require.Equal(t, 2, run(context.Background(), nil, io.Discard, stderr))
+	require.Contains(t, stderr.String(), "migrate")
+
+	require.Equal(t, 2, run(context.Background(), []string{"nope"}, io.Discard, io.Discard))
+	require.Equal(t, 2, run(context.Background(), []string{"migrate", "-from", "a.yml"}, io.Discard, io.Discard))
+	require.Equal(t, 2, run(context.Background(), []string{"export", "-config", "a.yml"}, io.Discard, io.Discard))
+	require.Equal(t, 2, run(context.Background(), []string{"import", "-i", "a.jsonl"}, io.Discard, io.Discard))
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	from := newBoltConfig(t, dir)
+	to := newPebbleConfig(t, dir, "pebble")
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	require.Equal(t, 0, run(context.Background(), []string{"migrate", "-from", from, "-to", to}, stdout, stderr), stderr.String())
+	require.Contains(t, stdout.String(), "migrated "+stored.String())
+	require.Contains(t, stdout.String(), "verified")
+
+	// records replace records with the same keys, so a second run is harmless.
+	require.Equal(t, 0, run(context.Background(), []string{"migrate", "-from", from, "-to", to}, io.Discard, stderr), stderr.String())
+
+	// a target holding other records fails verification.
+	other := newPebbleConfig(t, dir, "other")
+	h, err := openStore(other, io.Discard)
+	require.NoError(t, err)
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl9"}, packets.Packet{})
+	require.NoError(t, h.Stop())
+
+	stderr.Reset()
+	require.Equal(t, 1, run(context.Background(), []string{"migrate", "-from", to, "-to", other}, io.Discard, stderr))
+	require.Contains(t, stderr.String(), migrate.ErrCountMismatch.Error())
+}
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newBoltConfig(t, dir)
+	dump := filepath.Join(dir, "dump.jsonl")
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	require.Equal(t, 0, run(context.Background(), []string{"export", "-config", cfg, "-o", dump}, stdout, stderr), stderr.String())
+	require.Contains(t, stdout.String(), "exported "+stored.String())
+
+	to := newPebbleConfig(t, dir, "pebble")
+	stdout.Reset()
+	require.Equal(t, 0, run(context.Background(), []string{"import", "-config", to, "-i", dump}, stdout, stderr), stderr.String())
+	require.Contains(t, stdout.String(), "imported "+stored.String())
+}
+
+func TestInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newBoltConfig(t, dir)
+	dump := filepath.Join(dir, "dump.jsonl")
+	require.Equal(t, 0, run(context.Background(), []string{"export", "-config", cfg, "-o", dump}, io.Discard, io.Discard))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // as if interrupted.
+
+	for _, args := range [][]string{
+		{"migrate", "-from", cfg, "-to", newPebbleConfig(t, dir, "migrated")},
+		{"export", "-config", cfg, "-o", filepath.Join(dir, "cancelled.jsonl")},
+		{"import", "-config", newPebbleConfig(t, dir, "imported"), "-i", dump},
+	} {
+		stderr := new(bytes.Buffer)
+		require.Equal(t, 1, run(ctx, args, io.Discard, stderr), args[0])
+		require.Contains(t, stderr.String(), context.Canceled.Error())
+	}
+}
+
+func TestOpenStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := openStore(filepath.Join(dir, "missing.yml"), io.Discard)
+	require.Error(t, err)
+
+	_, err = openStore(writeConfig(t, dir, "none.yml", "hooks:\n  auth:\n    allow_all: true\n"), io.Discard)
+	require.ErrorIs(t, err, errNoStorage)
+
+	_, err = openStore(writeConfig(t, dir, "empty.yml", ""), io.Discard)
+	require.ErrorIs(t, err, errNoStorage)
+
+	_, err = openStore(writeConfig(t, dir, "many.yml", "hooks:\n  storage:\n    bolt:\n      path: "+
+		filepath.Join(dir, "a.db")+"\n    pebble:\n      path: "+filepath.Join(dir, "b")+"\n"), io.Discard)
+	require.ErrorIs(t, err, errManyStorage)
+
+	stderr := new(bytes.Buffer)
+	cfg := newPebbleConfig(t, dir, "pebble")
+	require.Equal(t, 1, run(context.Background(), []string{"import", "-config", cfg, "-i", filepath.Join(dir, "missing.jsonl")}, io.Discard, stderr))
+	require.Equal(t, 1, run(context.Background(), []string{"export", "-config", filepath.Join(dir, "missing.yml"), "-o", filepath.Join(dir, "out.jsonl")}, io.Discard, stderr))
+}
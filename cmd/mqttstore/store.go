@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/config"
+	"github.com/xyzj/mqtt-server/hooks/storage/migrate"
+)
+
+var (
+	// errNoStorage indicates that a config file does not configure a storage hook.
+	errNoStorage = errors.New("no storage hook configured")
+
+	// errManyStorage indicates that a config file configures more than one storage hook.
+	errManyStorage = errors.New("more than one storage hook configured")
+)
+
+// store is a storage hook which records can be read from and written to.
+type store interface {
+	mqtt.Hook
+	migrate.Target
+}
+
+// openStore initialises the one storage hook configured in a broker config file.
+func openStore(path string, stderr io.Writer) (store, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := config.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var found []mqtt.HookLoadConfig
+	if opts != nil {
+		for _, hlc := range opts.Hooks {
+			if _, ok := hlc.Hook.(store); ok {
+				found = append(found, hlc)
+			}
+		}
+	}
+
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("%s: %w", path, errNoStorage)
+	case len(found) > 1:
+		return nil, fmt.Errorf("%s: %w", path, errManyStorage)
+	}
+
+	h := found[0].Hook.(store)
+	h.SetOpts(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelWarn})), nil)
+	if err := h.Init(found[0].Config); err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", path, h.ID(), err)
+	}
+
+	return h, nil
+}
+
+// runMigrate copies all records from one storage hook to another.
+func runMigrate(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	from := fs.String("from", "", "config file of the storage hook to read")
+	to := fs.String("to", "", "config file of the storage hook to write, which should be empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *from == "" || *to == "" {
+		fs.Usage()
+		return 2
+	}
+
+	src, err := openStore(*from, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, "open:", err)
+		return 1
+	}
+	defer src.Stop()
+
+	dst, err := openStore(*to, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, "open:", err)
+		return 1
+	}
+	defer dst.Stop()
+
+	c, err := migrate.Copy(ctx, dst, src)
+	if err != nil {
+		fmt.Fprintln(stderr, "migrate:", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "migrated %s from %s to %s; verified\n", c, src.ID(), dst.ID())
+	return 0
+}
+
+// runExport writes all records of a storage hook to a JSON Lines dump.
+func runExport(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cfg := fs.String("config", "", "config file of the storage hook to read")
+	out := fs.String("o", "", "file to write the dump to")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *cfg == "" || *out == "" {
+		fs.Usage()
+		return 2
+	}
+
+	src, err := openStore(*cfg, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, "open:", err)
+		return 1
+	}
+	defer src.Stop()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	c, err := migrate.Export(ctx, f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "export:", err)
+		return 1
+	}
+
+	// read the dump back to verify it.
+	f, err = os.Open(*out)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	r, err := migrate.Decode(ctx, f)
+	if err == nil && r.Counts() != c {
+		err = fmt.Errorf("want %s, got %s; %w", c, r.Counts(), migrate.ErrCountMismatch)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "verify:", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "exported %s from %s to %s; verified\n", c, src.ID(), *out)
+	return 0
+}
+
+// runImport writes all records of a JSON Lines dump to a storage hook.
+func runImport(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cfg := fs.String("config", "", "config file of the storage hook to write, which should be empty")
+	in := fs.String("i", "", "file to read the dump from")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *cfg == "" || *in == "" {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	dst, err := openStore(*cfg, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, "open:", err)
+		return 1
+	}
+	defer dst.Stop()
+
+	c, err := migrate.Import(ctx, dst, f)
+	if err != nil {
+		fmt.Fprintln(stderr, "import:", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "imported %s from %s to %s; verified\n", c, *in, dst.ID())
+	return 0
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"html/template"
 	"io"
 	"log/slog"
@@ -15,7 +16,9 @@ import (
 
 	"github.com/gin-gonic/gin/render"
 	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage/msglog"
 	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
 	"github.com/xyzj/mqtt-server/system"
 	"github.com/xyzj/toolbox"
 	"github.com/xyzj/toolbox/json"
@@ -135,6 +138,8 @@ var t3 = `{{define "body"}}
                 <th>Client Ver</th>
                 <th>Protocol</th>
                 <th>Subscribes</th>
+                <th>Queued</th>
+                <th>Queue Age</th>
                 <th>Subscribe Detail</th>
             </tr>
         </thead>
@@ -162,6 +167,10 @@ type Lopt struct {
 	PortWS string
 	// Authfile string
 	Auth map[string]string
+	// broker, for the admin endpoints
+	Server *mqtt.Server
+	// message log, for the /messages endpoint
+	MessageLog *msglog.Hook
 }
 
 func (o *Lopt) String() string {
@@ -239,6 +248,14 @@ func (l *HTTPStats) Init(log *slog.Logger) error {
 	mux.HandleFunc("/connections", toolbox.HTTPBasicAuth(l.lopt.Auth, l.clientHandler))
 	mux.HandleFunc("/clientsrawdata", toolbox.HTTPBasicAuth(l.lopt.Auth, l.debugHandler))
 	mux.HandleFunc("/processrecords", toolbox.HTTPBasicAuth(l.lopt.Auth, p.HTTPHandler))
+	if l.lopt.Server != nil {
+		mux.HandleFunc("/delayed", toolbox.HTTPBasicAuth(l.lopt.Auth, l.delayedHandler))
+		mux.HandleFunc("/slow", toolbox.HTTPBasicAuth(l.lopt.Auth, l.slowHandler))
+		mux.HandleFunc("/wills", toolbox.HTTPBasicAuth(l.lopt.Auth, l.willsHandler))
+	}
+	if l.lopt.MessageLog != nil {
+		mux.HandleFunc("/messages", toolbox.HTTPBasicAuth(l.lopt.Auth, l.messagesHandler))
+	}
 	l.listen = &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
@@ -298,7 +315,8 @@ func (l *HTTPStats) clientHandler(w http.ResponseWriter, req *http.Request) {
 		sort.Slice(ss, func(i, j int) bool {
 			return ss[i] < ss[j]
 		})
-		sss = append(sss, []string{json.String(v.Properties.Username), v.ID, v.Net.Remote, strconv.Itoa(int(v.Properties.ProtocolVersion)), v.Net.Listener, strconv.Itoa(v.State.Subscriptions.Len()), strings.Join(ss, "\n")}) //
+		q := v.OutboundStats()
+		sss = append(sss, []string{json.String(v.Properties.Username), v.ID, v.Net.Remote, strconv.Itoa(int(v.Properties.ProtocolVersion)), v.Net.Listener, strconv.Itoa(v.State.Subscriptions.Len()), strconv.Itoa(q.Depth), q.Age.Round(time.Millisecond).String(), strings.Join(ss, "\n")}) //
 
 		if vv, ok := counts[v.Net.Listener]; ok {
 			counts[v.Net.Listener] = vv + 1
@@ -356,3 +374,202 @@ func (l *HTTPStats) debugHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 }
+
+// delayedMessage is the json form of a pending delayed message.
+type delayedMessage struct {
+	ID      string `json:"id"`
+	Client  string `json:"client"`
+	Due     string `json:"due"`
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload string `json:"payload"`
+}
+
+// delayedHandler is an HTTP handler which lists pending delayed messages as JSON,
+// or cancels a delayed message with DELETE /delayed?id={id}.
+func (l *HTTPStats) delayedHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		msgs := l.lopt.Server.DelayedMessages()
+		out := make([]delayedMessage, 0, len(msgs))
+		for _, v := range msgs {
+			out = append(out, delayedMessage{
+				ID:      v.ID,
+				Client:  v.Client,
+				Due:     time.Unix(v.Due, 0).Format(time.RFC3339),
+				Topic:   v.Packet.TopicName,
+				Qos:     v.Packet.FixedHeader.Qos,
+				Retain:  v.Packet.FixedHeader.Retain,
+				Payload: string(v.Packet.Payload),
+			})
+		}
+
+		b, err := json.MarshalIndent(out, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	case http.MethodDelete:
+		err := l.lopt.Server.CancelDelayed(req.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// delayedWill is the json form of a pending delayed will message.
+type delayedWill struct {
+	Client  string `json:"client"`
+	Due     string `json:"due"`
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload string `json:"payload"`
+}
+
+// willsHandler is an HTTP handler which lists pending delayed will messages as JSON,
+// or cancels the delayed will message of a client with DELETE /wills?client={id}.
+func (l *HTTPStats) willsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		wills := l.lopt.Server.DelayedWills()
+		out := make([]delayedWill, 0, len(wills))
+		for _, v := range wills {
+			out = append(out, delayedWill{
+				Client:  v.Client,
+				Due:     time.Unix(v.Due, 0).Format(time.RFC3339),
+				Topic:   v.Packet.TopicName,
+				Qos:     v.Packet.FixedHeader.Qos,
+				Retain:  v.Packet.FixedHeader.Retain,
+				Payload: string(v.Packet.Payload),
+			})
+		}
+
+		b, err := json.MarshalIndent(out, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	case http.MethodDelete:
+		err := l.lopt.Server.CancelDelayedWill(req.URL.Query().Get("client"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// slowHandler is an HTTP handler which lists the current slow subscribers as JSON.
+func (l *HTTPStats) slowHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	subs := l.lopt.Server.SlowSubscribers()
+	if subs == nil {
+		subs = []mqtt.SlowSubscriber{}
+	}
+
+	b, err := json.MarshalIndent(subs, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// defaultMessagesLimit is the number of messages returned by /messages if no limit is given.
+const defaultMessagesLimit = 1000
+
+// loggedMessage is the json form of a message recorded in the message log.
+type loggedMessage struct {
+	Time    string                 `json:"time"`
+	Client  string                 `json:"client"`
+	Topic   string                 `json:"topic"`
+	Qos     byte                   `json:"qos"`
+	Retain  bool                   `json:"retain"`
+	User    []packets.UserProperty `json:"user,omitempty"`
+	Payload string                 `json:"payload"`
+}
+
+// messagesHandler is an HTTP handler which lists the messages recorded in the message log as
+// JSON, selected with GET /messages?filter={filter}&client={id}&from={time}&to={time}&limit={n}.
+// Times are RFC3339.
+func (l *HTTPStats) messagesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := req.URL.Query()
+	q := msglog.Query{
+		Filter: params.Get("filter"),
+		Client: params.Get("client"),
+		Limit:  defaultMessagesLimit,
+	}
+
+	var err error
+	for _, v := range []struct {
+		key string
+		t   *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if s := params.Get(v.key); s != "" {
+			if *v.t, err = time.Parse(time.RFC3339, s); err != nil {
+				http.Error(w, v.key+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if s := params.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			http.Error(w, "limit: invalid value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	msgs, err := l.lopt.MessageLog.Query(q)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, msglog.ErrInvalidFilter) {
+			code = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	out := make([]loggedMessage, 0, len(msgs))
+	for _, v := range msgs {
+		out = append(out, loggedMessage{
+			Time:    v.Time.Format(time.RFC3339Nano),
+			Client:  v.Client,
+			Topic:   v.Topic,
+			Qos:     v.Qos,
+			Retain:  v.Retain,
+			User:    v.User,
+			Payload: string(v.Payload),
+		})
+	}
+
+	b, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
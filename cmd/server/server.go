@@ -8,6 +8,7 @@ import (
 
 	"github.com/xyzj/mqtt-server"
 	"github.com/xyzj/mqtt-server/hooks/auth"
+	"github.com/xyzj/mqtt-server/hooks/storage/msglog"
 	"github.com/xyzj/mqtt-server/listeners"
 	"github.com/xyzj/toolbox"
 	"github.com/xyzj/toolbox/crypto"
@@ -46,6 +47,8 @@ type Opt struct {
 	DisableAuth bool
 	// InsideJob enable or disable inline client
 	InsideJob bool
+	// MessageLog records every accepted publish to disk when set, queryable on /messages
+	MessageLog *msglog.Options
 }
 
 func (o *Opt) ensureDefaults() {
@@ -66,9 +69,10 @@ func (o *Opt) ensureDefaults() {
 
 // MqttServer a new mqtt server
 type MqttServer struct {
-	svr *mqtt.Server
-	opt *Opt
-	st  *atomic.Bool
+	svr    *mqtt.Server
+	opt    *Opt
+	st     *atomic.Bool
+	msglog *msglog.Hook
 }
 
 // NewServer make a new server
@@ -150,6 +154,15 @@ func (m *MqttServer) Start() error {
 		m.opt.FileLogger.Error("[mqtt-broker] config auth error: " + err.Error())
 		return err
 	}
+	// set message log
+	if m.opt.MessageLog != nil {
+		m.msglog = new(msglog.Hook)
+		err = m.svr.AddHook(m.msglog, m.opt.MessageLog)
+		if err != nil {
+			m.opt.FileLogger.Error("[mqtt-broker] config message log error: " + err.Error())
+			return err
+		}
+	}
 	// check tls files
 	var tl *tls.Config
 	if m.opt.TLSConfig != nil {
@@ -216,10 +229,12 @@ func (m *MqttServer) Start() error {
 			m.svr.Info,
 			m.svr.Clients,
 			&Lopt{
-				PortMqtt: m.opt.MqttAddr,
-				PortTLS:  m.opt.MqttTlsAddr,
-				PortWS:   m.opt.WSAddr,
-				Auth:     userMap,
+				PortMqtt:   m.opt.MqttAddr,
+				PortTLS:    m.opt.MqttTlsAddr,
+				PortWS:     m.opt.WSAddr,
+				Auth:       userMap,
+				Server:     m.svr,
+				MessageLog: m.msglog,
 			},
 		))
 		if err != nil {
@@ -13,6 +13,8 @@ import (
 	"github.com/xyzj/mqtt-server/hooks/debug"
 	"github.com/xyzj/mqtt-server/hooks/storage/badger"
 	"github.com/xyzj/mqtt-server/hooks/storage/bolt"
+	"github.com/xyzj/mqtt-server/hooks/storage/file"
+	"github.com/xyzj/mqtt-server/hooks/storage/msglog"
 	"github.com/xyzj/mqtt-server/hooks/storage/pebble"
 	"github.com/xyzj/mqtt-server/hooks/storage/redis"
 	"github.com/xyzj/mqtt-server/listeners"
@@ -61,10 +63,12 @@ type HookAuthConfig struct {
 
 // HookStorageConfig contains configurations for the different storage hooks.
 type HookStorageConfig struct {
-	Badger *badger.Options `yaml:"badger" json:"badger"`
-	Bolt   *bolt.Options   `yaml:"bolt" json:"bolt"`
-	Pebble *pebble.Options `yaml:"pebble" json:"pebble"`
-	Redis  *redis.Options  `yaml:"redis" json:"redis"`
+	Badger     *badger.Options `yaml:"badger" json:"badger"`
+	Bolt       *bolt.Options   `yaml:"bolt" json:"bolt"`
+	File       *file.Options   `yaml:"file" json:"file"`
+	Pebble     *pebble.Options `yaml:"pebble" json:"pebble"`
+	Redis      *redis.Options  `yaml:"redis" json:"redis"`
+	MessageLog *msglog.Options `yaml:"message_log" json:"message_log"`
 }
 
 // ToHooks converts Hook file configurations into Hooks to be added to the server.
@@ -141,6 +145,20 @@ func (hc HookConfigs) toHooksStorage() []mqtt.HookLoadConfig {
 			Config: hc.Storage.Pebble,
 		})
 	}
+
+	if hc.Storage.File != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(file.Hook),
+			Config: hc.Storage.File,
+		})
+	}
+
+	if hc.Storage.MessageLog != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(msglog.Hook),
+			Config: hc.Storage.MessageLog,
+		})
+	}
 	return hlc
 }
 
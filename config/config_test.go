@@ -8,12 +8,16 @@ import (
 	"log/slog"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/xyzj/mqtt-server/hooks/auth"
 	"github.com/xyzj/mqtt-server/hooks/storage/badger"
 	"github.com/xyzj/mqtt-server/hooks/storage/bolt"
+	"github.com/xyzj/mqtt-server/hooks/storage/file"
+	"github.com/xyzj/mqtt-server/hooks/storage/kv"
+	"github.com/xyzj/mqtt-server/hooks/storage/msglog"
 	"github.com/xyzj/mqtt-server/hooks/storage/pebble"
 	"github.com/xyzj/mqtt-server/hooks/storage/redis"
 	"github.com/xyzj/mqtt-server/listeners"
@@ -236,3 +240,85 @@ func TestToHooksStoragePebble(t *testing.T) {
 
 	require.Equal(t, expect, th)
 }
+
+func TestToHooksStorageFile(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			File: &file.Options{
+				Path: "file",
+				Sync: file.SyncAlways,
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(file.Hook),
+			Config: hc.Storage.File,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksStorageMessageLog(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			MessageLog: &msglog.Options{
+				Path:   "msglog",
+				MaxAge: 86400,
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(msglog.Hook),
+			Config: hc.Storage.MessageLog,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestFromBytesStorageWriteBehind(t *testing.T) {
+	o, err := FromBytes([]byte(`
+hooks:
+  storage:
+    file:
+      path: "file"
+      write_behind:
+        queue_size: 500
+        batch_size: 50
+        flush_interval: 250ms
+        durability: sync
+`))
+	require.NoError(t, err)
+	require.Len(t, o.Hooks, 1)
+	require.Equal(t, &kv.WriteBehindOptions{
+		QueueSize:     500,
+		BatchSize:     50,
+		FlushInterval: 250 * time.Millisecond,
+		Durability:    kv.WriteBehindSync,
+	}, o.Hooks[0].Config.(*file.Options).WriteBehind)
+}
+
+func TestFromBytesStorageEncryption(t *testing.T) {
+	o, err := FromBytes([]byte(`
+hooks:
+  storage:
+    pebble:
+      path: "pebble"
+      encryption:
+        key_file: /etc/mqtt/storage.keys
+        key_env: MQTT_STORAGE_KEYS
+`))
+	require.NoError(t, err)
+	require.Len(t, o.Hooks, 1)
+	require.Equal(t, &kv.EncryptionOptions{
+		KeyFile: "/etc/mqtt/storage.keys",
+		KeyEnv:  "MQTT_STORAGE_KEYS",
+	}, o.Hooks[0].Config.(*pebble.Options).Encryption)
+}
@@ -0,0 +1,264 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// DelayedPrefix is the topic prefix for delayed publishes, in the form $delayed/{seconds}/{topic}.
+const DelayedPrefix = "$delayed/"
+
+// ErrDelayedMessageNotFound indicates that a delayed message does not exist or has already been published.
+var ErrDelayedMessageNotFound = errors.New("delayed message not found")
+
+// DelayedMessage is a message published to a $delayed/{seconds}/{topic} topic, which is
+// held by the server and published to the target topic when it is due.
+type DelayedMessage struct {
+	ID     string         `json:"id"`              // the unique id of the delayed message
+	Client string         `json:"client"`          // the id of the client which published the message
+	Owner  string         `json:"owner,omitempty"` // the user or client whose retain quota the message counts against, empty for the inline client
+	Due    int64          `json:"due"`             // the time the message is due to be published in unixtime
+	Packet packets.Packet `json:"-"`               // the message, with the target topic name
+}
+
+// delayedItem is a delayed message and its position in the due queue.
+type delayedItem struct {
+	msg   DelayedMessage
+	index int
+}
+
+// delayedQueue is a min-heap of delayed messages ordered by due time.
+type delayedQueue []*delayedItem
+
+func (q delayedQueue) Len() int { return len(q) }
+
+func (q delayedQueue) Less(i, j int) bool {
+	if q[i].msg.Due == q[j].msg.Due {
+		return q[i].msg.ID < q[j].msg.ID // xids sort by creation time
+	}
+	return q[i].msg.Due < q[j].msg.Due
+}
+
+func (q delayedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *delayedQueue) Push(x any) {
+	item := x.(*delayedItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *delayedQueue) Pop() any {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// delayedMessages is a map of delayed messages keyed on id, indexed by due time.
+type delayedMessages struct {
+	internal map[string]*delayedItem
+	queue    delayedQueue
+	sync.RWMutex
+}
+
+// newDelayedMessages returns a new instance of delayedMessages.
+func newDelayedMessages() *delayedMessages {
+	return &delayedMessages{
+		internal: map[string]*delayedItem{},
+	}
+}
+
+// Add adds a delayed message, replacing any existing message with the same id.
+func (d *delayedMessages) Add(msg DelayedMessage) {
+	d.Lock()
+	defer d.Unlock()
+	if item, ok := d.internal[msg.ID]; ok {
+		item.msg = msg
+		heap.Fix(&d.queue, item.index)
+		return
+	}
+
+	item := &delayedItem{msg: msg}
+	d.internal[msg.ID] = item
+	heap.Push(&d.queue, item)
+}
+
+// Delete removes a delayed message, returning true if it existed.
+func (d *delayedMessages) Delete(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+	item, ok := d.internal[id]
+	if !ok {
+		return false
+	}
+
+	delete(d.internal, id)
+	heap.Remove(&d.queue, item.index)
+	return true
+}
+
+// PopDue removes and returns the delayed messages which are due at or before now,
+// ordered by due time.
+func (d *delayedMessages) PopDue(now int64) []DelayedMessage {
+	d.Lock()
+	defer d.Unlock()
+	var v []DelayedMessage
+	for len(d.queue) > 0 && d.queue[0].msg.Due <= now {
+		item := heap.Pop(&d.queue).(*delayedItem)
+		delete(d.internal, item.msg.ID)
+		v = append(v, item.msg)
+	}
+	return v
+}
+
+// Len returns the number of delayed messages.
+func (d *delayedMessages) Len() int {
+	d.RLock()
+	defer d.RUnlock()
+	return len(d.internal)
+}
+
+// GetAll returns all delayed messages, ordered by due time.
+func (d *delayedMessages) GetAll() []DelayedMessage {
+	d.RLock()
+	v := make([]DelayedMessage, 0, len(d.internal))
+	for _, item := range d.internal {
+		v = append(v, item.msg)
+	}
+	d.RUnlock()
+
+	sort.Slice(v, func(i, j int) bool {
+		if v[i].Due == v[j].Due {
+			return v[i].ID < v[j].ID // xids sort by creation time
+		}
+		return v[i].Due < v[j].Due
+	})
+	return v
+}
+
+// parseDelayedTopic splits a $delayed/{seconds}/{topic} topic into the delay and target
+// topic. ok is false if the topic is not a delayed topic or the delay is malformed.
+func parseDelayedTopic(topic string) (delay int64, target string, ok bool) {
+	if !strings.HasPrefix(topic, DelayedPrefix) {
+		return 0, topic, false
+	}
+
+	n, target, found := strings.Cut(strings.TrimPrefix(topic, DelayedPrefix), "/")
+	if !found || target == "" {
+		return 0, topic, false
+	}
+
+	v, err := strconv.ParseUint(n, 10, 32)
+	if err != nil {
+		return 0, topic, false
+	}
+
+	return int64(v), target, true
+}
+
+// DelayedMessages returns all pending delayed messages, ordered by due time.
+func (s *Server) DelayedMessages() []DelayedMessage {
+	return s.loop.delayed.GetAll()
+}
+
+// CancelDelayed cancels a pending delayed message so that it is never published.
+func (s *Server) CancelDelayed(id string) error {
+	if !s.loop.delayed.Delete(id) {
+		return ErrDelayedMessageNotFound
+	}
+
+	s.hooks.OnDelayedRemoved(id)
+	return nil
+}
+
+// delayPublish schedules a message to be published to subscribers after a delay in seconds.
+func (s *Server) delayPublish(cl *Client, pk packets.Packet, delay int64) {
+	pk = pk.Copy(false)
+	pk.Expiry = 0 // message expiry is counted from when the message is published.
+
+	msg := DelayedMessage{
+		ID:     xid.New().String(),
+		Client: cl.ID,
+		Owner:  retainOwner(cl),
+		Due:    time.Now().Unix() + delay,
+		Packet: pk,
+	}
+
+	s.loop.delayed.Add(msg)
+	s.hooks.OnDelayedMessage(cl, msg)
+}
+
+// sendDelayedMessages publishes any delayed messages which have reached their due time.
+func (s *Server) sendDelayedMessages(now int64) {
+	for _, msg := range s.loop.delayed.PopDue(now) {
+		s.hooks.OnDelayedRemoved(msg.ID)
+
+		pk := msg.Packet
+		pk.Created = now
+		if expiry := minimum(s.Options.Capabilities.MaximumMessageExpiryInterval,
+			int64(pk.Properties.MessageExpiryInterval)); expiry > 0 {
+			pk.Expiry = pk.Created + expiry
+		}
+
+		if pk.FixedHeader.Retain {
+			if err := s.retainMessage(s.delayedClient(msg), pk); err != nil {
+				s.Log.Warn("delayed message not retained", "id", msg.ID, "topic", pk.TopicName, "error", err)
+			}
+		}
+
+		s.publishToSubscribers(pk)
+	}
+}
+
+// delayedClient returns the client which published a delayed message, or if it is no longer
+// connected, a stand-in client with the same retain quota owner.
+func (s *Server) delayedClient(msg DelayedMessage) *Client {
+	if cl, ok := s.Clients.Get(msg.Client); ok {
+		return cl
+	}
+
+	cl := s.NewClient(nil, LocalListener, msg.Client, msg.Owner == "")
+	if msg.Owner != msg.Client {
+		cl.Properties.Username = []byte(msg.Owner)
+	}
+
+	return cl
+}
+
+// loadDelayed restores delayed messages from the datastore. Messages stored without a retain
+// quota owner count against the publishing client, unless it is the inline client.
+func (s *Server) loadDelayed(v []storage.Message) {
+	for _, msg := range v {
+		owner := msg.Owner
+		if owner == "" && msg.Client != InlineClientId {
+			owner = msg.Client
+		}
+
+		s.loop.delayed.Add(DelayedMessage{
+			ID:     strings.TrimPrefix(msg.ID, storage.DelayedKey+"_"),
+			Client: msg.Client,
+			Owner:  owner,
+			Due:    msg.Due,
+			Packet: msg.ToPacket(),
+		})
+	}
+}
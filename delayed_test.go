@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+type delayedStoreHook struct {
+	HookBase
+	stored  map[string]DelayedMessage
+	removed []string
+}
+
+func (h *delayedStoreHook) ID() string {
+	return "delayed-store"
+}
+
+func (h *delayedStoreHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnDelayedMessage, OnDelayedRemoved}, []byte{b})
+}
+
+func (h *delayedStoreHook) OnDelayedMessage(cl *Client, msg DelayedMessage) {
+	h.stored[msg.ID] = msg
+}
+
+func (h *delayedStoreHook) OnDelayedRemoved(id string) {
+	h.removed = append(h.removed, id)
+}
+
+func TestParseDelayedTopic(t *testing.T) {
+	tt := []struct {
+		topic  string
+		delay  int64
+		target string
+		ok     bool
+	}{
+		{topic: "$delayed/10/a/b", delay: 10, target: "a/b", ok: true},
+		{topic: "$delayed/0/a", delay: 0, target: "a", ok: true},
+		{topic: "$delayed/4294967295/a", delay: 4294967295, target: "a", ok: true},
+		{topic: "$delayed/4294967296/a", target: "$delayed/4294967296/a"},
+		{topic: "$delayed/-1/a", target: "$delayed/-1/a"},
+		{topic: "$delayed/x/a", target: "$delayed/x/a"},
+		{topic: "$delayed/10", target: "$delayed/10"},
+		{topic: "$delayed/10/", target: "$delayed/10/"},
+		{topic: "a/b", target: "a/b"},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.topic, func(t *testing.T) {
+			delay, target, ok := parseDelayedTopic(tx.topic)
+			require.Equal(t, tx.delay, delay)
+			require.Equal(t, tx.target, target)
+			require.Equal(t, tx.ok, ok)
+		})
+	}
+}
+
+func TestServerDelayedPublish(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	hook := &delayedStoreHook{stored: map[string]DelayedMessage{}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	got := make(chan packets.Packet, 1)
+	require.NoError(t, s.Subscribe("a/b", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	now := time.Now().Unix()
+	require.NoError(t, s.Publish("$delayed/10/a/b", []byte("later"), true, 0))
+
+	msgs := s.DelayedMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, "a/b", msgs[0].Packet.TopicName)
+	require.Equal(t, s.inlineClient.ID, msgs[0].Client)
+	require.GreaterOrEqual(t, msgs[0].Due, now+10)
+	require.Contains(t, hook.stored, msgs[0].ID)
+	require.Empty(t, s.Topics.Messages("a/b"))
+	require.Len(t, got, 0)
+
+	s.sendDelayedMessages(msgs[0].Due - 1)
+	require.Len(t, got, 0)
+	require.Len(t, s.DelayedMessages(), 1)
+
+	s.sendDelayedMessages(msgs[0].Due)
+	select {
+	case pk := <-got:
+		require.Equal(t, []byte("later"), pk.Payload)
+		require.Equal(t, "a/b", pk.TopicName)
+	case <-time.After(time.Second):
+		t.Fatal("delayed message not published")
+	}
+
+	require.Len(t, s.DelayedMessages(), 0)
+	require.Equal(t, []string{msgs[0].ID}, hook.removed)
+	require.Len(t, s.Topics.Messages("a/b"), 1)
+}
+
+func TestServerDelayedPublishImmediate(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	got := make(chan packets.Packet, 1)
+	require.NoError(t, s.Subscribe("a/b", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	require.NoError(t, s.Publish("$delayed/0/a/b", []byte("now"), false, 0))
+	require.Len(t, got, 1)
+	require.Len(t, s.DelayedMessages(), 0)
+}
+
+func TestServerDelayedPublishInvalid(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	require.ErrorIs(t, s.Publish("$delayed/soon/a/b", []byte("x"), false, 0), packets.ErrTopicNameInvalid)
+	require.ErrorIs(t, s.Publish("$delayed/10", []byte("x"), false, 0), packets.ErrTopicNameInvalid)
+	require.Len(t, s.DelayedMessages(), 0)
+}
+
+func TestServerDelayedPublishACL(t *testing.T) {
+	s, _ := newMemoryTestServer(t, &Options{}, new(UsernameHook))
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+
+	require.ErrorIs(t, ic.Publish(context.Background(), "$delayed/10/other/a", []byte("x"), false, 1), packets.ErrNotAuthorized)
+	require.ErrorIs(t, ic.Publish(context.Background(), "$delayed/10/svc/#", []byte("x"), false, 1), packets.ErrTopicNameInvalid)
+	require.Len(t, s.DelayedMessages(), 0)
+
+	require.NoError(t, ic.Publish(context.Background(), "$delayed/10/svc/a", []byte("x"), false, 1))
+	msgs := s.DelayedMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, "svc/a", msgs[0].Packet.TopicName)
+	require.Equal(t, "svc-1", msgs[0].Packet.Origin)
+}
+
+func TestServerCancelDelayed(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	hook := &delayedStoreHook{stored: map[string]DelayedMessage{}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	got := make(chan packets.Packet, 1)
+	require.NoError(t, s.Subscribe("a/b", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	require.NoError(t, s.Publish("$delayed/10/a/b", []byte("later"), false, 0))
+	msgs := s.DelayedMessages()
+	require.Len(t, msgs, 1)
+
+	require.NoError(t, s.CancelDelayed(msgs[0].ID))
+	require.ErrorIs(t, s.CancelDelayed(msgs[0].ID), ErrDelayedMessageNotFound)
+	require.Equal(t, []string{msgs[0].ID}, hook.removed)
+
+	s.sendDelayedMessages(msgs[0].Due + 1)
+	require.Len(t, got, 0)
+}
+
+func TestDelayedMessagesPopDue(t *testing.T) {
+	d := newDelayedMessages()
+	for i, due := range []int64{30, 10, 20, 40, 10} {
+		d.Add(DelayedMessage{ID: string(rune('a' + i)), Due: due})
+	}
+	d.Add(DelayedMessage{ID: "d", Due: 5}) // replaced with an earlier due time
+	require.True(t, d.Delete("c"))
+	require.False(t, d.Delete("c"))
+
+	require.Empty(t, d.PopDue(4))
+
+	var ids []string
+	for _, msg := range d.PopDue(20) {
+		ids = append(ids, msg.ID)
+	}
+	require.Equal(t, []string{"d", "b", "e"}, ids)
+	require.Equal(t, 1, d.Len())
+	require.Len(t, d.queue, 1)
+	require.Equal(t, "a", d.PopDue(30)[0].ID)
+	require.Equal(t, 0, d.Len())
+}
+
+func TestServerDelayedMessagesOrdered(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	require.NoError(t, s.Publish("$delayed/30/a/b", []byte("3"), false, 0))
+	require.NoError(t, s.Publish("$delayed/10/a/b", []byte("1"), false, 0))
+	require.NoError(t, s.Publish("$delayed/20/a/b", []byte("2"), false, 0))
+
+	msgs := s.DelayedMessages()
+	require.Len(t, msgs, 3)
+	for i, msg := range msgs {
+		require.Equal(t, []byte{byte('1' + i)}, msg.Packet.Payload)
+	}
+}
+
+func TestServerLoadDelayed(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	s.loadDelayed([]storage.Message{
+		{ID: storage.DelayedKey + "_d1", Client: "mochi", Due: 100, TopicName: "a/b", Payload: []byte("hello")},
+		{ID: "d2", Client: "zen", Owner: "team", Due: 50, TopicName: "c/d"},
+		{ID: "d3", Client: InlineClientId, Due: 150, TopicName: "e/f"},
+	})
+
+	msgs := s.DelayedMessages()
+	require.Len(t, msgs, 3)
+	require.Equal(t, "d2", msgs[0].ID)
+	require.Equal(t, "team", msgs[0].Owner)
+	require.Equal(t, "d1", msgs[1].ID)
+	require.Equal(t, "mochi", msgs[1].Client)
+	require.Equal(t, "mochi", msgs[1].Owner) // stored without an owner.
+	require.Equal(t, "", msgs[2].Owner)
+	require.Equal(t, int64(100), msgs[1].Due)
+	require.Equal(t, "a/b", msgs[1].Packet.TopicName)
+	require.Equal(t, []byte("hello"), msgs[1].Packet.Payload)
+
+	require.NoError(t, s.CancelDelayed("d1"))
+	require.Len(t, s.DelayedMessages(), 2)
+}
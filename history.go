@@ -0,0 +1,268 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	HistoryPrefix          = "$history/" // the filter prefix to request replay, in the form $history/{n}/{filter}
+	HistoryProperty        = "history"   // the v5 subscribe user property to request replay of the last n messages
+	defaultHistoryMessages = 1000        // the number of messages kept for each topic if not set
+)
+
+// ErrHistoryInvalid indicates that the topic history options are misconfigured.
+var ErrHistoryInvalid = errors.New("invalid history options")
+
+// HistoryTopic keeps a history of the messages published to the topics matching a filter, which
+// subscribers can ask to have replayed when they subscribe.
+type HistoryTopic struct {
+	Filter   string `yaml:"filter" json:"filter"`     // the topic filter to match
+	Messages int    `yaml:"messages" json:"messages"` // the number of messages kept for each topic; 1000 if zero
+	Age      int64  `yaml:"age" json:"age"`           // seconds a message is kept; unlimited if 0
+}
+
+// validate returns an error if the history topic is misconfigured.
+func (o HistoryTopic) validate() error {
+	if !IsValidFilter(o.Filter, false) || IsSharedFilter(o.Filter) {
+		return fmt.Errorf("filter %q: %w", o.Filter, ErrHistoryInvalid)
+	}
+
+	if o.Messages < 0 || o.Age < 0 {
+		return fmt.Errorf("negative value; %w", ErrHistoryInvalid)
+	}
+
+	return nil
+}
+
+// validateHistory returns an error if any of the configured history topics are misconfigured.
+func (o *Options) validateHistory() error {
+	for _, h := range o.History {
+		if err := h.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// historyMessage is a message kept in the history of a topic.
+type historyMessage struct {
+	pk  packets.Packet // the message
+	seq uint64         // the order the message was recorded in, across all topics
+}
+
+// historyRing is a ring buffer of the most recent messages published to a topic.
+type historyRing struct {
+	age      int64            // seconds a message is kept; unlimited if 0
+	messages []historyMessage // the buffer, which wraps around at its length
+	start    int              // the index of the oldest message
+	size     int              // the number of messages in the buffer
+}
+
+// newHistoryRing returns a new history ring for the limits of a history topic.
+func newHistoryRing(t HistoryTopic) *historyRing {
+	n := t.Messages
+	if n == 0 {
+		n = defaultHistoryMessages
+	}
+
+	return &historyRing{
+		age:      t.Age,
+		messages: make([]historyMessage, n),
+	}
+}
+
+// at returns the message i places after the oldest message.
+func (r *historyRing) at(i int) historyMessage {
+	return r.messages[(r.start+i)%len(r.messages)]
+}
+
+// push adds a message, overwriting the oldest message if the buffer is full.
+func (r *historyRing) push(m historyMessage) {
+	if r.size == len(r.messages) {
+		r.messages[r.start] = m
+		r.start = (r.start + 1) % len(r.messages)
+		return
+	}
+
+	r.messages[(r.start+r.size)%len(r.messages)] = m
+	r.size++
+}
+
+// stale returns true if a message is older than the age limit or has expired.
+func (r *historyRing) stale(m historyMessage, now int64) bool {
+	return (r.age > 0 && now-m.pk.Created > r.age) || (m.pk.Expiry > 0 && m.pk.Expiry < now)
+}
+
+// trim drops the oldest messages while they are stale.
+func (r *historyRing) trim(now int64) {
+	for r.size > 0 && r.stale(r.at(0), now) {
+		r.messages[r.start] = historyMessage{} // release the message for gc.
+		r.start = (r.start + 1) % len(r.messages)
+		r.size--
+	}
+}
+
+// last returns up to n of the most recent messages which are not stale, oldest first.
+func (r *historyRing) last(n int, now int64) []historyMessage {
+	var out []historyMessage
+	for i := max(r.size-n, 0); i < r.size; i++ {
+		if m := r.at(i); !r.stale(m, now) {
+			out = append(out, m)
+		}
+	}
+
+	return out
+}
+
+// topicHistory contains the history rings of the topics matching the history filters.
+type topicHistory struct {
+	sync.Mutex
+	seq    uint64                  // the sequence of the last recorded message
+	topics map[string]*historyRing // history rings keyed on topic name
+}
+
+// newTopicHistory returns a new instance of topicHistory.
+func newTopicHistory() *topicHistory {
+	return &topicHistory{
+		topics: map[string]*historyRing{},
+	}
+}
+
+// record adds a message to the history of its topic, creating the history with the limits
+// of t if it does not exist.
+func (h *topicHistory) record(t HistoryTopic, pk packets.Packet) {
+	h.Lock()
+	defer h.Unlock()
+	r, ok := h.topics[pk.TopicName]
+	if !ok {
+		r = newHistoryRing(t)
+		h.topics[pk.TopicName] = r
+	}
+
+	h.seq++
+	r.push(historyMessage{pk: pk, seq: h.seq})
+}
+
+// replay returns up to n of the most recent messages of each topic matching a filter, in the
+// order they were recorded.
+func (h *topicHistory) replay(filter string, n int, now int64) []packets.Packet {
+	h.Lock()
+	var messages []historyMessage
+	for topic, r := range h.topics {
+		if packets.MatchTopic(filter, topic) {
+			messages = append(messages, r.last(n, now)...)
+		}
+	}
+	h.Unlock()
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].seq < messages[j].seq
+	})
+
+	out := make([]packets.Packet, len(messages))
+	for i, m := range messages {
+		out[i] = m.pk
+	}
+
+	return out
+}
+
+// clearExpired drops stale messages, and the histories of topics with no messages left.
+func (h *topicHistory) clearExpired(now int64) {
+	h.Lock()
+	defer h.Unlock()
+	for topic, r := range h.topics {
+		r.trim(now)
+		if r.size == 0 {
+			delete(h.topics, topic)
+		}
+	}
+}
+
+// parseHistoryFilter splits a $history/{n}/{filter} filter into the number of messages to
+// replay and the filter to subscribe to. ok is false if the filter is not a history filter
+// or the number is malformed.
+func parseHistoryFilter(filter string) (n int, target string, ok bool) {
+	if !strings.HasPrefix(filter, HistoryPrefix) {
+		return 0, filter, false
+	}
+
+	v, target, found := strings.Cut(strings.TrimPrefix(filter, HistoryPrefix), "/")
+	if !found || target == "" {
+		return 0, filter, false
+	}
+
+	i, err := strconv.ParseUint(v, 10, 16)
+	if err != nil {
+		return 0, filter, false
+	}
+
+	return int(i), target, true
+}
+
+// recordHistory adds a published message to the history of its topic, if the topic matches
+// a history filter.
+func (s *Server) recordHistory(pk packets.Packet) {
+	for _, t := range s.Options.History {
+		if packets.MatchTopic(t.Filter, pk.TopicName) {
+			s.history.record(t, pk.Copy(false))
+			return
+		}
+	}
+}
+
+// historyRequests returns the number of history messages requested for each filter of a
+// subscribe packet, removing any $history/{n}/ prefixes from the filters. A prefix takes
+// precedence over the history user property of a v5 subscribe packet.
+func (s *Server) historyRequests(cl *Client, pk packets.Packet) []int {
+	var requested int
+	if cl.Properties.ProtocolVersion == 5 {
+		for _, p := range pk.Properties.User {
+			if p.Key != HistoryProperty {
+				continue
+			}
+
+			if v, err := strconv.ParseUint(p.Val, 10, 16); err == nil {
+				requested = int(v)
+			}
+		}
+	}
+
+	out := make([]int, len(pk.Filters))
+	for i, sub := range pk.Filters {
+		out[i] = requested
+		if n, filter, ok := parseHistoryFilter(sub.Filter); ok {
+			out[i] = n
+			pk.Filters[i].Filter = filter
+		}
+	}
+
+	return out
+}
+
+// publishHistoryToClient replays the last n messages of each topic matching a new subscription
+// of a client, oldest first.
+func (s *Server) publishHistoryToClient(cl *Client, sub packets.Subscription, n int) {
+	if n <= 0 || IsSharedFilter(sub.Filter) {
+		return
+	}
+
+	for _, pk := range s.history.replay(sub.Filter, n, time.Now().Unix()) {
+		if _, err := s.publishToClient(cl, sub, pk); err != nil {
+			s.Log.Debug("failed to publish history message", "error", err, "client", cl.ID, "listener", cl.Net.Listener, "topic", pk.TopicName)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+type historyACLHook struct {
+	HookBase
+}
+
+func (h *historyACLHook) ID() string {
+	return "history-acl"
+}
+
+func (h *historyACLHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck}, []byte{b})
+}
+
+func (h *historyACLHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	return true
+}
+
+func (h *historyACLHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return topic != "a/secret"
+}
+
+// historyTestPacket returns a publish packet created at a time.
+func historyTestPacket(topic, payload string, created int64) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+		Created:     created,
+	}
+}
+
+// historyPayloads returns the payloads of packets.
+func historyPayloads(pks []packets.Packet) []string {
+	out := make([]string, len(pks))
+	for i, pk := range pks {
+		out[i] = string(pk.Payload)
+	}
+	return out
+}
+
+func TestHistoryTopicValidate(t *testing.T) {
+	require.NoError(t, HistoryTopic{Filter: "a/#", Messages: 10, Age: 60}.validate())
+	require.ErrorIs(t, HistoryTopic{Filter: "a/#/b"}.validate(), ErrHistoryInvalid)
+	require.ErrorIs(t, HistoryTopic{Filter: "$share/g/a"}.validate(), ErrHistoryInvalid)
+	require.ErrorIs(t, HistoryTopic{Filter: "a", Messages: -1}.validate(), ErrHistoryInvalid)
+}
+
+func TestServerServeHistoryInvalid(t *testing.T) {
+	s := New(&Options{Logger: logger, History: []HistoryTopic{{Filter: "a", Age: -1}}})
+	defer s.Close()
+	require.ErrorIs(t, s.Serve(), ErrHistoryInvalid)
+}
+
+func TestHistoryRing(t *testing.T) {
+	r := newHistoryRing(HistoryTopic{Messages: 3, Age: 10})
+	for i, v := range []string{"1", "2", "3", "4"} {
+		r.push(historyMessage{pk: historyTestPacket("a", v, int64(i)), seq: uint64(i)})
+	}
+	require.Equal(t, 3, r.size) // the oldest message was overwritten.
+
+	var got []string
+	for _, m := range r.last(5, 3) {
+		got = append(got, string(m.pk.Payload))
+	}
+	require.Equal(t, []string{"2", "3", "4"}, got)
+	require.Len(t, r.last(1, 3), 1)
+	require.Len(t, r.last(5, 12), 2) // "2" is more than 10 seconds old.
+
+	r.trim(13)
+	require.Equal(t, 1, r.size)
+	require.Equal(t, "4", string(r.at(0).pk.Payload))
+
+	require.Len(t, newHistoryRing(HistoryTopic{}).messages, defaultHistoryMessages)
+}
+
+func TestTopicHistoryReplay(t *testing.T) {
+	h := newTopicHistory()
+	ht := HistoryTopic{Filter: "a/#", Messages: 2}
+	h.record(ht, historyTestPacket("a/b", "b1", 1))
+	h.record(ht, historyTestPacket("a/c", "c1", 1))
+	h.record(ht, historyTestPacket("a/b", "b2", 1))
+	h.record(ht, historyTestPacket("a/b", "b3", 1))
+	h.record(ht, historyTestPacket("x", "x1", 1))
+
+	require.Equal(t, []string{"c1", "b2", "b3"}, historyPayloads(h.replay("a/+", 5, 1)))
+	require.Equal(t, []string{"c1", "b3"}, historyPayloads(h.replay("a/+", 1, 1)))
+	require.Empty(t, h.replay("b", 5, 1))
+
+	expired := historyTestPacket("e", "e1", 1)
+	expired.Expiry = 2
+	h.record(ht, expired)
+	require.Empty(t, h.replay("e", 5, 3))
+	h.clearExpired(3)
+	require.NotContains(t, h.topics, "e") // topics with no messages left are dropped.
+
+	h.topics["a/b"].age = 1
+	h.clearExpired(3)
+	require.NotContains(t, h.topics, "a/b")
+	require.Len(t, h.topics, 2)
+}
+
+func TestParseHistoryFilter(t *testing.T) {
+	n, filter, ok := parseHistoryFilter("$history/10/a/+/c")
+	require.True(t, ok)
+	require.Equal(t, 10, n)
+	require.Equal(t, "a/+/c", filter)
+
+	for _, v := range []string{"a/b", "$history/x/a", "$history/10", "$history/10/", "$history/-1/a"} {
+		_, filter, ok = parseHistoryFilter(v)
+		require.False(t, ok, v)
+		require.Equal(t, v, filter)
+	}
+}
+
+func TestServerHistoryRequests(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+
+	pk := packets.Packet{
+		Filters: packets.Subscriptions{{Filter: "a/b"}, {Filter: "$history/3/a/c"}},
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: HistoryProperty, Val: "5"}},
+		},
+	}
+	require.Equal(t, []int{5, 3}, s.historyRequests(cl, pk))
+	require.Equal(t, "a/c", pk.Filters[1].Filter)
+
+	cl.Properties.ProtocolVersion = 4
+	pk.Filters[1].Filter = "$history/3/a/c"
+	require.Equal(t, []int{0, 3}, s.historyRequests(cl, pk))
+}
+
+func TestServerProcessSubscribeHistory(t *testing.T) {
+	s := New(&Options{
+		Logger:  logger,
+		History: []HistoryTopic{{Filter: "a/#", Messages: 2}},
+	})
+	require.NoError(t, s.AddHook(new(historyACLHook), nil))
+	defer s.Close()
+
+	for _, pk := range []packets.Packet{
+		historyTestPacket("a/b", "1", 0),
+		historyTestPacket("a/secret", "s", 0),
+		historyTestPacket("a/b", "2", 0),
+		historyTestPacket("x/y", "x", 0),
+		historyTestPacket("a/b", "3", 0),
+	} {
+		s.publishToSubscribers(pk)
+	}
+
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 4
+	s.Clients.Add(cl)
+
+	done := make(chan error)
+	go func() {
+		done <- s.processSubscribe(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
+			PacketID:    1,
+			Filters:     packets.Subscriptions{{Filter: "$history/5/a/+"}},
+		})
+	}()
+
+	require.Equal(t, packets.Suback, readSlowTestPacket(t, r).FixedHeader.Type)
+	for _, v := range []string{"2", "3"} { // the secret topic is not readable by the client.
+		pk := readSlowTestPacket(t, r)
+		require.Equal(t, packets.Publish, pk.FixedHeader.Type)
+		require.Equal(t, "a/b", pk.TopicName)
+		require.Equal(t, v, string(pk.Payload))
+	}
+	require.NoError(t, <-done)
+
+	_, ok := cl.State.Subscriptions.Get("a/+")
+	require.True(t, ok)
+}
@@ -55,6 +55,18 @@ const (
 	StoredInflightMessages
 	StoredRetainedMessages
 	StoredSysInfo
+	OnDelayedMessage
+	OnDelayedRemoved
+	StoredDelayedMessages
+	OnAutoSubscribe
+	OnSelectRateLimit
+	OnRateLimited
+	OnSlowSubscriber
+	OnSelectOfflineQueue
+	OnSelectRetainQuota
+	OnDelayedWill
+	OnDelayedWillRemoved
+	StoredDelayedWills
 )
 
 // ErrInvalidConfigType indicates a different Type of config value was expected to what was received.
@@ -83,6 +95,9 @@ type Hook interface {
 	OnConnect(cl *Client, pk packets.Packet) error
 	OnSessionEstablish(cl *Client, pk packets.Packet)
 	OnSessionEstablished(cl *Client, pk packets.Packet)
+	OnAutoSubscribe(cl *Client, subs []AutoSubscription) []AutoSubscription
+	OnSelectRateLimit(cl *Client, limit RateLimit) RateLimit
+	OnSelectOfflineQueue(cl *Client, q OfflineQueue) OfflineQueue
 	OnDisconnect(cl *Client, err error, expire bool)
 	OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error)
 	OnPacketRead(cl *Client, pk packets.Packet) (packets.Packet, error) // triggers when a new packet is received by a client, but before packet validation
@@ -97,6 +112,9 @@ type Hook interface {
 	OnPublish(cl *Client, pk packets.Packet) (packets.Packet, error)
 	OnPublished(cl *Client, pk packets.Packet)
 	OnPublishDropped(cl *Client, pk packets.Packet)
+	OnRateLimited(cl *Client, pk packets.Packet, limit RateLimit, reason packets.Code)
+	OnSlowSubscriber(cl *Client, sub SlowSubscriber)
+	OnSelectRetainQuota(cl *Client, q RetainQuota) RetainQuota
 	OnRetainMessage(cl *Client, pk packets.Packet, r int64)
 	OnRetainPublished(cl *Client, pk packets.Packet)
 	OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int)
@@ -107,11 +125,17 @@ type Hook interface {
 	OnWillSent(cl *Client, pk packets.Packet)
 	OnClientExpired(cl *Client)
 	OnRetainedExpired(filter string)
+	OnDelayedMessage(cl *Client, msg DelayedMessage)
+	OnDelayedRemoved(id string)
+	OnDelayedWill(cl *Client, pk packets.Packet)
+	OnDelayedWillRemoved(id string)
 	StoredClients() ([]storage.Client, error)
 	StoredSubscriptions() ([]storage.Subscription, error)
 	StoredInflightMessages() ([]storage.Message, error)
 	StoredRetainedMessages() ([]storage.Message, error)
 	StoredSysInfo() (storage.SystemInfo, error)
+	StoredDelayedMessages() ([]storage.Message, error)
+	StoredDelayedWills() ([]storage.Message, error)
 }
 
 // HookOptions contains values which are inherited from the server on initialisation.
@@ -254,6 +278,46 @@ func (h *Hooks) OnSessionEstablished(cl *Client, pk packets.Packet) {
 	}
 }
 
+// OnAutoSubscribe is called when a client has established a session, to select the subscriptions
+// which the server adds on behalf of the client. It is passed the global auto subscriptions, and
+// can be used to add, remove or modify subscriptions for the client. The return values of the
+// hook methods are passed-through in the order the hooks were attached.
+func (h *Hooks) OnAutoSubscribe(cl *Client, subs []AutoSubscription) []AutoSubscription {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnAutoSubscribe) {
+			subs = hook.OnAutoSubscribe(cl, subs)
+		}
+	}
+	return subs
+}
+
+// OnSelectRateLimit is called when a client has established a session, to select the publish
+// rate limit of the client. It is passed the global or listener rate limit, and can be used to
+// set a different limit for the client, such as by username. The return values of the hook
+// methods are passed-through in the order the hooks were attached.
+func (h *Hooks) OnSelectRateLimit(cl *Client, limit RateLimit) RateLimit {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnSelectRateLimit) {
+			limit = hook.OnSelectRateLimit(cl, limit)
+		}
+	}
+	return limit
+}
+
+// OnSelectOfflineQueue is called when a client has established a session, to select the queue
+// of qos 0 messages buffered while the client is disconnected. It is passed the global or
+// listener offline queue, and can be used to set a different queue for the client, such as by
+// username. The return values of the hook methods are passed-through in the order the hooks
+// were attached.
+func (h *Hooks) OnSelectOfflineQueue(cl *Client, q OfflineQueue) OfflineQueue {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnSelectOfflineQueue) {
+			q = hook.OnSelectOfflineQueue(cl, q)
+		}
+	}
+	return q
+}
+
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *Hooks) OnDisconnect(cl *Client, err error, expire bool) {
 	for _, hook := range h.GetAll() {
@@ -438,6 +502,40 @@ func (h *Hooks) OnPublishDropped(cl *Client, pk packets.Packet) {
 	}
 }
 
+// OnRateLimited is called when a publish from a client exceeds its rate limit, before the
+// policy of the limit is applied. The reason is ErrMessageRateTooHigh if the messages limit
+// was exceeded, or ErrQuotaExceeded if the bytes limit was exceeded.
+func (h *Hooks) OnRateLimited(cl *Client, pk packets.Packet, limit RateLimit, reason packets.Code) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnRateLimited) {
+			hook.OnRateLimited(cl, pk, limit, reason)
+		}
+	}
+}
+
+// OnSlowSubscriber is called when a client is found to be a slow subscriber, before the
+// policy for slow subscribers is applied.
+func (h *Hooks) OnSlowSubscriber(cl *Client, sub SlowSubscriber) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnSlowSubscriber) {
+			hook.OnSlowSubscriber(cl, sub)
+		}
+	}
+}
+
+// OnSelectRetainQuota is called when a client publishes a retained message, to select the
+// quota of retained messages counted against the user or client. It is passed the default user
+// quota, and can be used to set a different quota for the client, such as by username. The
+// return values of the hook methods are passed-through in the order the hooks were attached.
+func (h *Hooks) OnSelectRetainQuota(cl *Client, q RetainQuota) RetainQuota {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnSelectRetainQuota) {
+			q = hook.OnSelectRetainQuota(cl, q)
+		}
+	}
+	return q
+}
+
 // OnRetainMessage is called then a published message is retained.
 func (h *Hooks) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {
 	for _, hook := range h.GetAll() {
@@ -548,6 +646,44 @@ func (h *Hooks) OnRetainedExpired(filter string) {
 	}
 }
 
+// OnDelayedMessage is called when a delayed message has been scheduled for publishing.
+func (h *Hooks) OnDelayedMessage(cl *Client, msg DelayedMessage) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnDelayedMessage) {
+			hook.OnDelayedMessage(cl, msg)
+		}
+	}
+}
+
+// OnDelayedRemoved is called when a delayed message has been published or cancelled and should be deleted.
+func (h *Hooks) OnDelayedRemoved(id string) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnDelayedRemoved) {
+			hook.OnDelayedRemoved(id)
+		}
+	}
+}
+
+// OnDelayedWill is called when the will message of a disconnected client has been scheduled
+// to be sent after its will delay interval. The time it is due is the expiry of the packet.
+func (h *Hooks) OnDelayedWill(cl *Client, pk packets.Packet) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnDelayedWill) {
+			hook.OnDelayedWill(cl, pk)
+		}
+	}
+}
+
+// OnDelayedWillRemoved is called when the delayed will message of a client has been sent or
+// cancelled and should be deleted.
+func (h *Hooks) OnDelayedWillRemoved(id string) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnDelayedWillRemoved) {
+			hook.OnDelayedWillRemoved(id)
+		}
+	}
+}
+
 // StoredClients returns all clients, e.g. from a persistent store, is used to
 // populate the server clients list before start.
 func (h *Hooks) StoredClients() (v []storage.Client, err error) {
@@ -647,6 +783,46 @@ func (h *Hooks) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return
 }
 
+// StoredDelayedMessages returns all delayed messages, e.g. from a persistent store,
+// and is used to reschedule pending delayed messages before start.
+func (h *Hooks) StoredDelayedMessages() (v []storage.Message, err error) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(StoredDelayedMessages) {
+			v, err := hook.StoredDelayedMessages()
+			if err != nil {
+				h.Log.Error("failed to load delayed messages", "error", err, "hook", hook.ID())
+				return v, err
+			}
+
+			if len(v) > 0 {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
+// StoredDelayedWills returns all delayed will messages, e.g. from a persistent store,
+// and is used to reschedule pending will messages before start.
+func (h *Hooks) StoredDelayedWills() (v []storage.Message, err error) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(StoredDelayedWills) {
+			v, err := hook.StoredDelayedWills()
+			if err != nil {
+				h.Log.Error("failed to load delayed wills", "error", err, "hook", hook.ID())
+				return v, err
+			}
+
+			if len(v) > 0 {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
 // OnConnectAuthenticate is called when a user attempts to authenticate with the server.
 // An implementation of this method MUST be used to allow or deny access to the
 // server (see hooks/auth/allow_all or basic). It can be used in custom hooks to
@@ -747,6 +923,21 @@ func (h *HookBase) OnSessionEstablish(cl *Client, pk packets.Packet) {}
 // OnSessionEstablished is called when a new client establishes a session (after OnConnect).
 func (h *HookBase) OnSessionEstablished(cl *Client, pk packets.Packet) {}
 
+// OnAutoSubscribe returns the subscriptions to add on behalf of a client when its session is established.
+func (h *HookBase) OnAutoSubscribe(cl *Client, subs []AutoSubscription) []AutoSubscription {
+	return subs
+}
+
+// OnSelectRateLimit returns the publish rate limit of a client when its session is established.
+func (h *HookBase) OnSelectRateLimit(cl *Client, limit RateLimit) RateLimit {
+	return limit
+}
+
+// OnSelectOfflineQueue returns the offline queue of a client when its session is established.
+func (h *HookBase) OnSelectOfflineQueue(cl *Client, q OfflineQueue) OfflineQueue {
+	return q
+}
+
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *HookBase) OnDisconnect(cl *Client, err error, expire bool) {}
 
@@ -803,6 +994,18 @@ func (h *HookBase) OnPublished(cl *Client, pk packets.Packet) {}
 // OnPublishDropped is called when a message to a client is dropped instead of being delivered.
 func (h *HookBase) OnPublishDropped(cl *Client, pk packets.Packet) {}
 
+// OnRateLimited is called when a publish from a client exceeds its rate limit.
+func (h *HookBase) OnRateLimited(cl *Client, pk packets.Packet, limit RateLimit, reason packets.Code) {
+}
+
+// OnSlowSubscriber is called when a client is found to be a slow subscriber.
+func (h *HookBase) OnSlowSubscriber(cl *Client, sub SlowSubscriber) {}
+
+// OnSelectRetainQuota returns the retain quota of a client when it publishes a retained message.
+func (h *HookBase) OnSelectRetainQuota(cl *Client, q RetainQuota) RetainQuota {
+	return q
+}
+
 // OnRetainMessage is called then a published message is retained.
 func (h *HookBase) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {}
 
@@ -835,6 +1038,18 @@ func (h *HookBase) OnClientExpired(cl *Client) {}
 // OnRetainedExpired is called when a retained message for a topic has expired.
 func (h *HookBase) OnRetainedExpired(topic string) {}
 
+// OnDelayedMessage is called when a delayed message has been scheduled for publishing.
+func (h *HookBase) OnDelayedMessage(cl *Client, msg DelayedMessage) {}
+
+// OnDelayedRemoved is called when a delayed message has been published or cancelled.
+func (h *HookBase) OnDelayedRemoved(id string) {}
+
+// OnDelayedWill is called when a will message has been scheduled to be sent after a delay.
+func (h *HookBase) OnDelayedWill(cl *Client, pk packets.Packet) {}
+
+// OnDelayedWillRemoved is called when a delayed will message has been sent or cancelled.
+func (h *HookBase) OnDelayedWillRemoved(id string) {}
+
 // StoredClients returns all clients from a store.
 func (h *HookBase) StoredClients() (v []storage.Client, err error) {
 	return
@@ -859,3 +1074,13 @@ func (h *HookBase) StoredRetainedMessages() (v []storage.Message, err error) {
 func (h *HookBase) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return
 }
+
+// StoredDelayedMessages returns all delayed messages from a store.
+func (h *HookBase) StoredDelayedMessages() (v []storage.Message, err error) {
+	return
+}
+
+// StoredDelayedWills returns all delayed will messages from a store.
+func (h *HookBase) StoredDelayedWills() (v []storage.Message, err error) {
+	return
+}
@@ -34,6 +34,10 @@ func (h *Hook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
 		mqtt.OnConnectAuthenticate,
 		mqtt.OnACLCheck,
+		mqtt.OnAutoSubscribe,
+		mqtt.OnSelectRateLimit,
+		mqtt.OnSelectOfflineQueue,
+		mqtt.OnSelectRetainQuota,
 	}, []byte{b})
 }
 
@@ -101,3 +105,39 @@ func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
 
 	return false
 }
+
+// OnAutoSubscribe adds the subscriptions of the user in the auth ledger to the subscriptions
+// made on behalf of the client when it connects.
+func (h *Hook) OnAutoSubscribe(cl *mqtt.Client, subs []mqtt.AutoSubscription) []mqtt.AutoSubscription {
+	return append(subs, h.ledger.Subscriptions(cl)...)
+}
+
+// OnSelectRateLimit returns the publish rate limit of the user in the auth ledger, if set,
+// or otherwise the default rate limit of the client.
+func (h *Hook) OnSelectRateLimit(cl *mqtt.Client, limit mqtt.RateLimit) mqtt.RateLimit {
+	if v, ok := h.ledger.RateLimit(cl); ok {
+		return v
+	}
+
+	return limit
+}
+
+// OnSelectOfflineQueue returns the qos 0 offline queue of the user in the auth ledger, if set,
+// or otherwise the default offline queue of the client.
+func (h *Hook) OnSelectOfflineQueue(cl *mqtt.Client, q mqtt.OfflineQueue) mqtt.OfflineQueue {
+	if v, ok := h.ledger.OfflineQueue(cl); ok {
+		return v
+	}
+
+	return q
+}
+
+// OnSelectRetainQuota returns the retained message quota of the user in the auth ledger, if
+// set, or otherwise the default quota.
+func (h *Hook) OnSelectRetainQuota(cl *mqtt.Client, q mqtt.RetainQuota) mqtt.RetainQuota {
+	if v, ok := h.ledger.RetainQuota(cl); ok {
+		return v
+	}
+
+	return q
+}
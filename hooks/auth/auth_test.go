@@ -29,6 +29,10 @@ func TestBasicProvides(t *testing.T) {
 	h := new(Hook)
 	require.True(t, h.Provides(mqtt.OnACLCheck))
 	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnAutoSubscribe))
+	require.True(t, h.Provides(mqtt.OnSelectRateLimit))
+	require.True(t, h.Provides(mqtt.OnSelectOfflineQueue))
+	require.True(t, h.Provides(mqtt.OnSelectRetainQuota))
 	require.False(t, h.Provides(mqtt.OnPublish))
 }
 
@@ -211,3 +215,101 @@ func TestOnACL(t *testing.T) {
 		true,
 	))
 }
+
+func TestOnAutoSubscribe(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			Users: Users{
+				"device": {
+					Subscriptions: []mqtt.AutoSubscription{{Filter: "cmd/%c/#", Qos: 1}},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	global := []mqtt.AutoSubscription{{Filter: "broadcast/#"}}
+	subs := h.OnAutoSubscribe(&mqtt.Client{
+		Properties: mqtt.ClientProperties{
+			Username: []byte("device"),
+		},
+	}, global)
+	require.Equal(t, []mqtt.AutoSubscription{{Filter: "broadcast/#"}, {Filter: "cmd/%c/#", Qos: 1}}, subs)
+
+	subs = h.OnAutoSubscribe(&mqtt.Client{}, global)
+	require.Equal(t, global, subs)
+}
+
+func TestOnSelectRateLimit(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			Users: Users{
+				"device": {
+					RateLimit: &mqtt.RateLimit{Messages: 5, Policy: mqtt.RateLimitDisconnect},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	global := mqtt.RateLimit{Messages: 100}
+	limit := h.OnSelectRateLimit(&mqtt.Client{
+		Properties: mqtt.ClientProperties{
+			Username: []byte("device"),
+		},
+	}, global)
+	require.Equal(t, mqtt.RateLimit{Messages: 5, Policy: mqtt.RateLimitDisconnect}, limit)
+	require.Equal(t, global, h.OnSelectRateLimit(&mqtt.Client{}, global))
+}
+
+func TestOnSelectOfflineQueue(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			Users: Users{
+				"device": {
+					OfflineQueue: &mqtt.OfflineQueue{Messages: 50, Age: 300},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	global := mqtt.OfflineQueue{}
+	q := h.OnSelectOfflineQueue(&mqtt.Client{
+		Properties: mqtt.ClientProperties{
+			Username: []byte("device"),
+		},
+	}, global)
+	require.Equal(t, mqtt.OfflineQueue{Messages: 50, Age: 300}, q)
+	require.Equal(t, global, h.OnSelectOfflineQueue(&mqtt.Client{}, global))
+}
+
+func TestOnSelectRetainQuota(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			Users: Users{
+				"device": {
+					RetainQuota: &mqtt.RetainQuota{Messages: 10, Bytes: 1024},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	global := mqtt.RetainQuota{Messages: 100}
+	q := h.OnSelectRetainQuota(&mqtt.Client{
+		Properties: mqtt.ClientProperties{
+			Username: []byte("device"),
+		},
+	}, global)
+	require.Equal(t, mqtt.RetainQuota{Messages: 10, Bytes: 1024}, q)
+	require.Equal(t, global, h.OnSelectRetainQuota(&mqtt.Client{}, global))
+}
@@ -30,10 +30,14 @@ type Users map[string]UserRule
 
 // UserRule defines a set of access rules for a specific user.
 type UserRule struct {
-	Username RString `json:"username,omitempty" yaml:"username,omitempty"` // the username of a user
-	Password RString `json:"password,omitempty" yaml:"password,omitempty"` // the password of a user
-	ACL      Filters `json:"acl,omitempty" yaml:"acl,omitempty"`           // filters to match, if desired
-	Disallow bool    `json:"disallow,omitempty" yaml:"disallow,omitempty"` // allow or disallow the user
+	Username      RString                 `json:"username,omitempty" yaml:"username,omitempty"`           // the username of a user
+	Password      RString                 `json:"password,omitempty" yaml:"password,omitempty"`           // the password of a user
+	ACL           Filters                 `json:"acl,omitempty" yaml:"acl,omitempty"`                     // filters to match, if desired
+	Disallow      bool                    `json:"disallow,omitempty" yaml:"disallow,omitempty"`           // allow or disallow the user
+	Subscriptions []mqtt.AutoSubscription `json:"subscriptions,omitempty" yaml:"subscriptions,omitempty"` // subscriptions added when the user connects
+	RateLimit     *mqtt.RateLimit         `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`       // the publish rate limit of the user, if not the default
+	OfflineQueue  *mqtt.OfflineQueue      `json:"offline_queue,omitempty" yaml:"offline_queue,omitempty"` // the qos 0 offline queue of the user, if not the default
+	RetainQuota   *mqtt.RetainQuota       `json:"retain_quota,omitempty" yaml:"retain_quota,omitempty"`   // the retained message quota of the user, if not the default
 }
 
 // AuthRules defines generic access rules applicable to all users.
@@ -224,6 +228,58 @@ func (l *Ledger) ACLOk(cl *mqtt.Client, topic string, write bool) (n int, ok boo
 	return 0, false
 }
 
+// Subscriptions returns the auto subscriptions of the user the client connected as, if any.
+func (l *Ledger) Subscriptions(cl *mqtt.Client) []mqtt.AutoSubscription {
+	if l.Users == nil {
+		return nil
+	}
+
+	if u, ok := l.Users[string(cl.Properties.Username)]; ok {
+		return u.Subscriptions
+	}
+
+	return nil
+}
+
+// RateLimit returns the publish rate limit of the user the client connected as, if set.
+func (l *Ledger) RateLimit(cl *mqtt.Client) (mqtt.RateLimit, bool) {
+	if l.Users == nil {
+		return mqtt.RateLimit{}, false
+	}
+
+	if u, ok := l.Users[string(cl.Properties.Username)]; ok && u.RateLimit != nil {
+		return *u.RateLimit, true
+	}
+
+	return mqtt.RateLimit{}, false
+}
+
+// OfflineQueue returns the qos 0 offline queue of the user the client connected as, if set.
+func (l *Ledger) OfflineQueue(cl *mqtt.Client) (mqtt.OfflineQueue, bool) {
+	if l.Users == nil {
+		return mqtt.OfflineQueue{}, false
+	}
+
+	if u, ok := l.Users[string(cl.Properties.Username)]; ok && u.OfflineQueue != nil {
+		return *u.OfflineQueue, true
+	}
+
+	return mqtt.OfflineQueue{}, false
+}
+
+// RetainQuota returns the retained message quota of the user the client connected as, if set.
+func (l *Ledger) RetainQuota(cl *mqtt.Client) (mqtt.RetainQuota, bool) {
+	if l.Users == nil {
+		return mqtt.RetainQuota{}, false
+	}
+
+	if u, ok := l.Users[string(cl.Properties.Username)]; ok && u.RetainQuota != nil {
+		return *u.RetainQuota, true
+	}
+
+	return mqtt.RetainQuota{}, false
+}
+
 // ToJSON encodes the values into a JSON string.
 func (l *Ledger) ToJSON() (data []byte, err error) {
 	return json.Marshal(l)
@@ -572,6 +572,104 @@ func TestLedgerUpdate(t *testing.T) {
 	require.NotSame(t, n, old)
 }
 
+func TestLedgerSubscriptions(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"device": {
+				Subscriptions: []mqtt.AutoSubscription{
+					{Filter: "cmd/%u/#", Qos: 1},
+				},
+			},
+			"mochi": {},
+		},
+	}
+
+	subs := l.Subscriptions(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("device")}})
+	require.Equal(t, []mqtt.AutoSubscription{{Filter: "cmd/%u/#", Qos: 1}}, subs)
+	require.Empty(t, l.Subscriptions(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}}))
+	require.Empty(t, l.Subscriptions(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("nobody")}}))
+	require.Empty(t, new(Ledger).Subscriptions(&mqtt.Client{}))
+}
+
+func TestLedgerSubscriptionsUnmarshal(t *testing.T) {
+	l := new(Ledger)
+	err := l.Unmarshal([]byte(`
+users:
+  device:
+    password: pass
+    subscriptions:
+      - filter: cmd/%c/#
+        qos: 1
+        no_local: true
+`))
+	require.NoError(t, err)
+	require.Equal(t, []mqtt.AutoSubscription{
+		{Filter: "cmd/%c/#", Qos: 1, NoLocal: true},
+	}, l.Users["device"].Subscriptions)
+}
+
+func TestLedgerRateLimit(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"device": {
+				RateLimit: &mqtt.RateLimit{Messages: 10, Policy: mqtt.RateLimitDrop},
+			},
+			"mochi": {},
+		},
+	}
+
+	limit, ok := l.RateLimit(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("device")}})
+	require.True(t, ok)
+	require.Equal(t, mqtt.RateLimit{Messages: 10, Policy: mqtt.RateLimitDrop}, limit)
+
+	_, ok = l.RateLimit(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}})
+	require.False(t, ok)
+	_, ok = l.RateLimit(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("nobody")}})
+	require.False(t, ok)
+	_, ok = new(Ledger).RateLimit(&mqtt.Client{})
+	require.False(t, ok)
+}
+
+func TestLedgerOfflineQueue(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"device": {
+				OfflineQueue: &mqtt.OfflineQueue{Messages: 100, Age: 60},
+			},
+			"mochi": {},
+		},
+	}
+
+	q, ok := l.OfflineQueue(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("device")}})
+	require.True(t, ok)
+	require.Equal(t, mqtt.OfflineQueue{Messages: 100, Age: 60}, q)
+
+	_, ok = l.OfflineQueue(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}})
+	require.False(t, ok)
+	_, ok = new(Ledger).OfflineQueue(&mqtt.Client{})
+	require.False(t, ok)
+}
+
+func TestLedgerRetainQuota(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"device": {
+				RetainQuota: &mqtt.RetainQuota{Messages: 10},
+			},
+			"mochi": {},
+		},
+	}
+
+	q, ok := l.RetainQuota(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("device")}})
+	require.True(t, ok)
+	require.Equal(t, mqtt.RetainQuota{Messages: 10}, q)
+
+	_, ok = l.RetainQuota(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}})
+	require.False(t, ok)
+	_, ok = new(Ledger).RetainQuota(&mqtt.Client{})
+	require.False(t, ok)
+}
+
 func TestLedgerToJSON(t *testing.T) {
 	data, err := ledgerStruct.ToJSON()
 	require.NoError(t, err)
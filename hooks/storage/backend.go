@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package storage
+
+import "errors"
+
+// ErrKeyNotFound indicates that a key does not exist in a backend.
+var ErrKeyNotFound = errors.New("key not found")
+
+// Backend is a key-value store which the kv storage hook keeps its data in. Keys are one of
+// the type keys above (e.g. ClientKey), optionally followed by an underscore and an id, so
+// backends may group keys by type. Backends must be safe for concurrent use.
+type Backend interface {
+	// Get returns the value of a key, or ErrKeyNotFound if it does not exist.
+	Get(key string) ([]byte, error)
+
+	// Set sets the value of a key.
+	Set(key string, value []byte) error
+
+	// Delete deletes a key. Deleting a key which does not exist is not an error.
+	Delete(key string) error
+
+	// Iterate calls visit with the value of each key beginning with a prefix, in key order,
+	// returning the first error from visit. The prefix is a type key, optionally followed by
+	// an underscore and the start of an id.
+	Iterate(prefix string, visit func(value []byte) error) error
+
+	// Close closes the backend.
+	Close() error
+}
+
+// Op is a change to a key in a batch, which either sets its value or deletes it.
+type Op struct {
+	Key    string // the key to change
+	Value  []byte // the value to set, if not a delete
+	Delete bool   // true if the key is deleted
+}
+
+// Batcher is implemented by backends which can apply a batch of changes together, e.g. in
+// one transaction, which is usually much cheaper than applying them one at a time. The
+// write-behind queue of the kv storage hook writes its batches this way when it can.
+type Batcher interface {
+	// Batch applies a batch of changes in order.
+	Batch(ops []Op) error
+}
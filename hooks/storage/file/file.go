@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+// Package file provides a persistent storage hook which needs nothing beyond the standard
+// library, keeping its data in memory and making it durable with a write-ahead log which is
+// periodically compacted into a snapshot.
+package file
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/hooks/storage/kv"
+)
+
+var (
+	// ErrKeyNotFound indicates that a key is not in the store.
+	ErrKeyNotFound = storage.ErrKeyNotFound
+
+	// ErrInvalidSync indicates that the fsync policy is not one of the Sync constants.
+	ErrInvalidSync = errors.New("invalid sync policy")
+)
+
+const (
+	SyncAlways   = "always"   // SyncAlways syncs the write-ahead log to disk after every write.
+	SyncInterval = "interval" // SyncInterval syncs the write-ahead log to disk at each sync interval.
+	SyncNever    = "never"    // SyncNever leaves syncing the write-ahead log to the operating system.
+)
+
+const (
+	// defaultPath is the default directory of the store files.
+	defaultPath = ".filedb"
+
+	// defaultSyncInterval is the default interval at which the write-ahead log is synced.
+	defaultSyncInterval = time.Second
+
+	// defaultCompactSize is the default size of the write-ahead log at which it is compacted.
+	defaultCompactSize = 4 << 20
+
+	// defaultCompactInterval is the default interval at which the write-ahead log is compacted.
+	defaultCompactInterval = 5 * time.Minute
+)
+
+// Options contains configuration settings for the file store.
+type Options struct {
+	Path            string                 `yaml:"path" json:"path"`                         // the directory of the store files; .filedb if empty
+	Sync            string                 `yaml:"sync" json:"sync"`                         // the fsync policy: always, interval or never; interval if empty
+	SyncInterval    time.Duration          `yaml:"sync_interval" json:"sync_interval"`       // the interval of the interval fsync policy; 1s if zero
+	CompactSize     int64                  `yaml:"compact_size" json:"compact_size"`         // the bytes of the write-ahead log at which it is compacted; 4MB if zero
+	CompactInterval time.Duration          `yaml:"compact_interval" json:"compact_interval"` // the interval at which the write-ahead log is compacted; 5m if zero
+	WriteBehind     *kv.WriteBehindOptions `yaml:"write_behind" json:"write_behind"`         // queue writes and write them to the log in batches if set
+	Encryption      *kv.EncryptionOptions  `yaml:"encryption" json:"encryption"`             // encrypt the values written to the log if set
+}
+
+// Hook is a persistent storage hook using a write-ahead log and snapshot file store as a backend.
+type Hook struct {
+	kv.Hook
+	config  *Options      // options for configuring the file store
+	db      *store        // the file store
+	done    chan struct{} // closed when the hook is stopped
+	stopped chan struct{} // closed when the maintenance loop has returned
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "file-db"
+}
+
+// Init opens the file store, recovering its data from the snapshot and write-ahead log.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if len(h.config.Path) == 0 {
+		h.config.Path = defaultPath
+	}
+
+	switch h.config.Sync {
+	case "":
+		h.config.Sync = SyncInterval
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return fmt.Errorf("%q; %w", h.config.Sync, ErrInvalidSync)
+	}
+
+	if h.config.SyncInterval <= 0 {
+		h.config.SyncInterval = defaultSyncInterval
+	}
+
+	if h.config.CompactSize <= 0 {
+		h.config.CompactSize = defaultCompactSize
+	}
+
+	if h.config.CompactInterval <= 0 {
+		h.config.CompactInterval = defaultCompactInterval
+	}
+
+	var err error
+	h.db, err = openStore(h.config.Path, h.config.Sync)
+	if err != nil {
+		return err
+	}
+
+	h.db.compactSize = h.config.CompactSize
+	h.db.oversize = make(chan struct{}, 1)
+	h.done = make(chan struct{})
+	h.stopped = make(chan struct{})
+	go h.maintain()
+
+	return h.Hook.Init(&kv.Options{
+		Backend:     h.db,
+		WriteBehind: h.config.WriteBehind,
+		Encryption:  h.config.Encryption,
+	})
+}
+
+// Stop compacts and closes the file store.
+func (h *Hook) Stop() error {
+	if h.db == nil {
+		return nil
+	}
+
+	close(h.done)
+	<-h.stopped
+
+	err := h.Hook.Stop()
+	h.db = nil
+	return err
+}
+
+// maintain syncs the write-ahead log under the interval fsync policy, and compacts it when
+// it is over size or at each compact interval, until the hook is stopped.
+func (h *Hook) maintain() {
+	defer close(h.stopped)
+	syncTicker := time.NewTicker(h.config.SyncInterval)
+	defer syncTicker.Stop()
+	compactTicker := time.NewTicker(h.config.CompactInterval)
+	defer compactTicker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-syncTicker.C:
+			if h.config.Sync != SyncInterval {
+				continue
+			}
+			if err := h.db.flush(); err != nil {
+				h.Log.Error("failed to sync write-ahead log", "error", err)
+			}
+		case <-h.db.oversize:
+			h.compactStore()
+		case <-compactTicker.C:
+			h.compactStore()
+		}
+	}
+}
+
+// compactStore compacts the write-ahead log into a new snapshot.
+func (h *Hook) compactStore() {
+	if err := h.db.compact(); err != nil {
+		h.Log.Error("failed to compact write-ahead log", "error", err)
+	}
+}
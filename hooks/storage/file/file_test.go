@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package file
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/hooks/storage/kv"
+	"github.com/xyzj/mqtt-server/hooks/storage/storagetest"
+	"github.com/xyzj/mqtt-server/packets"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+func teardown(t *testing.T, path string, h *Hook) {
+	_ = h.Stop()
+	err := os.RemoveAll(path)
+	require.NoError(t, err)
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "file-db", h.ID())
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.Error(t, err)
+}
+
+func TestInitUseDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.Equal(t, defaultPath, h.config.Path)
+	require.Equal(t, SyncInterval, h.config.Sync)
+	require.Equal(t, defaultSyncInterval, h.config.SyncInterval)
+	require.Equal(t, int64(defaultCompactSize), h.config.CompactSize)
+	require.Equal(t, defaultCompactInterval, h.config.CompactInterval)
+}
+
+func TestInitBadPath(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	err := h.Init(&Options{
+		Path: path,
+	})
+	require.Error(t, err)
+}
+
+func TestInitBadSync(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Path: t.TempDir(),
+		Sync: "sometimes",
+	})
+	require.ErrorIs(t, err, ErrInvalidSync)
+}
+
+func TestStopNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Stop())
+}
+
+func TestBackend(t *testing.T) {
+	storagetest.RunBackendTests(t, func(t *testing.T) storage.Backend {
+		s, err := openStore(t.TempDir(), SyncNever)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestHook(t *testing.T) {
+	for _, sync := range []string{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(sync, func(t *testing.T) {
+			storagetest.RunHookTests(t, func(t *testing.T) mqtt.Hook {
+				h := new(Hook)
+				h.SetOpts(logger, nil)
+				err := h.Init(&Options{
+					Path: t.TempDir(),
+					Sync: sync,
+				})
+				require.NoError(t, err)
+				return h
+			})
+		})
+	}
+}
+
+func TestHookWriteBehind(t *testing.T) {
+	storagetest.RunHookTests(t, func(t *testing.T) mqtt.Hook {
+		h := new(Hook)
+		h.SetOpts(logger, nil)
+		err := h.Init(&Options{
+			Path:        t.TempDir(),
+			WriteBehind: &kv.WriteBehindOptions{Durability: kv.WriteBehindSync},
+		})
+		require.NoError(t, err)
+		return h
+	})
+}
+
+func TestHookEncryption(t *testing.T) {
+	t.Setenv("MQTT_STORAGE_KEYS", "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	storagetest.RunHookTests(t, func(t *testing.T) mqtt.Hook {
+		h := new(Hook)
+		h.SetOpts(logger, nil)
+		err := h.Init(&Options{
+			Path:       t.TempDir(),
+			Encryption: &kv.EncryptionOptions{KeyEnv: "MQTT_STORAGE_KEYS"},
+		})
+		require.NoError(t, err)
+		return h
+	})
+}
@@ -0,0 +1,527 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xyzj/mqtt-server/hooks/storage"
+)
+
+const (
+	snapshotFile = "snapshot" // the name of the snapshot file
+	walFile      = "wal"      // the name of the write-ahead log file
+	oldWalFile   = "wal.old"  // the name of the write-ahead log being compacted into a snapshot
+
+	headerSize = 8 // the bytes of the length and checksum before each record
+
+	opSet    byte = 1 // a record which sets the value of a key
+	opDelete byte = 2 // a record which deletes a key
+)
+
+var (
+	// ErrCorrupt indicates that a snapshot record failed its checksum or could not be decoded.
+	ErrCorrupt = errors.New("file store record corrupt")
+
+	// ErrClosed indicates that the store has been closed.
+	ErrClosed = errors.New("file store closed")
+)
+
+// store is a key-value store held in memory, made durable by a write-ahead log of every
+// change and a snapshot of all values which the log is compacted into. It implements
+// storage.Backend.
+type store struct {
+	sync.RWMutex
+	compactMu   sync.Mutex        // serialises compactions
+	dir         string            // the directory of the store files
+	sync        string            // the fsync policy for writes to the log
+	values      map[string][]byte // the current values, keyed on key
+	wal         *os.File          // the write-ahead log
+	walSize     int64             // the bytes of the write-ahead log
+	rotated     bool              // true if the old log has not yet been compacted into a snapshot
+	dirty       bool              // true if the log has been written since it was last synced
+	compactSize int64             // the bytes of the log at which compact is signalled; never if zero
+	oversize    chan struct{}     // signalled when the log reaches the compact size
+}
+
+// openStore opens or creates a store in a directory, loading the snapshot and replaying
+// any old write-ahead log left by an unfinished compaction and then the write-ahead log
+// over it. Any partial record left at the end of the log by a crash is discarded.
+func openStore(dir, sync string) (*store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &store{
+		dir:    dir,
+		sync:   sync,
+		values: map[string][]byte{},
+	}
+
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	if err := s.replayOld(); err != nil {
+		return nil, err
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadSnapshot reads the values of the snapshot, if there is one.
+func (s *store) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		op, key, value, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil || op != opSet {
+			return ErrCorrupt // snapshots are renamed into place whole, so are never partial.
+		}
+		s.values[key] = value
+	}
+}
+
+// replayOld applies the records of the old write-ahead log, if a compaction was
+// interrupted before it could be removed. Its records may already be in the snapshot, but
+// applying them again leaves the same values, since the newer log is applied after it.
+func (s *store) replayOld() error {
+	f, err := os.Open(filepath.Join(s.dir, oldWalFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.rotated = true
+	r := bufio.NewReader(f)
+	for {
+		op, key, value, err := readRecord(r)
+		if err != nil {
+			return nil // the old log is synced before it is rotated, so is never partial.
+		}
+		s.apply(op, key, value)
+	}
+}
+
+// replay applies the records of the write-ahead log, truncating the log after the last
+// complete record, and opens the log for appending.
+func (s *store) replay() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, walFile), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		op, key, value, err := readRecord(r)
+		if err != nil {
+			break
+		}
+
+		s.apply(op, key, value)
+		offset += int64(headerSize + recordBodySize(key, value))
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	s.wal = f
+	s.walSize = offset
+	return nil
+}
+
+// apply applies a change to the values in memory.
+func (s *store) apply(op byte, key string, value []byte) {
+	switch op {
+	case opSet:
+		s.values[key] = value
+	case opDelete:
+		delete(s.values, key)
+	}
+}
+
+// write appends a batch of changes to the write-ahead log and applies them, signalling
+// compact if the log has reached the compact size. Deletes of keys which do not exist are
+// skipped.
+func (s *store) write(ops []storage.Op) error {
+	s.Lock()
+	if s.wal == nil {
+		s.Unlock()
+		return ErrClosed
+	}
+
+	var rec []byte
+	exists := map[string]bool{} // keys set or deleted earlier in the batch
+	for _, op := range ops {
+		if op.Delete {
+			ok, seen := exists[op.Key]
+			if !seen {
+				_, ok = s.values[op.Key]
+			}
+			exists[op.Key] = false
+			if !ok {
+				continue
+			}
+			rec = appendRecord(rec, opDelete, op.Key, nil)
+		} else {
+			exists[op.Key] = true
+			rec = appendRecord(rec, opSet, op.Key, op.Value)
+		}
+	}
+
+	if len(rec) == 0 {
+		s.Unlock()
+		return nil
+	}
+
+	err := s.append(rec)
+	if err == nil {
+		for _, op := range ops {
+			if op.Delete {
+				s.apply(opDelete, op.Key, nil)
+			} else {
+				s.apply(opSet, op.Key, bytes.Clone(op.Value))
+			}
+		}
+	}
+	oversize := s.compactSize > 0 && s.walSize >= s.compactSize
+	s.Unlock()
+
+	if oversize {
+		select {
+		case s.oversize <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// append appends records to the write-ahead log, syncing it under the always fsync policy.
+// The store must be locked.
+func (s *store) append(rec []byte) error {
+	if _, err := s.wal.Write(rec); err != nil {
+		return err
+	}
+	s.walSize += int64(len(rec))
+
+	if s.sync != SyncAlways {
+		s.dirty = true
+		return nil
+	}
+	return s.wal.Sync()
+}
+
+// Set sets the value of a key.
+func (s *store) Set(key string, value []byte) error {
+	return s.write([]storage.Op{{Key: key, Value: value}})
+}
+
+// Delete deletes a key. Deleting a key which does not exist is not an error.
+func (s *store) Delete(key string) error {
+	return s.write([]storage.Op{{Key: key, Delete: true}})
+}
+
+// Batch applies a batch of changes, appending them to the write-ahead log together.
+func (s *store) Batch(ops []storage.Op) error {
+	return s.write(ops)
+}
+
+// Get returns the value of a key.
+func (s *store) Get(key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	v, ok := s.values[key]
+	if !ok {
+		return nil, storage.ErrKeyNotFound
+	}
+	return bytes.Clone(v), nil
+}
+
+// Iterate calls visit with the values of the keys beginning with a prefix, in key order.
+// The store must not be changed from within visit.
+func (s *store) Iterate(prefix string, visit func([]byte) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	keys := make([]string, 0)
+	for k := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := visit(bytes.Clone(s.values[k])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// size returns the bytes of the write-ahead log.
+func (s *store) size() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.walSize
+}
+
+// flush syncs the write-ahead log to disk if it has been written since it was last synced.
+func (s *store) flush() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.wal == nil {
+		return ErrClosed
+	}
+
+	if !s.dirty {
+		return nil
+	}
+
+	s.dirty = false
+	return s.wal.Sync()
+}
+
+// compact writes all values to a new snapshot and empties the write-ahead log. The values
+// are copied and the log is rotated to the old log under the lock, so writes continue to a
+// fresh log while the snapshot is written. The snapshot is written to a temporary file and
+// renamed into place, so a crash leaves either the old snapshot and the full logs, or the
+// new snapshot and logs whose records it already contains or which follow it.
+func (s *store) compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.Lock()
+	if s.wal == nil {
+		s.Unlock()
+		return ErrClosed
+	}
+
+	if s.walSize == 0 && !s.rotated {
+		s.Unlock()
+		return nil
+	}
+
+	// values are replaced by writes, never changed in place. If the old log is left by a
+	// failed compaction, the log is not rotated over it, and is kept after the snapshot.
+	values := maps.Clone(s.values)
+	if !s.rotated {
+		if err := s.rotate(); err != nil {
+			s.Unlock()
+			return err
+		}
+	}
+	s.Unlock()
+
+	if err := s.writeSnapshot(values); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, oldWalFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	s.Lock()
+	s.rotated = false
+	s.Unlock()
+	return nil
+}
+
+// rotate syncs the write-ahead log and renames it to the old log, opening a fresh log for
+// subsequent writes. The store must be locked.
+func (s *store) rotate() error {
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, walFile)
+	old := filepath.Join(s.dir, oldWalFile)
+	if err := os.Rename(path, old); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o600)
+	if err != nil {
+		_ = os.Rename(old, path)
+		return err
+	}
+
+	if err := syncDir(s.dir); err != nil {
+		_ = f.Close()
+		_ = os.Rename(old, path)
+		return err
+	}
+
+	_ = s.wal.Close()
+	s.wal = f
+	s.walSize = 0
+	s.dirty = false
+	s.rotated = true
+	return nil
+}
+
+// writeSnapshot writes values to a temporary file and renames it into place as the snapshot.
+func (s *store) writeSnapshot(values map[string][]byte) error {
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	var rec []byte
+	for k, v := range values {
+		rec = appendRecord(rec[:0], opSet, k, v)
+		if _, err := w.Write(rec); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	return syncDir(s.dir)
+}
+
+// Close compacts the write-ahead log into a new snapshot and closes it.
+func (s *store) Close() error {
+	err := s.compact()
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+
+	if cerr := s.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// close syncs and closes the write-ahead log.
+func (s *store) close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+
+	err := s.wal.Sync()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	s.wal = nil
+	return err
+}
+
+// syncDir syncs a directory, making renames within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// recordBodySize returns the bytes of the body of a record, after its header.
+func recordBodySize(key string, value []byte) int {
+	return 1 + binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(len(key))) + len(key) + len(value)
+}
+
+// appendRecord appends a record to b. A record is the length and crc32 checksum of its body,
+// followed by the body of an op, the length of the key, the key, and the value.
+func appendRecord(b []byte, op byte, key string, value []byte) []byte {
+	start := len(b)
+	b = append(b, make([]byte, headerSize)...)
+	b = append(b, op)
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	b = append(b, value...)
+
+	body := b[start+headerSize:]
+	binary.BigEndian.PutUint32(b[start:], uint32(len(body)))
+	binary.BigEndian.PutUint32(b[start+4:], crc32.ChecksumIEEE(body))
+	return b
+}
+
+// readRecord reads a record from r. It returns io.EOF if r is at the end, and an error if
+// the record is partial or fails its checksum.
+func readRecord(r io.Reader) (op byte, key string, value []byte, err error) {
+	header := make([]byte, headerSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+
+	if len(body) == 0 || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, "", nil, ErrCorrupt
+	}
+
+	n, w := binary.Uvarint(body[1:])
+	if w <= 0 || uint64(len(body)-1-w) < n {
+		return 0, "", nil, ErrCorrupt
+	}
+
+	op = body[0]
+	key = string(body[1+w : 1+w+int(n)])
+	value = body[1+w+int(n):]
+	return op, key, value, nil
+}
@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package file
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	b := appendRecord(nil, opSet, "key", []byte("value"))
+	require.Len(t, b, headerSize+recordBodySize("key", []byte("value")))
+
+	op, key, value, err := readRecord(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, opSet, op)
+	require.Equal(t, "key", key)
+	require.Equal(t, []byte("value"), value)
+
+	b[len(b)-1] ^= 0xff
+	_, _, _, err = readRecord(bytes.NewReader(b))
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir, SyncNever)
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+	require.NoError(t, s.Set("b", []byte("2")))
+	require.NoError(t, s.Set("a", []byte("3")))
+	require.NoError(t, s.Delete("b"))
+	require.NoError(t, s.Delete("c")) // deleting a missing key is not logged.
+	require.NoError(t, s.close())
+	require.ErrorIs(t, s.Set("a", nil), ErrClosed)
+	require.NoError(t, s.Close()) // closing a closed store is not an error.
+
+	s, err = openStore(dir, SyncNever)
+	require.NoError(t, err)
+	defer s.close()
+	v, err := s.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), v)
+	_, err = s.Get("b")
+	require.ErrorIs(t, err, storage.ErrKeyNotFound)
+}
+
+func TestStoreTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+	size := s.size()
+	require.NoError(t, s.close())
+
+	rec := appendRecord(nil, opSet, "b", []byte("2"))
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.Write(rec[:len(rec)-1]) // a record cut short by a crash.
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	defer s.close()
+	require.Equal(t, size, s.size())
+	_, err = s.Get("b")
+	require.ErrorIs(t, err, storage.ErrKeyNotFound)
+
+	require.NoError(t, s.Set("c", []byte("3")))
+	require.NoError(t, s.close())
+	s, err = openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	_, err = s.Get("c")
+	require.NoError(t, err)
+}
+
+func TestStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir, SyncInterval)
+	require.NoError(t, err)
+	require.NoError(t, s.compact()) // nothing to compact.
+	require.NoFileExists(t, filepath.Join(dir, snapshotFile))
+
+	require.NoError(t, s.Set("a", []byte("1")))
+	require.NoError(t, s.Set("b", []byte("2")))
+	require.NoError(t, s.Delete("a"))
+	require.NoError(t, s.compact())
+	require.Equal(t, int64(0), s.size())
+	require.FileExists(t, filepath.Join(dir, snapshotFile))
+
+	require.NoError(t, s.Set("c", []byte("3")))
+	require.NoError(t, s.flush())
+	require.NoError(t, s.close())
+
+	s, err = openStore(dir, SyncInterval)
+	require.NoError(t, err)
+	defer s.close()
+	require.Len(t, s.values, 2)
+	require.Equal(t, []byte("2"), s.values["b"])
+	require.Equal(t, []byte("3"), s.values["c"])
+}
+
+func TestStoreCompactInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+	require.NoError(t, s.Set("b", []byte("2")))
+
+	s.Lock()
+	require.NoError(t, s.rotate()) // crash after rotating, before the snapshot is written.
+	s.Unlock()
+	require.FileExists(t, filepath.Join(dir, oldWalFile))
+	require.Equal(t, int64(0), s.size())
+
+	require.NoError(t, s.Delete("a"))
+	require.NoError(t, s.Set("c", []byte("3")))
+	require.NoError(t, s.close())
+
+	s, err = openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	require.True(t, s.rotated)
+	require.Equal(t, map[string][]byte{"b": []byte("2"), "c": []byte("3")}, s.values)
+
+	require.NoError(t, s.compact())
+	require.NoFileExists(t, filepath.Join(dir, oldWalFile))
+	require.NoError(t, s.close())
+
+	s, err = openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	defer s.close()
+	require.Equal(t, map[string][]byte{"b": []byte("2"), "c": []byte("3")}, s.values)
+}
+
+func TestStoreCompactFailed(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+
+	tmp := filepath.Join(dir, snapshotFile+".tmp")
+	require.NoError(t, os.Mkdir(tmp, 0o700)) // the snapshot cannot be written.
+	require.Error(t, s.compact())
+	require.FileExists(t, filepath.Join(dir, oldWalFile))
+
+	require.NoError(t, s.Set("b", []byte("2"))) // writes continue to the fresh log.
+	require.NoError(t, os.Remove(tmp))
+	require.NoError(t, s.compact())
+	require.NoFileExists(t, filepath.Join(dir, oldWalFile))
+	require.NotZero(t, s.size()) // the fresh log is kept, as it was not rotated.
+	require.NoError(t, s.close())
+
+	s, err = openStore(dir, SyncAlways)
+	require.NoError(t, err)
+	defer s.close()
+	require.Equal(t, map[string][]byte{"a": []byte("1"), "b": []byte("2")}, s.values)
+}
+
+func TestStoreCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, snapshotFile), []byte{0, 0, 0, 1, 0, 0, 0, 0, 1}, 0o600))
+	_, err := openStore(dir, SyncNever)
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestHookPersistsAcrossRestart(t *testing.T) {
+	path := t.TempDir()
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Path: path, Sync: SyncAlways}))
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnSessionEstablished(client, pkf)
+	require.NoError(t, h.Stop())
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Path: path}))
+	defer h.Stop()
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, pkf.Filters[0].Filter, subs[0].Filter)
+	require.Equal(t, byte(1), subs[0].Qos)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+}
+
+func TestHookCompactsOverSize(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Path: t.TempDir(), CompactSize: 64}))
+	defer h.Stop()
+
+	for i := 0; i < 4; i++ {
+		h.OnClientExpired(&mqtt.Client{ID: "none"})
+		h.OnSessionEstablished(client, packets.Packet{})
+	}
+
+	require.Eventually(t, func() bool {
+		return h.db.size() == 0
+	}, time.Second, time.Millisecond)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+}
@@ -0,0 +1,479 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package kv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xyzj/mqtt-server/hooks/storage"
+)
+
+// envelopeVersion is the first byte of an encrypted value. Stored records are json, so
+// values without it are plain records written before encryption was enabled.
+const envelopeVersion byte = 1
+
+var (
+	// ErrNoKeys indicates that no encryption keys were found in the key file or variable.
+	ErrNoKeys = errors.New("no encryption keys")
+
+	// ErrInvalidKey indicates that an encryption key is not in the form id:base64, or is not
+	// a 16, 24 or 32 byte AES key.
+	ErrInvalidKey = errors.New("invalid encryption key")
+
+	// ErrUnknownKey indicates that a value was encrypted with a key which is not loaded.
+	ErrUnknownKey = errors.New("unknown encryption key")
+
+	// ErrInvalidEnvelope indicates that an encrypted value is truncated, fails authentication,
+	// or was encrypted for a different key of the store.
+	ErrInvalidEnvelope = errors.New("invalid encrypted value")
+
+	// ErrPlaintext indicates that a value is not encrypted, and plain values are not allowed.
+	ErrPlaintext = errors.New("unencrypted value")
+)
+
+// EncryptionOptions contains configuration settings for encrypting stored values. Keys are
+// given one per line (or separated by commas) as id:base64, where the id is recorded with
+// each value encrypted by the key, and the key is 16, 24 or 32 bytes for AES-128, AES-192
+// or AES-256. The first key encrypts new values; the others are only used to read values
+// encrypted before it was added, which are re-encrypted with the first key in the background.
+// Values which are not encrypted are refused unless Plaintext is set, which should only be
+// while enabling encryption on an existing store.
+type EncryptionOptions struct {
+	KeyFile   string `yaml:"key_file" json:"key_file"`   // a file containing the keys
+	KeyEnv    string `yaml:"key_env" json:"key_env"`     // an environment variable containing the keys, if no key file is set
+	Plaintext bool   `yaml:"plaintext" json:"plaintext"` // read values which are not encrypted, to migrate a store written before encryption was enabled
+}
+
+// EncryptionStats contains the state of the re-encryption of stored values.
+type EncryptionStats struct {
+	Key      string `json:"key"`      // the id of the key encrypting new values
+	Rotated  int64  `json:"rotated"`  // the values re-encrypted with the key
+	Errors   int64  `json:"errors"`   // the values which could not be re-encrypted
+	Rotating bool   `json:"rotating"` // true until all values have been checked
+}
+
+// keyring contains the keys for encrypting and decrypting values.
+type keyring struct {
+	current   string                 // the id of the key encrypting new values
+	keys      map[string]cipher.AEAD // all keys by id
+	plaintext bool                   // true if values which are not encrypted are read as they are
+}
+
+// parseKeyring parses keys in the form id:base64, separated by new lines or commas. Blank
+// lines and lines beginning with # are ignored.
+func parseKeyring(data string) (*keyring, error) {
+	kr := &keyring{keys: map[string]cipher.AEAD{}}
+	for _, line := range strings.FieldsFunc(data, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, enc, ok := strings.Cut(line, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("%q; %w", id, ErrInvalidKey)
+		}
+
+		if _, ok := kr.keys[id]; ok {
+			return nil, fmt.Errorf("%q is duplicated; %w", id, ErrInvalidKey)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v; %w", id, err, ErrInvalidKey)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v; %w", id, err, ErrInvalidKey)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v; %w", id, err, ErrInvalidKey)
+		}
+
+		if kr.current == "" {
+			kr.current = id
+		}
+		kr.keys[id] = aead
+	}
+
+	if kr.current == "" {
+		return nil, ErrNoKeys
+	}
+
+	return kr, nil
+}
+
+// loadKeyring loads the keys from the key file or environment variable of the options.
+func loadKeyring(config *EncryptionOptions) (*keyring, error) {
+	var data string
+	switch {
+	case config.KeyFile != "":
+		b, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	case config.KeyEnv != "":
+		data = os.Getenv(config.KeyEnv)
+	default:
+		return nil, ErrNoKeys
+	}
+
+	kr, err := parseKeyring(data)
+	if err != nil {
+		return nil, err
+	}
+
+	kr.plaintext = config.Plaintext
+	return kr, nil
+}
+
+// seal encrypts the value of a record key with the current key into an envelope of the
+// version, the length of the key id, the key id, the length of the record key, the record
+// key, the nonce and the sealed value. The record key is authenticated with the value, so
+// the value cannot be moved to another key of the store.
+func (kr *keyring) seal(key string, value []byte) ([]byte, error) {
+	aead := kr.keys[kr.current]
+	out := make([]byte, 0, 2+len(kr.current)+binary.MaxVarintLen64+len(key)+aead.NonceSize()+len(value)+aead.Overhead())
+	out = append(out, envelopeVersion, byte(len(kr.current)))
+	out = append(out, kr.current...)
+	out = binary.AppendUvarint(out, uint64(len(key)))
+	out = append(out, key...)
+
+	nonce := out[len(out) : len(out)+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = out[:len(out)+aead.NonceSize()]
+
+	return aead.Seal(out, nonce, value, []byte(key)), nil
+}
+
+// open decrypts a value, returning it with the id of the key it was encrypted with and the
+// record key it was sealed for. Plain values are returned as they are, with an empty key id
+// and record key, if plain values are allowed.
+func (kr *keyring) open(value []byte) (plain []byte, id, key string, err error) {
+	if len(value) == 0 || value[0] != envelopeVersion {
+		if !kr.plaintext {
+			return nil, "", "", ErrPlaintext
+		}
+		return value, "", "", nil
+	}
+
+	if len(value) < 2 || len(value) < 2+int(value[1]) {
+		return nil, "", "", ErrInvalidEnvelope
+	}
+
+	id = string(value[2 : 2+int(value[1])])
+	aead, ok := kr.keys[id]
+	if !ok {
+		return nil, id, "", fmt.Errorf("%q; %w", id, ErrUnknownKey)
+	}
+
+	rest := value[2+int(value[1]):]
+	n, w := binary.Uvarint(rest)
+	if w <= 0 || uint64(len(rest)-w) < n {
+		return nil, id, "", ErrInvalidEnvelope
+	}
+	key = string(rest[w : w+int(n)])
+
+	sealed := rest[w+int(n):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, id, key, ErrInvalidEnvelope
+	}
+
+	plain, err = aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, id, key, fmt.Errorf("%q: %v; %w", id, err, ErrInvalidEnvelope)
+	}
+
+	return plain, id, key, nil
+}
+
+// openKey decrypts the value of a record key, returning it with the id of the key it was
+// encrypted with. It returns ErrInvalidEnvelope if the value was sealed for another key.
+func (kr *keyring) openKey(key string, value []byte) ([]byte, string, error) {
+	plain, id, sealedFor, err := kr.open(value)
+	if err != nil {
+		return nil, id, err
+	}
+
+	if id != "" && sealedFor != key {
+		return nil, id, fmt.Errorf("%q sealed for %q; %w", key, sealedFor, ErrInvalidEnvelope)
+	}
+
+	return plain, id, nil
+}
+
+// recordKey returns the key of a stored record from its id and type.
+func recordKey(value []byte) (string, bool) {
+	var r struct {
+		T  string `json:"t"`
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(value, &r); err != nil || r.ID == "" {
+		return "", false
+	}
+
+	if r.T == storage.ClientKey {
+		return storage.ClientKey + "_" + r.ID, true
+	}
+
+	return r.ID, strings.HasPrefix(r.ID, r.T)
+}
+
+// encrypted is a backend which encrypts values with AES-GCM before writing them to another
+// backend. When opened, it re-encrypts any values which are plain or were encrypted with an
+// older key in the background.
+type encrypted struct {
+	mu      sync.RWMutex    // held for reading by writes, and for writing while a value is re-encrypted
+	backend storage.Backend // the backend to write to
+	keys    *keyring        // the keys to encrypt and decrypt values with
+	log     *slog.Logger    // a logger for re-encryption errors
+	done    chan struct{}   // closed when the backend is closed
+	stopped chan struct{}   // closed when re-encryption has returned
+	closed  bool            // true if the backend has been closed
+
+	rotated  atomic.Int64 // the values re-encrypted
+	errors   atomic.Int64 // the values which could not be re-encrypted
+	rotating atomic.Bool  // true until all values have been checked
+}
+
+// newEncrypted returns an encrypting backend in front of another backend, using the keys
+// of the options, and starts re-encrypting values which are not encrypted with the first key.
+func newEncrypted(backend storage.Backend, config *EncryptionOptions, log *slog.Logger) (*encrypted, error) {
+	kr, err := loadKeyring(config)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encrypted{
+		backend: backend,
+		keys:    kr,
+		log:     log,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	e.rotating.Store(true)
+
+	go e.rotate()
+	return e, nil
+}
+
+// rotate re-encrypts each stored record which is not encrypted with the current key.
+func (e *encrypted) rotate() {
+	defer close(e.stopped)
+	defer e.rotating.Store(false)
+
+	for _, prefix := range []string{
+		storage.ClientKey,
+		storage.SubscriptionKey,
+		storage.RetainedKey,
+		storage.InflightKey,
+		storage.DelayedKey,
+		storage.DelayedWillKey,
+		storage.SysInfoKey,
+	} {
+		var keys []string
+		err := e.backend.Iterate(prefix, func(v []byte) error {
+			plain, id, k, err := e.keys.open(v)
+			if err != nil {
+				e.errors.Add(1)
+				e.log.Error("failed to decrypt storage record", "error", err, "prefix", prefix)
+				return nil
+			}
+
+			if id == e.keys.current {
+				return nil
+			}
+
+			ok := true
+			if k == "" { // a plain record, which is keyed on its id.
+				k, ok = recordKey(plain)
+			}
+			if !ok || !strings.HasPrefix(k, prefix) {
+				e.errors.Add(1)
+				e.log.Error("failed to find key of storage record", "prefix", prefix)
+				return nil
+			}
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			e.log.Error("failed to iterate storage records for re-encryption", "error", err, "prefix", prefix)
+			return
+		}
+
+		for _, k := range keys {
+			select {
+			case <-e.done:
+				return
+			default:
+			}
+
+			if err := e.reseal(k); err != nil {
+				e.errors.Add(1)
+				e.log.Error("failed to re-encrypt storage record", "error", err, "key", k)
+			}
+		}
+	}
+
+	if n := e.rotated.Load(); n > 0 {
+		e.log.Info("re-encrypted storage records", "key", e.keys.current, "records", n)
+	}
+}
+
+// reseal re-encrypts the value of a key with the current key, unless it has since been
+// deleted or rewritten with the current key.
+func (e *encrypted) reseal(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	v, err := e.backend.Get(key)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	plain, id, err := e.keys.openKey(key, v)
+	if err != nil || id == e.keys.current {
+		return err
+	}
+
+	sealed, err := e.keys.seal(key, plain)
+	if err != nil {
+		return err
+	}
+
+	if err := e.backend.Set(key, sealed); err != nil {
+		return err
+	}
+
+	e.rotated.Add(1)
+	return nil
+}
+
+// Get returns the decrypted value of a key.
+func (e *encrypted) Get(key string) ([]byte, error) {
+	v, err := e.backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v, _, err = e.keys.openKey(key, v)
+	return v, err
+}
+
+// Set encrypts and sets the value of a key.
+func (e *encrypted) Set(key string, value []byte) error {
+	sealed, err := e.keys.seal(key, value)
+	if err != nil {
+		return err
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.backend.Set(key, sealed)
+}
+
+// Delete deletes a key.
+func (e *encrypted) Delete(key string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.backend.Delete(key)
+}
+
+// Iterate calls visit with the decrypted values of the keys beginning with a prefix. It
+// returns ErrInvalidEnvelope if a value was sealed for a key without the prefix.
+func (e *encrypted) Iterate(prefix string, visit func([]byte) error) error {
+	return e.backend.Iterate(prefix, func(v []byte) error {
+		v, id, key, err := e.keys.open(v)
+		if err != nil {
+			return err
+		}
+
+		if id != "" && !strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("%q sealed for %q; %w", prefix, key, ErrInvalidEnvelope)
+		}
+		return visit(v)
+	})
+}
+
+// Batch encrypts and applies a batch of changes, in one call if the backend is a batcher.
+func (e *encrypted) Batch(ops []storage.Op) error {
+	sealed := make([]storage.Op, len(ops))
+	for i, op := range ops {
+		sealed[i] = op
+		if op.Delete {
+			continue
+		}
+
+		var err error
+		if sealed[i].Value, err = e.keys.seal(op.Key, op.Value); err != nil {
+			return err
+		}
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if bb, ok := e.backend.(storage.Batcher); ok {
+		return bb.Batch(sealed)
+	}
+
+	for _, op := range sealed {
+		var err error
+		if op.Delete {
+			err = e.backend.Delete(op.Key)
+		} else {
+			err = e.backend.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops re-encryption and closes the backend.
+func (e *encrypted) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	close(e.done)
+	<-e.stopped
+	return e.backend.Close()
+}
+
+// Stats returns the state of the re-encryption.
+func (e *encrypted) Stats() EncryptionStats {
+	return EncryptionStats{
+		Key:      e.keys.current,
+		Rotated:  e.rotated.Load(),
+		Errors:   e.errors.Load(),
+		Rotating: e.rotating.Load(),
+	}
+}
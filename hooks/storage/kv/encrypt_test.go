@@ -0,0 +1,347 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package kv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/hooks/storage/storagetest"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// testKey returns a key in the form id:base64 with a key of n bytes.
+func testKey(id string, n int) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), n))
+}
+
+// newTestEncrypted returns an encrypting backend in front of b using the keys.
+func newTestEncrypted(t *testing.T, b storage.Backend, keys ...string) *encrypted {
+	t.Helper()
+	t.Setenv("MQTT_TEST_KEYS", strings.Join(keys, ","))
+	e, err := newEncrypted(b, &EncryptionOptions{KeyEnv: "MQTT_TEST_KEYS"}, logger)
+	require.NoError(t, err)
+	return e
+}
+
+// newEncryptedHook returns a kv hook encrypting its values in b using the keys.
+func newEncryptedHook(t *testing.T, b storage.Backend, keys ...string) *Hook {
+	t.Helper()
+	return newMigratingHook(t, b, false, keys...)
+}
+
+// newMigratingHook returns a kv hook encrypting its values in b using the keys, which also
+// reads values which are not encrypted if plaintext is true.
+func newMigratingHook(t *testing.T, b storage.Backend, plaintext bool, keys ...string) *Hook {
+	t.Helper()
+	t.Setenv("MQTT_TEST_KEYS", strings.Join(keys, "\n"))
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{
+		Backend:    b,
+		Encryption: &EncryptionOptions{KeyEnv: "MQTT_TEST_KEYS", Plaintext: plaintext},
+	}))
+	return h
+}
+
+func TestParseKeyring(t *testing.T) {
+	kr, err := parseKeyring("# keys\n" + testKey("k2", 32) + "\n\n" + testKey("k1", 16) + "," + testKey("k0", 24))
+	require.NoError(t, err)
+	require.Equal(t, "k2", kr.current)
+	require.Len(t, kr.keys, 3)
+
+	for _, data := range []string{
+		"k1",
+		":" + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"k1:!!",
+		testKey("k1", 10),
+		testKey("k1", 32) + "\n" + testKey("k1", 16),
+	} {
+		_, err := parseKeyring(data)
+		require.ErrorIs(t, err, ErrInvalidKey, data)
+	}
+
+	_, err = parseKeyring("# no keys\n")
+	require.ErrorIs(t, err, ErrNoKeys)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte(testKey("k1", 32)+"\n"), 0o600))
+	t.Setenv("MQTT_TEST_KEYS", testKey("k2", 32))
+
+	kr, err := loadKeyring(&EncryptionOptions{KeyFile: path, KeyEnv: "MQTT_TEST_KEYS"})
+	require.NoError(t, err)
+	require.Equal(t, "k1", kr.current) // the key file takes precedence.
+
+	kr, err = loadKeyring(&EncryptionOptions{KeyEnv: "MQTT_TEST_KEYS"})
+	require.NoError(t, err)
+	require.Equal(t, "k2", kr.current)
+
+	_, err = loadKeyring(&EncryptionOptions{KeyFile: filepath.Join(t.TempDir(), "missing")})
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = loadKeyring(&EncryptionOptions{KeyEnv: "MQTT_TEST_KEYS_UNSET"})
+	require.ErrorIs(t, err, ErrNoKeys)
+
+	_, err = loadKeyring(&EncryptionOptions{})
+	require.ErrorIs(t, err, ErrNoKeys)
+}
+
+func TestSealOpen(t *testing.T) {
+	kr, err := parseKeyring(testKey("k1", 32))
+	require.NoError(t, err)
+
+	sealed, err := kr.seal("CL_cl1", []byte(`{"id":"secret"}`))
+	require.NoError(t, err)
+	require.Equal(t, envelopeVersion, sealed[0])
+	require.NotContains(t, string(sealed), "secret")
+
+	plain, id, key, err := kr.open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "k1", id)
+	require.Equal(t, "CL_cl1", key)
+	require.Equal(t, []byte(`{"id":"secret"}`), plain)
+
+	plain, id, err = kr.openKey("CL_cl1", sealed)
+	require.NoError(t, err)
+	require.Equal(t, "k1", id)
+	require.Equal(t, []byte(`{"id":"secret"}`), plain)
+
+	_, _, err = kr.openKey("CL_cl2", sealed) // moved to another key.
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	_, _, _, err = kr.open([]byte(`{"id":"cl1"}`))
+	require.ErrorIs(t, err, ErrPlaintext)
+
+	kr.plaintext = true
+	plain, id, key, err = kr.open([]byte(`{"id":"cl1"}`))
+	require.NoError(t, err)
+	require.Equal(t, "", id) // plain values are read as they are while migrating.
+	require.Equal(t, "", key)
+	require.Equal(t, []byte(`{"id":"cl1"}`), plain)
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	_, _, _, err = kr.open(tampered)
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	relabelled := bytes.Clone(sealed)
+	relabelled[bytes.Index(relabelled, []byte("cl1"))+2] = '2' // the record key is authenticated.
+	_, _, _, err = kr.open(relabelled)
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	_, _, _, err = kr.open(sealed[:6])
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	_, _, _, err = kr.open([]byte{envelopeVersion, 9, 'k'})
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	other, err := parseKeyring(testKey("k2", 32))
+	require.NoError(t, err)
+	_, id, _, err = other.open(sealed)
+	require.ErrorIs(t, err, ErrUnknownKey)
+	require.Equal(t, "k1", id)
+}
+
+func TestEncryptedMovedValue(t *testing.T) {
+	b := newMemBackend()
+	e := newTestEncrypted(t, b, testKey("k1", 32))
+	defer e.Close()
+
+	require.NoError(t, e.Set(storage.ClientKey+"_cl1", []byte(`{"t":"CL","id":"cl1"}`)))
+	require.NoError(t, e.Set(storage.ClientKey+"_cl2", []byte(`{"t":"CL","id":"cl2"}`)))
+	require.NoError(t, e.Set(storage.RetainedKey+"_a", []byte(`{"t":"RET","id":"RET_a"}`)))
+
+	b.values[storage.ClientKey+"_cl2"] = bytes.Clone(b.values[storage.ClientKey+"_cl1"])
+	_, err := e.Get(storage.ClientKey + "_cl2")
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	b.values[storage.ClientKey+"_cl2"] = bytes.Clone(b.values[storage.RetainedKey+"_a"])
+	err = e.Iterate(storage.ClientKey, func([]byte) error { return nil })
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	b.values[storage.ClientKey+"_cl3"] = []byte(`{"t":"CL","id":"cl3"}`) // injected without encryption.
+	_, err = e.Get(storage.ClientKey + "_cl3")
+	require.ErrorIs(t, err, ErrPlaintext)
+}
+
+func TestRecordKey(t *testing.T) {
+	for value, want := range map[string]string{
+		`{"t":"CL","id":"cl1"}`:          storage.ClientKey + "_cl1",
+		`{"t":"SUB","id":"SUB_cl1:a/b"}`: storage.SubscriptionKey + "_cl1:a/b",
+		`{"t":"SYS","id":"SYS"}`:         storage.SysInfoKey,
+	} {
+		k, ok := recordKey([]byte(value))
+		require.True(t, ok)
+		require.Equal(t, want, k)
+	}
+
+	for _, value := range []string{`{`, `{"t":"SUB"}`, `{"t":"SUB","id":"cl1:a/b"}`} {
+		_, ok := recordKey([]byte(value))
+		require.False(t, ok, value)
+	}
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	storagetest.RunBackendTests(t, func(t *testing.T) storage.Backend {
+		return newTestEncrypted(t, newMemBackend(), testKey("k1", 32))
+	})
+}
+
+func TestEncryptedBatch(t *testing.T) {
+	storagetest.RunBackendTests(t, func(t *testing.T) storage.Backend {
+		return newTestEncrypted(t, &batchBackend{memBackend: newMemBackend()}, testKey("k1", 32))
+	})
+}
+
+func TestEncryptedHook(t *testing.T) {
+	storagetest.RunHookTests(t, func(t *testing.T) mqtt.Hook {
+		return newEncryptedHook(t, newMemBackend(), testKey("k1", 32))
+	})
+}
+
+func TestEncryptedHookWriteBehind(t *testing.T) {
+	storagetest.RunHookTests(t, func(t *testing.T) mqtt.Hook {
+		t.Setenv("MQTT_TEST_KEYS", testKey("k1", 32))
+		h := new(Hook)
+		h.SetOpts(logger, nil)
+		require.NoError(t, h.Init(&Options{
+			Backend:     newMemBackend(),
+			WriteBehind: &WriteBehindOptions{},
+			Encryption:  &EncryptionOptions{KeyEnv: "MQTT_TEST_KEYS"},
+		}))
+		return h
+	})
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	b := newMemBackend()
+	h := newEncryptedHook(t, b, testKey("k1", 32))
+	defer h.Stop()
+
+	cl := &mqtt.Client{ID: "cl1"}
+	cl.Properties.Username = []byte("secret-user")
+	cl.Properties.Will.Payload = []byte("secret-will")
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnRetainMessage(cl, packets.Packet{TopicName: "a/b", Payload: []byte("secret-retained")}, 1)
+
+	require.Len(t, b.values, 2)
+	for k, v := range b.values {
+		require.Equal(t, envelopeVersion, v[0], k)
+		require.NotContains(t, string(v), "secret")
+		require.NotContains(t, string(v), base64.StdEncoding.EncodeToString([]byte("secret-user")))
+	}
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret-user"), clients[0].Username)
+	require.Equal(t, []byte("secret-will"), clients[0].Will.Payload)
+}
+
+func TestEncryptedRotate(t *testing.T) {
+	b := newMemBackend()
+	h := newEncryptedHook(t, b, testKey("k1", 32))
+	cl := &mqtt.Client{ID: "cl1"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b"}}}, []byte{0})
+	h.OnRetainMessage(cl, packets.Packet{TopicName: "a/b", Payload: []byte("hello")}, 1)
+	require.Eventually(t, func() bool {
+		s, _ := h.EncryptionStats()
+		return !s.Rotating
+	}, time.Second, time.Millisecond)
+	require.NoError(t, h.Stop())
+
+	// a record written before encryption was enabled.
+	require.NoError(t, b.Set(storage.ClientKey+"_cl2", []byte(`{"t":"CL","id":"cl2"}`)))
+
+	h = newMigratingHook(t, b, true, testKey("k2", 32), testKey("k1", 32))
+	defer h.Stop()
+	require.Eventually(t, func() bool {
+		s, _ := h.EncryptionStats()
+		return !s.Rotating
+	}, time.Second, time.Millisecond)
+
+	s, ok := h.EncryptionStats()
+	require.True(t, ok)
+	require.Equal(t, EncryptionStats{Key: "k2", Rotated: 4}, s)
+
+	for k, v := range b.values {
+		_, id, err := h.enc.keys.openKey(k, v)
+		require.NoError(t, err)
+		require.Equal(t, "k2", id, k)
+	}
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+}
+
+func TestEncryptedRotateErrors(t *testing.T) {
+	b := newMemBackend()
+	h := newEncryptedHook(t, b, testKey("k1", 32))
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	require.NoError(t, h.Stop())
+
+	// a record with an id not matching its key cannot be rewritten.
+	require.NoError(t, b.Set(storage.SubscriptionKey+"_cl1:a", []byte(`{"t":"SUB","id":"cl1:a"}`)))
+
+	h = newMigratingHook(t, b, true, testKey("k2", 32))
+	defer h.Stop()
+	require.Eventually(t, func() bool {
+		s, _ := h.EncryptionStats()
+		return !s.Rotating
+	}, time.Second, time.Millisecond)
+
+	s, _ := h.EncryptionStats()
+	require.Equal(t, int64(0), s.Rotated)
+	require.Equal(t, int64(2), s.Errors)
+
+	_, err := h.StoredClients()
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestEncryptedReseal(t *testing.T) {
+	b := newMemBackend()
+	e := newTestEncrypted(t, b, testKey("k1", 32))
+	defer e.Close()
+
+	require.NoError(t, e.reseal("missing"))
+
+	require.NoError(t, e.Set("a", []byte("1")))
+	sealed := bytes.Clone(b.values["a"])
+	require.NoError(t, e.reseal("a"))
+	require.Equal(t, sealed, b.values["a"]) // already encrypted with the current key.
+}
+
+func TestHookEncryptionStats(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Backend: newMemBackend()}))
+	defer h.Stop()
+	_, ok := h.EncryptionStats()
+	require.False(t, ok)
+}
+
+func TestInitBadEncryption(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Backend:    newMemBackend(),
+		Encryption: &EncryptionOptions{},
+	})
+	require.ErrorIs(t, err, ErrNoKeys)
+}
@@ -0,0 +1,683 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+// Package kv provides a persistent storage hook which keeps its data in any key-value store
+// implementing storage.Backend. The other storage hooks are built on it.
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/mqtt-server/system"
+)
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return storage.ClientKey + "_" + cl.ID
+}
+
+// subscriptionKey returns a primary key for a subscription.
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return storage.SubscriptionKey + "_" + cl.ID + ":" + filter
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return storage.RetainedKey + "_" + topic
+}
+
+// inflightKey returns a primary key for an inflight message.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// delayedKey returns a primary key for a delayed message.
+func delayedKey(id string) string {
+	return storage.DelayedKey + "_" + id
+}
+
+// delayedWillKey returns a primary key for the delayed will message of a client.
+func delayedWillKey(cl *mqtt.Client) string {
+	return storage.DelayedWillKey + "_" + cl.ID
+}
+
+// ErrInvalidRecord indicates that a record cannot be restored because its type is unknown.
+var ErrInvalidRecord = errors.New("invalid storage record")
+
+// Options contains configuration settings for the kv storage hook.
+type Options struct {
+	Backend     storage.Backend     // the key-value store to keep data in
+	WriteBehind *WriteBehindOptions // queue writes and write them in batches if set
+	Encryption  *EncryptionOptions  // encrypt stored values if set
+}
+
+// Hook is a persistent storage hook using a key-value store as a backend. Storage hooks for
+// a particular store embed it, and initialise it with their backend.
+type Hook struct {
+	mqtt.HookBase
+	db  storage.Backend // the key-value store
+	wb  *writeBehind    // the write-behind queue in front of the key-value store, if any
+	enc *encrypted      // the encryption in front of the key-value store, if any
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "kv-db"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnWillSent,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.OnDelayedMessage,
+		mqtt.OnDelayedRemoved,
+		mqtt.OnDelayedWill,
+		mqtt.OnDelayedWillRemoved,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredDelayedMessages,
+		mqtt.StoredDelayedWills,
+	}, []byte{b})
+}
+
+// Init sets the backend of the hook. If the encryption or write-behind options are invalid,
+// the backend is closed.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config.(*Options).Backend == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	db := config.(*Options).Backend
+	if eo := config.(*Options).Encryption; eo != nil {
+		enc, err := newEncrypted(db, eo, h.Log)
+		if err != nil {
+			_ = db.Close()
+			return err
+		}
+		db, h.enc = enc, enc
+	}
+
+	if wbo := config.(*Options).WriteBehind; wbo != nil {
+		wb, err := newWriteBehind(db, wbo, h.Log)
+		if err != nil {
+			_ = db.Close()
+			return err
+		}
+		db, h.wb = wb, wb
+	}
+
+	h.db = db
+	return nil
+}
+
+// WriteBehindStats returns the metrics of the write-behind queue, and false if the hook is
+// not using one.
+func (h *Hook) WriteBehindStats() (WriteBehindStats, bool) {
+	if h.wb == nil {
+		return WriteBehindStats{}, false
+	}
+
+	return h.wb.Stats(), true
+}
+
+// EncryptionStats returns the state of the re-encryption of stored values, and false if the
+// hook is not encrypting them.
+func (h *Hook) EncryptionStats() (EncryptionStats, bool) {
+	if h.enc == nil {
+		return EncryptionStats{}, false
+	}
+
+	return h.enc.Stats(), true
+}
+
+// Stop closes the backend.
+func (h *Hook) Stop() error {
+	if h.db == nil {
+		return nil
+	}
+
+	err := h.db.Close()
+	h.db = nil
+	return err
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	_ = h.setKv(clientKey(cl), in)
+}
+
+// OnDisconnect updates a client in the store, and removes them if their session has expired.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.updateClient(cl)
+
+	if !expire {
+		return
+	}
+
+	if errors.Is(cl.StopCause(), packets.ErrSessionTakenOver) {
+		return
+	}
+
+	_ = h.delKv(clientKey(cl))
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var in *storage.Subscription
+	for i := 0; i < len(pk.Filters); i++ {
+		in = &storage.Subscription{
+			ID:                subscriptionKey(cl, pk.Filters[i].Filter),
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            pk.Filters[i].Filter,
+			Identifier:        pk.Filters[i].Identifier,
+			NoLocal:           pk.Filters[i].NoLocal,
+			RetainHandling:    pk.Filters[i].RetainHandling,
+			RetainAsPublished: pk.Filters[i].RetainAsPublished,
+			RewriteTemplate:   pk.Filters[i].RewriteTemplate,
+		}
+		_ = h.setKv(in.ID, in)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	for i := 0; i < len(pk.Filters); i++ {
+		_ = h.delKv(subscriptionKey(cl, pk.Filters[i].Filter))
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		_ = h.delKv(retainedKey(pk.TopicName))
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          retainedKey(pk.TopicName),
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          inflightKey(cl, pk),
+		T:           storage.InflightKey,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		PacketID:    pk.PacketID,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        sent,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	_ = h.delKv(inflightKey(cl, pk))
+}
+
+// OnQosDropped removes a dropped inflight message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys.Clone(),
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+	_ = h.delKv(retainedKey(filter))
+}
+
+// OnDelayedMessage adds a delayed message to the store.
+func (h *Hook) OnDelayedMessage(cl *mqtt.Client, msg mqtt.DelayedMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	pk := msg.Packet
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          delayedKey(msg.ID),
+		T:           storage.DelayedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Due:         msg.Due,
+		Client:      msg.Client,
+		Owner:       msg.Owner,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnDelayedRemoved deletes a published or cancelled delayed message from the store.
+func (h *Hook) OnDelayedRemoved(id string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	_ = h.delKv(delayedKey(id))
+}
+
+// OnDelayedWill adds the delayed will message of a client to the store.
+func (h *Hook) OnDelayedWill(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.Message{
+		ID:          delayedWillKey(cl),
+		T:           storage.DelayedWillKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Due:         pk.Expiry,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			User: pk.Properties.Copy(false).User,
+		},
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnDelayedWillRemoved deletes a sent or cancelled delayed will message from the store.
+func (h *Hook) OnDelayedWillRemoved(id string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	_ = h.delKv(delayedWillKey(&mqtt.Client{ID: id}))
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+	_ = h.delKv(clientKey(cl))
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Client, 0)
+	err = h.iterKv(storage.ClientKey, func(value []byte) error {
+		obj := storage.Client{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Subscription, 0)
+	err = h.iterKv(storage.SubscriptionKey, func(value []byte) error {
+		obj := storage.Subscription{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.RetainedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.InflightKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredDelayedMessages returns all stored delayed messages from the store.
+func (h *Hook) StoredDelayedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.DelayedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredDelayedWills returns all stored delayed will messages from the store.
+func (h *Hook) StoredDelayedWills() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.DelayedWillKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	err = h.getKv(storage.SysInfoKey, &v)
+	if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+		return
+	}
+
+	return v, nil
+}
+
+// Restore writes a stored record to the store under the key the hook would have given it,
+// replacing any record with the same key. The record is a *storage.Client,
+// *storage.Subscription, *storage.SystemInfo, or a *storage.Message with a type of
+// retained, inflight, delayed or delayed will. It is used to import records read from another store.
+func (h *Hook) Restore(v storage.Serializable) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	switch r := v.(type) {
+	case *storage.Client:
+		r.T = storage.ClientKey
+		return h.setKv(clientKey(&mqtt.Client{ID: r.ID}), r)
+	case *storage.Subscription:
+		r.T = storage.SubscriptionKey
+		r.ID = subscriptionKey(&mqtt.Client{ID: r.Client}, r.Filter)
+		return h.setKv(r.ID, r)
+	case *storage.SystemInfo:
+		r.T = storage.SysInfoKey
+		r.ID = sysInfoKey()
+		return h.setKv(r.ID, r)
+	case *storage.Message:
+		switch r.T {
+		case storage.RetainedKey:
+			r.ID = retainedKey(r.TopicName)
+		case storage.InflightKey:
+			r.ID = inflightKey(&mqtt.Client{ID: r.Client}, packets.Packet{PacketID: r.PacketID})
+		case storage.DelayedKey:
+			r.ID = delayedKey(strings.TrimPrefix(r.ID, storage.DelayedKey+"_"))
+		case storage.DelayedWillKey:
+			r.ID = delayedWillKey(&mqtt.Client{ID: r.Client})
+		default:
+			return fmt.Errorf("message type %q; %w", r.T, ErrInvalidRecord)
+		}
+		return h.setKv(r.ID, r)
+	default:
+		return fmt.Errorf("%T; %w", v, ErrInvalidRecord)
+	}
+}
+
+// setKv stores a key-value pair in the backend.
+func (h *Hook) setKv(k string, v storage.Serializable) error {
+	data, err := v.MarshalBinary()
+	if err == nil {
+		err = h.db.Set(k, data)
+	}
+	if err != nil {
+		h.Log.Error("failed to upsert data", "error", err, "key", k)
+	}
+	return err
+}
+
+// delKv deletes a key-value pair from the backend.
+func (h *Hook) delKv(k string) error {
+	err := h.db.Delete(k)
+	if err != nil {
+		h.Log.Error("failed to delete data", "error", err, "key", k)
+	}
+	return err
+}
+
+// getKv retrieves the value associated with a key from the backend.
+func (h *Hook) getKv(k string, v storage.Serializable) error {
+	value, err := h.db.Get(k)
+	if err == nil {
+		err = v.UnmarshalBinary(value)
+	}
+	if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+		h.Log.Error("failed to get data", "error", err, "key", k)
+	}
+	return err
+}
+
+// iterKv iterates over key-value pairs with keys having the specified prefix in the backend.
+func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	err := h.db.Iterate(prefix, visit)
+	if err != nil {
+		h.Log.Error("failed to iter data", "error", err, "prefix", prefix)
+	}
+	return err
+}
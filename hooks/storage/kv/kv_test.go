@@ -0,0 +1,246 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package kv
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/hooks/storage/storagetest"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// memBackend is an in-memory storage backend.
+type memBackend struct {
+	sync.RWMutex
+	values  map[string][]byte
+	err     error // returned by every method if set
+	sets    int   // the number of calls to Set
+	deletes int   // the number of calls to Delete
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{values: map[string][]byte{}}
+}
+
+func (b *memBackend) Get(key string) ([]byte, error) {
+	b.RLock()
+	defer b.RUnlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	v, ok := b.values[key]
+	if !ok {
+		return nil, storage.ErrKeyNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (b *memBackend) Set(key string, value []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.sets++
+	b.values[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memBackend) Delete(key string) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.deletes++
+	delete(b.values, key)
+	return nil
+}
+
+func (b *memBackend) Iterate(prefix string, visit func([]byte) error) error {
+	b.RLock()
+	defer b.RUnlock()
+	if b.err != nil {
+		return b.err
+	}
+	var keys []string
+	for k := range b.values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := visit(b.values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) Close() error {
+	return nil
+}
+
+// fail sets the error returned by every method.
+func (b *memBackend) fail(err error) {
+	b.Lock()
+	defer b.Unlock()
+	b.err = err
+}
+
+// calls returns the number of calls to Set and Delete.
+func (b *memBackend) calls() (sets, deletes int) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.sets, b.deletes
+}
+
+func TestClientKey(t *testing.T) {
+	k := clientKey(&mqtt.Client{ID: "cl1"})
+	require.Equal(t, storage.ClientKey+"_cl1", k)
+}
+
+func TestSubscriptionKey(t *testing.T) {
+	k := subscriptionKey(&mqtt.Client{ID: "cl1"}, "a/b/c")
+	require.Equal(t, storage.SubscriptionKey+"_cl1:a/b/c", k)
+}
+
+func TestRetainedKey(t *testing.T) {
+	k := retainedKey("a/b/c")
+	require.Equal(t, storage.RetainedKey+"_a/b/c", k)
+}
+
+func TestInflightKey(t *testing.T) {
+	k := inflightKey(&mqtt.Client{ID: "cl1"}, packets.Packet{PacketID: 1})
+	require.Equal(t, storage.InflightKey+"_cl1:1", k)
+}
+
+func TestSysInfoKey(t *testing.T) {
+	require.Equal(t, storage.SysInfoKey, sysInfoKey())
+}
+
+func TestDelayedKey(t *testing.T) {
+	k := delayedKey("d1")
+	require.Equal(t, storage.DelayedKey+"_d1", k)
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "kv-db", h.ID())
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(&Options{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestBackend(t *testing.T) {
+	storagetest.RunBackendTests(t, func(t *testing.T) storage.Backend {
+		return newMemBackend()
+	})
+}
+
+func TestHook(t *testing.T) {
+	storagetest.RunHookTests(t, func(t *testing.T) mqtt.Hook {
+		h := new(Hook)
+		h.SetOpts(logger, nil)
+		require.NoError(t, h.Init(&Options{Backend: newMemBackend()}))
+		return h
+	})
+}
+
+func TestNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Stop())
+
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	_, err := h.StoredClients()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestBackendErrors(t *testing.T) {
+	b := newMemBackend()
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Backend: b}))
+	defer h.Stop()
+
+	b.err = errors.New("backend error")
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	h.OnClientExpired(&mqtt.Client{ID: "cl1"})
+
+	_, err := h.StoredClients()
+	require.ErrorIs(t, err, b.err)
+	_, err = h.StoredSysInfo()
+	require.ErrorIs(t, err, b.err)
+}
+
+func TestStoredCorruptValue(t *testing.T) {
+	b := newMemBackend()
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Backend: b}))
+	defer h.Stop()
+
+	require.NoError(t, b.Set(storage.SubscriptionKey+"_cl1:a", []byte("{")))
+	_, err := h.StoredSubscriptions()
+	require.Error(t, err)
+}
+
+func TestRestore(t *testing.T) {
+	b := newMemBackend()
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Backend: b}))
+	defer h.Stop()
+
+	require.NoError(t, h.Restore(&storage.Client{ID: "cl1"}))
+	require.NoError(t, h.Restore(&storage.Subscription{ID: "cl1:a/b", Client: "cl1", Filter: "a/b"}))
+	require.NoError(t, h.Restore(&storage.SystemInfo{}))
+	require.NoError(t, h.Restore(&storage.Message{T: storage.RetainedKey, TopicName: "a/b"}))
+	require.NoError(t, h.Restore(&storage.Message{T: storage.InflightKey, Client: "cl1", PacketID: 7}))
+	require.NoError(t, h.Restore(&storage.Message{T: storage.DelayedKey, ID: "d1"}))
+	require.NoError(t, h.Restore(&storage.Message{T: storage.DelayedKey, ID: storage.DelayedKey + "_d2"}))
+	require.NoError(t, h.Restore(&storage.Message{T: storage.DelayedWillKey, Client: "cl1"}))
+
+	for _, k := range []string{
+		storage.ClientKey + "_cl1",
+		storage.SubscriptionKey + "_cl1:a/b",
+		storage.SysInfoKey,
+		storage.RetainedKey + "_a/b",
+		storage.InflightKey + "_cl1:7",
+		storage.DelayedKey + "_d1",
+		storage.DelayedKey + "_d2",
+		storage.DelayedWillKey + "_cl1",
+	} {
+		require.Contains(t, b.values, k)
+	}
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, storage.SubscriptionKey, subs[0].T)
+	require.Equal(t, storage.SubscriptionKey+"_cl1:a/b", subs[0].ID)
+
+	require.ErrorIs(t, h.Restore(&storage.Message{T: "nope"}), ErrInvalidRecord)
+	require.ErrorIs(t, h.Restore(nil), ErrInvalidRecord)
+
+	require.NoError(t, h.Stop())
+	require.ErrorIs(t, h.Restore(&storage.Client{ID: "cl1"}), storage.ErrDBFileNotOpen)
+}
@@ -0,0 +1,418 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/hooks/storage"
+)
+
+const (
+	WriteBehindAsync = "async" // WriteBehindAsync returns from a write once it is queued.
+	WriteBehindSync  = "sync"  // WriteBehindSync returns from a write once the batch holding it is written.
+)
+
+const (
+	// defaultQueueSize is the default number of queued keys at which writes wait for a batch to be written.
+	defaultQueueSize = 10000
+
+	// defaultBatchSize is the default number of queued keys at which a batch is written without waiting.
+	defaultBatchSize = 1000
+
+	// defaultFlushInterval is the default longest time a write waits in the queue.
+	defaultFlushInterval = 100 * time.Millisecond
+
+	// maxRetryDelay is the longest time between attempts to write a batch which failed.
+	maxRetryDelay = 30 * time.Second
+)
+
+// ErrInvalidDurability indicates that the durability of a write-behind queue is not one of
+// the WriteBehind constants.
+var ErrInvalidDurability = errors.New("invalid write-behind durability")
+
+// WriteBehindOptions contains configuration settings for a write-behind queue, which moves
+// writes off the broker goroutines calling the storage hook and writes them in batches.
+type WriteBehindOptions struct {
+	QueueSize     int           `yaml:"queue_size" json:"queue_size"`         // the queued keys at which writes wait for a batch to be written; 10000 if zero
+	BatchSize     int           `yaml:"batch_size" json:"batch_size"`         // the queued keys at which a batch is written without waiting for the interval; 1000 if zero
+	FlushInterval time.Duration `yaml:"flush_interval" json:"flush_interval"` // the longest time a write waits in the queue; 100ms if zero
+	Durability    string        `yaml:"durability" json:"durability"`         // async or sync; async if empty
+}
+
+// WriteBehindStats contains the metrics of a write-behind queue.
+type WriteBehindStats struct {
+	Depth       int64         `json:"depth"`        // the keys queued or being written
+	Batches     int64         `json:"batches"`      // the batches written
+	Writes      int64         `json:"writes"`       // the changes written
+	Coalesced   int64         `json:"coalesced"`    // the changes superseded by a later change to the same key before being written
+	Errors      int64         `json:"errors"`       // the batches which failed to be written; their changes are queued again and retried
+	Lost        int64         `json:"lost"`         // the changes dropped because they could not be written before the queue was closed
+	LastLatency time.Duration `json:"last_latency"` // the time taken to write the last batch
+	MaxLatency  time.Duration `json:"max_latency"`  // the longest time taken to write a batch
+	AvgLatency  time.Duration `json:"avg_latency"`  // the average time taken to write a batch
+}
+
+// wbBatch is a batch of queued changes, keyed on key, which are written together.
+type wbBatch struct {
+	ops  map[string]storage.Op // the latest change to each key
+	keys []string              // the keys in the order they were first queued
+	done chan struct{}         // closed when the batch has been written
+	err  error                 // the error writing the batch, set before done is closed
+}
+
+// newWbBatch returns a new empty batch.
+func newWbBatch() *wbBatch {
+	return &wbBatch{
+		ops:  map[string]storage.Op{},
+		done: make(chan struct{}),
+	}
+}
+
+// writeBehind is a backend which queues changes and writes them to another backend in
+// batches from its own goroutine. Changes to a key replace any change to the same key
+// still in the queue, so a key set many times is written once, and a set followed by a
+// delete leaves only the delete. Reads see queued changes. The changes of a batch which
+// fails to be written are queued again, ahead of newer changes, and retried with backoff.
+type writeBehind struct {
+	mu       sync.Mutex
+	space    *sync.Cond          // signalled when the queue is taken for writing
+	flushMu  sync.Mutex          // held while a batch is written, so batches are written in order
+	backend  storage.Backend     // the backend to write to
+	config   *WriteBehindOptions // options for configuring the queue
+	log      *slog.Logger        // a logger for write errors
+	queue    *wbBatch            // the changes waiting to be written
+	flushing *wbBatch            // the changes being written, if any
+	kick     chan struct{}       // signals the flush loop to write the queue without waiting
+	done     chan struct{}       // closed when the queue is closed
+	stopped  chan struct{}       // closed when the flush loop has returned
+	closed   bool                // true if the queue has been closed
+	retry    time.Duration       // the delay before retrying a failed batch, zero if the last batch was written
+	retryAt  time.Time           // the loop does not write the queue before this time
+
+	depth     atomic.Int64 // the keys queued or being written
+	batches   atomic.Int64 // the batches written
+	writes    atomic.Int64 // the changes written
+	coalesced atomic.Int64 // the changes superseded before being written
+	errors    atomic.Int64 // the batches which failed
+	lost      atomic.Int64 // the changes dropped on close
+	last      atomic.Int64 // the latency of the last batch in nanoseconds
+	max       atomic.Int64 // the highest latency of a batch in nanoseconds
+	total     atomic.Int64 // the total latency of all batches in nanoseconds
+}
+
+// newWriteBehind returns a write-behind queue in front of a backend, applying the default
+// options to config, and starts its flush loop.
+func newWriteBehind(backend storage.Backend, config *WriteBehindOptions, log *slog.Logger) (*writeBehind, error) {
+	switch config.Durability {
+	case "":
+		config.Durability = WriteBehindAsync
+	case WriteBehindAsync, WriteBehindSync:
+	default:
+		return nil, fmt.Errorf("%q; %w", config.Durability, ErrInvalidDurability)
+	}
+
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+
+	w := &writeBehind{
+		backend: backend,
+		config:  config,
+		log:     log,
+		queue:   newWbBatch(),
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	w.space = sync.NewCond(&w.mu)
+
+	go w.loop()
+	return w, nil
+}
+
+// loop writes the queue at each flush interval, or when signalled, until the queue is closed.
+func (w *writeBehind) loop() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.flushDue()
+		case <-w.kick:
+			w.flushDue()
+		}
+	}
+}
+
+// flushDue writes the queue unless a failed batch is waiting for its retry delay.
+func (w *writeBehind) flushDue() {
+	w.mu.Lock()
+	wait := time.Now().Before(w.retryAt)
+	w.mu.Unlock()
+	if !wait {
+		_ = w.flush()
+	}
+}
+
+// flush writes the queued changes to the backend as one batch, returning any error. If the
+// batch fails, its changes are queued again unless a newer change to the same key is queued.
+func (w *writeBehind) flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	b := w.queue
+	if len(b.keys) == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+	w.queue = newWbBatch()
+	w.flushing = b
+	w.space.Broadcast()
+	w.mu.Unlock()
+
+	ops := make([]storage.Op, len(b.keys))
+	for i, k := range b.keys {
+		ops[i] = b.ops[k]
+	}
+
+	start := time.Now()
+	b.err = w.write(ops)
+	w.record(time.Since(start), len(ops), b.err)
+
+	w.mu.Lock()
+	w.flushing = nil
+	requeued := 0
+	if b.err != nil {
+		requeued = w.requeue(b)
+		w.retry = min(max(w.retry*2, w.config.FlushInterval), maxRetryDelay)
+		w.retryAt = time.Now().Add(w.retry)
+	} else {
+		w.retry = 0
+		w.retryAt = time.Time{}
+	}
+	w.mu.Unlock()
+	w.depth.Add(-int64(len(ops) - requeued))
+	close(b.done)
+	return b.err
+}
+
+// requeue puts the changes of a failed batch back at the front of the queue, except those
+// replaced by a newer change to the same key, and returns the number queued again. The lock
+// must be held.
+func (w *writeBehind) requeue(b *wbBatch) int {
+	keys := make([]string, 0, len(b.keys)+len(w.queue.keys))
+	for _, k := range b.keys {
+		if _, ok := w.queue.ops[k]; ok {
+			w.coalesced.Add(1)
+			continue
+		}
+
+		w.queue.ops[k] = b.ops[k]
+		keys = append(keys, k)
+	}
+
+	w.queue.keys = append(keys, w.queue.keys...)
+	return len(keys)
+}
+
+// write writes a batch of changes to the backend, in one call if the backend is a batcher.
+func (w *writeBehind) write(ops []storage.Op) error {
+	if bb, ok := w.backend.(storage.Batcher); ok {
+		return bb.Batch(ops)
+	}
+
+	var err error
+	for _, op := range ops {
+		var oerr error
+		if op.Delete {
+			oerr = w.backend.Delete(op.Key)
+		} else {
+			oerr = w.backend.Set(op.Key, op.Value)
+		}
+		if oerr != nil && err == nil {
+			err = oerr
+		}
+	}
+	return err
+}
+
+// record updates the metrics with a written batch.
+func (w *writeBehind) record(latency time.Duration, n int, err error) {
+	w.batches.Add(1)
+	if err == nil {
+		w.writes.Add(int64(n))
+	}
+	w.last.Store(int64(latency))
+	w.total.Add(int64(latency))
+	for {
+		m := w.max.Load()
+		if int64(latency) <= m || w.max.CompareAndSwap(m, int64(latency)) {
+			break
+		}
+	}
+
+	if err != nil {
+		w.errors.Add(1)
+		w.log.Error("failed to write storage batch, will retry", "error", err, "size", n)
+	}
+}
+
+// enqueue queues a change, waiting for space if the queue is full, and under the sync
+// durability until the batch holding it has been written.
+func (w *writeBehind) enqueue(op storage.Op) error {
+	w.mu.Lock()
+	for !w.closed && len(w.queue.keys) >= w.config.QueueSize {
+		if _, ok := w.queue.ops[op.Key]; ok {
+			break // replacing a queued change takes no more space.
+		}
+		w.space.Wait()
+	}
+
+	if w.closed {
+		w.mu.Unlock()
+		return storage.ErrDBFileNotOpen
+	}
+
+	b := w.queue
+	if _, ok := b.ops[op.Key]; ok {
+		w.coalesced.Add(1)
+	} else {
+		b.keys = append(b.keys, op.Key)
+		w.depth.Add(1)
+	}
+	b.ops[op.Key] = op
+	full := len(b.keys) >= w.config.BatchSize
+	w.mu.Unlock()
+
+	wait := w.config.Durability == WriteBehindSync
+	if full || wait {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	if !wait {
+		return nil
+	}
+
+	<-b.done
+	return b.err
+}
+
+// Get returns the value of a key, from the queue if it has a change waiting to be written.
+func (w *writeBehind) Get(key string) ([]byte, error) {
+	w.mu.Lock()
+	for _, b := range []*wbBatch{w.queue, w.flushing} {
+		if b == nil {
+			continue
+		}
+
+		if op, ok := b.ops[key]; ok {
+			w.mu.Unlock()
+			if op.Delete {
+				return nil, storage.ErrKeyNotFound
+			}
+			return bytes.Clone(op.Value), nil
+		}
+	}
+	w.mu.Unlock()
+
+	return w.backend.Get(key)
+}
+
+// Set queues setting the value of a key.
+func (w *writeBehind) Set(key string, value []byte) error {
+	return w.enqueue(storage.Op{Key: key, Value: bytes.Clone(value)})
+}
+
+// Delete queues deleting a key.
+func (w *writeBehind) Delete(key string) error {
+	return w.enqueue(storage.Op{Key: key, Delete: true})
+}
+
+// Iterate writes the queue, then calls visit with the values of the keys beginning with a
+// prefix from the backend, in key order. If the queue cannot be written, the error is
+// returned and the changes stay queued.
+func (w *writeBehind) Iterate(prefix string, visit func([]byte) error) error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	return w.backend.Iterate(prefix, visit)
+}
+
+// Close writes the queue and closes the backend. Changes which cannot be written are
+// dropped and counted as lost.
+func (w *writeBehind) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.space.Broadcast()
+	w.mu.Unlock()
+
+	close(w.done)
+	<-w.stopped
+
+	err := w.flush()
+	if err != nil {
+		w.mu.Lock()
+		b := w.queue
+		w.queue = newWbBatch()
+		w.mu.Unlock()
+		w.depth.Add(-int64(len(b.keys)))
+		w.lost.Add(int64(len(b.keys)))
+		w.log.Error("dropped unwritten storage changes", "error", err, "lost", len(b.keys))
+		b.err = err
+		close(b.done)
+	}
+
+	if cerr := w.backend.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Stats returns the metrics of the queue.
+func (w *writeBehind) Stats() WriteBehindStats {
+	s := WriteBehindStats{
+		Depth:       w.depth.Load(),
+		Batches:     w.batches.Load(),
+		Writes:      w.writes.Load(),
+		Coalesced:   w.coalesced.Load(),
+		Errors:      w.errors.Load(),
+		Lost:        w.lost.Load(),
+		LastLatency: time.Duration(w.last.Load()),
+		MaxLatency:  time.Duration(w.max.Load()),
+	}
+
+	if s.Batches > 0 {
+		s.AvgLatency = time.Duration(w.total.Load() / s.Batches)
+	}
+	return s
+}
@@ -0,0 +1,364 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package kv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/hooks/storage/storagetest"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// batchBackend is an in-memory storage backend which applies batches.
+type batchBackend struct {
+	*memBackend
+	batches int // the number of calls to Batch
+}
+
+func (b *batchBackend) Batch(ops []storage.Op) error {
+	b.Lock()
+	b.batches++
+	b.Unlock()
+
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = b.Delete(op.Key)
+		} else {
+			err = b.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTestWriteBehind returns a write-behind queue in front of b which only writes when
+// flushed or closed.
+func newTestWriteBehind(t *testing.T, b storage.Backend, durability string) *writeBehind {
+	w, err := newWriteBehind(b, &WriteBehindOptions{
+		FlushInterval: time.Hour,
+		Durability:    durability,
+	}, logger)
+	require.NoError(t, err)
+	return w
+}
+
+func TestWriteBehindDefaults(t *testing.T) {
+	w := newTestWriteBehind(t, newMemBackend(), "")
+	defer w.Close()
+	require.Equal(t, WriteBehindAsync, w.config.Durability)
+	require.Equal(t, defaultQueueSize, w.config.QueueSize)
+	require.Equal(t, defaultBatchSize, w.config.BatchSize)
+}
+
+func TestWriteBehindInvalidDurability(t *testing.T) {
+	_, err := newWriteBehind(newMemBackend(), &WriteBehindOptions{Durability: "sometimes"}, logger)
+	require.ErrorIs(t, err, ErrInvalidDurability)
+}
+
+func TestWriteBehindBackend(t *testing.T) {
+	for _, durability := range []string{WriteBehindAsync, WriteBehindSync} {
+		t.Run(durability, func(t *testing.T) {
+			storagetest.RunBackendTests(t, func(t *testing.T) storage.Backend {
+				return newTestWriteBehind(t, newMemBackend(), durability)
+			})
+		})
+	}
+}
+
+func TestWriteBehindHook(t *testing.T) {
+	for _, durability := range []string{WriteBehindAsync, WriteBehindSync} {
+		t.Run(durability, func(t *testing.T) {
+			storagetest.RunHookTests(t, func(t *testing.T) mqtt.Hook {
+				h := new(Hook)
+				h.SetOpts(logger, nil)
+				require.NoError(t, h.Init(&Options{
+					Backend:     newMemBackend(),
+					WriteBehind: &WriteBehindOptions{Durability: durability},
+				}))
+				return h
+			})
+		})
+	}
+}
+
+func TestWriteBehindCoalesce(t *testing.T) {
+	b := newMemBackend()
+	w := newTestWriteBehind(t, b, WriteBehindAsync)
+	defer w.Close()
+
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.NoError(t, w.Set("a", []byte("2")))
+	require.NoError(t, w.Set("a", []byte("3")))
+	require.NoError(t, w.Set("b", []byte("1")))
+	require.NoError(t, w.Delete("b"))
+	require.Equal(t, int64(2), w.Stats().Depth)
+
+	sets, deletes := b.calls()
+	require.Zero(t, sets+deletes) // nothing is written until flushed.
+
+	v, err := w.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), v)
+	_, err = w.Get("b")
+	require.ErrorIs(t, err, storage.ErrKeyNotFound)
+
+	require.NoError(t, w.flush())
+	sets, deletes = b.calls()
+	require.Equal(t, 1, sets)
+	require.Equal(t, 1, deletes)
+	require.Equal(t, []byte("3"), b.values["a"])
+
+	s := w.Stats()
+	require.Equal(t, int64(0), s.Depth)
+	require.Equal(t, int64(1), s.Batches)
+	require.Equal(t, int64(2), s.Writes)
+	require.Equal(t, int64(3), s.Coalesced)
+	require.Equal(t, int64(0), s.Errors)
+	require.Equal(t, s.LastLatency, s.MaxLatency)
+	require.Equal(t, s.LastLatency, s.AvgLatency)
+}
+
+func TestWriteBehindBatcher(t *testing.T) {
+	b := &batchBackend{memBackend: newMemBackend()}
+	w := newTestWriteBehind(t, b, WriteBehindAsync)
+
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.NoError(t, w.Set("b", []byte("2")))
+	require.NoError(t, w.Close())
+	require.Equal(t, 1, b.batches)
+	require.Len(t, b.values, 2)
+}
+
+func TestWriteBehindFlushInterval(t *testing.T) {
+	b := newMemBackend()
+	w, err := newWriteBehind(b, &WriteBehindOptions{FlushInterval: time.Millisecond}, logger)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.Eventually(t, func() bool {
+		sets, _ := b.calls()
+		return sets == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestWriteBehindBatchSize(t *testing.T) {
+	b := newMemBackend()
+	w, err := newWriteBehind(b, &WriteBehindOptions{FlushInterval: time.Hour, BatchSize: 2}, logger)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.NoError(t, w.Set("b", []byte("2")))
+	require.Eventually(t, func() bool {
+		sets, _ := b.calls()
+		return sets == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestWriteBehindQueueFull(t *testing.T) {
+	b := newMemBackend()
+	w, err := newWriteBehind(b, &WriteBehindOptions{FlushInterval: time.Hour, QueueSize: 1}, logger)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.NoError(t, w.Set("a", []byte("2"))) // replacing a queued key takes no space.
+
+	queued := make(chan error)
+	go func() {
+		queued <- w.Set("b", []byte("1"))
+	}()
+
+	select {
+	case <-queued:
+		require.Fail(t, "write should wait for space in the queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	require.NoError(t, w.flush())
+	require.NoError(t, <-queued)
+	require.NoError(t, w.flush())
+	require.Len(t, b.values, 2)
+}
+
+func TestWriteBehindSync(t *testing.T) {
+	b := newMemBackend()
+	w := newTestWriteBehind(t, b, WriteBehindSync)
+	defer w.Close()
+
+	require.NoError(t, w.Set("a", []byte("1")))
+	sets, _ := b.calls()
+	require.Equal(t, 1, sets) // written before returning.
+
+	b.fail(errors.New("backend error"))
+	require.ErrorIs(t, w.Set("a", []byte("2")), b.err)
+	require.Equal(t, int64(1), w.Stats().Errors)
+}
+
+func TestWriteBehindRetry(t *testing.T) {
+	b := newMemBackend()
+	w := newTestWriteBehind(t, b, WriteBehindAsync)
+	defer w.Close()
+
+	b.fail(errors.New("backend error"))
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.NoError(t, w.Set("b", []byte("1")))
+	require.ErrorIs(t, w.flush(), b.err)
+
+	s := w.Stats()
+	require.Equal(t, int64(1), s.Errors)
+	require.Equal(t, int64(2), s.Depth) // the changes are queued again.
+	require.Equal(t, int64(0), s.Writes)
+	v, err := w.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), v)
+
+	w.mu.Lock()
+	retry, retryAt := w.retry, w.retryAt
+	w.mu.Unlock()
+	require.Equal(t, maxRetryDelay, retry) // the flush interval, up to the longest delay.
+	require.True(t, retryAt.After(time.Now()))
+
+	require.NoError(t, w.Set("b", []byte("2"))) // a newer change replaces the failed one.
+	require.NoError(t, w.Set("c", []byte("1")))
+	require.ErrorIs(t, w.flush(), b.err)
+	w.mu.Lock()
+	keys := w.queue.keys
+	w.mu.Unlock()
+	require.Equal(t, []string{"a", "b", "c"}, keys) // failed changes stay ahead of newer ones.
+
+	w.flushDue() // waits for the retry delay.
+	require.Equal(t, int64(3), w.Stats().Depth)
+
+	b.fail(nil)
+	require.NoError(t, w.flush())
+	require.Equal(t, []byte("1"), b.values["a"])
+	require.Equal(t, []byte("2"), b.values["b"])
+	require.Equal(t, []byte("1"), b.values["c"])
+
+	s = w.Stats()
+	require.Equal(t, int64(0), s.Depth)
+	require.Equal(t, int64(3), s.Writes)
+	require.Equal(t, int64(0), s.Lost)
+	w.mu.Lock()
+	retry = w.retry
+	w.mu.Unlock()
+	require.Zero(t, retry)
+}
+
+func TestWriteBehindRetryDelay(t *testing.T) {
+	b := newMemBackend()
+	w, err := newWriteBehind(b, &WriteBehindOptions{FlushInterval: time.Millisecond}, logger)
+	require.NoError(t, err)
+	defer w.Close()
+
+	b.fail(errors.New("backend error"))
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.Eventually(t, func() bool {
+		return w.Stats().Errors >= 2
+	}, time.Second, time.Millisecond)
+
+	b.fail(nil)
+	require.Eventually(t, func() bool {
+		return w.Stats().Depth == 0
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, []byte("1"), b.values["a"])
+}
+
+func TestWriteBehindCloseLost(t *testing.T) {
+	b := newMemBackend()
+	w := newTestWriteBehind(t, b, WriteBehindAsync)
+
+	b.fail(errors.New("backend error"))
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.NoError(t, w.Set("b", []byte("1")))
+	require.ErrorIs(t, w.Close(), b.err)
+
+	s := w.Stats()
+	require.Equal(t, int64(2), s.Lost)
+	require.Equal(t, int64(0), s.Depth)
+}
+
+func TestWriteBehindIterateFlushes(t *testing.T) {
+	b := newMemBackend()
+	w := newTestWriteBehind(t, b, WriteBehindAsync)
+	defer w.Close()
+
+	require.NoError(t, w.Set(storage.ClientKey+"_cl1", []byte("1")))
+	var got []string
+	require.NoError(t, w.Iterate(storage.ClientKey, func(v []byte) error {
+		got = append(got, string(v))
+		return nil
+	}))
+	require.Equal(t, []string{"1"}, got)
+
+	b.fail(errors.New("backend error"))
+	require.NoError(t, w.Set(storage.ClientKey+"_cl2", []byte("2")))
+	require.ErrorIs(t, w.Iterate(storage.ClientKey, func(v []byte) error { return nil }), b.err)
+}
+
+func TestWriteBehindClose(t *testing.T) {
+	b := newMemBackend()
+	w := newTestWriteBehind(t, b, WriteBehindAsync)
+
+	require.NoError(t, w.Set("a", []byte("1")))
+	require.NoError(t, w.Close())
+	require.Equal(t, []byte("1"), b.values["a"]) // the queue is written on close.
+
+	require.ErrorIs(t, w.Set("b", nil), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, w.Delete("a"), storage.ErrDBFileNotOpen)
+	require.NoError(t, w.Close())
+}
+
+func TestHookWriteBehindStats(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Backend: newMemBackend()}))
+	_, ok := h.WriteBehindStats()
+	require.False(t, ok)
+	require.NoError(t, h.Stop())
+
+	b := newMemBackend()
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{
+		Backend:     b,
+		WriteBehind: &WriteBehindOptions{FlushInterval: time.Hour},
+	}))
+
+	cl := &mqtt.Client{ID: "cl1"}
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}
+	h.OnQosPublish(cl, pk, 0, 0)
+	h.OnQosComplete(cl, pk)
+
+	s, ok := h.WriteBehindStats()
+	require.True(t, ok)
+	require.Equal(t, int64(1), s.Depth)
+	require.Equal(t, int64(1), s.Coalesced)
+
+	require.NoError(t, h.Stop())
+	sets, deletes := b.calls()
+	require.Equal(t, 0, sets) // the inflight message was completed before it was written.
+	require.Equal(t, 1, deletes)
+}
+
+func TestInitBadWriteBehind(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Backend:     newMemBackend(),
+		WriteBehind: &WriteBehindOptions{Durability: "sometimes"},
+	})
+	require.ErrorIs(t, err, ErrInvalidDurability)
+}
@@ -0,0 +1,335 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+// Package migrate copies the records of a storage hook to another storage hook, or to and
+// from a portable JSON Lines dump, verifying the record counts after each copy. Copies stop
+// between records when their context is done.
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/xyzj/mqtt-server/hooks/storage"
+)
+
+var (
+	// ErrCountMismatch indicates that the records read back after a copy do not match the
+	// records copied.
+	ErrCountMismatch = errors.New("record counts do not match")
+
+	// ErrInvalidDump indicates that a line of a dump is not a known record.
+	ErrInvalidDump = errors.New("invalid dump record")
+)
+
+// Source is a storage hook which records are read from.
+type Source interface {
+	StoredClients() ([]storage.Client, error)
+	StoredSubscriptions() ([]storage.Subscription, error)
+	StoredInflightMessages() ([]storage.Message, error)
+	StoredRetainedMessages() ([]storage.Message, error)
+	StoredDelayedMessages() ([]storage.Message, error)
+	StoredDelayedWills() ([]storage.Message, error)
+	StoredSysInfo() (storage.SystemInfo, error)
+}
+
+// Target is a storage hook which records are written to, such as any of the storage hooks
+// built on the kv hook. Records are read back from it to verify a copy.
+type Target interface {
+	Source
+	Restore(v storage.Serializable) error
+}
+
+// Counts contains the number of records of each type.
+type Counts struct {
+	Clients       int `json:"clients"`
+	Subscriptions int `json:"subscriptions"`
+	Inflight      int `json:"inflight"`
+	Retained      int `json:"retained"`
+	Delayed       int `json:"delayed"`
+	DelayedWills  int `json:"delayed_wills"`
+	SysInfo       int `json:"sysinfo"`
+}
+
+// String returns the counts in a form suitable for logs and reports.
+func (c Counts) String() string {
+	return fmt.Sprintf("clients=%d subscriptions=%d inflight=%d retained=%d delayed=%d delayed_wills=%d sysinfo=%d",
+		c.Clients, c.Subscriptions, c.Inflight, c.Retained, c.Delayed, c.DelayedWills, c.SysInfo)
+}
+
+// Records contains all the records of a storage hook.
+type Records struct {
+	Clients       []storage.Client
+	Subscriptions []storage.Subscription
+	Inflight      []storage.Message
+	Retained      []storage.Message
+	Delayed       []storage.Message
+	DelayedWills  []storage.Message
+	SysInfo       *storage.SystemInfo // nil if no system info is stored
+}
+
+// Counts returns the number of records of each type.
+func (r *Records) Counts() Counts {
+	c := Counts{
+		Clients:       len(r.Clients),
+		Subscriptions: len(r.Subscriptions),
+		Inflight:      len(r.Inflight),
+		Retained:      len(r.Retained),
+		Delayed:       len(r.Delayed),
+		DelayedWills:  len(r.DelayedWills),
+	}
+
+	if r.SysInfo != nil {
+		c.SysInfo = 1
+	}
+
+	return c
+}
+
+// Read returns all the records of a storage hook.
+func Read(src Source) (*Records, error) {
+	r := new(Records)
+	var err error
+
+	if r.Clients, err = src.StoredClients(); err != nil {
+		return nil, fmt.Errorf("clients; %w", err)
+	}
+
+	if r.Subscriptions, err = src.StoredSubscriptions(); err != nil {
+		return nil, fmt.Errorf("subscriptions; %w", err)
+	}
+
+	if r.Inflight, err = src.StoredInflightMessages(); err != nil {
+		return nil, fmt.Errorf("inflight messages; %w", err)
+	}
+
+	if r.Retained, err = src.StoredRetainedMessages(); err != nil {
+		return nil, fmt.Errorf("retained messages; %w", err)
+	}
+
+	if r.Delayed, err = src.StoredDelayedMessages(); err != nil {
+		return nil, fmt.Errorf("delayed messages; %w", err)
+	}
+
+	if r.DelayedWills, err = src.StoredDelayedWills(); err != nil {
+		return nil, fmt.Errorf("delayed wills; %w", err)
+	}
+
+	sys, err := src.StoredSysInfo()
+	if err != nil {
+		return nil, fmt.Errorf("sysinfo; %w", err)
+	}
+
+	if sys.ID != "" || sys.T != "" {
+		r.SysInfo = &sys
+	}
+
+	return r, nil
+}
+
+// each calls fn with each record, typed as the kv hook stores it, returning the context
+// error if the context is done before all the records have been visited.
+func (r *Records) each(ctx context.Context, fn func(v storage.Serializable) error) error {
+	visit := func(v storage.Serializable) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(v)
+	}
+
+	for i := range r.Clients {
+		r.Clients[i].T = storage.ClientKey
+		if err := visit(&r.Clients[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range r.Subscriptions {
+		r.Subscriptions[i].T = storage.SubscriptionKey
+		if err := visit(&r.Subscriptions[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range []struct {
+		t    string
+		msgs []storage.Message
+	}{
+		{t: storage.InflightKey, msgs: r.Inflight},
+		{t: storage.RetainedKey, msgs: r.Retained},
+		{t: storage.DelayedKey, msgs: r.Delayed},
+		{t: storage.DelayedWillKey, msgs: r.DelayedWills},
+	} {
+		for i := range m.msgs {
+			m.msgs[i].T = m.t
+			if err := visit(&m.msgs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.SysInfo != nil {
+		r.SysInfo.T = storage.SysInfoKey
+		if err := visit(r.SysInfo); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write writes the records to a storage hook, replacing any records with the same keys.
+func (r *Records) Write(ctx context.Context, dst Target) error {
+	return r.each(ctx, dst.Restore)
+}
+
+// Encode writes the records as a JSON Lines dump, one record per line. Each record carries
+// its type in the t field.
+func (r *Records) Encode(ctx context.Context, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	err := r.each(ctx, func(v storage.Serializable) error {
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(append(b, '\n'))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Decode reads the records of a JSON Lines dump written by Encode.
+func Decode(ctx context.Context, rd io.Reader) (*Records, error) {
+	r := new(Records)
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<28) // records may hold large payloads
+
+	for line := 1; sc.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		b := sc.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+
+		var head struct {
+			T string `json:"t"`
+		}
+		if err := json.Unmarshal(b, &head); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var err error
+		switch head.T {
+		case storage.ClientKey:
+			v := storage.Client{}
+			err = v.UnmarshalBinary(b)
+			r.Clients = append(r.Clients, v)
+		case storage.SubscriptionKey:
+			v := storage.Subscription{}
+			err = v.UnmarshalBinary(b)
+			r.Subscriptions = append(r.Subscriptions, v)
+		case storage.InflightKey, storage.RetainedKey, storage.DelayedKey, storage.DelayedWillKey:
+			v := storage.Message{}
+			err = v.UnmarshalBinary(b)
+			switch head.T {
+			case storage.InflightKey:
+				r.Inflight = append(r.Inflight, v)
+			case storage.RetainedKey:
+				r.Retained = append(r.Retained, v)
+			case storage.DelayedWillKey:
+				r.DelayedWills = append(r.DelayedWills, v)
+			default:
+				r.Delayed = append(r.Delayed, v)
+			}
+		case storage.SysInfoKey:
+			v := new(storage.SystemInfo)
+			err = v.UnmarshalBinary(b)
+			r.SysInfo = v
+		default:
+			err = fmt.Errorf("type %q; %w", head.T, ErrInvalidDump)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Verify reads the records of a storage hook back and checks that there are as many of each
+// type as expected.
+func Verify(src Source, want Counts) error {
+	r, err := Read(src)
+	if err != nil {
+		return err
+	}
+
+	if got := r.Counts(); got != want {
+		return fmt.Errorf("want %s, got %s; %w", want, got, ErrCountMismatch)
+	}
+
+	return nil
+}
+
+// Copy copies all the records of one storage hook to another and verifies them. The target
+// should be empty, as records it already holds are counted in the verification.
+func Copy(ctx context.Context, dst Target, src Source) (Counts, error) {
+	r, err := Read(src)
+	if err != nil {
+		return Counts{}, fmt.Errorf("read; %w", err)
+	}
+
+	return restore(ctx, dst, r)
+}
+
+// Export writes all the records of a storage hook to a JSON Lines dump.
+func Export(ctx context.Context, w io.Writer, src Source) (Counts, error) {
+	r, err := Read(src)
+	if err != nil {
+		return Counts{}, fmt.Errorf("read; %w", err)
+	}
+
+	if err := r.Encode(ctx, w); err != nil {
+		return Counts{}, fmt.Errorf("encode; %w", err)
+	}
+
+	return r.Counts(), nil
+}
+
+// Import writes all the records of a JSON Lines dump to a storage hook and verifies them.
+// The target should be empty, as records it already holds are counted in the verification.
+func Import(ctx context.Context, dst Target, rd io.Reader) (Counts, error) {
+	r, err := Decode(ctx, rd)
+	if err != nil {
+		return Counts{}, fmt.Errorf("decode; %w", err)
+	}
+
+	return restore(ctx, dst, r)
+}
+
+// restore writes records to a storage hook and verifies them.
+func restore(ctx context.Context, dst Target, r *Records) (Counts, error) {
+	c := r.Counts()
+	if err := r.Write(ctx, dst); err != nil {
+		return c, fmt.Errorf("write; %w", err)
+	}
+
+	return c, Verify(dst, c)
+}
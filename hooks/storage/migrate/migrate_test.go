@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/hooks/storage/bolt"
+	"github.com/xyzj/mqtt-server/hooks/storage/pebble"
+	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/mqtt-server/system"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newBolt returns a new bolt storage hook in a temporary directory.
+func newBolt(t *testing.T) *bolt.Hook {
+	t.Helper()
+	h := new(bolt.Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&bolt.Options{Path: filepath.Join(t.TempDir(), "bolt.db")}))
+	t.Cleanup(func() {
+		_ = h.Stop()
+	})
+	return h
+}
+
+// newPebble returns a new pebble storage hook in a temporary directory.
+func newPebble(t *testing.T) *pebble.Hook {
+	t.Helper()
+	h := new(pebble.Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&pebble.Options{Path: filepath.Join(t.TempDir(), "pebble")}))
+	t.Cleanup(func() {
+		_ = h.Stop()
+	})
+	return h
+}
+
+// populate stores records of every type in a storage hook through its events.
+func populate(h *bolt.Hook) {
+	cl := &mqtt.Client{ID: "cl1"}
+	cl.Properties.Username = []byte("mochi")
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+	h.OnSubscribed(cl, packets.Packet{
+		Filters: packets.Subscriptions{{Filter: "a/b"}, {Filter: "a/#", Qos: 1}},
+	}, []byte{0, 1})
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+	h.OnQosPublish(cl, pk, 1, 0)
+	h.OnRetainMessage(cl, packets.Packet{TopicName: "a/b", Payload: []byte("kept")}, 1)
+	h.OnDelayedMessage(cl, mqtt.DelayedMessage{ID: "d1", Client: "cl1", Due: 10, Packet: pk})
+	h.OnDelayedWill(&mqtt.Client{ID: "cl2"}, packets.Packet{TopicName: "wills/cl2", Payload: []byte("gone"), Expiry: 20})
+	h.OnSysInfoTick(&system.Info{Version: "2.7.9", Uptime: 100})
+}
+
+var populated = Counts{Clients: 2, Subscriptions: 2, Inflight: 1, Retained: 1, Delayed: 1, DelayedWills: 1, SysInfo: 1}
+
+func TestCountsString(t *testing.T) {
+	require.Equal(t, "clients=2 subscriptions=2 inflight=1 retained=1 delayed=1 delayed_wills=1 sysinfo=1", populated.String())
+}
+
+func TestRead(t *testing.T) {
+	src := newBolt(t)
+	r, err := Read(src)
+	require.NoError(t, err)
+	require.Equal(t, Counts{}, r.Counts())
+	require.Nil(t, r.SysInfo)
+
+	populate(src)
+	r, err = Read(src)
+	require.NoError(t, err)
+	require.Equal(t, populated, r.Counts())
+	require.Equal(t, int64(100), r.SysInfo.Uptime)
+}
+
+func TestReadClosed(t *testing.T) {
+	src := newBolt(t)
+	require.NoError(t, src.Stop())
+	_, err := Read(src)
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestCopy(t *testing.T) {
+	src := newBolt(t)
+	populate(src)
+	dst := newPebble(t)
+
+	c, err := Copy(context.Background(), dst, src)
+	require.NoError(t, err)
+	require.Equal(t, populated, c)
+
+	want, err := Read(src)
+	require.NoError(t, err)
+	got, err := Read(dst)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestCopyNotEmpty(t *testing.T) {
+	src := newBolt(t)
+	populate(src)
+	dst := newPebble(t)
+	dst.OnSessionEstablished(&mqtt.Client{ID: "cl3"}, packets.Packet{})
+
+	_, err := Copy(context.Background(), dst, src)
+	require.ErrorIs(t, err, ErrCountMismatch)
+}
+
+func TestCopyCancelled(t *testing.T) {
+	src := newBolt(t)
+	populate(src)
+	dst := newPebble(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Copy(ctx, dst, src)
+	require.ErrorIs(t, err, context.Canceled)
+
+	r, err := Read(dst)
+	require.NoError(t, err)
+	require.Equal(t, Counts{}, r.Counts()) // stopped before the first record.
+
+	_, err = Export(ctx, io.Discard, src)
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = Import(ctx, dst, strings.NewReader(`{"t":"CL","id":"cl1"}`))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestExportImport(t *testing.T) {
+	src := newBolt(t)
+	populate(src)
+
+	buf := new(bytes.Buffer)
+	c, err := Export(context.Background(), buf, src)
+	require.NoError(t, err)
+	require.Equal(t, populated, c)
+	require.Equal(t, 9, strings.Count(buf.String(), "\n"))
+
+	dst := newPebble(t)
+	c, err = Import(context.Background(), dst, buf)
+	require.NoError(t, err)
+	require.Equal(t, populated, c)
+
+	want, err := Read(src)
+	require.NoError(t, err)
+	got, err := Read(dst)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Decode(context.Background(), strings.NewReader(`{"t":"CL","id":"cl1"}`+"\n\n"+`{"t":"nope"}`+"\n"))
+	require.ErrorIs(t, err, ErrInvalidDump)
+	require.ErrorContains(t, err, "line 3")
+
+	_, err = Decode(context.Background(), strings.NewReader("{"))
+	require.ErrorContains(t, err, "line 1")
+}
+
+func TestImportWriteError(t *testing.T) {
+	dst := newPebble(t)
+	require.NoError(t, dst.Stop())
+	_, err := Import(context.Background(), dst, strings.NewReader(`{"t":"CL","id":"cl1"}`))
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write error")
+}
+
+func TestExportWriteError(t *testing.T) {
+	src := newBolt(t)
+	populate(src)
+	_, err := Export(context.Background(), errWriter{}, src)
+	require.ErrorContains(t, err, "write error")
+}
@@ -0,0 +1,546 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package msglog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	DefaultSegmentSize = 16 << 20 // the default size in bytes at which segments are rotated
+
+	headerSize     = 8  // the bytes of the length and checksum before each record
+	indexEntrySize = 24 // the bytes of the time, offset and topic hash of each index entry
+	logExt         = ".log"
+	indexExt       = ".idx"
+	topicsExt      = ".topics"
+)
+
+var (
+	// ErrClosed indicates that the log has been closed.
+	ErrClosed = errors.New("message log closed")
+
+	// ErrCorrupt indicates that a record failed its checksum or could not be decoded.
+	ErrCorrupt = errors.New("message log record corrupt")
+)
+
+// Message is a published message recorded in the log.
+type Message struct {
+	Time    time.Time              `json:"time"`              // the time the message was published
+	Topic   string                 `json:"topic"`             // the topic the message was published to
+	Payload []byte                 `json:"payload"`           // the message payload
+	Qos     byte                   `json:"qos"`               // the qos of the publish
+	Retain  bool                   `json:"retain,omitempty"`  // the retain flag of the publish
+	Client  string                 `json:"client"`            // the id of the client which published the message
+	User    []packets.UserProperty `json:"user,omitempty"`    // the user properties of the publish
+	Expiry  uint32                 `json:"expiry,omitempty"`  // the message expiry interval of the publish
+	Content string                 `json:"content,omitempty"` // the content type of the publish
+}
+
+// segment describes a pair of log and index files holding a run of records.
+type segment struct {
+	id     uint64              // the sequence of the segment, which names its files
+	size   int64               // the bytes of the log file
+	count  int64               // the number of records
+	first  int64               // the time of the first record, in unix nanoseconds
+	last   int64               // the time of the last record, in unix nanoseconds
+	topics map[string]struct{} // the topics of the records
+}
+
+// add updates the segment for a record appended to it.
+func (s *segment) add(t int64, topic string, size int64) {
+	if s.count == 0 {
+		s.first = t
+	}
+	s.last = t
+	s.count++
+	s.size += size
+	s.topics[topic] = struct{}{}
+}
+
+// Log is a segmented append-only log of messages on disk, indexed by time and topic.
+// It is safe for concurrent use.
+type Log struct {
+	sync.RWMutex
+	dir         string     // the directory of the log files
+	segmentSize int64      // the size in bytes at which the active segment is rotated
+	segments    []*segment // the segments, oldest first; the last is the active segment
+	logFile     *os.File   // the log file of the active segment
+	idxFile     *os.File   // the index file of the active segment
+	lastTime    int64      // the time of the last record, in unix nanoseconds
+	closed      bool       // true if the log has been closed
+}
+
+// Open opens or creates a log in a directory. Segments are rotated when they reach
+// segmentSize bytes, or DefaultSegmentSize if it is 0. Any partial record left at the end of
+// the active segment by a crash is discarded.
+func Open(dir string, segmentSize int64) (*Log, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), logExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+
+		if id, err := strconv.ParseUint(name, 16, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	l := &Log{
+		dir:         dir,
+		segmentSize: segmentSize,
+	}
+
+	for i, id := range ids {
+		seg, err := l.loadSegment(id, i == len(ids)-1)
+		if err != nil {
+			return nil, fmt.Errorf("segment %016x: %w", id, err)
+		}
+		l.segments = append(l.segments, seg)
+		if seg.count > 0 {
+			l.lastTime = seg.last
+		}
+	}
+
+	if len(l.segments) == 0 {
+		l.segments = append(l.segments, &segment{topics: map[string]struct{}{}})
+	}
+
+	if err := l.openActive(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// path returns the path of a file of a segment.
+func (l *Log) path(id uint64, ext string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016x%s", id, ext))
+}
+
+// loadSegment reads the description of a segment from its files. The index and topics of the
+// active segment, or of any segment without a topics file, are rebuilt from its log file.
+func (l *Log) loadSegment(id uint64, active bool) (*segment, error) {
+	seg := &segment{id: id, topics: map[string]struct{}{}}
+	if !active {
+		if data, err := os.ReadFile(l.path(id, topicsExt)); err == nil {
+			var topics []string
+			if err := json.Unmarshal(data, &topics); err != nil {
+				return nil, err
+			}
+
+			idx, err := os.ReadFile(l.path(id, indexExt))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, t := range topics {
+				seg.topics[t] = struct{}{}
+			}
+
+			seg.count = int64(len(idx) / indexEntrySize)
+			if seg.count > 0 {
+				seg.first = int64(binary.BigEndian.Uint64(idx))
+				seg.last = int64(binary.BigEndian.Uint64(idx[(seg.count-1)*indexEntrySize:]))
+			}
+
+			fi, err := os.Stat(l.path(id, logExt))
+			if err != nil {
+				return nil, err
+			}
+			seg.size = fi.Size()
+			return seg, nil
+		}
+	}
+
+	return seg, l.rebuildSegment(seg)
+}
+
+// rebuildSegment scans the log file of a segment, rewriting its index and truncating the log
+// at the first record which is partial or corrupt.
+func (l *Log) rebuildSegment(seg *segment) error {
+	f, err := os.OpenFile(l.path(seg.id, logExt), os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var idx []byte
+	r := bufio.NewReader(f)
+	for {
+		data, err := readRecord(r)
+		if err != nil {
+			break
+		}
+
+		var m Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			break
+		}
+
+		t := m.Time.UnixNano()
+		idx = appendIndexEntry(idx, t, seg.size, m.Topic)
+		seg.add(t, m.Topic, int64(headerSize+len(data)))
+	}
+
+	if err := f.Truncate(seg.size); err != nil {
+		return err
+	}
+
+	return os.WriteFile(l.path(seg.id, indexExt), idx, 0o600)
+}
+
+// openActive opens the files of the active segment for appending.
+func (l *Log) openActive() error {
+	seg := l.segments[len(l.segments)-1]
+	var err error
+	l.logFile, err = os.OpenFile(l.path(seg.id, logExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	l.idxFile, err = os.OpenFile(l.path(seg.id, indexExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		_ = l.logFile.Close()
+		return err
+	}
+
+	return nil
+}
+
+// closeActive closes the files of the active segment.
+func (l *Log) closeActive() error {
+	return errors.Join(l.logFile.Close(), l.idxFile.Close())
+}
+
+// rotate seals the active segment by writing its topics file, and starts a new segment.
+func (l *Log) rotate() error {
+	seg := l.segments[len(l.segments)-1]
+	topics := make([]string, 0, len(seg.topics))
+	for t := range seg.topics {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	data, err := json.Marshal(topics)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(l.path(seg.id, topicsExt), data, 0o600); err != nil {
+		return err
+	}
+
+	if err := l.closeActive(); err != nil {
+		return err
+	}
+
+	l.segments = append(l.segments, &segment{id: seg.id + 1, topics: map[string]struct{}{}})
+	return l.openActive()
+}
+
+// Append adds a message to the end of the log. Message times never go backwards, so a
+// message with a time before the last message is recorded with the time of the last message.
+func (l *Log) Append(m Message) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+
+	t := max(m.Time.UnixNano(), l.lastTime)
+	m.Time = time.Unix(0, t)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	if seg.size > 0 && seg.size+int64(headerSize+len(data)) > l.segmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		seg = l.segments[len(l.segments)-1]
+	}
+
+	rec := make([]byte, headerSize, headerSize+len(data))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(data))
+	if _, err := l.logFile.Write(append(rec, data...)); err != nil {
+		return err
+	}
+
+	if _, err := l.idxFile.Write(appendIndexEntry(nil, t, seg.size, m.Topic)); err != nil {
+		return err
+	}
+
+	seg.add(t, m.Topic, int64(headerSize+len(data)))
+	l.lastTime = t
+	return nil
+}
+
+// Size returns the total bytes of the log files of all segments.
+func (l *Log) Size() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	var n int64
+	for _, seg := range l.segments {
+		n += seg.size
+	}
+	return n
+}
+
+// Prune deletes the oldest segments while the log is larger than maxBytes, and the segments
+// whose newest message is older than maxAge at now. A zero limit is unlimited. Whole segments
+// are deleted, so the log may briefly hold up to one segment more than maxBytes.
+func (l *Log) Prune(maxBytes int64, maxAge time.Duration, now time.Time) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+
+	cutoff := int64(math.MinInt64)
+	if maxAge > 0 {
+		cutoff = now.Add(-maxAge).UnixNano()
+	}
+
+	for len(l.segments) > 0 {
+		seg := l.segments[0]
+		if seg.count == 0 || (!(maxBytes > 0 && total > maxBytes) && seg.last >= cutoff) {
+			return nil
+		}
+
+		if len(l.segments) == 1 { // the active segment is sealed before it is deleted.
+			if err := l.rotate(); err != nil {
+				return err
+			}
+		}
+
+		for _, ext := range []string{logExt, indexExt, topicsExt} {
+			if err := os.Remove(l.path(seg.id, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+
+		total -= seg.size
+		l.segments = l.segments[1:]
+	}
+
+	return nil
+}
+
+// Query selects messages from the log.
+type Query struct {
+	Filter string    // the topic filter to match; # if empty
+	Client string    // the id of the client which published the messages; any client if empty
+	From   time.Time // the earliest time of the messages, inclusive; unbounded if zero
+	To     time.Time // the latest time of the messages, inclusive; unbounded if zero
+	Limit  int       // the maximum number of messages; unlimited if zero
+}
+
+// Query returns the messages matching a query, oldest first.
+func (l *Log) Query(q Query) ([]Message, error) {
+	l.RLock()
+	defer l.RUnlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	if q.Filter == "" {
+		q.Filter = "#"
+	}
+
+	start, end := int64(math.MinInt64), int64(math.MaxInt64)
+	if !q.From.IsZero() {
+		start = q.From.UnixNano()
+	}
+	if !q.To.IsZero() {
+		end = q.To.UnixNano()
+	}
+
+	var out []Message
+	for _, seg := range l.segments {
+		if seg.count == 0 || seg.last < start || seg.first > end {
+			continue
+		}
+
+		hashes := map[uint64]struct{}{}
+		for t := range seg.topics {
+			if packets.MatchTopic(q.Filter, t) {
+				hashes[topicHash(t)] = struct{}{}
+			}
+		}
+
+		if len(hashes) == 0 {
+			continue
+		}
+
+		var err error
+		out, err = l.querySegment(seg, q, hashes, start, end, out)
+		if err != nil {
+			return nil, err
+		}
+
+		if q.Limit > 0 && len(out) >= q.Limit {
+			break
+		}
+	}
+
+	return out, nil
+}
+
+// querySegment appends the messages of a segment matching the query to out, using its index
+// to find the first message at or after start and to skip messages with other topics.
+func (l *Log) querySegment(seg *segment, q Query, hashes map[uint64]struct{}, start, end int64, out []Message) ([]Message, error) {
+	idx, err := os.Open(l.path(seg.id, indexExt))
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+
+	logf, err := os.Open(l.path(seg.id, logExt))
+	if err != nil {
+		return nil, err
+	}
+	defer logf.Close()
+
+	entry := make([]byte, indexEntrySize)
+	var searchErr error
+	n := sort.Search(int(seg.count), func(i int) bool {
+		if _, err := idx.ReadAt(entry, int64(i)*indexEntrySize); err != nil {
+			searchErr = err
+			return true
+		}
+		return int64(binary.BigEndian.Uint64(entry)) >= start
+	})
+
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(idx, int64(n)*indexEntrySize, (seg.count-int64(n))*indexEntrySize))
+	for {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return out, nil
+		}
+
+		t := int64(binary.BigEndian.Uint64(entry[0:8]))
+		if t > end {
+			return out, nil
+		}
+
+		if _, ok := hashes[binary.BigEndian.Uint64(entry[16:24])]; !ok {
+			continue
+		}
+
+		offset := int64(binary.BigEndian.Uint64(entry[8:16]))
+		data, err := readRecord(io.NewSectionReader(logf, offset, seg.size-offset))
+		if err != nil {
+			return nil, fmt.Errorf("segment %016x offset %d: %w", seg.id, offset, err)
+		}
+
+		var m Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("segment %016x offset %d: %w", seg.id, offset, ErrCorrupt)
+		}
+
+		if !packets.MatchTopic(q.Filter, m.Topic) { // a hash collision.
+			continue
+		}
+
+		if q.Client != "" && m.Client != q.Client {
+			continue
+		}
+
+		out = append(out, m)
+		if q.Limit > 0 && len(out) >= q.Limit {
+			return out, nil
+		}
+	}
+}
+
+// Close closes the log. The active segment is not sealed, and its index is rebuilt from its
+// log file when the log is next opened.
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	return l.closeActive()
+}
+
+// readRecord reads a record from r, checking its checksum.
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrCorrupt
+	}
+
+	return data, nil
+}
+
+// appendIndexEntry appends the index entry of a record to b.
+func appendIndexEntry(b []byte, t, offset int64, topic string) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(t))
+	b = binary.BigEndian.AppendUint64(b, uint64(offset))
+	return binary.BigEndian.AppendUint64(b, topicHash(topic))
+}
+
+// topicHash returns the hash of a topic stored in the index.
+func topicHash(topic string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(topic))
+	return h.Sum64()
+}
@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package msglog
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Unix(1700000000, 0)
+
+// appendTestMessages appends a message to each topic, one second apart from epoch.
+func appendTestMessages(t *testing.T, l *Log, topics ...string) {
+	for i, topic := range topics {
+		require.NoError(t, l.Append(Message{
+			Time:    epoch.Add(time.Duration(i) * time.Second),
+			Topic:   topic,
+			Payload: []byte(topic),
+			Client:  "zen",
+		}))
+	}
+}
+
+// payloads returns the payloads of messages.
+func payloads(ms []Message) []string {
+	out := make([]string, len(ms))
+	for i, m := range ms {
+		out[i] = string(m.Payload)
+	}
+	return out
+}
+
+func TestLogQuery(t *testing.T) {
+	l, err := Open(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer l.Close()
+	appendTestMessages(t, l, "a/b", "a/c", "x/y", "a/b/c", "a/b")
+
+	ms, err := l.Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, ms, 5)
+	require.Equal(t, "zen", ms[0].Client)
+	require.True(t, epoch.Equal(ms[0].Time))
+
+	ms, err = l.Query(Query{Filter: "a/+"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b", "a/c", "a/b"}, payloads(ms))
+
+	ms, err = l.Query(Query{Filter: "a/#", From: epoch.Add(time.Second), To: epoch.Add(3 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/c", "a/b/c"}, payloads(ms))
+
+	ms, err = l.Query(Query{Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b", "a/c"}, payloads(ms))
+
+	ms, err = l.Query(Query{Filter: "z"})
+	require.NoError(t, err)
+	require.Empty(t, ms)
+
+	require.NoError(t, l.Append(Message{Time: epoch.Add(5 * time.Second), Topic: "a/b", Payload: []byte("other"), Client: "other"}))
+	ms, err = l.Query(Query{Filter: "a/b", Client: "other"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"other"}, payloads(ms))
+}
+
+func TestLogAppendMonotonic(t *testing.T) {
+	l, err := Open(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Append(Message{Time: epoch.Add(time.Second), Topic: "a"}))
+	require.NoError(t, l.Append(Message{Time: epoch, Topic: "b"})) // the clock went backwards.
+
+	ms, err := l.Query(Query{From: epoch.Add(time.Second)})
+	require.NoError(t, err)
+	require.Len(t, ms, 2)
+}
+
+func TestLogRotateAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 128)
+	require.NoError(t, err)
+	appendTestMessages(t, l, "a", "b", "c", "d", "e")
+	require.Greater(t, len(l.segments), 2)
+	size := l.Size()
+	require.NoError(t, l.Close())
+
+	_, err = l.Query(Query{})
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, l.Append(Message{Topic: "a"}), ErrClosed)
+
+	l, err = Open(dir, 128)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, size, l.Size())
+
+	ms, err := l.Query(Query{From: epoch.Add(time.Second), To: epoch.Add(3 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c", "d"}, payloads(ms))
+
+	ms, err = l.Query(Query{Filter: "e"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"e"}, payloads(ms))
+
+	appendTestMessages(t, l, "f")
+	ms, err = l.Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, ms, 6)
+	require.Equal(t, "f", string(ms[5].Payload))
+	require.False(t, ms[5].Time.Before(ms[4].Time)) // times stay monotonic across reopening.
+}
+
+func TestLogOpenTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	require.NoError(t, err)
+	appendTestMessages(t, l, "a", "b")
+	seg := l.segments[len(l.segments)-1]
+	path := l.path(seg.id, logExt)
+	size := seg.size
+	require.NoError(t, l.Close())
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2}) // a record cut short by a crash.
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err = Open(dir, 0)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, size, l.Size())
+
+	appendTestMessages(t, l, "c")
+	ms, err := l.Query(Query{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, payloads(ms))
+}
+
+func TestLogPrune(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 128)
+	require.NoError(t, err)
+	defer l.Close()
+	appendTestMessages(t, l, "a", "b", "c", "d", "e")
+
+	require.NoError(t, l.Prune(0, 0, epoch))
+	require.Len(t, payloadsOf(t, l), 5)
+
+	require.NoError(t, l.Prune(0, 2*time.Second, epoch.Add(5*time.Second)))
+	ms := payloadsOf(t, l)
+	require.NotContains(t, ms, "a")
+	require.Contains(t, ms, "e")
+
+	require.NoError(t, l.Prune(1, 0, epoch))
+	require.Empty(t, payloadsOf(t, l))
+	require.Equal(t, int64(0), l.Size())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2) // only the files of the new active segment are left.
+
+	appendTestMessages(t, l, "f")
+	require.Equal(t, []string{"f"}, payloadsOf(t, l))
+}
+
+// payloadsOf returns the payloads of all the messages in a log.
+func payloadsOf(t *testing.T, l *Log) []string {
+	ms, err := l.Query(Query{})
+	require.NoError(t, err)
+	return payloads(ms)
+}
@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+// Package msglog provides a hook which records every accepted publish in a segmented
+// append-only log on local disk, and queries it by topic filter and time range.
+package msglog
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	// defaultPath is the default directory of the log files.
+	defaultPath = ".msglog"
+
+	// defaultPruneInterval is the default interval at which the retention limits are applied.
+	defaultPruneInterval = time.Minute
+)
+
+// ErrInvalidFilter indicates that a query filter is not a valid topic filter.
+var ErrInvalidFilter = errors.New("invalid query filter")
+
+// Options contains configuration settings for the message log.
+type Options struct {
+	Path          string        `yaml:"path" json:"path"`                 // the directory of the log files; .msglog if empty
+	SegmentSize   int64         `yaml:"segment_size" json:"segment_size"` // the size in bytes at which log files are rotated; 16MB if zero
+	MaxBytes      int64         `yaml:"max_bytes" json:"max_bytes"`       // the total bytes of log files kept; unlimited if zero
+	MaxAge        int64         `yaml:"max_age" json:"max_age"`           // seconds messages are kept; unlimited if zero
+	PruneInterval time.Duration `yaml:"-" json:"-"`                       // the interval at which the retention limits are applied; one minute if zero
+}
+
+// Hook is a storage hook which records every accepted publish in a message log.
+type Hook struct {
+	mqtt.HookBase
+	config *Options      // options for configuring the message log
+	log    *Log          // the message log
+	done   chan struct{} // closed when the hook is stopped
+	pruned chan struct{} // closed when the prune loop has returned
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "message-log"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init opens the message log and starts applying its retention limits.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if len(h.config.Path) == 0 {
+		h.config.Path = defaultPath
+	}
+
+	if h.config.PruneInterval <= 0 {
+		h.config.PruneInterval = defaultPruneInterval
+	}
+
+	var err error
+	h.log, err = Open(h.config.Path, h.config.SegmentSize)
+	if err != nil {
+		return err
+	}
+
+	h.done = make(chan struct{})
+	h.pruned = make(chan struct{})
+	go h.pruneLoop()
+
+	return nil
+}
+
+// Stop closes the message log.
+func (h *Hook) Stop() error {
+	if h.log == nil {
+		return nil
+	}
+
+	close(h.done)
+	<-h.pruned
+	err := h.log.Close()
+	h.log = nil
+	return err
+}
+
+// pruneLoop applies the retention limits of the log at each prune interval until the hook
+// is stopped.
+func (h *Hook) pruneLoop() {
+	defer close(h.pruned)
+	ticker := time.NewTicker(h.config.PruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			h.prune(now)
+		}
+	}
+}
+
+// prune deletes the log segments which are over the retention limits.
+func (h *Hook) prune(now time.Time) {
+	if err := h.log.Prune(h.config.MaxBytes, time.Duration(h.config.MaxAge)*time.Second, now); err != nil {
+		h.Log.Error("failed to prune message log", "error", err)
+	}
+}
+
+// OnPublished records a message accepted from a client.
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if h.log == nil {
+		h.Log.Error("", "error", ErrClosed)
+		return
+	}
+
+	if pk.Ignore {
+		return
+	}
+
+	err := h.log.Append(Message{
+		Time:    time.Now(),
+		Topic:   pk.TopicName,
+		Payload: pk.Payload,
+		Qos:     pk.FixedHeader.Qos,
+		Retain:  pk.FixedHeader.Retain,
+		Client:  cl.ID,
+		User:    pk.Properties.User,
+		Expiry:  pk.Properties.MessageExpiryInterval,
+		Content: pk.Properties.ContentType,
+	})
+	if err != nil {
+		h.Log.Error("failed to record message", "error", err, "client", cl.ID, "topic", pk.TopicName)
+	}
+}
+
+// Query returns the recorded messages matching a query, oldest first.
+func (h *Hook) Query(q Query) ([]Message, error) {
+	if h.log == nil {
+		return nil, ErrClosed
+	}
+
+	if q.Filter != "" && (!mqtt.IsValidFilter(q.Filter, false) || mqtt.IsSharedFilter(q.Filter)) {
+		return nil, ErrInvalidFilter
+	}
+
+	return h.log.Query(q)
+}
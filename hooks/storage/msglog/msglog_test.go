@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package msglog
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{ID: "test"}
+)
+
+// newTestHook returns an initialised hook logging to a temporary directory.
+func newTestHook(t *testing.T) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Path: filepath.Join(t.TempDir(), "log")}))
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "message-log", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnPublished))
+	require.False(t, h.Provides(mqtt.OnRetainMessage))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestInitUseDefaults(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer func() { _ = os.Chdir(wd) }()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	defer h.Stop()
+	require.Equal(t, defaultPath, h.config.Path)
+	require.Equal(t, defaultPruneInterval, h.config.PruneInterval)
+	require.DirExists(t, filepath.Join(dir, defaultPath))
+}
+
+func TestStop(t *testing.T) {
+	h := newTestHook(t)
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+
+	_, err := h.Query(Query{})
+	require.ErrorIs(t, err, ErrClosed)
+	h.OnPublished(client, packets.Packet{TopicName: "a"})
+}
+
+func TestOnPublished(t *testing.T) {
+	h := newTestHook(t)
+	defer h.Stop()
+
+	h.OnPublished(client, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+		Properties: packets.Properties{
+			ContentType: "text/plain",
+			User:        []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	})
+	h.OnPublished(client, packets.Packet{TopicName: "a/c", Ignore: true})
+	h.OnPublished(client, packets.Packet{TopicName: "x/y"})
+
+	ms, err := h.Query(Query{Filter: "a/#"})
+	require.NoError(t, err)
+	require.Len(t, ms, 1)
+	require.Equal(t, "a/b", ms[0].Topic)
+	require.Equal(t, []byte("hello"), ms[0].Payload)
+	require.Equal(t, byte(1), ms[0].Qos)
+	require.True(t, ms[0].Retain)
+	require.Equal(t, "test", ms[0].Client)
+	require.Equal(t, "text/plain", ms[0].Content)
+	require.Equal(t, []packets.UserProperty{{Key: "k", Val: "v"}}, ms[0].User)
+
+	ms, err = h.Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, ms, 2)
+
+	ms, err = h.Query(Query{From: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	require.Empty(t, ms)
+}
+
+func TestQueryInvalidFilter(t *testing.T) {
+	h := newTestHook(t)
+	defer h.Stop()
+
+	for _, f := range []string{"a/#/b", "$share/g/a"} {
+		_, err := h.Query(Query{Filter: f})
+		require.ErrorIs(t, err, ErrInvalidFilter, f)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{
+		Path:          filepath.Join(t.TempDir(), "log"),
+		MaxAge:        1,
+		PruneInterval: time.Millisecond,
+	}))
+	defer h.Stop()
+
+	require.NoError(t, h.log.Append(Message{Time: time.Now().Add(-time.Minute), Topic: "a"}))
+	require.Eventually(t, func() bool {
+		ms, err := h.Query(Query{})
+		return err == nil && len(ms) == 0
+	}, time.Second, time.Millisecond)
+}
@@ -18,6 +18,8 @@ const (
 	RetainedKey     = "RET" // unique key to denote retained messages in a store
 	InflightKey     = "IFM" // unique key to denote inflight messages in a store
 	ClientKey       = "CL"  // unique key to denote clients in a store
+	DelayedKey      = "DLY" // unique key to denote delayed messages in a store
+	DelayedWillKey  = "DWL" // unique key to denote delayed will messages in a store
 )
 
 // ErrDBFileNotOpen indicates that the file database (e.g. bolt/badger) wasn't open for reading.
@@ -89,11 +91,13 @@ type Message struct {
 	ID          string              `json:"id,omitempty" storm:"id"` // the storage key
 	Client      string              `json:"client,omitempty"`        // the client id the message is for
 	Origin      string              `json:"origin,omitempty"`        // the id of the client who sent the message
+	Owner       string              `json:"owner,omitempty"`         // the user or client whose retain quota the message counts against (if delayed)
 	TopicName   string              `json:"topic_name,omitempty"`    // the topic the message was sent to (if retained)
 	FixedHeader packets.FixedHeader `json:"fixedheader"`             // the header properties of the message
 	Created     int64               `json:"created,omitempty"`       // the time the message was created in unixtime
 	Sent        int64               `json:"sent,omitempty"`          // the last time the message was sent (for retries) in unixtime (if inflight)
 	PacketID    uint16              `json:"packet_id,omitempty"`     // the unique id of the packet (if inflight)
+	Due         int64               `json:"due,omitempty"`           // the time the message is due to be published in unixtime (if delayed or a delayed will)
 }
 
 // MessageProperties contains a limited subset of mqtt v5 properties specific to publish messages.
@@ -163,6 +167,7 @@ type Subscription struct {
 	Qos               byte   `json:"qos"`
 	RetainAsPublished bool   `json:"retain_as_pub,omitempty"`
 	NoLocal           bool   `json:"no_local,omitempty"`
+	RewriteTemplate   string `json:"rewrite_template,omitempty"`
 }
 
 // MarshalBinary encodes the values into a json string.
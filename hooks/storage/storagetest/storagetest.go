@@ -0,0 +1,562 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+// Package storagetest provides the conformance tests which every storage backend and storage
+// hook must pass.
+package storagetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/mqtt-server/system"
+)
+
+// RunBackendTests runs the conformance tests for a storage backend. open is called for each
+// test, and must return a new empty backend; it is closed by the test.
+func RunBackendTests(t *testing.T, open func(t *testing.T) storage.Backend) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, b storage.Backend)
+	}{
+		{"GetSetDelete", testBackendGetSetDelete},
+		{"Iterate", testBackendIterate},
+		{"IterateVisitError", testBackendIterateVisitError},
+		{"IterateTypeKey", testBackendIterateTypeKey},
+		{"ValuesAreCopied", testBackendValuesAreCopied},
+		{"Batch", testBackendBatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := open(t)
+			defer func() {
+				require.NoError(t, b.Close())
+			}()
+			tt.test(t, b)
+		})
+	}
+}
+
+func testBackendGetSetDelete(t *testing.T, b storage.Backend) {
+	_, err := b.Get(storage.ClientKey + "_cl1")
+	require.ErrorIs(t, err, storage.ErrKeyNotFound)
+
+	require.NoError(t, b.Set(storage.ClientKey+"_cl1", []byte("a")))
+	v, err := b.Get(storage.ClientKey + "_cl1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), v)
+
+	require.NoError(t, b.Set(storage.ClientKey+"_cl1", []byte("b")))
+	v, err = b.Get(storage.ClientKey + "_cl1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), v)
+
+	require.NoError(t, b.Set(storage.SysInfoKey, []byte("sys")))
+	v, err = b.Get(storage.SysInfoKey)
+	require.NoError(t, err)
+	require.Equal(t, []byte("sys"), v)
+
+	require.NoError(t, b.Delete(storage.ClientKey+"_cl1"))
+	_, err = b.Get(storage.ClientKey + "_cl1")
+	require.ErrorIs(t, err, storage.ErrKeyNotFound)
+	require.NoError(t, b.Delete(storage.ClientKey+"_cl1"))
+}
+
+func testBackendIterate(t *testing.T, b storage.Backend) {
+	require.NoError(t, b.Set(storage.SubscriptionKey+"_cl2:a/b", []byte("3")))
+	require.NoError(t, b.Set(storage.SubscriptionKey+"_cl1:a/c", []byte("2")))
+	require.NoError(t, b.Set(storage.SubscriptionKey+"_cl1:a/b", []byte("1")))
+	require.NoError(t, b.Set(storage.RetainedKey+"_a/b", []byte("r")))
+	require.NoError(t, b.Set(storage.SysInfoKey, []byte("s")))
+
+	var got []string
+	err := b.Iterate(storage.SubscriptionKey, func(v []byte) error {
+		got = append(got, string(v))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, got) // in key order.
+
+	got = nil
+	err = b.Iterate(storage.SubscriptionKey+"_cl1", func(v []byte) error {
+		got = append(got, string(v))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2"}, got)
+
+	got = nil
+	err = b.Iterate(storage.InflightKey, func(v []byte) error {
+		got = append(got, string(v))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func testBackendIterateVisitError(t *testing.T, b storage.Backend) {
+	require.NoError(t, b.Set(storage.ClientKey+"_cl1", []byte("1")))
+	require.NoError(t, b.Set(storage.ClientKey+"_cl2", []byte("2")))
+
+	visitErr := errors.New("visit error")
+	var n int
+	err := b.Iterate(storage.ClientKey, func(v []byte) error {
+		n++
+		return visitErr
+	})
+	require.ErrorIs(t, err, visitErr)
+	require.Equal(t, 1, n)
+}
+
+func testBackendIterateTypeKey(t *testing.T, b storage.Backend) {
+	require.NoError(t, b.Set(storage.SysInfoKey, []byte("s")))
+
+	var got []string
+	err := b.Iterate(storage.SysInfoKey, func(v []byte) error {
+		got = append(got, string(v))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"s"}, got)
+}
+
+func testBackendBatch(t *testing.T, b storage.Backend) {
+	bb, ok := b.(storage.Batcher)
+	if !ok {
+		t.Skip("backend is not a batcher")
+	}
+
+	require.NoError(t, b.Set(storage.ClientKey+"_cl0", []byte("0")))
+	require.NoError(t, bb.Batch([]storage.Op{
+		{Key: storage.ClientKey + "_cl1", Value: []byte("1")},
+		{Key: storage.ClientKey + "_cl2", Value: []byte("2")},
+		{Key: storage.ClientKey + "_cl0", Delete: true},
+		{Key: storage.ClientKey + "_cl1", Delete: true},
+		{Key: storage.ClientKey + "_cl3", Delete: true}, // does not exist.
+		{Key: storage.ClientKey + "_cl2", Value: []byte("22")},
+	}))
+
+	var got []string
+	err := b.Iterate(storage.ClientKey, func(v []byte) error {
+		got = append(got, string(v))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"22"}, got)
+
+	require.NoError(t, bb.Batch(nil))
+}
+
+func testBackendValuesAreCopied(t *testing.T, b storage.Backend) {
+	in := []byte("abc")
+	require.NoError(t, b.Set(storage.RetainedKey+"_a", in))
+	in[0] = 'x'
+
+	v, err := b.Get(storage.RetainedKey + "_a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), v)
+	v[0] = 'y'
+
+	v, err = b.Get(storage.RetainedKey + "_a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), v)
+}
+
+// RunHookTests runs the conformance tests for a storage hook. open is called for each test,
+// and must return a new hook which has been initialised with an empty store; it is stopped
+// by the test.
+func RunHookTests(t *testing.T, open func(t *testing.T) mqtt.Hook) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, h mqtt.Hook)
+	}{
+		{"Provides", testHookProvides},
+		{"OnSessionEstablishedThenOnDisconnect", testHookOnSessionEstablishedThenOnDisconnect},
+		{"OnDisconnectSessionTakenOver", testHookOnDisconnectSessionTakenOver},
+		{"OnWillSent", testHookOnWillSent},
+		{"OnClientExpired", testHookOnClientExpired},
+		{"OnSubscribedThenOnUnsubscribed", testHookOnSubscribedThenOnUnsubscribed},
+		{"OnRetainMessageThenUnset", testHookOnRetainMessageThenUnset},
+		{"OnRetainedExpired", testHookOnRetainedExpired},
+		{"OnQosPublishThenQosComplete", testHookOnQosPublishThenQosComplete},
+		{"OnSysInfoTick", testHookOnSysInfoTick},
+		{"OnDelayedMessageThenRemoved", testHookOnDelayedMessageThenRemoved},
+		{"OnDelayedWillThenRemoved", testHookOnDelayedWillThenRemoved},
+		{"StoredOrder", testHookStoredOrder},
+		{"Stopped", testHookStopped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := open(t)
+			defer func() {
+				require.NoError(t, h.Stop())
+			}()
+			tt.test(t, h)
+		})
+	}
+}
+
+// newClient returns a client for the hook tests.
+func newClient(id string) *mqtt.Client {
+	return &mqtt.Client{
+		ID: id,
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username:        []byte("username"),
+			ProtocolVersion: 5,
+		},
+	}
+}
+
+// newPublish returns a publish packet for the hook tests.
+func newPublish(topic string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+		TopicName:   topic,
+		Payload:     []byte("hello"),
+		PacketID:    2,
+		Created:     1700000000,
+		Origin:      "origin",
+		Properties: packets.Properties{
+			ContentType: "text/plain",
+			User:        []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}
+}
+
+func testHookProvides(t *testing.T, h mqtt.Hook) {
+	for _, b := range []byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnWillSent,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.OnDelayedMessage,
+		mqtt.OnDelayedRemoved,
+		mqtt.OnDelayedWill,
+		mqtt.OnDelayedWillRemoved,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredDelayedMessages,
+		mqtt.StoredDelayedWills,
+	} {
+		require.True(t, h.Provides(b), b)
+	}
+
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func testHookOnSessionEstablishedThenOnDisconnect(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	cl.Properties.Props.SessionExpiryInterval = 30
+	h.OnSessionEstablished(cl, packets.Packet{})
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, cl.ID, r[0].ID)
+	require.Equal(t, storage.ClientKey, r[0].T)
+	require.Equal(t, cl.Net.Remote, r[0].Remote)
+	require.Equal(t, cl.Net.Listener, r[0].Listener)
+	require.Equal(t, cl.Properties.Username, r[0].Username)
+	require.Equal(t, cl.Properties.ProtocolVersion, r[0].ProtocolVersion)
+	require.Equal(t, uint32(30), r[0].Properties.SessionExpiryInterval)
+
+	h.OnDisconnect(cl, nil, false)
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	h.OnDisconnect(cl, nil, true)
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func testHookOnDisconnectSessionTakenOver(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	h.OnSessionEstablished(cl, packets.Packet{})
+	cl.Stop(packets.ErrSessionTakenOver)
+	h.OnDisconnect(cl, nil, true)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1) // the session continues on the new connection.
+}
+
+func testHookOnWillSent(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	cl.Properties.Will.Flag = 1
+	cl.Properties.Will.TopicName = "a/b"
+	h.OnWillSent(cl, packets.Packet{})
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, uint32(1), r[0].Will.Flag)
+	require.Equal(t, "a/b", r[0].Will.TopicName)
+}
+
+func testHookOnClientExpired(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnClientExpired(cl)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func testHookOnSubscribedThenOnUnsubscribed(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	pk := packets.Packet{Filters: packets.Subscriptions{
+		{Filter: "a/b/c", Identifier: 3, NoLocal: true, RetainHandling: 1, RetainAsPublished: true},
+		{Filter: "d/e"},
+	}}
+	h.OnSubscribed(cl, pk, []byte{1, 0})
+
+	r, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.Equal(t, cl.ID, r[0].Client)
+	require.Equal(t, storage.SubscriptionKey, r[0].T)
+	require.Equal(t, "a/b/c", r[0].Filter)
+	require.Equal(t, byte(1), r[0].Qos)
+	require.Equal(t, 3, r[0].Identifier)
+	require.True(t, r[0].NoLocal)
+	require.Equal(t, byte(1), r[0].RetainHandling)
+	require.True(t, r[0].RetainAsPublished)
+	require.Equal(t, "d/e", r[1].Filter)
+
+	h.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}})
+	r, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "d/e", r[0].Filter)
+}
+
+func testHookOnRetainMessageThenUnset(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	pk := newPublish("a/b/c")
+	h.OnRetainMessage(cl, pk, 1)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, storage.RetainedKey, r[0].T)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+	require.Equal(t, pk.FixedHeader, r[0].FixedHeader)
+	require.Equal(t, pk.Created, r[0].Created)
+	require.Equal(t, pk.Origin, r[0].Origin)
+	require.Equal(t, cl.ID, r[0].Client)
+	require.Equal(t, pk.Properties.ContentType, r[0].Properties.ContentType)
+	require.Equal(t, pk.Properties.User, r[0].Properties.User)
+
+	h.OnRetainMessage(cl, pk, -1)
+	r, err = h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func testHookOnRetainedExpired(t *testing.T, h mqtt.Hook) {
+	h.OnRetainMessage(newClient("cl1"), newPublish("a/b/c"), 1)
+	h.OnRetainedExpired("a/b/c")
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func testHookOnQosPublishThenQosComplete(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	pk := newPublish("a/b/c")
+	h.OnQosPublish(cl, pk, 1700000001, 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, storage.InflightKey, r[0].T)
+	require.Equal(t, cl.ID, r[0].Client)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+	require.Equal(t, int64(1700000001), r[0].Sent)
+	require.Equal(t, pk.PacketID, r[0].ToPacket().PacketID)
+
+	h.OnQosComplete(cl, pk)
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+
+	h.OnQosPublish(cl, pk, 1700000001, 0)
+	h.OnQosDropped(cl, pk)
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func testHookOnSysInfoTick(t *testing.T, h mqtt.Hook) {
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, r.Version)
+
+	info := &system.Info{
+		Version:       "2.0.0",
+		BytesReceived: 100,
+	}
+	h.OnSysInfoTick(info)
+
+	r, err = h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, storage.SysInfoKey, r.T)
+	require.Equal(t, info.Version, r.Info.Version)
+	require.Equal(t, info.BytesReceived, r.Info.BytesReceived)
+}
+
+func testHookOnDelayedMessageThenRemoved(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	h.OnDelayedMessage(cl, mqtt.DelayedMessage{
+		ID:     "d1",
+		Client: cl.ID,
+		Owner:  "mochi",
+		Due:    1000,
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   "a/b/c",
+			Payload:     []byte("hello"),
+			Created:     900,
+		},
+	})
+
+	r, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, storage.DelayedKey, r[0].T)
+	require.Equal(t, cl.ID, r[0].Client)
+	require.Equal(t, "mochi", r[0].Owner)
+	require.Equal(t, int64(1000), r[0].Due)
+	require.Equal(t, "a/b/c", r[0].TopicName)
+	require.Equal(t, []byte("hello"), r[0].Payload)
+	require.True(t, r[0].FixedHeader.Retain)
+
+	h.OnDelayedRemoved("d1")
+	r, err = h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func testHookOnDelayedWillThenRemoved(t *testing.T, h mqtt.Hook) {
+	cl := newClient("cl1")
+	pk := newPublish("a/b/c")
+	pk.Expiry = 1000
+	h.OnDelayedWill(cl, pk)
+
+	r, err := h.StoredDelayedWills()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, storage.DelayedWillKey, r[0].T)
+	require.Equal(t, cl.ID, r[0].Client)
+	require.Equal(t, int64(1000), r[0].Due)
+	require.Equal(t, "a/b/c", r[0].TopicName)
+	require.Equal(t, []byte("hello"), r[0].Payload)
+	require.Equal(t, pk.Properties.User, r[0].Properties.User)
+	require.True(t, r[0].FixedHeader.Retain)
+
+	// delayed wills are not returned as delayed messages.
+	delayed, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Empty(t, delayed)
+
+	h.OnDelayedWillRemoved(cl.ID)
+	r, err = h.StoredDelayedWills()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func testHookStoredOrder(t *testing.T, h mqtt.Hook) {
+	for _, id := range []string{"cl3", "cl1", "cl2"} {
+		cl := newClient(id)
+		h.OnSessionEstablished(cl, packets.Packet{})
+		h.OnRetainMessage(cl, newPublish("a/"+id), 1)
+	}
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 3)
+	for i, id := range []string{"cl1", "cl2", "cl3"} {
+		require.Equal(t, id, clients[i].ID)
+	}
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 3)
+	for i, id := range []string{"cl1", "cl2", "cl3"} {
+		require.Equal(t, "a/"+id, retained[i].TopicName)
+	}
+
+	// other types are not returned.
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+}
+
+func testHookStopped(t *testing.T, h mqtt.Hook) {
+	require.NoError(t, h.Stop())
+
+	cl := newClient("cl1")
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnWillSent(cl, packets.Packet{})
+	h.OnDisconnect(cl, nil, true)
+	h.OnClientExpired(cl)
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}}, []byte{0})
+	h.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}})
+	h.OnRetainMessage(cl, newPublish("a"), 1)
+	h.OnRetainedExpired("a")
+	h.OnQosPublish(cl, newPublish("a"), 0, 0)
+	h.OnQosComplete(cl, newPublish("a"))
+	h.OnQosDropped(cl, newPublish("a"))
+	h.OnSysInfoTick(new(system.Info))
+	h.OnDelayedMessage(cl, mqtt.DelayedMessage{ID: "d1"})
+	h.OnDelayedRemoved("d1")
+	h.OnDelayedWill(cl, newPublish("a"))
+	h.OnDelayedWillRemoved(cl.ID)
+
+	_, err := h.StoredClients()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredSubscriptions()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredRetainedMessages()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredInflightMessages()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredDelayedMessages()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredDelayedWills()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredSysInfo()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
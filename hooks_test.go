@@ -170,6 +170,29 @@ func (h *modifiedHookBase) StoredSysInfo() (v storage.SystemInfo, err error) {
 	}, nil
 }
 
+func (h *modifiedHookBase) StoredDelayedMessages() (v []storage.Message, err error) {
+	if h.fail || h.failAt == 6 {
+		return v, errTestHook
+	}
+
+	return []storage.Message{
+		{ID: "d1"},
+		{ID: "d2"},
+		{ID: "d3"},
+	}, nil
+}
+
+func (h *modifiedHookBase) StoredDelayedWills() (v []storage.Message, err error) {
+	if h.fail || h.failAt == 7 {
+		return v, errTestHook
+	}
+
+	return []storage.Message{
+		{ID: "DWL_w1", Client: "w1", TopicName: "wills/w1", Due: 4102444800},
+		{ID: "DWL_w2", Client: "w2", TopicName: "wills/w2", Due: 4102444800},
+	}, nil
+}
+
 type providesCheckHook struct {
 	HookBase
 }
@@ -178,6 +201,15 @@ func (h *providesCheckHook) Provides(b byte) bool {
 	return b == OnConnect
 }
 
+func TestHookConstantsStable(t *testing.T) {
+	// hooks compare and store these values, so new constants are only ever added at the end.
+	require.Equal(t, byte(0), SetOptions)
+	require.Equal(t, byte(22), OnPublishDropped)
+	require.Equal(t, byte(32), OnRetainedExpired)
+	require.Equal(t, byte(37), StoredSysInfo)
+	require.Equal(t, StoredSysInfo+1, OnDelayedMessage)
+}
+
 func TestHooksProvides(t *testing.T) {
 	h := new(Hooks)
 	err := h.Add(new(providesCheckHook), nil)
@@ -245,6 +277,7 @@ func TestHooksNonReturns(t *testing.T) {
 			h.OnUnsubscribed(cl, packets.Packet{})
 			h.OnPublished(cl, packets.Packet{})
 			h.OnPublishDropped(cl, packets.Packet{})
+			h.OnSlowSubscriber(cl, SlowSubscriber{Client: "a"})
 			h.OnRetainMessage(cl, packets.Packet{}, 0)
 			h.OnRetainPublished(cl, packets.Packet{})
 			h.OnQosPublish(cl, packets.Packet{}, time.Now().Unix(), 0)
@@ -254,6 +287,10 @@ func TestHooksNonReturns(t *testing.T) {
 			h.OnWillSent(cl, packets.Packet{})
 			h.OnClientExpired(cl)
 			h.OnRetainedExpired("a/b/c")
+			h.OnDelayedMessage(cl, DelayedMessage{ID: "d1"})
+			h.OnDelayedRemoved("d1")
+			h.OnDelayedWill(cl, packets.Packet{})
+			h.OnDelayedWillRemoved(cl.ID)
 
 			// on second iteration, check added hook methods
 			err := h.Add(new(modifiedHookBase), nil)
@@ -557,6 +594,50 @@ func TestHooksStoredSysInfo(t *testing.T) {
 	require.Equal(t, "", v.Info.Version)
 }
 
+func TestHooksStoredDelayedMessages(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 3)
+
+	hook.fail = true
+	v, err = h.StoredDelayedMessages()
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
+func TestHooksStoredDelayedWills(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredDelayedWills()
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredDelayedWills()
+	require.NoError(t, err)
+	require.Len(t, v, 2)
+
+	hook.fail = true
+	v, err = h.StoredDelayedWills()
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
 func TestHookBaseID(t *testing.T) {
 	h := new(HookBase)
 	require.Equal(t, "base", h.ID())
@@ -631,6 +712,30 @@ func TestHookBaseOnLWT(t *testing.T) {
 	require.Equal(t, "a/b/c", lwt.TopicName)
 }
 
+func TestHookBaseOnAutoSubscribe(t *testing.T) {
+	h := new(HookBase)
+	subs := h.OnAutoSubscribe(new(Client), []AutoSubscription{{Filter: "a/b"}})
+	require.Equal(t, []AutoSubscription{{Filter: "a/b"}}, subs)
+}
+
+func TestHookBaseOnSelectRateLimit(t *testing.T) {
+	h := new(HookBase)
+	limit := h.OnSelectRateLimit(new(Client), RateLimit{Messages: 10})
+	require.Equal(t, RateLimit{Messages: 10}, limit)
+}
+
+func TestHookBaseOnSelectOfflineQueue(t *testing.T) {
+	h := new(HookBase)
+	q := h.OnSelectOfflineQueue(new(Client), OfflineQueue{Messages: 10})
+	require.Equal(t, OfflineQueue{Messages: 10}, q)
+}
+
+func TestHookBaseOnSelectRetainQuota(t *testing.T) {
+	h := new(HookBase)
+	q := h.OnSelectRetainQuota(new(Client), RetainQuota{Messages: 10})
+	require.Equal(t, RetainQuota{Messages: 10}, q)
+}
+
 func TestHookBaseStoredClients(t *testing.T) {
 	h := new(HookBase)
 	v, err := h.StoredClients()
@@ -659,6 +764,20 @@ func TestHookBaseStoredRetainedMessages(t *testing.T) {
 	require.Empty(t, v)
 }
 
+func TestHookBaseStoredDelayedMessages(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestHookBaseStoredDelayedWills(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredDelayedWills()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
 func TestHookBaseStoreSysInfo(t *testing.T) {
 	h := new(HookBase)
 	v, err := h.StoredSysInfo()
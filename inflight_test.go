@@ -71,6 +71,24 @@ func TestInflightClone(t *testing.T) {
 	require.NotSame(t, cloned, cl.State.Inflight)
 }
 
+func TestInflightBytes(t *testing.T) {
+	cl, _, _ := newTestClient()
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1, TopicName: "a/b", Payload: []byte("hello")})
+	cl.State.Inflight.Set(packets.Packet{PacketID: 2, TopicName: "a/b"})
+	require.Equal(t, int64(11), cl.State.Inflight.Bytes())
+
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1}) // eg. replaced by a pubrec.
+	require.Equal(t, int64(3), cl.State.Inflight.Bytes())
+
+	cloned := cl.State.Inflight.Clone()
+	require.Equal(t, int64(3), cloned.Bytes())
+
+	cl.State.Inflight.Delete(2)
+	cl.State.Inflight.Delete(3)
+	require.Equal(t, int64(0), cl.State.Inflight.Bytes())
+	require.Equal(t, int64(3), cloned.Bytes())
+}
+
 func TestInflightDelete(t *testing.T) {
 	cl, _, _ := newTestClient()
 
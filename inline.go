@@ -0,0 +1,467 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+var (
+	ErrInlineClientIDInvalid     = errors.New("inline client id must not be empty")                      // an inline client was created without an id
+	ErrInlineClientIDExists      = errors.New("client id already in use")                                // an inline client id is already used by another client
+	ErrInlineClientClosed        = errors.New("inline client closed")                                    // the inline client has been closed
+	ErrInlineDeliveryIncomplete  = errors.New("message was not acknowledged by every subscriber")        // one or more qos deliveries were dropped or refused
+	ErrInlineSubscriptionUnknown = errors.New("inline subscription not found for filter and identifier") // no matching subscription to unsubscribe
+)
+
+// InlineClient is a named embedded client which publishes and subscribes from within
+// the broker process. Unlike the built-in inline client used by Server.Publish, each
+// InlineClient has its own client id and username, is subject to ACL and topic validity
+// checks, and waits for qos 1 and 2 messages to be acknowledged by every subscriber.
+type InlineClient struct {
+	*Client
+	server *Server
+	stats  InlineClientStats
+	subs   map[inlineSubKey]struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+// InlineClientStats contains message counters for an InlineClient.
+type InlineClientStats struct {
+	MessagesPublished int64 `json:"messages_published"` // messages accepted by the broker from the client
+	MessagesAcked     int64 `json:"messages_acked"`     // qos messages acknowledged by every subscriber
+	MessagesReceived  int64 `json:"messages_received"`  // messages delivered to the client's subscriptions
+	Denied            int64 `json:"denied"`             // publishes, subscriptions and deliveries refused by acl
+}
+
+// inlineSubKey identifies an inline subscription by filter and subscription identifier.
+type inlineSubKey struct {
+	filter string
+	id     int
+}
+
+// NewInlineClient creates a named inline client with its own id and username, and adds it
+// to the server clients. The client is not dependent on Options.InlineClient, and is treated
+// by acl hooks like any other client on the local listener.
+func (s *Server) NewInlineClient(id, username string) (*InlineClient, error) {
+	if id == "" {
+		return nil, ErrInlineClientIDInvalid
+	}
+
+	cl := s.NewClient(nil, LocalListener, id, true)
+	cl.Net.InlineACL = true
+	cl.Properties.Username = []byte(username)
+	if !s.Clients.AddNew(cl) {
+		return nil, ErrInlineClientIDExists
+	}
+
+	return &InlineClient{
+		Client: cl,
+		server: s,
+		subs:   map[inlineSubKey]struct{}{},
+	}, nil
+}
+
+// Publish publishes a message as the inline client. For qos 1 and 2, Publish blocks until
+// every subscriber has acknowledged the message, returning ErrInlineDeliveryIncomplete if
+// any delivery was dropped, or the context error if the context is done first. Delayed
+// messages are complete once they have been scheduled, and are not counted as acked.
+func (ic *InlineClient) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	return ic.PublishPacket(ctx, inlinePublishPacket(topic, payload, retain, qos))
+}
+
+// PublishPacket publishes a publish packet as the inline client, allowing properties to be
+// set. It waits for acknowledgement as described for Publish.
+func (ic *InlineClient) PublishPacket(ctx context.Context, pk packets.Packet) error {
+	d, err := ic.publish(pk)
+	if err != nil {
+		return err
+	}
+
+	return ic.server.deliveries.wait(ctx, d)
+}
+
+// PublishAsync publishes a message as the inline client without blocking. If fn is not nil,
+// it is called with the outcome once every subscriber has acknowledged the message, as
+// described for Publish. For qos 0 messages, fn is called immediately.
+func (ic *InlineClient) PublishAsync(topic string, payload []byte, retain bool, qos byte, fn func(error)) error {
+	d, err := ic.publish(inlinePublishPacket(topic, payload, retain, qos))
+	if err != nil {
+		return err
+	}
+
+	if fn != nil {
+		go func() {
+			fn(ic.server.deliveries.wait(context.Background(), d))
+		}()
+	}
+
+	return nil
+}
+
+// publish injects a publish packet into the broker and returns the delivery tracking
+// its acknowledgement by subscribers.
+func (ic *InlineClient) publish(pk packets.Packet) (*delivery, error) {
+	if ic.isClosed() {
+		return nil, ErrInlineClientClosed
+	}
+
+	pk.FixedHeader.Type = packets.Publish
+	pk.ProtocolVersion = ic.Properties.ProtocolVersion
+
+	d := newDelivery(&ic.stats)
+	err := ic.server.processPublishAcked(ic.Client, pk, d)
+	if err != nil {
+		if errors.Is(err, packets.ErrNotAuthorized) {
+			atomic.AddInt64(&ic.stats.Denied, 1)
+		}
+		d.ignore()
+		d.release()
+		return nil, err
+	}
+
+	atomic.AddInt64(&ic.server.Info.PacketsReceived, 1)
+	atomic.AddInt64(&ic.server.Info.MessagesReceived, 1)
+	atomic.AddInt64(&ic.stats.MessagesPublished, 1)
+	if pk.FixedHeader.Qos == 0 {
+		d.ignore()
+	}
+	d.release()
+
+	return d, nil
+}
+
+// Subscribe adds an inline subscription for the client. The filter is checked against the
+// acl when subscribing, and each message is checked again before the handler is called.
+// Subscription identifiers are shared with all other inline subscriptions on the server.
+func (ic *InlineClient) Subscribe(filter string, subscriptionId int, handler InlineSubFn) error {
+	if ic.isClosed() {
+		return ErrInlineClientClosed
+	}
+
+	if handler == nil {
+		return packets.ErrInlineSubscriptionHandlerInvalid
+	}
+
+	if !IsValidFilter(filter, false) {
+		return packets.ErrTopicFilterInvalid
+	}
+
+	if !ic.server.aclCheck(ic.Client, filter, false) {
+		atomic.AddInt64(&ic.stats.Denied, 1)
+		return packets.ErrNotAuthorized
+	}
+
+	fn := func(_ *Client, sub packets.Subscription, pk packets.Packet) {
+		if !ic.server.aclCheck(ic.Client, pk.TopicName, false) {
+			atomic.AddInt64(&ic.stats.Denied, 1)
+			return
+		}
+		ic.server.grantResponse(ic.Client, pk)
+
+		atomic.AddInt64(&ic.stats.MessagesReceived, 1)
+		handler(ic.Client, sub, pk)
+	}
+
+	ic.mu.Lock()
+	ic.subs[inlineSubKey{filter: filter, id: subscriptionId}] = struct{}{}
+	ic.mu.Unlock()
+
+	if err := ic.server.inlineSubscribe(ic.Client, filter, subscriptionId, fn); err != nil {
+		return err
+	}
+
+	ic.server.inlineRetained(ic.Client, filter, subscriptionId, fn)
+	return nil
+}
+
+// Unsubscribe removes an inline subscription previously added by the client.
+func (ic *InlineClient) Unsubscribe(filter string, subscriptionId int) error {
+	key := inlineSubKey{filter: filter, id: subscriptionId}
+
+	ic.mu.Lock()
+	_, ok := ic.subs[key]
+	delete(ic.subs, key)
+	ic.mu.Unlock()
+
+	if !ok {
+		return ErrInlineSubscriptionUnknown
+	}
+
+	return ic.server.inlineUnsubscribe(ic.Client, filter, subscriptionId)
+}
+
+// Stats returns a snapshot of the message counters for the client.
+func (ic *InlineClient) Stats() InlineClientStats {
+	return InlineClientStats{
+		MessagesPublished: atomic.LoadInt64(&ic.stats.MessagesPublished),
+		MessagesAcked:     atomic.LoadInt64(&ic.stats.MessagesAcked),
+		MessagesReceived:  atomic.LoadInt64(&ic.stats.MessagesReceived),
+		Denied:            atomic.LoadInt64(&ic.stats.Denied),
+	}
+}
+
+// Close removes all of the client's inline subscriptions and removes the client from the
+// server, failing any deliveries to the client. Publishes already in progress continue to
+// be tracked.
+func (ic *InlineClient) Close() {
+	ic.mu.Lock()
+	if ic.closed {
+		ic.mu.Unlock()
+		return
+	}
+	ic.closed = true
+	subs := ic.subs
+	ic.subs = map[inlineSubKey]struct{}{}
+	ic.mu.Unlock()
+
+	for key := range subs {
+		_ = ic.server.inlineUnsubscribe(ic.Client, key.filter, key.id)
+	}
+
+	ic.server.deliveries.drop(ic.ID)
+	ic.server.Clients.Delete(ic.ID)
+}
+
+// isClosed returns true if the inline client has been closed.
+func (ic *InlineClient) isClosed() bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.closed
+}
+
+// inlinePublishPacket returns a publish packet for an inline publish.
+func inlinePublishPacket(topic string, payload []byte, retain bool, qos byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    qos,
+			Retain: retain,
+		},
+		TopicName: topic,
+		Payload:   payload,
+		PacketID:  uint16(qos), // we never process the inbound qos, but we need a packet id for validity checks.
+	}
+}
+
+// nextInlineSubID returns a unique negative inline subscription identifier, which
+// cannot collide with identifiers chosen by the embedding application.
+func (s *Server) nextInlineSubID() int {
+	return int(-atomic.AddInt64(&s.inlineSubID, 1))
+}
+
+// inlineSubscribe adds an inline subscription for an inline client. Retained messages
+// are not delivered, see inlineRetained.
+func (s *Server) inlineSubscribe(cl *Client, filter string, subscriptionId int, handler InlineSubFn) error {
+	if handler == nil {
+		return packets.ErrInlineSubscriptionHandlerInvalid
+	}
+
+	if !IsValidFilter(filter, false) {
+		return packets.ErrTopicFilterInvalid
+	}
+
+	subscription := packets.Subscription{
+		Identifier: subscriptionId,
+		Filter:     filter,
+	}
+
+	pk := s.hooks.OnSubscribe(cl, packets.Packet{ // subscribe like a normal client.
+		Origin:      cl.ID,
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
+		Filters:     packets.Subscriptions{subscription},
+	})
+
+	inlineSubscription := InlineSubscription{
+		Subscription: subscription,
+		Handler:      handler,
+	}
+
+	s.Topics.InlineSubscribe(inlineSubscription)
+	s.hooks.OnSubscribed(cl, pk, []byte{packets.CodeSuccess.Code})
+	return nil
+}
+
+// inlineRetained delivers any retained messages matching the filter to an inline subscription handler.
+func (s *Server) inlineRetained(cl *Client, filter string, subscriptionId int, handler InlineSubFn) {
+	sub := packets.Subscription{
+		Identifier: subscriptionId,
+		Filter:     filter,
+	}
+
+	for _, pkv := range s.Topics.Messages(filter) { // [MQTT-3.8.4-4]
+		handler(cl, sub, pkv)
+	}
+}
+
+// inlineUnsubscribe removes an inline subscription for an inline client.
+func (s *Server) inlineUnsubscribe(cl *Client, filter string, subscriptionId int) error {
+	if !IsValidFilter(filter, false) {
+		return packets.ErrTopicFilterInvalid
+	}
+
+	pk := s.hooks.OnUnsubscribe(cl, packets.Packet{
+		Origin:      cl.ID,
+		FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe},
+		Filters: packets.Subscriptions{
+			{
+				Identifier: subscriptionId,
+				Filter:     filter,
+			},
+		},
+	})
+
+	s.Topics.InlineUnsubscribe(subscriptionId, filter)
+	s.hooks.OnUnsubscribed(cl, pk)
+	return nil
+}
+
+// delivery tracks the acknowledgement of a single inline publish by all of its qos subscribers.
+// It is completed once every registered delivery has been acknowledged or dropped, and the
+// publish itself has finished dispatching to subscribers.
+type delivery struct {
+	pending int64              // outstanding deliveries, plus one held while dispatching
+	failed  int64              // deliveries which were dropped or refused
+	qos0    bool               // the message was published at qos 0 and is not acknowledged
+	stats   *InlineClientStats // the stats of the publishing client
+	done    chan struct{}      // closed when all deliveries are complete
+}
+
+// newDelivery returns a new delivery, pending until it is released after dispatch.
+func newDelivery(stats *InlineClientStats) *delivery {
+	return &delivery{
+		pending: 1,
+		stats:   stats,
+		done:    make(chan struct{}),
+	}
+}
+
+// ignore marks the delivery as not requiring acknowledgement, such as for qos 0.
+func (d *delivery) ignore() {
+	d.qos0 = true
+}
+
+// hold adds a pending delivery.
+func (d *delivery) hold() {
+	atomic.AddInt64(&d.pending, 1)
+}
+
+// release completes a pending delivery, closing the done channel if it was the last.
+func (d *delivery) release() {
+	if atomic.AddInt64(&d.pending, -1) == 0 {
+		if !d.qos0 && atomic.LoadInt64(&d.failed) == 0 && d.stats != nil {
+			atomic.AddInt64(&d.stats.MessagesAcked, 1)
+		}
+		close(d.done)
+	}
+}
+
+// deliveryKey identifies an outbound qos packet by client id and packet id.
+type deliveryKey struct {
+	client string
+	id     uint16
+}
+
+// deliveries is a registry of outbound qos packets which belong to inline client publishes.
+type deliveries struct {
+	internal map[deliveryKey]*delivery
+	count    int64 // the number of registered deliveries, checked before locking
+	sync.Mutex
+}
+
+// add registers an outbound qos packet as part of delivery d.
+func (r *deliveries) add(client string, id uint16, d *delivery) {
+	r.Lock()
+	defer r.Unlock()
+	key := deliveryKey{client: client, id: id}
+	if prev, ok := r.internal[key]; ok { // the packet id was reused, so the previous delivery cannot be acked.
+		atomic.AddInt64(&prev.failed, 1)
+		prev.release()
+	} else {
+		atomic.AddInt64(&r.count, 1)
+	}
+	d.hold()
+	r.internal[key] = d
+}
+
+// complete resolves a registered outbound qos packet, if any, as acknowledged or failed.
+func (r *deliveries) complete(client string, id uint16, ok bool) {
+	if atomic.LoadInt64(&r.count) == 0 {
+		return
+	}
+
+	key := deliveryKey{client: client, id: id}
+	r.Lock()
+	d, exists := r.internal[key]
+	if exists {
+		delete(r.internal, key)
+		atomic.AddInt64(&r.count, -1)
+	}
+	r.Unlock()
+
+	if !exists {
+		return
+	}
+
+	if !ok {
+		atomic.AddInt64(&d.failed, 1)
+	}
+	d.release()
+}
+
+// drop fails all registered outbound qos packets for a client whose session has ended.
+func (r *deliveries) drop(client string) {
+	if atomic.LoadInt64(&r.count) == 0 {
+		return
+	}
+
+	var ds []*delivery
+	r.Lock()
+	for key, d := range r.internal {
+		if key.client == client {
+			delete(r.internal, key)
+			atomic.AddInt64(&r.count, -1)
+			ds = append(ds, d)
+		}
+	}
+	r.Unlock()
+
+	for _, d := range ds {
+		atomic.AddInt64(&d.failed, 1)
+		d.release()
+	}
+}
+
+// forget removes all registered outbound qos packets for a delivery which is no longer awaited.
+func (r *deliveries) forget(d *delivery) {
+	r.Lock()
+	defer r.Unlock()
+	for key, v := range r.internal {
+		if v == d {
+			delete(r.internal, key)
+			atomic.AddInt64(&r.count, -1)
+		}
+	}
+}
+
+// wait blocks until delivery d is complete or the context is done.
+func (r *deliveries) wait(ctx context.Context, d *delivery) error {
+	select {
+	case <-d.done:
+		if atomic.LoadInt64(&d.failed) > 0 {
+			return ErrInlineDeliveryIncomplete
+		}
+		return nil
+	case <-ctx.Done():
+		r.forget(d)
+		return ctx.Err()
+	}
+}
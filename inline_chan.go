@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// OverflowPolicy determines what happens to a message published to an inline
+// subscription channel which is full.
+type OverflowPolicy byte
+
+const (
+	OverflowBlock      OverflowPolicy = iota // wait until the receiver makes room, stalling the publish
+	OverflowDropOldest                       // discard the oldest buffered message to make room
+	OverflowDropNewest                       // discard the message being published
+)
+
+const defaultInlineChanBuffer = 64
+
+// SubscribeChanOptions contains options for an inline channel subscription.
+type SubscribeChanOptions struct {
+	Buffer         int            // the capacity of the channel, default 64
+	Overflow       OverflowPolicy // the policy for messages published to a full channel
+	SubscriptionId int            // the inline subscription identifier; if 0, a unique negative identifier is assigned
+}
+
+// inlineChan is an inline subscription which delivers messages to a bounded channel.
+type inlineChan struct {
+	ch     chan packets.Packet
+	done   chan struct{}
+	policy OverflowPolicy
+	info   *int64 // the server counter for dropped messages
+	closed bool
+	once   sync.Once
+	sync.RWMutex
+}
+
+// SubscribeChan adds an inline subscription for the specified topic filter which delivers
+// messages to the returned channel instead of calling a handler, so a slow receiver does not
+// stall delivery to other subscribers unless the OverflowBlock policy is used. Messages dropped
+// due to a full channel are counted in Info.InlineDropped. The returned cancel function removes
+// the subscription and closes the channel; it is safe to call more than once.
+func (s *Server) SubscribeChan(filter string, opts *SubscribeChanOptions) (<-chan packets.Packet, func(), error) {
+	if !s.Options.InlineClient {
+		return nil, nil, ErrInlineClientNotEnabled
+	}
+
+	if opts == nil {
+		opts = new(SubscribeChanOptions)
+	}
+
+	size := opts.Buffer
+	if size <= 0 {
+		size = defaultInlineChanBuffer
+	}
+
+	id := opts.SubscriptionId
+	if id == 0 {
+		id = s.nextInlineSubID()
+	}
+
+	c := &inlineChan{
+		ch:     make(chan packets.Packet, size),
+		done:   make(chan struct{}),
+		policy: opts.Overflow,
+		info:   &s.Info.InlineDropped,
+	}
+
+	if err := s.inlineSubscribe(s.inlineClient, filter, id, c.handle); err != nil {
+		return nil, nil, err
+	}
+
+	cancel := func() {
+		c.once.Do(func() {
+			close(c.done) // release any blocked publishes before waiting for the lock.
+			_ = s.inlineUnsubscribe(s.inlineClient, filter, id)
+			c.Lock()
+			c.closed = true
+			close(c.ch)
+			c.Unlock()
+		})
+	}
+
+	if c.policy == OverflowBlock { // retained messages may exceed the buffer before the channel is returned.
+		go s.inlineRetained(s.inlineClient, filter, id, c.handle)
+	} else {
+		s.inlineRetained(s.inlineClient, filter, id, c.handle)
+	}
+
+	return c.ch, cancel, nil
+}
+
+// handle is the inline subscription handler which sends messages to the channel
+// according to the overflow policy.
+func (c *inlineChan) handle(_ *Client, _ packets.Subscription, pk packets.Packet) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.ch <- pk:
+		return
+	default:
+	}
+
+	switch c.policy {
+	case OverflowDropNewest:
+		atomic.AddInt64(c.info, 1)
+	case OverflowDropOldest:
+		for {
+			select {
+			case c.ch <- pk:
+				return
+			default:
+			}
+
+			select {
+			case <-c.ch:
+				atomic.AddInt64(c.info, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case c.ch <- pk:
+		case <-c.done:
+			atomic.AddInt64(c.info, 1)
+		}
+	}
+}
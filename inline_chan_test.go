@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+func TestSubscribeChanNotEnabled(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	_, _, err := s.SubscribeChan("a/b", nil)
+	require.ErrorIs(t, err, ErrInlineClientNotEnabled)
+}
+
+func TestSubscribeChanInvalidFilter(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	_, _, err := s.SubscribeChan("a/#/b", nil)
+	require.ErrorIs(t, err, packets.ErrTopicFilterInvalid)
+}
+
+func TestSubscribeChan(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	ch, cancel, err := s.SubscribeChan("a/#", nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultInlineChanBuffer, cap(ch))
+
+	subs := s.Topics.Subscribers("a/b").InlineSubscriptions
+	require.Len(t, subs, 1)
+	for id := range subs {
+		require.Equal(t, -1, id)
+	}
+
+	require.NoError(t, s.Publish("a/b", []byte("hello"), false, 0))
+	pk := <-ch
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+
+	cancel()
+	cancel() // coverage: cancel cancelled
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Len(t, s.Topics.Subscribers("a/b").InlineSubscriptions, 0)
+	require.NoError(t, s.Publish("a/b", []byte("hello"), false, 0))
+}
+
+func TestSubscribeChanRetained(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Publish("a/"+strconv.Itoa(i), []byte("retained"), true, 0))
+	}
+
+	ch, cancel, err := s.SubscribeChan("a/#", &SubscribeChanOptions{Buffer: 1, Overflow: OverflowBlock, SubscriptionId: 7})
+	require.NoError(t, err)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case pk := <-ch:
+			require.Equal(t, []byte("retained"), pk.Payload)
+		case <-time.After(time.Second):
+			t.Fatal("retained message not received")
+		}
+	}
+}
+
+func TestSubscribeChanDropNewest(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	ch, cancel, err := s.SubscribeChan("a/b", &SubscribeChanOptions{Buffer: 2, Overflow: OverflowDropNewest})
+	require.NoError(t, err)
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, s.Publish("a/b", []byte(strconv.Itoa(i)), false, 0))
+	}
+
+	require.Equal(t, []byte("0"), (<-ch).Payload)
+	require.Equal(t, []byte("1"), (<-ch).Payload)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.InlineDropped))
+}
+
+func TestSubscribeChanDropOldest(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	ch, cancel, err := s.SubscribeChan("a/b", &SubscribeChanOptions{Buffer: 2, Overflow: OverflowDropOldest})
+	require.NoError(t, err)
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, s.Publish("a/b", []byte(strconv.Itoa(i)), false, 0))
+	}
+
+	require.Equal(t, []byte("2"), (<-ch).Payload)
+	require.Equal(t, []byte("3"), (<-ch).Payload)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.InlineDropped))
+}
+
+func TestSubscribeChanBlock(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	ch, cancel, err := s.SubscribeChan("a/b", &SubscribeChanOptions{Buffer: 1, Overflow: OverflowBlock})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Publish("a/b", []byte("0"), false, 0))
+
+	published := make(chan struct{})
+	go func() {
+		_ = s.Publish("a/b", []byte("1"), false, 0)
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("publish did not block on full channel")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	require.Equal(t, []byte("0"), (<-ch).Payload)
+	<-published
+	require.Equal(t, []byte("1"), (<-ch).Payload)
+
+	released := make(chan struct{})
+	go func() {
+		_ = s.Publish("a/b", []byte("2"), false, 0) // fills the buffer
+		_ = s.Publish("a/b", []byte("3"), false, 0) // blocks until cancelled
+		close(released)
+	}()
+	require.Eventually(t, func() bool { return len(ch) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	<-released
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.InlineDropped))
+}
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// UsernameHook allows all connections, and access only to topics prefixed by the client username.
+type UsernameHook struct {
+	HookBase
+}
+
+func (h *UsernameHook) ID() string {
+	return "username-hook"
+}
+
+func (h *UsernameHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck}, []byte{b})
+}
+
+func (h *UsernameHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool { return true }
+func (h *UsernameHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return strings.HasPrefix(topic, string(cl.Properties.Username)+"/")
+}
+
+func TestNewInlineClient(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	_, err := s.NewInlineClient("", "svc")
+	require.ErrorIs(t, err, ErrInlineClientIDInvalid)
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+	require.Equal(t, "svc-1", ic.ID)
+	require.Equal(t, []byte("svc"), ic.Properties.Username)
+	require.True(t, ic.Net.Inline)
+	require.True(t, ic.Net.InlineACL)
+	require.Equal(t, LocalListener, ic.Net.Listener)
+
+	cl, ok := s.Clients.Get("svc-1")
+	require.True(t, ok)
+	require.Equal(t, ic.Client, cl)
+
+	_, err = s.NewInlineClient("svc-1", "svc")
+	require.ErrorIs(t, err, ErrInlineClientIDExists)
+}
+
+func TestInlineClientACL(t *testing.T) {
+	s, _ := newMemoryTestServer(t, &Options{}, new(UsernameHook))
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+
+	require.ErrorIs(t, ic.Publish(context.Background(), "other/a", []byte("x"), false, 0), packets.ErrNotAuthorized)
+	require.ErrorIs(t, ic.Publish(context.Background(), "svc/#", []byte("x"), false, 0), packets.ErrTopicNameInvalid)
+	require.ErrorIs(t, ic.Subscribe("other/#", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {}), packets.ErrNotAuthorized)
+	require.Equal(t, int64(2), ic.Stats().Denied)
+	require.Equal(t, int64(0), ic.Stats().MessagesPublished)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.MessagesReceived))
+}
+
+func TestInlineClientPublishSubscribe(t *testing.T) {
+	s, _ := newMemoryTestServer(t, &Options{}, new(UsernameHook))
+
+	pub, err := s.NewInlineClient("svc-pub", "svc")
+	require.NoError(t, err)
+	sub, err := s.NewInlineClient("svc-sub", "svc")
+	require.NoError(t, err)
+
+	got := make(chan packets.Packet, 1)
+	require.NoError(t, sub.Subscribe("svc/#", 1, func(cl *Client, _ packets.Subscription, pk packets.Packet) {
+		require.Equal(t, "svc-sub", cl.ID)
+		got <- pk
+	}))
+
+	require.NoError(t, pub.Publish(context.Background(), "svc/a", []byte("hello"), false, 1))
+	select {
+	case pk := <-got:
+		require.Equal(t, "svc-pub", pk.Origin)
+		require.Equal(t, "hello", string(pk.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	require.Equal(t, InlineClientStats{MessagesPublished: 1, MessagesAcked: 1}, pub.Stats())
+	require.Equal(t, int64(1), sub.Stats().MessagesReceived)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesReceived))
+
+	require.ErrorIs(t, sub.Unsubscribe("svc/#", 2), ErrInlineSubscriptionUnknown)
+	require.NoError(t, sub.Unsubscribe("svc/#", 1))
+	require.NoError(t, pub.Publish(context.Background(), "svc/a", []byte("hello"), false, 0))
+	require.Equal(t, int64(1), sub.Stats().MessagesReceived)
+}
+
+func TestInlineClientPublishAcked(t *testing.T) {
+	s, l := newMemoryTestServer(t, &Options{}, new(UsernameHook))
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+
+	subs := make([]*client.Client, 2)
+	for i := range subs {
+		subs[i] = connectMemoryTestClient(t, l, "sub-"+string(rune('a'+i)), "svc", nil)
+		_, err = subs[i].Subscribe(context.Background(), func(c *client.Client, pk packets.Packet) {},
+			packets.Subscription{Filter: "svc/#", Qos: byte(i + 1)})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, ic.Publish(ctx, "svc/a", []byte("hello"), false, 2))
+	require.Equal(t, int64(1), ic.Stats().MessagesAcked)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.deliveries.count))
+
+	done := make(chan error, 1)
+	require.NoError(t, ic.PublishAsync("svc/b", []byte("hello"), false, 1, func(err error) {
+		done <- err
+	}))
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish not acknowledged")
+	}
+	require.Equal(t, int64(2), ic.Stats().MessagesAcked)
+}
+
+func TestInlineClientPublishOfflineSubscriber(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+
+	cl := s.NewClient(nil, "tcp", "offline", false)
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "svc/#", Qos: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, ic.Publish(ctx, "svc/a", []byte("hello"), false, 1), context.DeadlineExceeded)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.deliveries.count))
+	require.Equal(t, 1, cl.State.Inflight.Len()) // retained for the session
+
+	done := make(chan error, 1)
+	require.NoError(t, ic.PublishAsync("svc/a", []byte("hello"), false, 1, func(err error) {
+		done <- err
+	}))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.deliveries.count))
+
+	s.deliveries.drop(cl.ID) // the session expired
+	require.ErrorIs(t, <-done, ErrInlineDeliveryIncomplete)
+	require.Equal(t, int64(0), ic.Stats().MessagesAcked)
+}
+
+func TestInlineClientPublishAckReason(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+
+	cl := s.NewClient(nil, "tcp", "offline", false)
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "svc/#", Qos: 1})
+
+	done := make(chan error, 1)
+	require.NoError(t, ic.PublishAsync("svc/a", []byte("hello"), false, 1, func(err error) {
+		done <- err
+	}))
+
+	pk, ok := cl.State.Inflight.Get(1)
+	require.True(t, ok)
+	require.NoError(t, s.processPuback(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Puback},
+		PacketID:    pk.PacketID,
+		ReasonCode:  packets.ErrNotAuthorized.Code,
+	}))
+	require.ErrorIs(t, <-done, ErrInlineDeliveryIncomplete)
+}
+
+func TestInlineClientPublishDelayed(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+
+	cl := s.NewClient(nil, "tcp", "offline", false)
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "svc/#", Qos: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, ic.Publish(ctx, DelayedPrefix+"5/svc/a", []byte("hello"), false, 1))
+	require.Equal(t, InlineClientStats{MessagesPublished: 1}, ic.Stats())
+	require.Equal(t, 1, s.loop.delayed.Len())
+
+	s.sendDelayedMessages(time.Now().Unix() + 5)
+	require.Equal(t, 1, cl.State.Inflight.Len())
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.deliveries.count))
+}
+
+func TestInlineClientClose(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	ic, err := s.NewInlineClient("svc-1", "svc")
+	require.NoError(t, err)
+	require.NoError(t, ic.Subscribe("svc/#", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {}))
+	require.Len(t, s.Topics.Subscribers("svc/a").InlineSubscriptions, 1)
+
+	d := newDelivery(nil)
+	s.deliveries.add(ic.ID, 1, d)
+	d.release()
+
+	ic.Close()
+	ic.Close() // coverage: close closed
+	require.ErrorIs(t, s.deliveries.wait(context.Background(), d), ErrInlineDeliveryIncomplete)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.deliveries.count))
+	require.Len(t, s.Topics.Subscribers("svc/a").InlineSubscriptions, 0)
+	_, ok := s.Clients.Get("svc-1")
+	require.False(t, ok)
+
+	require.ErrorIs(t, ic.Publish(context.Background(), "svc/a", nil, false, 0), ErrInlineClientClosed)
+	require.ErrorIs(t, ic.Subscribe("svc/#", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {}), ErrInlineClientClosed)
+}
+
+func TestServerPublishInlineTrusted(t *testing.T) {
+	s := New(&Options{Logger: logger, InlineClient: true})
+	require.NoError(t, s.AddHook(new(DenyHook), nil))
+	defer s.Close()
+
+	require.NoError(t, s.Publish("any/topic", []byte("x"), false, 1))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesReceived))
+}
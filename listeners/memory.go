@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"log/slog"
+)
+
+const TypeMemory = "memory"
+
+// ErrListenerClosed indicates a connection was dialed to a listener which has been closed.
+var ErrListenerClosed = errors.New("listener closed")
+
+// Memory is a listener for establishing client connections entirely in memory,
+// without opening a network socket. Connections are created with Dial, and are
+// established by the server in the same way as network clients.
+type Memory struct {
+	sync.RWMutex
+	id      string        // the internal id of the listener
+	address string        // the nominal address of the listener, used as the local address of connections
+	config  Config        // configuration values for the listener
+	conns   chan net.Conn // server-side ends of dialed connections, awaiting establishment
+	done    chan struct{} // closed when the listener is closed
+	log     *slog.Logger  // server logger
+	dialed  uint64        // the number of connections dialed, used to generate remote addresses
+	end     uint32        // ensure the close methods are only called once
+}
+
+// NewMemory initializes and returns a new in-memory listener.
+func NewMemory(config Config) *Memory {
+	if config.Address == "" {
+		config.Address = config.ID
+	}
+
+	return &Memory{
+		id:      config.ID,
+		address: config.Address,
+		config:  config,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+}
+
+// ID returns the id of the listener.
+func (l *Memory) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *Memory) Address() string {
+	return l.address
+}
+
+// Protocol returns the protocol of the listener.
+func (l *Memory) Protocol() string {
+	return TypeMemory
+}
+
+// Init initializes the listener.
+func (l *Memory) Init(log *slog.Logger) error {
+	l.log = log
+	return nil
+}
+
+// Serve starts waiting for dialed connections, and calls the establish
+// connection callback for any received.
+func (l *Memory) Serve(establish EstablishFn) {
+	for {
+		select {
+		case <-l.done:
+			return
+		case conn := <-l.conns:
+			go func() {
+				err := establish(l.id, conn)
+				if err != nil {
+					l.log.Warn("", "error", err)
+				}
+			}()
+		}
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *Memory) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+		close(l.done)
+	}
+}
+
+// Dial opens a new in-memory connection to the listener. The connection is
+// given a generated remote address of the form memory:{n}.
+func (l *Memory) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background(), "")
+}
+
+// DialFrom opens a new in-memory connection to the listener which reports
+// remote as its remote address, so rules which match on the client address
+// (such as auth ledger remote rules) can be exercised.
+func (l *Memory) DialFrom(remote string) (net.Conn, error) {
+	return l.DialContext(context.Background(), remote)
+}
+
+// DialContext opens a new in-memory connection to the listener with an optional
+// remote address, waiting until the listener accepts it or the context is done.
+func (l *Memory) DialContext(ctx context.Context, remote string) (net.Conn, error) {
+	n := atomic.AddUint64(&l.dialed, 1)
+	if remote == "" {
+		remote = TypeMemory + ":" + strconv.FormatUint(n, 10)
+	}
+
+	local := memoryAddr(l.address)
+	client, server := net.Pipe()
+	sc := &memoryConn{Conn: server, local: local, remote: memoryAddr(remote)}
+	cc := &memoryConn{Conn: client, local: memoryAddr(remote), remote: local}
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+	case l.conns <- sc:
+		return cc, nil
+	}
+
+	_ = client.Close()
+	_ = server.Close()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrListenerClosed
+}
+
+// memoryAddr is the address of one end of an in-memory connection.
+type memoryAddr string
+
+// Network returns the network name of the address.
+func (a memoryAddr) Network() string {
+	return TypeMemory
+}
+
+// String returns the address.
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+// memoryConn is one end of an in-memory connection with configurable addresses.
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the connection.
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMemory(t *testing.T) {
+	l := NewMemory(basicConfig)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+
+	l = NewMemory(Config{ID: "m1"})
+	require.Equal(t, "m1", l.Address())
+}
+
+func TestMemoryID(t *testing.T) {
+	l := NewMemory(basicConfig)
+	require.Equal(t, "t1", l.ID())
+}
+
+func TestMemoryAddress(t *testing.T) {
+	l := NewMemory(basicConfig)
+	require.Equal(t, testAddr, l.Address())
+}
+
+func TestMemoryProtocol(t *testing.T) {
+	l := NewMemory(basicConfig)
+	require.Equal(t, "memory", l.Protocol())
+}
+
+func TestMemoryInit(t *testing.T) {
+	l := NewMemory(basicConfig)
+	require.NoError(t, l.Init(logger))
+	require.Equal(t, logger, l.log)
+}
+
+func TestMemoryServeAndClose(t *testing.T) {
+	l := NewMemory(basicConfig)
+	require.NoError(t, l.Init(logger))
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+
+	_, err := l.Dial()
+	require.ErrorIs(t, err, ErrListenerClosed)
+}
+
+func TestMemoryDialEstablish(t *testing.T) {
+	l := NewMemory(basicConfig)
+	require.NoError(t, l.Init(logger))
+
+	established := make(chan net.Conn, 2)
+	go l.Serve(func(id string, c net.Conn) error {
+		require.Equal(t, "t1", id)
+		established <- c
+		return errors.New("ending") // return an error to exit immediately
+	})
+	defer l.Close(MockCloser)
+
+	cc, err := l.Dial()
+	require.NoError(t, err)
+	sc := <-established
+	require.Equal(t, "memory:1", sc.RemoteAddr().String())
+	require.Equal(t, "memory", sc.RemoteAddr().Network())
+	require.Equal(t, testAddr, sc.LocalAddr().String())
+	require.Equal(t, testAddr, cc.RemoteAddr().String())
+	require.Equal(t, "memory:1", cc.LocalAddr().String())
+
+	go func() {
+		_, _ = cc.Write([]byte{1, 2, 3})
+	}()
+	b := make([]byte, 3)
+	_, err = sc.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, b)
+
+	cc, err = l.DialFrom("10.0.0.1:1234")
+	require.NoError(t, err)
+	sc = <-established
+	require.Equal(t, "10.0.0.1:1234", sc.RemoteAddr().String())
+	require.Equal(t, "10.0.0.1:1234", cc.LocalAddr().String())
+}
+
+func TestMemoryDialContextCancelled(t *testing.T) {
+	l := NewMemory(basicConfig) // not serving, so dials are never accepted
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := l.DialContext(ctx, "")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	memoryCheckInterval = 100 * time.Millisecond // the interval between memory usage checks
+)
+
+const (
+	memoryOk   int32 = iota // memory usage is under the limits
+	memorySoft              // memory usage is over the soft limit
+	memoryHard              // memory usage is over the hard limit
+)
+
+// MemoryBudget sets limits on the bytes of messages held by the broker in client outbound
+// queues, inflight messages and retained messages. A zero limit is disabled.
+type MemoryBudget struct {
+	SoftLimit int64 `yaml:"soft_limit" json:"soft_limit"` // bytes over which reads from publishing clients are paused
+	HardLimit int64 `yaml:"hard_limit" json:"hard_limit"` // bytes over which new connections are refused and qos 0 outbound messages are dropped
+}
+
+// enabled returns true if either limit of the memory budget is set.
+func (b MemoryBudget) enabled() bool {
+	return b.SoftLimit > 0 || b.HardLimit > 0
+}
+
+// memoryState tracks whether memory usage is over the limits of the memory budget.
+type memoryState struct {
+	sync.RWMutex
+	level  int32         // the current memoryOk, memorySoft, or memoryHard level
+	relief chan struct{} // closed when the usage falls back under the soft limit
+}
+
+// newMemoryState returns a new instance of memoryState.
+func newMemoryState() *memoryState {
+	return &memoryState{
+		relief: make(chan struct{}),
+	}
+}
+
+// Level returns the current memory usage level.
+func (m *memoryState) Level() int32 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.level
+}
+
+// paused returns a channel which is closed when memory usage falls back under the soft
+// limit, or nil if the usage is not over the soft limit.
+func (m *memoryState) paused() <-chan struct{} {
+	m.RLock()
+	defer m.RUnlock()
+	if m.level == memoryOk {
+		return nil
+	}
+	return m.relief
+}
+
+// set sets the memory usage level, returning true if it changed.
+func (m *memoryState) set(level int32) bool {
+	m.Lock()
+	defer m.Unlock()
+	if level == m.level {
+		return false
+	}
+
+	if level == memoryOk {
+		close(m.relief)
+	} else if m.level == memoryOk {
+		m.relief = make(chan struct{})
+	}
+
+	m.level = level
+	return true
+}
+
+// parkedMessages is the packet ids of the qos messages of a client which were kept inflight
+// without being sent while memory usage was over the hard limit.
+type parkedMessages struct {
+	sync.Mutex
+	ids []uint16
+}
+
+// add adds the packet id of a parked message.
+func (p *parkedMessages) add(id uint16) {
+	p.Lock()
+	defer p.Unlock()
+	p.ids = append(p.ids, id)
+}
+
+// take removes and returns the packet ids of all parked messages, in the order they were parked.
+func (p *parkedMessages) take() []uint16 {
+	p.Lock()
+	defer p.Unlock()
+	ids := p.ids
+	p.ids = nil
+	return ids
+}
+
+// checkMemory totals the bytes held in outbound queues, inflight messages and retained
+// messages, updating the server info and the memory usage level. It is called at each
+// memory check interval while the memory budget is enabled, and with each $SYS update.
+func (s *Server) checkMemory() {
+	var outbound, inflight int64
+	s.Clients.RLock()
+	for _, cl := range s.Clients.internal {
+		outbound += atomic.LoadInt64(&cl.State.outboundBytes)
+		inflight += cl.State.Inflight.Bytes()
+	}
+	s.Clients.RUnlock()
+	retained := s.Topics.Retained.Bytes()
+
+	atomic.StoreInt64(&s.Info.MemoryOutbound, outbound)
+	atomic.StoreInt64(&s.Info.MemoryInflight, inflight)
+	atomic.StoreInt64(&s.Info.MemoryRetained, retained)
+
+	budget := s.Options.MemoryBudget
+	total := outbound + inflight + retained
+	level := memoryOk
+	switch {
+	case budget.HardLimit > 0 && total > budget.HardLimit:
+		level = memoryHard
+	case budget.SoftLimit > 0 && total > budget.SoftLimit:
+		level = memorySoft
+	}
+
+	previous := s.memory.Level()
+	if s.memory.set(level) {
+		s.Log.Warn("memory budget level changed", "level", level, "bytes", total,
+			"soft_limit", budget.SoftLimit, "hard_limit", budget.HardLimit)
+		if previous == memoryHard {
+			s.releaseParked()
+		}
+	}
+}
+
+// releaseParked queues the parked messages of all clients to be sent, once memory usage
+// falls back under the hard limit. The messages are already inflight and counted against
+// the send quota, so are only queued. A message which has since expired is skipped, and a
+// message which cannot be queued stays parked, or inflight to be resent on reconnect.
+func (s *Server) releaseParked() {
+	for _, cl := range s.Clients.GetAll() {
+		for _, id := range cl.State.parked.take() {
+			pk, ok := cl.State.Inflight.Get(id)
+			if !ok || cl.Closed() {
+				continue
+			}
+
+			out := pk
+			if !s.enqueueOutbound(cl, pk, &out, false) {
+				cl.State.parked.add(id)
+			}
+		}
+	}
+}
+
+// memoryBackpressure pauses reading from a publishing client while memory usage is over the
+// soft limit. A publish is paused until the usage falls back under the soft limit. Returns
+// false if the client was closed while paused.
+func (s *Server) memoryBackpressure(cl *Client) bool {
+	relief := s.memory.paused()
+	if relief == nil {
+		return true
+	}
+
+	select {
+	case <-relief:
+		return true
+	case <-cl.State.open.Done():
+		return false
+	}
+}
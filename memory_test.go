@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+func TestMemoryStateSet(t *testing.T) {
+	m := newMemoryState()
+	require.Equal(t, memoryOk, m.Level())
+	require.Nil(t, m.paused())
+	require.False(t, m.set(memoryOk))
+
+	require.True(t, m.set(memorySoft))
+	relief := m.paused()
+	require.NotNil(t, relief)
+
+	require.True(t, m.set(memoryHard))
+	require.Equal(t, relief, m.paused()) // still paused by the same relief.
+
+	require.True(t, m.set(memoryOk))
+	require.Nil(t, m.paused())
+	select {
+	case <-relief:
+	default:
+		t.Fatal("relief not closed")
+	}
+
+	require.True(t, m.set(memorySoft))
+	require.NotEqual(t, relief, m.paused())
+}
+
+func TestMemoryBudgetEnabled(t *testing.T) {
+	require.False(t, MemoryBudget{}.enabled())
+	require.True(t, MemoryBudget{SoftLimit: 1}.enabled())
+	require.True(t, MemoryBudget{HardLimit: 1}.enabled())
+}
+
+func TestServerCheckMemory(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+	atomic.StoreInt64(&cl.State.outboundBytes, 100)
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1, Payload: make([]byte, 200)})
+	s.Topics.RetainMessage(packets.Packet{TopicName: "a/b", Payload: make([]byte, 297)})
+
+	s.checkMemory()
+	require.Equal(t, int64(100), atomic.LoadInt64(&s.Info.MemoryOutbound))
+	require.Equal(t, int64(200), atomic.LoadInt64(&s.Info.MemoryInflight))
+	require.Equal(t, int64(300), atomic.LoadInt64(&s.Info.MemoryRetained))
+	require.Equal(t, memoryOk, s.memory.Level()) // no limits are set.
+
+	s.Options.MemoryBudget = MemoryBudget{SoftLimit: 500, HardLimit: 1000}
+	s.checkMemory()
+	require.Equal(t, memorySoft, s.memory.Level())
+
+	atomic.StoreInt64(&cl.State.outboundBytes, 600)
+	s.checkMemory()
+	require.Equal(t, memoryHard, s.memory.Level())
+
+	s.Options.MemoryBudget.HardLimit = 0
+	s.checkMemory()
+	require.Equal(t, memorySoft, s.memory.Level())
+
+	s.Topics.RetainMessage(packets.Packet{TopicName: "a/b"})
+	atomic.StoreInt64(&cl.State.outboundBytes, 0)
+	s.checkMemory()
+	require.Equal(t, memoryOk, s.memory.Level())
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.MemoryRetained))
+}
+
+func TestServerMemoryBackpressure(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	require.True(t, s.memoryBackpressure(cl))
+
+	s.memory.set(memorySoft)
+	done := make(chan bool)
+	go func() {
+		done <- s.memoryBackpressure(cl)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("publish not paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.memory.set(memoryOk)
+	require.True(t, <-done)
+
+	s.memory.set(memorySoft)
+	go func() {
+		done <- s.memoryBackpressure(cl)
+	}()
+	cl.Stop(packets.ErrServerShuttingDown)
+	require.False(t, <-done)
+}
+
+func TestPublishToClientOutboundBytes(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+
+	pk := packets.Packet{TopicName: "a/b", Payload: []byte("hello")}
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.NoError(t, err)
+	require.Equal(t, int64(8), atomic.LoadInt64(&cl.State.outboundBytes))
+
+	s.memory.set(memoryHard)
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk.Copy(false))
+	require.ErrorIs(t, err, packets.ErrPendingClientWritesExceeded)
+	require.Equal(t, int64(8), atomic.LoadInt64(&cl.State.outboundBytes))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+
+	go cl.WriteLoop()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&cl.State.outboundBytes) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestServerMemoryHardLimitParksQos(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.MemoryBudget = MemoryBudget{HardLimit: 1 << 20}
+
+	cl, r, _ := newTestClient()
+	s.Clients.Add(cl)
+	s.memory.set(memoryHard)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b", Payload: []byte("hello")}
+	out, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b", Qos: 1}, pk)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), atomic.LoadInt64(&cl.State.outboundBytes)) // not queued,
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.MessagesDropped)) // nor dropped,
+	_, ok := cl.State.Inflight.Get(out.PacketID)                          // but kept inflight.
+	require.True(t, ok)
+	require.Equal(t, int32(4), atomic.LoadInt32(&cl.State.Inflight.sendQuota))
+
+	go cl.WriteLoop()
+	s.checkMemory() // back under the hard limit.
+	require.Equal(t, memoryOk, s.memory.Level())
+
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, packets.Publish, buf[0]>>4)
+	require.Equal(t, out.PacketID, binary.BigEndian.Uint16(buf[n-len("hello")-2:]))
+
+	require.NoError(t, s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Puback},
+		PacketID:    out.PacketID,
+	}))
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Equal(t, int32(5), atomic.LoadInt32(&cl.State.Inflight.sendQuota))
+	require.Empty(t, cl.State.parked.take())
+}
+
+func TestServerMemoryHardLimitRefusesConnect(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(AllowHook), nil))
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	s.memory.set(memoryHard)
+	c := client.New(&client.Options{
+		ClientID:        "late",
+		ProtocolVersion: 5,
+		Clean:           true,
+		Logger:          logger,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return l.DialContext(ctx, "")
+		},
+	})
+	require.ErrorIs(t, c.Connect(context.Background()), packets.ErrServerBusy)
+}
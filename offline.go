@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// ErrOfflineQueueInvalid indicates that an offline queue is misconfigured.
+var ErrOfflineQueueInvalid = errors.New("invalid offline queue")
+
+// OfflineQueue configures the buffering of qos 0 messages for a persistent session while its
+// client is disconnected. Buffered messages are delivered when the client reconnects. When
+// the buffer is full, the oldest message is dropped to make space.
+type OfflineQueue struct {
+	Messages int   `yaml:"messages" json:"messages"` // the maximum number of buffered messages; disabled if 0
+	Age      int64 `yaml:"age" json:"age"`           // seconds a message is buffered before it is dropped; unlimited if 0
+}
+
+// validate returns an error if the offline queue is misconfigured.
+func (o OfflineQueue) validate() error {
+	if o.Messages < 0 || o.Age < 0 {
+		return fmt.Errorf("negative value; %w", ErrOfflineQueueInvalid)
+	}
+
+	return nil
+}
+
+// validateOfflineQueues returns an error if any of the configured offline queues are misconfigured.
+func (o *Options) validateOfflineQueues() error {
+	if err := o.OfflineQueue.validate(); err != nil {
+		return err
+	}
+
+	for id, q := range o.ListenerOfflineQueues {
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("listener %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// offlineMessage is a qos 0 message buffered for a disconnected client.
+type offlineMessage struct {
+	pk     packets.Packet // the message
+	queued int64          // the unix time the message was buffered
+}
+
+// offlineQueue buffers the qos 0 messages of a persistent session while its client is
+// disconnected. It is safe for concurrent use.
+type offlineQueue struct {
+	sync.Mutex
+	limit    OfflineQueue     // the limits of the queue
+	messages []offlineMessage // the buffered messages, oldest first
+}
+
+// setLimit sets the limits of the queue.
+func (q *offlineQueue) setLimit(limit OfflineQueue) {
+	q.Lock()
+	defer q.Unlock()
+	q.limit = limit
+}
+
+// Len returns the number of buffered messages.
+func (q *offlineQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.messages)
+}
+
+// push buffers a message, returning false if the queue is disabled. Messages which are older
+// than the age limit, or the oldest message if the queue is full, are dropped and returned.
+func (q *offlineQueue) push(pk packets.Packet, now int64) (dropped []packets.Packet, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	if q.limit.Messages <= 0 {
+		return nil, false
+	}
+
+	n := 0
+	for n < len(q.messages) && (q.stale(q.messages[n], now) || len(q.messages)-n >= q.limit.Messages) {
+		dropped = append(dropped, q.messages[n].pk)
+		n++
+	}
+
+	clear(q.messages[:n]) // release the dropped messages for gc.
+	q.messages = append(q.messages[n:], offlineMessage{pk: pk, queued: now})
+	return dropped, true
+}
+
+// stale returns true if a message has been buffered for longer than the age limit.
+func (q *offlineQueue) stale(m offlineMessage, now int64) bool {
+	return q.limit.Age > 0 && now-m.queued > q.limit.Age
+}
+
+// takeAll removes and returns all the buffered messages, oldest first, along with any which
+// were dropped for being older than the age limit.
+func (q *offlineQueue) takeAll(now int64) (messages, dropped []packets.Packet) {
+	q.Lock()
+	defer q.Unlock()
+	for _, m := range q.messages {
+		if q.stale(m, now) {
+			dropped = append(dropped, m.pk)
+			continue
+		}
+		messages = append(messages, m.pk)
+	}
+
+	q.messages = nil
+	return messages, dropped
+}
+
+// selectOfflineQueue returns the offline queue limits of a client, using the queue of its
+// listener if set, or the global queue, as selected by any hooks.
+func (s *Server) selectOfflineQueue(cl *Client) OfflineQueue {
+	q := s.Options.OfflineQueue
+	if v, ok := s.Options.ListenerOfflineQueues[cl.Net.Listener]; ok {
+		q = v
+	}
+
+	q = s.hooks.OnSelectOfflineQueue(cl, q)
+	if err := q.validate(); err != nil {
+		s.Log.Warn("ignored client offline queue", "client", cl.ID, "error", err)
+		return OfflineQueue{}
+	}
+
+	return q
+}
+
+// queueOffline buffers a qos 0 message for a disconnected client with a persistent session,
+// returning false if the client does not buffer messages.
+func (s *Server) queueOffline(cl *Client, pk packets.Packet) bool {
+	if !cl.persistent() {
+		return false
+	}
+
+	dropped, ok := cl.State.offline.push(pk, time.Now().Unix())
+	for _, v := range dropped {
+		s.dropOffline(cl, v)
+	}
+
+	return ok
+}
+
+// dropOffline drops a buffered qos 0 message which was too old or made way for a newer message.
+func (s *Server) dropOffline(cl *Client, pk packets.Packet) {
+	atomic.AddInt64(&s.Info.MessagesDropped, 1)
+	s.hooks.OnPublishDropped(cl, pk)
+}
+
+// sendOfflineMessages writes the qos 0 messages buffered while the client was disconnected,
+// skipping any which have expired.
+func (s *Server) sendOfflineMessages(cl *Client) error {
+	now := time.Now().Unix()
+	messages, dropped := cl.State.offline.takeAll(now)
+	for _, pk := range dropped {
+		s.dropOffline(cl, pk)
+	}
+
+	for _, pk := range messages {
+		if pk.Expiry > 0 && pk.Expiry < now { // [MQTT-3.3.2-5]
+			s.dropOffline(cl, pk)
+			continue
+		}
+
+		if err := cl.WritePacket(pk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
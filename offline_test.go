@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+type offlineQueueHook struct {
+	HookBase
+	q *OfflineQueue
+}
+
+func (h *offlineQueueHook) ID() string {
+	return "offline-queue"
+}
+
+func (h *offlineQueueHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnSelectOfflineQueue}, []byte{b})
+}
+
+func (h *offlineQueueHook) OnSelectOfflineQueue(cl *Client, q OfflineQueue) OfflineQueue {
+	if h.q != nil {
+		return *h.q
+	}
+	return q
+}
+
+func TestOfflineQueueValidate(t *testing.T) {
+	require.NoError(t, OfflineQueue{}.validate())
+	require.NoError(t, OfflineQueue{Messages: 100, Age: 60}.validate())
+	require.ErrorIs(t, OfflineQueue{Messages: -1}.validate(), ErrOfflineQueueInvalid)
+	require.ErrorIs(t, OfflineQueue{Age: -1}.validate(), ErrOfflineQueueInvalid)
+}
+
+func TestServerServeOfflineQueueInvalid(t *testing.T) {
+	s := New(&Options{Logger: logger, OfflineQueue: OfflineQueue{Messages: -1}})
+	defer s.Close()
+	require.ErrorIs(t, s.Serve(), ErrOfflineQueueInvalid)
+
+	s = New(&Options{
+		Logger:                logger,
+		ListenerOfflineQueues: map[string]OfflineQueue{"t1": {Age: -1}},
+	})
+	defer s.Close()
+	require.ErrorIs(t, s.Serve(), ErrOfflineQueueInvalid)
+}
+
+func TestOfflineQueuePush(t *testing.T) {
+	q := new(offlineQueue)
+	_, ok := q.push(packets.Packet{TopicName: "a"}, 0)
+	require.False(t, ok) // disabled.
+
+	q.setLimit(OfflineQueue{Messages: 2, Age: 10})
+	for i, v := range []string{"a", "b", "c"} {
+		dropped, ok := q.push(packets.Packet{TopicName: v}, int64(i))
+		require.True(t, ok)
+		if v == "c" {
+			require.Equal(t, []packets.Packet{{TopicName: "a"}}, dropped) // the oldest makes way.
+		}
+	}
+	require.Equal(t, 2, q.Len())
+
+	dropped, ok := q.push(packets.Packet{TopicName: "d"}, 12) // b is more than 10 seconds old.
+	require.True(t, ok)
+	require.Equal(t, []packets.Packet{{TopicName: "b"}}, dropped)
+
+	messages, dropped := q.takeAll(12)
+	require.Equal(t, []packets.Packet{{TopicName: "c"}, {TopicName: "d"}}, messages)
+	require.Empty(t, dropped)
+	require.Equal(t, 0, q.Len())
+}
+
+func TestOfflineQueueTakeAllStale(t *testing.T) {
+	q := new(offlineQueue)
+	q.setLimit(OfflineQueue{Messages: 5, Age: 10})
+	q.push(packets.Packet{TopicName: "a"}, 0)
+	q.push(packets.Packet{TopicName: "b"}, 5)
+
+	messages, dropped := q.takeAll(12)
+	require.Equal(t, []packets.Packet{{TopicName: "b"}}, messages)
+	require.Equal(t, []packets.Packet{{TopicName: "a"}}, dropped)
+}
+
+func TestHooksOnSelectOfflineQueue(t *testing.T) {
+	h := new(Hooks)
+	require.NoError(t, h.Add(&offlineQueueHook{q: &OfflineQueue{Messages: 1}}, nil))
+	require.NoError(t, h.Add(new(HookBase), nil))
+	require.Equal(t, OfflineQueue{Messages: 1}, h.OnSelectOfflineQueue(new(Client), OfflineQueue{Messages: 10}))
+}
+
+func TestServerSelectOfflineQueue(t *testing.T) {
+	s := New(&Options{
+		Logger:       logger,
+		OfflineQueue: OfflineQueue{Messages: 10},
+		ListenerOfflineQueues: map[string]OfflineQueue{
+			"t1": {Messages: 100, Age: 60},
+			"t2": {},
+		},
+	})
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "t0"
+	require.Equal(t, OfflineQueue{Messages: 10}, s.selectOfflineQueue(cl))
+
+	cl.Net.Listener = "t1"
+	require.Equal(t, OfflineQueue{Messages: 100, Age: 60}, s.selectOfflineQueue(cl))
+
+	cl.Net.Listener = "t2"
+	require.Equal(t, OfflineQueue{}, s.selectOfflineQueue(cl)) // the listener disables the global queue.
+
+	hook := &offlineQueueHook{q: &OfflineQueue{Messages: -1}}
+	require.NoError(t, s.AddHook(hook, nil))
+	require.Equal(t, OfflineQueue{}, s.selectOfflineQueue(cl))
+
+	hook.q.Messages = 5
+	require.Equal(t, OfflineQueue{Messages: 5}, s.selectOfflineQueue(cl))
+}
+
+func TestPublishToClientOffline(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	cl.State.offline.setLimit(OfflineQueue{Messages: 10})
+	s.Clients.Add(cl)
+	cl.Stop(packets.ErrServerShuttingDown)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b"}
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.NoError(t, err)
+	require.Equal(t, 1, cl.State.offline.Len())
+
+	pk.FixedHeader.Qos = 1
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b", Qos: 1}, pk)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 1, cl.State.offline.Len()) // qos messages are kept inflight instead.
+	require.Equal(t, 1, cl.State.Inflight.Len())
+
+	cl.Properties.Clean = true
+	pk.FixedHeader.Qos = 0
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 1, cl.State.offline.Len())
+}
+
+func TestServerSendOfflineMessages(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 4
+	cl.State.offline.setLimit(OfflineQueue{Messages: 10})
+	now := time.Now().Unix()
+	for _, pk := range []packets.Packet{
+		{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b", Payload: []byte("1")},
+		{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b", Payload: []byte("2"), Expiry: now - 1},
+		{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b", Payload: []byte("3"), Expiry: now + 60},
+	} {
+		_, ok := cl.State.offline.push(pk, now)
+		require.True(t, ok)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.sendOfflineMessages(cl)
+	}()
+
+	require.Equal(t, "1", string(readSlowTestPacket(t, r).Payload))
+	require.Equal(t, "3", string(readSlowTestPacket(t, r).Payload))
+	require.NoError(t, <-done)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped)) // the expired message.
+	require.Equal(t, 0, cl.State.offline.Len())
+}
+
+func TestServerOfflineQueueDeliveredOnReconnect(t *testing.T) {
+	s := New(&Options{
+		Logger:                logger,
+		InlineClient:          true,
+		ListenerOfflineQueues: map[string]OfflineQueue{"mem": {Messages: 2}},
+	})
+	require.NoError(t, s.AddHook(new(AllowHook), nil))
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	conn, err := l.DialContext(context.Background(), "")
+	require.NoError(t, err)
+	_, err = conn.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes) // persistent session "zen"
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4)) // connack
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{
+		packets.Subscribe<<4 | 1<<1, 8, // Fixed header
+		0, 1, // Packet ID
+		0, 3, 'a', '/', 'b', // Topic Name
+		0, // QoS
+	})
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5)) // suback
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{packets.Disconnect << 4, 0})
+	require.NoError(t, err)
+
+	cl, ok := s.Clients.Get("zen")
+	require.True(t, ok)
+	require.Eventually(t, cl.Closed, time.Second, time.Millisecond)
+
+	for _, v := range []string{"1", "2", "3"} {
+		require.NoError(t, s.Publish("a/b", []byte(v), false, 0))
+	}
+	require.Equal(t, 2, cl.State.offline.Len())
+
+	conn, err = l.DialContext(context.Background(), "")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+	require.NoError(t, err)
+	require.Equal(t, packets.Connack, readSlowTestPacket(t, conn).FixedHeader.Type)
+
+	for _, v := range []string{"2", "3"} { // the oldest message made way.
+		pk := readSlowTestPacket(t, conn)
+		require.Equal(t, packets.Publish, pk.FixedHeader.Type)
+		require.Equal(t, byte(0), pk.FixedHeader.Qos)
+		require.Equal(t, v, string(pk.Payload))
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+}
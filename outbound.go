@@ -0,0 +1,309 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	OutboundDropNewest = "drop_newest" // drop the new message when the queue is full
+	OutboundDropOldest = "drop_oldest" // drop the oldest message of the same or a lower priority when the queue is full
+	OutboundBlock      = "block"       // wait for space in the queue, dropping the new message on timeout
+)
+
+const (
+	maxOutboundPriority         = 7           // the highest outbound priority lane
+	defaultOutboundBlockTimeout = time.Second // the default time a publish waits for space under the block policy
+)
+
+// ErrOutboundQueueInvalid indicates that the outbound queue options are misconfigured.
+var ErrOutboundQueueInvalid = errors.New("invalid outbound queue options")
+
+// OutboundQueue configures the queue of messages waiting to be written to each client.
+// The queue holds up to Capabilities.MaximumClientWritesPending messages across all of its
+// priority lanes, and messages in higher lanes are written first.
+type OutboundQueue struct {
+	Policy           string             `yaml:"policy" json:"policy"`                       // drop_newest, drop_oldest, or block; drop_newest if empty
+	BlockTimeout     int64              `yaml:"block_timeout" json:"block_timeout"`         // milliseconds a publish waits for space under the block policy; 1000 if zero
+	PriorityProperty string             `yaml:"priority_property" json:"priority_property"` // a user property whose value sets the priority of a message
+	Priorities       []OutboundPriority `yaml:"priorities" json:"priorities"`               // priorities for messages by topic, the first match applies
+}
+
+// OutboundPriority sets the priority of the messages published to topics matching a filter.
+type OutboundPriority struct {
+	Filter   string `yaml:"filter" json:"filter"`     // the topic filter to match
+	Priority int    `yaml:"priority" json:"priority"` // the priority lane, from 0 (the default) to 7
+}
+
+// validate returns an error if the outbound queue options are misconfigured.
+func (o OutboundQueue) validate() error {
+	switch o.Policy {
+	case "", OutboundDropNewest, OutboundDropOldest, OutboundBlock:
+	default:
+		return fmt.Errorf("unknown policy %q; %w", o.Policy, ErrOutboundQueueInvalid)
+	}
+
+	if o.BlockTimeout < 0 {
+		return fmt.Errorf("negative block timeout; %w", ErrOutboundQueueInvalid)
+	}
+
+	for _, p := range o.Priorities {
+		if !IsValidFilter(p.Filter, false) {
+			return fmt.Errorf("priority filter %q: %w", p.Filter, ErrOutboundQueueInvalid)
+		}
+
+		if p.Priority < 0 || p.Priority > maxOutboundPriority {
+			return fmt.Errorf("priority %d out of range; %w", p.Priority, ErrOutboundQueueInvalid)
+		}
+	}
+
+	return nil
+}
+
+// reorders returns true if the queue can write or drop messages out of the order they were queued.
+func (o OutboundQueue) reorders() bool {
+	return o.Policy == OutboundDropOldest || o.PriorityProperty != "" || len(o.Priorities) > 0
+}
+
+// priority returns the priority lane of a message.
+func (o OutboundQueue) priority(pk packets.Packet) int {
+	if o.PriorityProperty != "" {
+		for _, p := range pk.Properties.User {
+			if p.Key != o.PriorityProperty {
+				continue
+			}
+
+			if n, err := strconv.Atoi(p.Val); err == nil {
+				return min(max(n, 0), maxOutboundPriority)
+			}
+		}
+	}
+
+	for _, p := range o.Priorities {
+		if packets.MatchTopic(p.Filter, pk.TopicName) {
+			return p.Priority
+		}
+	}
+
+	return 0
+}
+
+// OutboundStats describes the queue of messages waiting to be written to a client.
+type OutboundStats struct {
+	Depth int           `json:"depth"` // the number of messages in the queue
+	Lanes []int         `json:"lanes"` // the number of messages in each priority lane, from priority 0
+	Age   time.Duration `json:"age"`   // the time the oldest message has been waiting
+}
+
+// outboundMessage is a message waiting in an outbound queue.
+type outboundMessage struct {
+	pk     *packets.Packet // the message
+	queued time.Time       // the time the message was queued
+}
+
+// outboundQueue is a bounded queue of messages waiting to be written to a client, with a
+// lane for each priority. It is safe for concurrent use.
+type outboundQueue struct {
+	sync.Mutex
+	lanes    [][]outboundMessage // messages waiting in each priority lane
+	size     int32               // the number of messages in all lanes
+	capacity int                 // the maximum number of messages in all lanes
+	ready    chan struct{}       // signalled when a message is added
+	space    chan struct{}       // signalled when a message is removed
+}
+
+// newOutboundQueue returns a new outbound queue holding up to capacity messages.
+func newOutboundQueue(capacity int) *outboundQueue {
+	return &outboundQueue{
+		lanes:    make([][]outboundMessage, maxOutboundPriority+1),
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+	}
+}
+
+// Len returns the number of messages in the queue.
+func (q *outboundQueue) Len() int {
+	return int(atomic.LoadInt32(&q.size))
+}
+
+// signal signals a channel without blocking.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// push adds a message to the queue, returning false if the queue is full.
+func (q *outboundQueue) push(pk *packets.Packet, priority int) bool {
+	q.Lock()
+	defer q.Unlock()
+	if int(q.size) >= q.capacity {
+		return false
+	}
+
+	q.add(pk, priority)
+	return true
+}
+
+// add adds a message to a lane. The queue must be locked.
+func (q *outboundQueue) add(pk *packets.Packet, priority int) {
+	q.lanes[priority] = append(q.lanes[priority], outboundMessage{pk: pk, queued: time.Now()})
+	atomic.AddInt32(&q.size, 1)
+	signal(q.ready)
+}
+
+// pushDropOldest adds a message to the queue. If the queue is full, the oldest message of
+// the lowest lane not above the priority of the message is dropped to make space, and
+// returned. If all the queued messages have a higher priority, ok is false.
+func (q *outboundQueue) pushDropOldest(pk *packets.Packet, priority int) (dropped *packets.Packet, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	if int(q.size) >= q.capacity {
+		for i := 0; i <= priority; i++ {
+			if len(q.lanes[i]) > 0 {
+				dropped = q.lanes[i][0].pk
+				q.lanes[i][0] = outboundMessage{}
+				q.lanes[i] = q.lanes[i][1:]
+				atomic.AddInt32(&q.size, -1)
+				break
+			}
+		}
+
+		if dropped == nil {
+			return nil, false
+		}
+	}
+
+	q.add(pk, priority)
+	return dropped, true
+}
+
+// pushWait adds a message to the queue, waiting up to timeout for space if the queue
+// is full. Returns false if the message was not added before the timeout or done.
+func (q *outboundQueue) pushWait(pk *packets.Packet, priority int, timeout time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !q.push(pk, priority) {
+		select {
+		case <-q.space:
+		case <-timer.C:
+			return false
+		case <-done:
+			return false
+		}
+	}
+
+	return true
+}
+
+// pop removes and returns the oldest message of the highest non-empty lane, returning
+// false if the queue is empty.
+func (q *outboundQueue) pop() (*packets.Packet, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for i := len(q.lanes) - 1; i >= 0; i-- {
+		if len(q.lanes[i]) > 0 {
+			pk := q.lanes[i][0].pk
+			q.lanes[i][0] = outboundMessage{} // release the message for gc.
+			q.lanes[i] = q.lanes[i][1:]
+			atomic.AddInt32(&q.size, -1)
+			signal(q.space)
+			return pk, true
+		}
+	}
+
+	return nil, false
+}
+
+// stats returns the depth and age of the queue.
+func (q *outboundQueue) stats(now time.Time) OutboundStats {
+	q.Lock()
+	defer q.Unlock()
+	out := OutboundStats{
+		Depth: int(q.size),
+		Lanes: make([]int, len(q.lanes)),
+	}
+
+	for i, lane := range q.lanes {
+		out.Lanes[i] = len(lane)
+		if len(lane) > 0 {
+			out.Age = max(out.Age, now.Sub(lane[0].queued))
+		}
+	}
+
+	return out
+}
+
+// OutboundStats returns the depth and age of the queue of messages waiting to be
+// written to the client.
+func (cl *Client) OutboundStats() OutboundStats {
+	return cl.State.outbound.stats(time.Now())
+}
+
+// enqueueOutbound adds a message to the outbound queue of a client according to the queue
+// policy, returning false if the message was dropped instead. Messages published by the
+// server itself, such as $SYS topics, are never blocked, nor are any messages if wait is false.
+func (s *Server) enqueueOutbound(cl *Client, pk packets.Packet, out *packets.Packet, wait bool) bool {
+	opts := s.Options.OutboundQueue
+	priority := opts.priority(pk)
+	size := out.MemorySize()
+	atomic.AddInt64(&cl.State.outboundBytes, size)
+
+	switch {
+	case opts.Policy == OutboundDropOldest:
+		dropped, ok := cl.State.outbound.pushDropOldest(out, priority)
+		if dropped != nil {
+			s.dropOutbound(cl, dropped)
+		}
+
+		if ok {
+			return true
+		}
+	case opts.Policy == OutboundBlock && wait && pk.Origin != "":
+		timeout := time.Duration(opts.BlockTimeout) * time.Millisecond
+		if timeout == 0 {
+			timeout = defaultOutboundBlockTimeout
+		}
+
+		if cl.State.outbound.pushWait(out, priority, timeout, cl.State.open.Done()) {
+			return true
+		}
+	default:
+		if cl.State.outbound.push(out, priority) {
+			return true
+		}
+	}
+
+	atomic.AddInt64(&cl.State.outboundBytes, -size)
+	cl.State.slow.drop()
+	return false
+}
+
+// dropOutbound drops a message which was removed from the outbound queue of a client to make
+// space for a newer message, rolling back its inflight state.
+func (s *Server) dropOutbound(cl *Client, pk *packets.Packet) {
+	atomic.AddInt64(&cl.State.outboundBytes, -pk.MemorySize())
+	atomic.AddInt64(&s.Info.MessagesDropped, 1)
+	cl.State.slow.drop()
+	cl.ops.hooks.OnPublishDropped(cl, *pk)
+	if pk.FixedHeader.Qos > 0 {
+		if cl.State.Inflight.Delete(pk.PacketID) {
+			atomic.AddInt64(&s.Info.Inflight, -1)
+			s.hooks.OnQosDropped(cl, *pk) // the message is not resent, so remove the stored inflight copy.
+		}
+		cl.State.Inflight.IncreaseSendQuota()
+		s.deliveries.complete(cl.ID, pk.PacketID, false)
+	}
+}
@@ -0,0 +1,339 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/mqtt-server/system"
+)
+
+// stallTestClient blocks the write loop of a test client on a write which is not read,
+// so that further messages stay in the outbound queue.
+func stallTestClient(t *testing.T, cl *Client) {
+	cl.State.outbound.push(&packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "stall"}, 0)
+	require.Eventually(t, func() bool {
+		return cl.State.outbound.Len() == 0
+	}, time.Second, time.Millisecond)
+}
+
+// newQueueTestClient returns a test client without a write loop, so qos messages can be
+// queued without waiting on a stalled write, which holds the client lock.
+func newQueueTestClient() *Client {
+	_, w := net.Pipe()
+	cl := newClient(w, &ops{
+		info:  new(system.Info),
+		hooks: new(Hooks),
+		log:   logger,
+		options: &Options{
+			Capabilities: &Capabilities{
+				MaximumInflight:            5,
+				MaximumClientWritesPending: 3,
+				maximumPacketID:            10,
+			},
+		},
+	})
+	cl.ID = "mochi"
+	cl.State.Inflight.maximumSendQuota = 5
+	cl.State.Inflight.sendQuota = 5
+
+	return cl
+}
+
+func TestOutboundQueueValidate(t *testing.T) {
+	require.NoError(t, OutboundQueue{}.validate())
+	require.NoError(t, OutboundQueue{
+		Policy:     OutboundBlock,
+		Priorities: []OutboundPriority{{Filter: "alarms/#", Priority: 7}},
+	}.validate())
+	require.ErrorIs(t, OutboundQueue{Policy: "drop_all"}.validate(), ErrOutboundQueueInvalid)
+	require.ErrorIs(t, OutboundQueue{BlockTimeout: -1}.validate(), ErrOutboundQueueInvalid)
+	require.ErrorIs(t, OutboundQueue{Priorities: []OutboundPriority{{Filter: "a/#/b"}}}.validate(), ErrOutboundQueueInvalid)
+	require.ErrorIs(t, OutboundQueue{Priorities: []OutboundPriority{{Filter: "a", Priority: 8}}}.validate(), ErrOutboundQueueInvalid)
+}
+
+func TestServerServeOutboundQueueInvalid(t *testing.T) {
+	s := New(&Options{Logger: logger, OutboundQueue: OutboundQueue{Policy: "drop_all"}})
+	require.ErrorIs(t, s.Serve(), ErrOutboundQueueInvalid)
+}
+
+func TestOutboundQueueReorders(t *testing.T) {
+	require.False(t, OutboundQueue{}.reorders())
+	require.False(t, OutboundQueue{Policy: OutboundBlock}.reorders())
+	require.True(t, OutboundQueue{Policy: OutboundDropOldest}.reorders())
+	require.True(t, OutboundQueue{PriorityProperty: "priority"}.reorders())
+	require.True(t, OutboundQueue{Priorities: []OutboundPriority{{Filter: "a", Priority: 1}}}.reorders())
+}
+
+func TestOutboundQueuePriority(t *testing.T) {
+	o := OutboundQueue{
+		PriorityProperty: "priority",
+		Priorities: []OutboundPriority{
+			{Filter: "alarms/#", Priority: 5},
+			{Filter: "+/fire", Priority: 3},
+		},
+	}
+
+	withPriority := func(topic, v string) packets.Packet {
+		return packets.Packet{TopicName: topic, Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: "other", Val: "1"}, {Key: "priority", Val: v}},
+		}}
+	}
+
+	require.Equal(t, 0, o.priority(packets.Packet{TopicName: "telemetry/a"}))
+	require.Equal(t, 5, o.priority(packets.Packet{TopicName: "alarms/fire"})) // first match applies
+	require.Equal(t, 3, o.priority(packets.Packet{TopicName: "room/fire"}))
+	require.Equal(t, 2, o.priority(withPriority("telemetry/a", "2")))
+	require.Equal(t, 0, o.priority(withPriority("alarms/fire", "0"))) // the property applies ahead of filters
+	require.Equal(t, maxOutboundPriority, o.priority(withPriority("telemetry/a", "99")))
+	require.Equal(t, 0, o.priority(withPriority("telemetry/a", "-1")))
+	require.Equal(t, 5, o.priority(withPriority("alarms/fire", "high"))) // invalid values are ignored
+}
+
+func TestOutboundQueuePushPop(t *testing.T) {
+	q := newOutboundQueue(4)
+	_, ok := q.pop()
+	require.False(t, ok)
+
+	require.True(t, q.push(&packets.Packet{PacketID: 1}, 0))
+	require.True(t, q.push(&packets.Packet{PacketID: 2}, 3))
+	require.True(t, q.push(&packets.Packet{PacketID: 3}, 0))
+	require.True(t, q.push(&packets.Packet{PacketID: 4}, 3))
+	require.False(t, q.push(&packets.Packet{PacketID: 5}, 7))
+	require.Equal(t, 4, q.Len())
+
+	for _, id := range []uint16{2, 4, 1, 3} { // higher lanes first, then in order of queueing
+		pk, ok := q.pop()
+		require.True(t, ok)
+		require.Equal(t, id, pk.PacketID)
+	}
+	require.Equal(t, 0, q.Len())
+}
+
+func TestOutboundQueuePushDropOldest(t *testing.T) {
+	q := newOutboundQueue(3)
+	dropped, ok := q.pushDropOldest(&packets.Packet{PacketID: 1}, 1)
+	require.True(t, ok)
+	require.Nil(t, dropped)
+	_, _ = q.pushDropOldest(&packets.Packet{PacketID: 2}, 0)
+	_, _ = q.pushDropOldest(&packets.Packet{PacketID: 3}, 0)
+
+	dropped, ok = q.pushDropOldest(&packets.Packet{PacketID: 4}, 0)
+	require.True(t, ok)
+	require.Equal(t, uint16(2), dropped.PacketID) // the oldest message of the lowest lane
+
+	dropped, ok = q.pushDropOldest(&packets.Packet{PacketID: 5}, 2)
+	require.True(t, ok)
+	require.Equal(t, uint16(3), dropped.PacketID)
+
+	dropped, ok = q.pushDropOldest(&packets.Packet{PacketID: 6}, 1)
+	require.True(t, ok)
+	require.Equal(t, uint16(4), dropped.PacketID)
+
+	dropped, ok = q.pushDropOldest(&packets.Packet{PacketID: 7}, 0) // all queued messages have a higher priority
+	require.False(t, ok)
+	require.Nil(t, dropped)
+	require.Equal(t, 3, q.Len())
+
+	for _, id := range []uint16{5, 1, 6} {
+		pk, _ := q.pop()
+		require.Equal(t, id, pk.PacketID)
+	}
+}
+
+func TestOutboundQueuePushWait(t *testing.T) {
+	q := newOutboundQueue(1)
+	done := make(chan struct{})
+	require.True(t, q.pushWait(&packets.Packet{PacketID: 1}, 0, time.Millisecond, done))
+	require.False(t, q.pushWait(&packets.Packet{PacketID: 2}, 0, 10*time.Millisecond, done))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = q.pop()
+	}()
+	require.True(t, q.pushWait(&packets.Packet{PacketID: 3}, 0, time.Second, done))
+
+	close(done)
+	require.False(t, q.pushWait(&packets.Packet{PacketID: 4}, 0, time.Second, done))
+
+	pk, _ := q.pop()
+	require.Equal(t, uint16(3), pk.PacketID)
+}
+
+func TestOutboundQueueStats(t *testing.T) {
+	q := newOutboundQueue(4)
+	require.Equal(t, OutboundStats{Lanes: make([]int, maxOutboundPriority+1)}, q.stats(time.Now()))
+
+	q.push(&packets.Packet{}, 0)
+	q.push(&packets.Packet{}, 0)
+	q.push(&packets.Packet{}, 2)
+
+	stats := q.stats(time.Now().Add(time.Second))
+	require.Equal(t, 3, stats.Depth)
+	require.Equal(t, []int{2, 0, 1, 0, 0, 0, 0, 0}, stats.Lanes)
+	require.GreaterOrEqual(t, stats.Age, time.Second)
+
+	cl, _, _ := newTestClient()
+	stallTestClient(t, cl)
+	cl.State.outbound.push(&packets.Packet{}, 1)
+	require.Equal(t, 1, cl.OutboundStats().Depth)
+}
+
+// inflightStoreHook records the inflight messages stored and removed like a storage hook.
+type inflightStoreHook struct {
+	HookBase
+	stored map[uint16]bool
+}
+
+func (h *inflightStoreHook) ID() string {
+	return "inflight-store"
+}
+
+func (h *inflightStoreHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnQosPublish, OnQosDropped}, []byte{b})
+}
+
+func (h *inflightStoreHook) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int) {
+	h.stored[pk.PacketID] = true
+}
+
+func (h *inflightStoreHook) OnQosDropped(cl *Client, pk packets.Packet) {
+	delete(h.stored, pk.PacketID)
+}
+
+func TestServerEnqueueOutboundDropOldest(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.OutboundQueue.Policy = OutboundDropOldest
+	hook := &inflightStoreHook{stored: map[uint16]bool{}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+
+	var ids []uint16
+	for _, v := range []string{"1", "2", "3", "4"} { // the queue holds 3 messages
+		out, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b", Qos: 1}, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			TopicName:   "a/b",
+			Payload:     []byte(v),
+		})
+		require.NoError(t, err)
+		ids = append(ids, out.PacketID)
+	}
+
+	require.Equal(t, 3, cl.State.outbound.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.State.slow.dropped))
+	require.Equal(t, int64(3*(3+1)), atomic.LoadInt64(&cl.State.outboundBytes))
+
+	_, ok := cl.State.Inflight.Get(ids[0])
+	require.False(t, ok) // the dropped message is no longer inflight,
+	require.Equal(t, 3, cl.State.Inflight.Len())
+	require.Equal(t, int64(3), atomic.LoadInt64(&s.Info.Inflight))
+	require.NotContains(t, hook.stored, ids[0]) // nor stored.
+	require.Len(t, hook.stored, 3)
+
+	for _, v := range []string{"2", "3", "4"} {
+		pk, _ := cl.State.outbound.pop()
+		require.Equal(t, v, string(pk.Payload))
+	}
+}
+
+func TestServerEnqueueOutboundBlock(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.OutboundQueue = OutboundQueue{Policy: OutboundBlock, BlockTimeout: 10}
+
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+	stallTestClient(t, cl)
+
+	pk := packets.Packet{TopicName: "a/b", Origin: "pub"}
+	for i := 0; i < cl.State.outbound.capacity; i++ {
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+		require.NoError(t, err)
+	}
+
+	start := time.Now()
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.ErrorIs(t, err, packets.ErrPendingClientWritesExceeded)
+	require.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	s.Options.OutboundQueue.BlockTimeout = 0 // default timeout
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = cl.State.outbound.pop()
+	}()
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.NoError(t, err)
+
+	start = time.Now()
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, packets.Packet{TopicName: "a/b"})
+	require.ErrorIs(t, err, packets.ErrPendingClientWritesExceeded)
+	require.Less(t, time.Since(start), defaultOutboundBlockTimeout) // server messages never block.
+}
+
+func TestPublishToClientTopicAliasReorders(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.OutboundQueue.Priorities = []OutboundPriority{{Filter: "alarms/#", Priority: 1}}
+
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.TopicAliasMaximum = 5
+	s.Clients.Add(cl)
+
+	pk := packets.Packet{TopicName: "a/b"}
+	out, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), out.Properties.TopicAlias)
+
+	out, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), out.Properties.TopicAlias)
+	require.Equal(t, "a/b", out.TopicName) // kept, as the first message may be written later.
+}
+
+func TestClientWriteLoopPriority(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.OutboundQueue.Priorities = []OutboundPriority{{Filter: "alarms/#", Priority: 2}}
+
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 4
+	s.Clients.Add(cl)
+	defer cl.Stop(nil)
+	stallTestClient(t, cl)
+
+	for _, topic := range []string{"bulk/1", "bulk/2", "alarms/fire"} {
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "#"}, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish},
+			TopicName:   topic,
+		})
+		require.NoError(t, err)
+	}
+
+	for _, want := range []string{"stall", "alarms/fire", "bulk/1", "bulk/2"} {
+		b := make([]byte, 2)
+		_, err := io.ReadFull(r, b)
+		require.NoError(t, err)
+		body := make([]byte, b[1])
+		_, err = io.ReadFull(r, body)
+		require.NoError(t, err)
+
+		pk := packets.Packet{ProtocolVersion: 4}
+		require.NoError(t, pk.FixedHeader.Decode(b[0]))
+		require.NoError(t, pk.PublishDecode(body))
+		require.Equal(t, want, pk.TopicName)
+	}
+}
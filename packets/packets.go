@@ -65,6 +65,7 @@ var (
 // Packets is a concurrency safe map of packets.
 type Packets struct {
 	internal map[string]Packet
+	bytes    int64 // the memory size of the packets in the map
 	sync.RWMutex
 }
 
@@ -79,7 +80,11 @@ func NewPackets() *Packets {
 func (p *Packets) Add(id string, val Packet) {
 	p.Lock()
 	defer p.Unlock()
+	if old, ok := p.internal[id]; ok {
+		p.bytes -= old.MemorySize()
+	}
 	p.internal[id] = val
+	p.bytes += val.MemorySize()
 }
 
 // GetAll returns all packets in the map.
@@ -109,11 +114,42 @@ func (p *Packets) Len() int {
 	return val
 }
 
+// Bytes returns an estimate of the bytes of memory held by the packets in the map.
+func (p *Packets) Bytes() int64 {
+	p.RLock()
+	defer p.RUnlock()
+	return p.bytes
+}
+
 // Delete removes a packet from the map by packet id.
 func (p *Packets) Delete(id string) {
 	p.Lock()
 	defer p.Unlock()
+	if old, ok := p.internal[id]; ok {
+		p.bytes -= old.MemorySize()
+	}
+	delete(p.internal, id)
+}
+
+// Take removes a packet from the map by packet id and returns it, if it existed. Only one
+// of any concurrent callers taking the same packet receives it.
+func (p *Packets) Take(id string) (val Packet, ok bool) {
+	return p.TakeIf(id, nil)
+}
+
+// TakeIf removes a packet from the map by packet id and returns it, if it exists and cond
+// is nil or returns true for it.
+func (p *Packets) TakeIf(id string, cond func(Packet) bool) (val Packet, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+	val, ok = p.internal[id]
+	if !ok || (cond != nil && !cond(val)) {
+		return Packet{}, false
+	}
+
+	p.bytes -= val.MemorySize()
 	delete(p.internal, id)
+	return val, true
 }
 
 // Packet represents an MQTT packet. Instead of providing a packet interface
@@ -178,7 +214,22 @@ type Subscription struct {
 	Qos               byte
 	RetainAsPublished bool
 	NoLocal           bool
-	FwdRetainedFlag   bool // true if the subscription forms part of a publish response to a client subscription and packet is retained.
+	FwdRetainedFlag   bool   // true if the subscription forms part of a publish response to a client subscription and packet is retained.
+	RewriteTemplate   string // maps delivered topics back to the filter the client subscribed with, if the filter was rewritten.
+}
+
+// MemorySize returns an estimate of the bytes of memory held by the variable length fields of
+// the packet, such as the topic name, payload and properties.
+func (pk *Packet) MemorySize() int64 {
+	n := len(pk.TopicName) + len(pk.Payload) + len(pk.Origin) +
+		len(pk.Properties.CorrelationData) + len(pk.Properties.ContentType) +
+		len(pk.Properties.ResponseTopic) + len(pk.Properties.ReasonString) +
+		len(pk.Properties.SubscriptionIdentifier)*8
+	for _, v := range pk.Properties.User {
+		n += len(v.Key) + len(v.Val)
+	}
+
+	return int64(n)
 }
 
 // Copy creates a new instance of a packet, but with an empty header for inheriting new QoS flags, etc.
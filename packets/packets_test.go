@@ -111,6 +111,62 @@ func TestSPacketsDelete(t *testing.T) {
 	require.False(t, ok)
 }
 
+func TestPacketsTake(t *testing.T) {
+	s := NewPackets()
+	s.Add("cl1", Packet{TopicName: "a1", Payload: []byte("hello")})
+
+	pk, ok := s.Take("cl1")
+	require.True(t, ok)
+	require.Equal(t, "a1", pk.TopicName)
+	require.NotContains(t, s.internal, "cl1")
+	require.Equal(t, int64(0), s.Bytes())
+
+	_, ok = s.Take("cl1")
+	require.False(t, ok)
+
+	s.Add("cl2", Packet{TopicName: "a2"})
+	_, ok = s.TakeIf("cl2", func(pk Packet) bool { return pk.TopicName == "a1" })
+	require.False(t, ok)
+	require.Contains(t, s.internal, "cl2")
+
+	pk, ok = s.TakeIf("cl2", func(pk Packet) bool { return pk.TopicName == "a2" })
+	require.True(t, ok)
+	require.Equal(t, "a2", pk.TopicName)
+	require.Equal(t, 0, s.Len())
+}
+
+func TestPacketsBytes(t *testing.T) {
+	s := NewPackets()
+	s.Add("cl1", Packet{TopicName: "a1", Payload: []byte("hello")})
+	s.Add("cl2", Packet{TopicName: "a2"})
+	require.Equal(t, int64(9), s.Bytes())
+
+	s.Add("cl1", Packet{TopicName: "a1", Payload: []byte("hi")})
+	require.Equal(t, int64(6), s.Bytes())
+
+	s.Delete("cl1")
+	s.Delete("cl3")
+	require.Equal(t, int64(2), s.Bytes())
+}
+
+func TestPacketMemorySize(t *testing.T) {
+	pk := Packet{
+		TopicName: "a/b",
+		Payload:   []byte("hello"),
+		Origin:    "cl1",
+		Properties: Properties{
+			CorrelationData:        []byte("cd"),
+			ContentType:            "json",
+			ResponseTopic:          "resp",
+			ReasonString:           "ok",
+			SubscriptionIdentifier: []int{1, 2},
+			User:                   []UserProperty{{Key: "k", Val: "vv"}},
+		},
+	}
+	require.Equal(t, int64(3+5+3+2+4+4+2+16+3), pk.MemorySize())
+	require.Equal(t, int64(0), new(Packet).MemorySize())
+}
+
 func TestFormatPacketID(t *testing.T) {
 	for _, id := range []uint16{0, 7, 0x100, 0xffff} {
 		packet := &Packet{PacketID: id}
@@ -0,0 +1,30 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package packets
+
+import "strings"
+
+// MatchTopic returns true if a topic name matches a topic filter, observing the single (+)
+// and multi-level (#) wildcards. Topics beginning with $ are not matched by filters
+// beginning with a wildcard.
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false // [MQTT-4.7.2-1]
+	}
+
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+
+		if i >= len(ts) || f != "+" && f != ts[i] {
+			return false
+		}
+	}
+
+	return len(fs) == len(ts)
+}
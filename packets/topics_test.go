@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package packets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tt := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/c", false},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.match, MatchTopic(tx.filter, tx.topic), tx.filter+" "+tx.topic)
+	}
+}
@@ -0,0 +1,232 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	RateLimitDelay      = "delay"      // stop reading from the client until the publish is within the limit
+	RateLimitDrop       = "drop"       // drop the publish, rejecting v5 qos publishes with quota exceeded and disconnecting older clients
+	RateLimitDisconnect = "disconnect" // disconnect the client with message rate too high or quota exceeded
+)
+
+// ErrRateLimitInvalid indicates that a rate limit is misconfigured.
+var ErrRateLimitInvalid = errors.New("invalid rate limit")
+
+// RateLimit is a token bucket limit on the publishes a client can send. A zero limit disables
+// the limit of that kind. The burst of a limit defaults to one second of the limit.
+type RateLimit struct {
+	Messages      float64 `yaml:"messages" json:"messages"`             // publishes per second
+	MessagesBurst int64   `yaml:"messages_burst" json:"messages_burst"` // publishes which can be sent at once
+	Bytes         float64 `yaml:"bytes" json:"bytes"`                   // publish packet bytes per second
+	BytesBurst    int64   `yaml:"bytes_burst" json:"bytes_burst"`       // publish packet bytes which can be sent at once
+	Policy        string  `yaml:"policy" json:"policy"`                 // delay, drop, or disconnect; delay if empty
+}
+
+// validate returns an error if the rate limit is misconfigured.
+func (r RateLimit) validate() error {
+	if r.Messages < 0 || r.Bytes < 0 || r.MessagesBurst < 0 || r.BytesBurst < 0 {
+		return fmt.Errorf("negative limit; %w", ErrRateLimitInvalid)
+	}
+
+	switch r.Policy {
+	case "", RateLimitDelay, RateLimitDrop, RateLimitDisconnect:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q; %w", r.Policy, ErrRateLimitInvalid)
+	}
+}
+
+// tokenBucket is a token bucket which is refilled at a constant rate.
+type tokenBucket struct {
+	rate   float64   // tokens added per second
+	burst  float64   // the maximum number of tokens
+	tokens float64   // the current number of tokens, which is negative if in debt
+	last   time.Time // the time the tokens were last refilled
+}
+
+// newTokenBucket returns a full token bucket, or nil if the rate is zero.
+func newTokenBucket(rate float64, burst int64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := float64(burst)
+	if b <= 0 {
+		b = max(rate, 1)
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   now,
+	}
+}
+
+// refill adds the tokens accrued since the bucket was last refilled.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// ready returns true if n tokens can be taken. Takes larger than the burst are allowed
+// when the bucket is full, so they are not refused forever.
+func (b *tokenBucket) ready(n float64) bool {
+	return b.tokens >= min(n, b.burst)
+}
+
+// wait returns the time until the bucket is no longer in debt.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter applies a rate limit to the publishes of a client. It is only used by
+// the goroutine reading from the client.
+type rateLimiter struct {
+	limit    RateLimit    // the limit being applied
+	messages *tokenBucket // the messages bucket, if limited
+	bytes    *tokenBucket // the bytes bucket, if limited
+}
+
+// newRateLimiter returns a rate limiter for a limit, or nil if the limit is disabled.
+func newRateLimiter(limit RateLimit, now time.Time) *rateLimiter {
+	rl := &rateLimiter{
+		limit:    limit,
+		messages: newTokenBucket(limit.Messages, limit.MessagesBurst, now),
+		bytes:    newTokenBucket(limit.Bytes, limit.BytesBurst, now),
+	}
+
+	if rl.messages == nil && rl.bytes == nil {
+		return nil
+	}
+
+	return rl
+}
+
+// take takes a publish of n bytes from the buckets. If the publish is over the limit, ok is
+// false and reason indicates which limit was exceeded. Under the delay policy the publish is
+// taken anyway, and wait is the time until the buckets have refilled enough to cover it;
+// otherwise nothing is taken.
+func (rl *rateLimiter) take(n int64, now time.Time) (reason packets.Code, wait time.Duration, ok bool) {
+	reason, ok = packets.CodeSuccess, true
+	for _, b := range []*tokenBucket{rl.messages, rl.bytes} {
+		if b != nil {
+			b.refill(now)
+		}
+	}
+
+	if rl.messages != nil && !rl.messages.ready(1) {
+		reason, ok = packets.ErrMessageRateTooHigh, false
+	} else if rl.bytes != nil && !rl.bytes.ready(float64(n)) {
+		reason, ok = packets.ErrQuotaExceeded, false
+	}
+
+	if !ok && rl.limit.Policy != "" && rl.limit.Policy != RateLimitDelay {
+		return reason, 0, false
+	}
+
+	if rl.messages != nil {
+		rl.messages.tokens--
+	}
+
+	if rl.bytes != nil {
+		rl.bytes.tokens -= float64(n)
+	}
+
+	if ok {
+		return reason, 0, true
+	}
+
+	for _, b := range []*tokenBucket{rl.messages, rl.bytes} {
+		if b != nil {
+			wait = max(wait, b.wait())
+		}
+	}
+
+	return reason, wait, false
+}
+
+// validateRateLimits returns an error if any of the configured rate limits are misconfigured.
+func (o *Options) validateRateLimits() error {
+	if err := o.RateLimit.validate(); err != nil {
+		return err
+	}
+
+	for id, limit := range o.ListenerRateLimits {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("listener %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// newClientRateLimiter returns the rate limiter for a client, using the limit of its listener
+// if set, or the global limit, as selected by any hooks.
+func (s *Server) newClientRateLimiter(cl *Client) *rateLimiter {
+	limit := s.Options.RateLimit
+	if v, ok := s.Options.ListenerRateLimits[cl.Net.Listener]; ok {
+		limit = v
+	}
+
+	limit = s.hooks.OnSelectRateLimit(cl, limit)
+	if err := limit.validate(); err != nil {
+		s.Log.Warn("ignored client rate limit", "client", cl.ID, "error", err)
+		return nil
+	}
+
+	return newRateLimiter(limit, time.Now())
+}
+
+// rateLimitPublish applies the rate limit of a client to an inbound publish, returning false
+// if the publish should not be processed.
+func (s *Server) rateLimitPublish(cl *Client, pk packets.Packet) (bool, error) {
+	rl := cl.State.rateLimiter
+	if rl == nil {
+		return true, nil
+	}
+
+	reason, wait, ok := rl.take(int64(pk.FixedHeader.Remaining), time.Now())
+	if ok {
+		return true, nil
+	}
+
+	atomic.AddInt64(&s.Info.RateLimited, 1)
+	s.hooks.OnRateLimited(cl, pk, rl.limit, reason)
+
+	switch rl.limit.Policy {
+	case RateLimitDrop:
+		atomic.AddInt64(&s.Info.RateLimitDropped, 1)
+		if pk.Properties.TopicAliasFlag && pk.Properties.TopicAlias > 0 {
+			cl.State.TopicAliases.Inbound.Set(pk.Properties.TopicAlias, pk.TopicName) // later publishes may use the alias.
+		}
+
+		return false, s.rejectPublish(cl, pk, packets.ErrQuotaExceeded)
+	case RateLimitDisconnect:
+		return false, s.DisconnectClient(cl, reason)
+	}
+
+	timer := time.NewTimer(wait) // delay reading any further packets from the client.
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-cl.State.open.Done():
+		return false, nil
+	}
+}
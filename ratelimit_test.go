@@ -0,0 +1,304 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+type rateLimitHook struct {
+	HookBase
+	sync.Mutex
+	limit   *RateLimit
+	reasons []packets.Code
+}
+
+func (h *rateLimitHook) ID() string {
+	return "rate-limit"
+}
+
+func (h *rateLimitHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnSelectRateLimit, OnRateLimited}, []byte{b})
+}
+
+func (h *rateLimitHook) OnSelectRateLimit(cl *Client, limit RateLimit) RateLimit {
+	if h.limit != nil {
+		return *h.limit
+	}
+	return limit
+}
+
+func (h *rateLimitHook) OnRateLimited(cl *Client, pk packets.Packet, limit RateLimit, reason packets.Code) {
+	h.Lock()
+	defer h.Unlock()
+	h.reasons = append(h.reasons, reason)
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	require.NoError(t, RateLimit{}.validate())
+	require.NoError(t, RateLimit{Messages: 1, Bytes: 10, Policy: RateLimitDelay}.validate())
+	require.NoError(t, RateLimit{Messages: 1, Policy: RateLimitDrop}.validate())
+	require.NoError(t, RateLimit{Messages: 1, Policy: RateLimitDisconnect}.validate())
+	require.ErrorIs(t, RateLimit{Messages: 1, Policy: "block"}.validate(), ErrRateLimitInvalid)
+	require.ErrorIs(t, RateLimit{Messages: -1}.validate(), ErrRateLimitInvalid)
+	require.ErrorIs(t, RateLimit{Bytes: 1, BytesBurst: -1}.validate(), ErrRateLimitInvalid)
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	now := time.Now()
+	require.Nil(t, newRateLimiter(RateLimit{Policy: RateLimitDrop}, now))
+
+	rl := newRateLimiter(RateLimit{Messages: 0.5}, now)
+	require.NotNil(t, rl)
+	require.Nil(t, rl.bytes)
+	require.Equal(t, float64(1), rl.messages.burst) // a burst of at least one message
+
+	rl = newRateLimiter(RateLimit{Bytes: 100, BytesBurst: 500}, now)
+	require.Nil(t, rl.messages)
+	require.Equal(t, float64(500), rl.bytes.burst)
+	require.Equal(t, float64(500), rl.bytes.tokens)
+}
+
+func TestRateLimiterTakeMessages(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(RateLimit{Messages: 2, Policy: RateLimitDrop}, now)
+
+	for i := 0; i < 2; i++ {
+		reason, wait, ok := rl.take(10, now)
+		require.True(t, ok)
+		require.Equal(t, packets.CodeSuccess, reason)
+		require.Equal(t, time.Duration(0), wait)
+	}
+
+	reason, _, ok := rl.take(10, now)
+	require.False(t, ok)
+	require.Equal(t, packets.ErrMessageRateTooHigh, reason)
+
+	_, _, ok = rl.take(10, now.Add(500*time.Millisecond)) // one message has been refilled.
+	require.True(t, ok)
+	_, _, ok = rl.take(10, now.Add(500*time.Millisecond))
+	require.False(t, ok)
+}
+
+func TestRateLimiterTakeBytes(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(RateLimit{Messages: 100, Bytes: 100, Policy: RateLimitDisconnect}, now)
+
+	_, _, ok := rl.take(80, now)
+	require.True(t, ok)
+
+	reason, _, ok := rl.take(80, now)
+	require.False(t, ok)
+	require.Equal(t, packets.ErrQuotaExceeded, reason)
+	require.Equal(t, float64(99), rl.messages.tokens) // nothing is taken from a refused publish.
+
+	_, _, ok = rl.take(250, now.Add(time.Second)) // larger than the burst, but the bucket is full.
+	require.True(t, ok)
+	require.Equal(t, float64(-150), rl.bytes.tokens)
+
+	_, _, ok = rl.take(1, now.Add(time.Second))
+	require.False(t, ok)
+}
+
+func TestRateLimiterTakeDelay(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(RateLimit{Messages: 10, MessagesBurst: 1, Bytes: 100}, now)
+
+	_, wait, ok := rl.take(10, now)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), wait)
+
+	reason, wait, ok := rl.take(10, now)
+	require.False(t, ok)
+	require.Equal(t, packets.ErrMessageRateTooHigh, reason)
+	require.Equal(t, 100*time.Millisecond, wait) // the delayed publish is taken in advance.
+
+	rl = newRateLimiter(RateLimit{Bytes: 100}, now)
+	_, _, ok = rl.take(80, now)
+	require.True(t, ok)
+
+	reason, wait, ok = rl.take(50, now)
+	require.False(t, ok)
+	require.Equal(t, packets.ErrQuotaExceeded, reason)
+	require.Equal(t, 300*time.Millisecond, wait) // 20 bytes were available, 50 taken.
+}
+
+func TestHooksOnSelectRateLimit(t *testing.T) {
+	h := new(Hooks)
+	require.NoError(t, h.Add(&rateLimitHook{limit: &RateLimit{Messages: 1}}, nil))
+	require.NoError(t, h.Add(new(HookBase), nil))
+	require.Equal(t, RateLimit{Messages: 1}, h.OnSelectRateLimit(new(Client), RateLimit{Messages: 10}))
+
+	require.NoError(t, h.Add(&rateLimitHook{limit: &RateLimit{Bytes: 5}}, nil))
+	require.Equal(t, RateLimit{Bytes: 5}, h.OnSelectRateLimit(new(Client), RateLimit{Messages: 10}))
+}
+
+func TestServerNewClientRateLimiter(t *testing.T) {
+	s := New(&Options{
+		Logger:    logger,
+		RateLimit: RateLimit{Messages: 10},
+		ListenerRateLimits: map[string]RateLimit{
+			"t1": {Bytes: 100},
+			"t2": {},
+		},
+	})
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "t0"
+	rl := s.newClientRateLimiter(cl)
+	require.Equal(t, RateLimit{Messages: 10}, rl.limit)
+
+	cl.Net.Listener = "t1"
+	rl = s.newClientRateLimiter(cl)
+	require.Equal(t, RateLimit{Bytes: 100}, rl.limit)
+
+	cl.Net.Listener = "t2"
+	require.Nil(t, s.newClientRateLimiter(cl)) // the listener disables the global limit.
+
+	hook := &rateLimitHook{limit: &RateLimit{Messages: 1, Policy: "bad"}}
+	require.NoError(t, s.AddHook(hook, nil))
+	require.Nil(t, s.newClientRateLimiter(cl))
+
+	hook.limit.Policy = RateLimitDrop
+	rl = s.newClientRateLimiter(cl)
+	require.Equal(t, RateLimit{Messages: 1, Policy: RateLimitDrop}, rl.limit)
+}
+
+func TestServerServeRateLimitInvalid(t *testing.T) {
+	s := New(&Options{
+		Logger:    logger,
+		RateLimit: RateLimit{Messages: 1, Policy: "block"},
+	})
+	defer s.Close()
+	require.ErrorIs(t, s.Serve(), ErrRateLimitInvalid)
+
+	s = New(&Options{
+		Logger:             logger,
+		ListenerRateLimits: map[string]RateLimit{"t1": {Bytes: -1}},
+	})
+	defer s.Close()
+	require.ErrorIs(t, s.Serve(), ErrRateLimitInvalid)
+}
+
+func TestServerRateLimitDrop(t *testing.T) {
+	hook := new(rateLimitHook)
+	s, l := newMemoryTestServer(t, &Options{
+		InlineClient: true,
+		RateLimit:    RateLimit{Messages: 0.001, MessagesBurst: 2, Policy: RateLimitDrop},
+	}, new(AllowHook), hook)
+
+	got := make(chan packets.Packet, 4)
+	require.NoError(t, s.Subscribe("a/b", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	c := connectMemoryTestClient(t, l, "chatty", "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("1"), 1, false))
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("2"), 0, false))
+	require.ErrorIs(t, c.Publish(ctx, "a/b", []byte("3"), 1, false), packets.ErrQuotaExceeded)
+	require.ErrorIs(t, c.Publish(ctx, "a/b", []byte("4"), 2, false), packets.ErrQuotaExceeded)
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&s.Info.RateLimitDropped) == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.RateLimited))
+	require.Len(t, got, 2)
+
+	hook.Lock()
+	defer hook.Unlock()
+	require.Equal(t, []packets.Code{packets.ErrMessageRateTooHigh, packets.ErrMessageRateTooHigh}, hook.reasons)
+}
+
+func TestServerRateLimitDropV3(t *testing.T) {
+	s, l := newMemoryTestServer(t, &Options{
+		RateLimit: RateLimit{Messages: 0.001, MessagesBurst: 1, Policy: RateLimitDrop},
+	}, new(AllowHook))
+
+	c := client.New(&client.Options{
+		ClientID:        "chatty",
+		ProtocolVersion: 4,
+		Clean:           true,
+		Logger:          logger,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return l.DialContext(ctx, "")
+		},
+	})
+	require.NoError(t, c.Connect(context.Background()))
+	defer c.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("1"), 0, false))
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("2"), 0, false)) // dropped silently.
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&s.Info.RateLimitDropped) == 1
+	}, time.Second, time.Millisecond)
+
+	_ = c.Publish(ctx, "a/b", []byte("3"), 1, false) // an ack without a reason code would read as success.
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("client not disconnected")
+	}
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.RateLimitDropped))
+}
+
+func TestServerRateLimitDisconnect(t *testing.T) {
+	hook := &rateLimitHook{limit: &RateLimit{Bytes: 0.001, BytesBurst: 20, Policy: RateLimitDisconnect}}
+	s, l := newMemoryTestServer(t, &Options{}, new(AllowHook), hook)
+
+	c := connectMemoryTestClient(t, l, "chatty", "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("small"), 1, false))
+	_ = c.Publish(ctx, "a/b", []byte("much larger than the burst"), 1, false)
+
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("client not disconnected")
+	}
+
+	require.ErrorIs(t, c.Err(), packets.ErrQuotaExceeded)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RateLimited))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.RateLimitDropped))
+}
+
+func TestServerRateLimitDelay(t *testing.T) {
+	hook := new(rateLimitHook)
+	s, l := newMemoryTestServer(t, &Options{
+		ListenerRateLimits: map[string]RateLimit{
+			"mem": {Messages: 20, MessagesBurst: 1},
+		},
+	}, new(AllowHook), hook)
+
+	c := connectMemoryTestClient(t, l, "chatty", "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Publish(ctx, "a/b", []byte("x"), 1, false))
+	}
+
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond) // two publishes waited 50ms each.
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.RateLimited))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.RateLimitDropped))
+}
@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/rs/xid"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const defaultResponseTopicPrefix = "$inline/response/"
+
+// RequestOptions contains options for an inline request.
+type RequestOptions struct {
+	Qos                 byte               // the qos of the request publish
+	ResponseTopicPrefix string             // the prefix of the generated response topic, default $inline/response/
+	Properties          packets.Properties // request properties; ResponseTopic and CorrelationData are always generated
+}
+
+// ResponderFn is the signature for a function which handles a request received by
+// Server.Handle and returns the payload of the response. If an error is returned,
+// no response is sent.
+type ResponderFn func(req packets.Packet) ([]byte, error)
+
+// requests tracks inline requests awaiting a response, keyed on correlation data.
+type requests struct {
+	pending   map[string]chan packets.Packet // response channels keyed on correlation id
+	listening map[string]bool                // response topic prefixes with an inline subscription
+	sync.Mutex
+}
+
+// Request publishes a request message using the inline client and waits for a response.
+// The request is published with a generated correlation id as Correlation Data, and a
+// per-call Response Topic beneath the response topic prefix. Responses are received by a
+// single inline subscription for each prefix and matched on Correlation Data. Request
+// returns the response packet, or the context error if the context is done first.
+func (s *Server) Request(ctx context.Context, topic string, payload []byte, opts *RequestOptions) (packets.Packet, error) {
+	if !s.Options.InlineClient {
+		return packets.Packet{}, ErrInlineClientNotEnabled
+	}
+
+	if opts == nil {
+		opts = new(RequestOptions)
+	}
+
+	prefix := opts.ResponseTopicPrefix
+	if prefix == "" {
+		prefix = defaultResponseTopicPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	if err := s.listenResponses(prefix); err != nil {
+		return packets.Packet{}, err
+	}
+
+	id := xid.New().String()
+	ch := make(chan packets.Packet, 1)
+	s.requests.Lock()
+	s.requests.pending[id] = ch
+	s.requests.Unlock()
+
+	defer func() {
+		s.requests.Lock()
+		delete(s.requests.pending, id)
+		s.requests.Unlock()
+	}()
+
+	props := opts.Properties.Copy(false)
+	props.ResponseTopic = prefix + id
+	props.CorrelationData = []byte(id)
+
+	err := s.InjectPacket(s.inlineClient, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  opts.Qos,
+		},
+		TopicName:  topic,
+		Payload:    payload,
+		Properties: props,
+		PacketID:   uint16(opts.Qos), // we never process the inbound qos, but we need a packet id for validity checks.
+	})
+	if err != nil {
+		return packets.Packet{}, err
+	}
+
+	select {
+	case pk := <-ch:
+		return pk, nil
+	case <-ctx.Done():
+		return packets.Packet{}, ctx.Err()
+	}
+}
+
+// listenResponses adds an inline subscription for responses beneath a response topic
+// prefix, if one does not already exist.
+func (s *Server) listenResponses(prefix string) error {
+	s.requests.Lock()
+	defer s.requests.Unlock()
+	if s.requests.listening[prefix] {
+		return nil
+	}
+
+	err := s.inlineSubscribe(s.inlineClient, prefix+"+", s.nextInlineSubID(), func(_ *Client, _ packets.Subscription, pk packets.Packet) {
+		s.requests.Lock()
+		ch, ok := s.requests.pending[string(pk.Properties.CorrelationData)]
+		s.requests.Unlock()
+		if !ok {
+			return // the request has already been answered or abandoned.
+		}
+
+		select {
+		case ch <- pk:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	s.requests.listening[prefix] = true
+	return nil
+}
+
+// Handle adds an inline subscription which responds to requests matching the topic filter.
+// For each message with a Response Topic, fn is called on a new goroutine and its result is
+// published to the Response Topic with the request's Correlation Data, using the inline client
+// and the qos of the request. Messages without a Response Topic are ignored. The returned
+// function removes the subscription.
+func (s *Server) Handle(filter string, fn ResponderFn) (func(), error) {
+	if !s.Options.InlineClient {
+		return nil, ErrInlineClientNotEnabled
+	}
+
+	if fn == nil {
+		return nil, packets.ErrInlineSubscriptionHandlerInvalid
+	}
+
+	id := s.nextInlineSubID()
+	err := s.inlineSubscribe(s.inlineClient, filter, id, func(_ *Client, _ packets.Subscription, pk packets.Packet) {
+		if pk.Properties.ResponseTopic == "" {
+			return
+		}
+
+		if !s.responseAllowed(pk) {
+			s.Log.Warn("inline request response topic not allowed", "topic", pk.Properties.ResponseTopic, "client", pk.Origin)
+			return
+		}
+
+		go s.respond(pk, fn)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		_ = s.inlineUnsubscribe(s.inlineClient, filter, id)
+	}, nil
+}
+
+// responseAllowed returns true if the Response Topic of a request is a valid topic name which
+// the requesting client may publish to, or is beneath its own response topic prefix, so that
+// responses published by the inline client cannot be used to reach other topics.
+func (s *Server) responseAllowed(req packets.Packet) bool {
+	topic := req.Properties.ResponseTopic
+	if !IsValidFilter(topic, true) {
+		return false
+	}
+
+	if s.inlineClient != nil && req.Origin == s.inlineClient.ID {
+		return true
+	}
+
+	cl, ok := s.Clients.Get(req.Origin)
+	if !ok {
+		return false
+	}
+
+	if prefix := cl.Properties.Props.ResponseInfo; prefix != "" && beneathPrefix(topic, prefix) {
+		return true
+	}
+
+	return s.aclCheck(cl, topic, true)
+}
+
+// respond calls a responder function for a request and publishes the response.
+func (s *Server) respond(req packets.Packet, fn ResponderFn) {
+	payload, err := fn(req)
+	if err != nil {
+		s.Log.Debug("inline responder failed", "error", err, "topic", req.TopicName, "client", req.Origin)
+		return
+	}
+
+	err = s.InjectPacket(s.inlineClient, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  req.FixedHeader.Qos,
+		},
+		TopicName: req.Properties.ResponseTopic,
+		Payload:   payload,
+		Properties: packets.Properties{
+			CorrelationData: req.Properties.CorrelationData,
+		},
+		PacketID: uint16(req.FixedHeader.Qos),
+	})
+	if err != nil {
+		s.Log.Warn("failed publishing inline response", "error", err, "topic", req.Properties.ResponseTopic)
+	}
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+func TestRequestNotEnabled(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	_, err := s.Request(context.Background(), "svc/echo", nil, nil)
+	require.ErrorIs(t, err, ErrInlineClientNotEnabled)
+
+	_, err = s.Handle("svc/echo", func(req packets.Packet) ([]byte, error) { return nil, nil })
+	require.ErrorIs(t, err, ErrInlineClientNotEnabled)
+}
+
+func TestRequestHandle(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	_, err := s.Handle("svc/echo", nil)
+	require.ErrorIs(t, err, packets.ErrInlineSubscriptionHandlerInvalid)
+
+	cancel, err := s.Handle("svc/+", func(req packets.Packet) ([]byte, error) {
+		return append([]byte("re: "+req.Properties.ContentType+" "), req.Payload...), nil
+	})
+	require.NoError(t, err)
+
+	ctx, done := context.WithTimeout(context.Background(), time.Second)
+	defer done()
+	pk, err := s.Request(ctx, "svc/echo", []byte("hello"), &RequestOptions{
+		Qos:        1,
+		Properties: packets.Properties{ContentType: "json"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("re: json hello"), pk.Payload)
+	require.NotEmpty(t, pk.Properties.CorrelationData)
+	require.Equal(t, defaultResponseTopicPrefix+string(pk.Properties.CorrelationData), pk.TopicName)
+
+	pk, err = s.Request(ctx, "svc/echo", []byte("again"), &RequestOptions{ResponseTopicPrefix: "replies"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("re:  again"), pk.Payload)
+	require.True(t, strings.HasPrefix(pk.TopicName, "replies/"))
+	require.Len(t, s.requests.listening, 2)
+	require.Len(t, s.requests.pending, 0)
+
+	cancel()
+	require.Len(t, s.Topics.Subscribers("svc/echo").InlineSubscriptions, 0)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	_, err := s.Handle("svc/fail", func(req packets.Packet) ([]byte, error) {
+		return nil, errors.New("failed")
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = s.Request(ctx, "svc/fail", []byte("hello"), nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, s.requests.pending, 0)
+}
+
+func TestRequestInvalidTopic(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	_, err := s.Request(context.Background(), "svc/echo", nil, &RequestOptions{ResponseTopicPrefix: "a/#/b"})
+	require.ErrorIs(t, err, packets.ErrTopicFilterInvalid)
+}
+
+func TestHandleIgnoresNonRequests(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	called := make(chan struct{}, 1)
+	_, err := s.Handle("svc/echo", func(req packets.Packet) ([]byte, error) {
+		called <- struct{}{}
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Publish("svc/echo", []byte("hello"), false, 0))
+	select {
+	case <-called:
+		t.Fatal("responder called without response topic")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestHandleResponseTopicNotAllowed(t *testing.T) {
+	s, l := newMemoryTestServer(t, &Options{InlineClient: true}, new(RemoteHook)) // denies the topic "denied".
+
+	called := make(chan string, 3)
+	_, err := s.Handle("svc/echo", func(req packets.Packet) ([]byte, error) {
+		called <- req.Properties.ResponseTopic
+		return []byte("pong"), nil
+	})
+	require.NoError(t, err)
+
+	c := connectMemoryTestClient(t, l, "requester", "", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, topic := range []string{"denied", "$SYS/broker", "allowed"} {
+		require.NoError(t, c.PublishPacket(ctx, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			TopicName:   "svc/echo",
+			Properties:  packets.Properties{ResponseTopic: topic, CorrelationData: []byte("1")},
+		}))
+	}
+
+	select {
+	case topic := <-called:
+		require.Equal(t, "allowed", topic)
+	case <-ctx.Done():
+		t.Fatal("responder not called")
+	}
+
+	select {
+	case topic := <-called:
+		t.Fatal("responder called for " + topic)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRequestRemoteResponder(t *testing.T) {
+	s := New(&Options{Logger: logger, InlineClient: true})
+	require.NoError(t, s.AddHook(new(AllowHook), nil))
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	c := client.New(&client.Options{
+		ClientID:        "responder",
+		ProtocolVersion: 5,
+		Clean:           true,
+		Logger:          logger,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return l.DialContext(ctx, "")
+		},
+	})
+	require.NoError(t, c.Connect(context.Background()))
+	defer c.Disconnect()
+
+	_, err := c.Subscribe(context.Background(), func(c *client.Client, pk packets.Packet) {
+		_ = c.PublishPacket(context.Background(), packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			TopicName:   pk.Properties.ResponseTopic,
+			Payload:     []byte("pong"),
+			Properties:  packets.Properties{CorrelationData: pk.Properties.CorrelationData},
+		})
+	}, packets.Subscription{Filter: "svc/ping", Qos: 1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pk, err := s.Request(ctx, "svc/ping", []byte("ping"), &RequestOptions{Qos: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), pk.Payload)
+	require.Equal(t, "responder", pk.Origin)
+}
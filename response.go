@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	responseInfoClientID = "{clientid}" // replaced with the client id in the response information template
+	responseInfoUsername = "{username}" // replaced with the username in the response information template
+	maxResponseGrants    = 64           // the most response topic prefixes a client may be granted at once
+)
+
+// responseGrant is a response topic prefix a client has been granted write access to.
+type responseGrant struct {
+	owner string // the id of the requesting client, or empty for inline requests
+	seq   uint64 // the order in which the grant was added
+}
+
+// responseGrants is a set of response topic prefixes a client has been granted write access
+// to by receiving a request which carried a response topic beneath them. Each prefix ends
+// with a topic level separator. The oldest grant is dropped when the set is full.
+type responseGrants struct {
+	internal map[string]responseGrant
+	seq      uint64
+	sync.RWMutex
+}
+
+// add grants write access to a response topic prefix of a requesting client.
+func (g *responseGrants) add(prefix, owner string) {
+	g.Lock()
+	defer g.Unlock()
+	if g.internal == nil {
+		g.internal = map[string]responseGrant{}
+	}
+
+	if _, ok := g.internal[prefix]; !ok && len(g.internal) >= maxResponseGrants {
+		oldest := ""
+		for k, v := range g.internal {
+			if oldest == "" || v.seq < g.internal[oldest].seq {
+				oldest = k
+			}
+		}
+		delete(g.internal, oldest)
+	}
+
+	g.seq++
+	g.internal[prefix] = responseGrant{owner: owner, seq: g.seq}
+}
+
+// remove revokes write access to a response topic prefix.
+func (g *responseGrants) remove(prefix string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.internal, prefix)
+}
+
+// len returns the number of granted prefixes.
+func (g *responseGrants) len() int {
+	g.RLock()
+	defer g.RUnlock()
+	return len(g.internal)
+}
+
+// match returns the granted prefix a topic is beneath, and the client which owns it.
+// Only the prefixes of the topic are looked up, so the cost does not depend on the
+// number of grants.
+func (g *responseGrants) match(topic string) (prefix string, grant responseGrant, ok bool) {
+	g.RLock()
+	defer g.RUnlock()
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '/' {
+			if grant, ok = g.internal[topic[:i+1]]; ok {
+				return topic[:i+1], grant, true
+			}
+		}
+	}
+
+	grant, ok = g.internal[topic+"/"]
+	return topic + "/", grant, ok
+}
+
+// beneathPrefix returns true if a topic or filter is beneath a response topic prefix ending
+// with a topic level separator, or is the prefix without the separator. Matching on whole
+// levels keeps the prefix resp/c1/ from matching resp/c10/.
+func beneathPrefix(topic, prefix string) bool {
+	return strings.HasPrefix(topic, prefix) || topic == strings.TrimSuffix(prefix, "/")
+}
+
+// responseInfo returns the response topic prefix for a client from the response information
+// template, or an empty string if the template is not set or the client id or username would
+// produce a prefix overlapping with those of other clients.
+func (s *Server) responseInfo(cl *Client) string {
+	tmpl := s.Options.Capabilities.ResponseInformation
+	if tmpl == "" {
+		return ""
+	}
+
+	for _, v := range []string{cl.ID, string(cl.Properties.Username)} {
+		if strings.ContainsAny(v, "/+#") {
+			return ""
+		}
+	}
+
+	if strings.Contains(tmpl, responseInfoUsername) && len(cl.Properties.Username) == 0 {
+		return ""
+	}
+
+	prefix := strings.NewReplacer(
+		responseInfoClientID, cl.ID,
+		responseInfoUsername, string(cl.Properties.Username),
+	).Replace(tmpl)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	if !IsValidFilter(prefix, true) {
+		return ""
+	}
+
+	return prefix
+}
+
+// grantResponse grants a client write access to the response topic prefix of a request it
+// is receiving, if the response topic is beneath the prefix assigned to the requesting client,
+// or beneath a response topic prefix used by inline requests. The grant lasts as long as the
+// requesting client's session, see responseGrantLive.
+func (s *Server) grantResponse(cl *Client, pk packets.Packet) {
+	topic := pk.Properties.ResponseTopic
+	if topic == "" || s.Options.Capabilities.ResponseInformation == "" {
+		return
+	}
+
+	if s.inlineClient != nil && pk.Origin == s.inlineClient.ID {
+		s.requests.Lock()
+		defer s.requests.Unlock()
+		for prefix := range s.requests.listening {
+			if beneathPrefix(topic, prefix) {
+				cl.State.responseGrants.add(prefix, "")
+				return
+			}
+		}
+		return
+	}
+
+	if owner, ok := s.Clients.Get(pk.Origin); ok {
+		prefix := owner.Properties.Props.ResponseInfo
+		if prefix != "" && beneathPrefix(topic, prefix) {
+			cl.State.responseGrants.add(prefix, owner.ID)
+		}
+	}
+}
+
+// responseGrantLive returns true if the requesting client which owns a granted response
+// topic prefix still has a session with that prefix, or if an inline subscription is still
+// listening beneath it.
+func (s *Server) responseGrantLive(prefix string, grant responseGrant) bool {
+	if grant.owner == "" {
+		s.requests.Lock()
+		defer s.requests.Unlock()
+		return s.requests.listening[prefix]
+	}
+
+	owner, ok := s.Clients.Get(grant.owner)
+	return ok && owner.Properties.Props.ResponseInfo == prefix
+}
+
+// aclCheck returns true if a client may read or write a topic. If response information is
+// enabled, clients may always read beneath their own response topic prefix, and write beneath
+// any prefix they have been granted by receiving a request. Grants are revoked once the
+// requesting client's session has ended. Otherwise, the acl hooks decide.
+func (s *Server) aclCheck(cl *Client, topic string, write bool) bool {
+	if s.Options.Capabilities.ResponseInformation != "" {
+		if prefix := cl.Properties.Props.ResponseInfo; !write && prefix != "" && beneathPrefix(topic, prefix) {
+			return true
+		}
+
+		if write {
+			if prefix, grant, ok := cl.State.responseGrants.match(topic); ok {
+				if s.responseGrantLive(prefix, grant) {
+					return true
+				}
+				cl.State.responseGrants.remove(prefix)
+			}
+		}
+	}
+
+	return s.hooks.OnACLCheck(cl, topic, write)
+}
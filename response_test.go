@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+func TestServerResponseInfo(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl := s.NewClient(nil, "tcp", "alice", false)
+	require.Equal(t, "", s.responseInfo(cl))
+
+	s.Options.Capabilities.ResponseInformation = "resp/{clientid}/"
+	require.Equal(t, "resp/alice/", s.responseInfo(cl))
+
+	s.Options.Capabilities.ResponseInformation = "resp/{username}/{clientid}/"
+	require.Equal(t, "", s.responseInfo(cl)) // no username
+	cl.Properties.Username = []byte("team")
+	require.Equal(t, "resp/team/alice/", s.responseInfo(cl))
+
+	cl.ID = "alice/bob"
+	require.Equal(t, "", s.responseInfo(cl))
+	cl.ID = "alice+"
+	require.Equal(t, "", s.responseInfo(cl))
+
+	s.Options.Capabilities.ResponseInformation = "$SYS/{clientid}/"
+	cl.ID = "alice"
+	require.Equal(t, "", s.responseInfo(cl))
+
+	s.Options.Capabilities.ResponseInformation = "resp/{clientid}"
+	require.Equal(t, "resp/alice/", s.responseInfo(cl)) // always ends with a level separator
+}
+
+// newResponseGrantTestServer returns a server which denies every topic to its acl hooks,
+// with a requesting client for each id.
+func newResponseGrantTestServer(ids ...string) (*Server, []*Client) {
+	s := New(&Options{Logger: logger})
+	s.Options.Capabilities.ResponseInformation = "resp/{clientid}"
+	_ = s.AddHook(new(UsernameHook), nil)
+
+	var cls []*Client
+	for _, id := range ids {
+		cl := s.NewClient(nil, "tcp", id, false)
+		cl.Properties.Props.ResponseInfo = s.responseInfo(cl)
+		s.Clients.Add(cl)
+		cls = append(cls, cl)
+	}
+	return s, cls
+}
+
+func TestServerResponseInfoLevelBoundary(t *testing.T) {
+	s, cls := newResponseGrantTestServer("c1", "c10", "responder")
+	defer s.Close()
+	c1, c10, responder := cls[0], cls[1], cls[2]
+
+	require.True(t, s.aclCheck(c1, "resp/c1/#", false))
+	require.True(t, s.aclCheck(c1, "resp/c1", false))
+	require.False(t, s.aclCheck(c1, "resp/c10/#", false))
+	require.False(t, s.aclCheck(c1, "resp/c10", false))
+	require.True(t, s.aclCheck(c10, "resp/c10/#", false))
+
+	s.grantResponse(responder, packets.Packet{Origin: "c1", Properties: packets.Properties{ResponseTopic: "resp/c1/1"}})
+	require.True(t, s.aclCheck(responder, "resp/c1/1", true))
+	require.True(t, s.aclCheck(responder, "resp/c1", true))
+	require.False(t, s.aclCheck(responder, "resp/c10/1", true))
+
+	s.grantResponse(responder, packets.Packet{Origin: "c1", Properties: packets.Properties{ResponseTopic: "resp/c10/1"}})
+	require.False(t, s.aclCheck(responder, "resp/c10/1", true)) // not beneath the requester's prefix
+}
+
+func TestServerResponseGrantRevoked(t *testing.T) {
+	s, cls := newResponseGrantTestServer("alice", "responder")
+	defer s.Close()
+	alice, responder := cls[0], cls[1]
+
+	s.grantResponse(responder, packets.Packet{Origin: "alice", Properties: packets.Properties{ResponseTopic: "resp/alice/1"}})
+	require.True(t, s.aclCheck(responder, "resp/alice/1", true))
+
+	s.Clients.Delete(alice.ID) // the requesting session has ended.
+	require.False(t, s.aclCheck(responder, "resp/alice/1", true))
+	require.Equal(t, 0, responder.State.responseGrants.len())
+
+	alice = s.NewClient(nil, "tcp", "alice", false)
+	s.Clients.Add(alice) // a new session without response information.
+	s.grantResponse(responder, packets.Packet{Origin: "alice", Properties: packets.Properties{ResponseTopic: "resp/alice/1"}})
+	require.False(t, s.aclCheck(responder, "resp/alice/1", true))
+}
+
+func TestResponseGrantsBounded(t *testing.T) {
+	g := new(responseGrants)
+	for i := 0; i < maxResponseGrants+10; i++ {
+		g.add("resp/"+strconv.Itoa(i)+"/", "")
+	}
+	require.Equal(t, maxResponseGrants, g.len())
+
+	_, _, ok := g.match("resp/0/1")
+	require.False(t, ok) // the oldest grants are dropped first.
+
+	prefix, _, ok := g.match("resp/" + strconv.Itoa(maxResponseGrants+9) + "/1")
+	require.True(t, ok)
+	require.Equal(t, "resp/"+strconv.Itoa(maxResponseGrants+9)+"/", prefix)
+}
+
+func TestServerResponseInfoACL(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	s.Options.Capabilities.ResponseInformation = "resp/{clientid}/"
+	require.NoError(t, s.AddHook(new(UsernameHook), nil)) // only topics beneath req/ are allowed for username req
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	connect := func(id string, request bool) (*client.Client, packets.Packet) {
+		connack := make(chan packets.Packet, 1)
+		opts := &client.Options{
+			ClientID:        id,
+			Username:        "req",
+			ProtocolVersion: 5,
+			Clean:           true,
+			Logger:          logger,
+			OnConnect: func(c *client.Client, ack packets.Packet) {
+				connack <- ack
+			},
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				return l.DialContext(ctx, "")
+			},
+		}
+		if request {
+			opts.Properties.RequestResponseInfo = 1
+		}
+
+		c := client.New(opts)
+		require.NoError(t, c.Connect(context.Background()))
+		return c, <-connack
+	}
+
+	alice, ack := connect("alice", true)
+	defer alice.Disconnect()
+	require.Equal(t, "resp/alice/", ack.Properties.ResponseInfo)
+
+	bob, ack := connect("bob", false)
+	defer bob.Disconnect()
+	require.Equal(t, "", ack.Properties.ResponseInfo)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := alice.Subscribe(ctx, nil, packets.Subscription{Filter: "resp/bob/#", Qos: 1})
+	require.ErrorContains(t, err, "0x87") // not authorized
+
+	responses := make(chan packets.Packet, 1)
+	codes, err := alice.Subscribe(ctx, func(c *client.Client, pk packets.Packet) {
+		responses <- pk
+	}, packets.Subscription{Filter: "resp/alice/#", Qos: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, codes)
+
+	require.Error(t, bob.Publish(ctx, "resp/alice/0", []byte("early"), 1, false)) // not yet granted
+
+	replied := make(chan error, 1)
+	_, err = bob.Subscribe(ctx, func(c *client.Client, pk packets.Packet) {
+		go func() {
+			replied <- c.PublishPacket(ctx, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+				TopicName:   pk.Properties.ResponseTopic,
+				Payload:     []byte("pong"),
+				Properties:  packets.Properties{CorrelationData: pk.Properties.CorrelationData},
+			})
+		}()
+	}, packets.Subscription{Filter: "req/rpc", Qos: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, alice.PublishPacket(ctx, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "req/rpc",
+		Payload:     []byte("ping"),
+		Properties: packets.Properties{
+			ResponseTopic:   "resp/alice/1",
+			CorrelationData: []byte("1"),
+		},
+	}))
+
+	require.NoError(t, <-replied)
+	select {
+	case pk := <-responses:
+		require.Equal(t, "resp/alice/1", pk.TopicName)
+		require.Equal(t, []byte("pong"), pk.Payload)
+		require.Equal(t, []byte("1"), pk.Properties.CorrelationData)
+	case <-ctx.Done():
+		t.Fatal("response not received")
+	}
+
+	require.Error(t, bob.Publish(ctx, "resp/carol/1", []byte("x"), 1, false)) // only the granted prefix
+}
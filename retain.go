@@ -0,0 +1,315 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	RetainReject      = "reject"       // reject new retained messages when the store is full
+	RetainEvictOldest = "evict_oldest" // evict the least recently updated retained messages to make space
+)
+
+// ErrRetainLimitsInvalid indicates that the retain limits are misconfigured.
+var ErrRetainLimitsInvalid = errors.New("invalid retain limits")
+
+// RetainLimits configures limits on the retained messages published by clients. A zero limit
+// is unlimited. Retained messages which exceed a limit are rejected with a quota exceeded reason
+// code, unless the store is full and the policy evicts older messages to make space.
+type RetainLimits struct {
+	MaxMessages int64       `yaml:"max_messages" json:"max_messages"` // the maximum number of retained messages
+	MaxBytes    int64       `yaml:"max_bytes" json:"max_bytes"`       // the maximum total bytes of retained payloads
+	MaxPayload  int64       `yaml:"max_payload" json:"max_payload"`   // the maximum bytes of a single retained payload
+	Policy      string      `yaml:"policy" json:"policy"`             // reject or evict_oldest when the store is full; reject if empty
+	User        RetainQuota `yaml:"user" json:"user"`                 // the default quota of each user
+}
+
+// RetainQuota limits the retained messages held for the publishes of a single user, or of a
+// single client if it did not connect with a username. A zero limit is unlimited.
+type RetainQuota struct {
+	Messages int64 `yaml:"messages" json:"messages"` // the maximum number of retained messages
+	Bytes    int64 `yaml:"bytes" json:"bytes"`       // the maximum total bytes of retained payloads
+}
+
+// validate returns an error if the retain limits are misconfigured.
+func (o RetainLimits) validate() error {
+	switch o.Policy {
+	case "", RetainReject, RetainEvictOldest:
+	default:
+		return fmt.Errorf("unknown policy %q; %w", o.Policy, ErrRetainLimitsInvalid)
+	}
+
+	if o.MaxMessages < 0 || o.MaxBytes < 0 || o.MaxPayload < 0 {
+		return fmt.Errorf("negative value; %w", ErrRetainLimitsInvalid)
+	}
+
+	return o.User.validate()
+}
+
+// validate returns an error if the retain quota is misconfigured.
+func (o RetainQuota) validate() error {
+	if o.Messages < 0 || o.Bytes < 0 {
+		return fmt.Errorf("negative quota; %w", ErrRetainLimitsInvalid)
+	}
+
+	return nil
+}
+
+// retainedEntry is the accounting for a single retained message.
+type retainedEntry struct {
+	topic string // the topic of the message
+	owner string // the user or client the message is counted against, if any
+	size  int64  // the bytes of the message payload
+}
+
+// retainUsage is the number and total bytes of the retained messages of an owner.
+type retainUsage struct {
+	messages int64
+	bytes    int64
+}
+
+// retainLedger tracks the retained messages published by clients, ordered by when they were
+// last updated, so that limits can be enforced. Lock it while checking and updating.
+type retainLedger struct {
+	sync.Mutex
+	order  *list.List               // entries, least recently updated first
+	topics map[string]*list.Element // entries keyed on topic
+	owners map[string]retainUsage   // usage keyed on owner
+	bytes  int64                    // total bytes of retained payloads
+}
+
+// newRetainLedger returns a new instance of retainLedger.
+func newRetainLedger() *retainLedger {
+	return &retainLedger{
+		order:  list.New(),
+		topics: map[string]*list.Element{},
+		owners: map[string]retainUsage{},
+	}
+}
+
+// Len returns the number of tracked retained messages.
+func (l *retainLedger) Len() int {
+	return l.order.Len()
+}
+
+// get returns the entry for a topic, if tracked.
+func (l *retainLedger) get(topic string) (*retainedEntry, bool) {
+	if el, ok := l.topics[topic]; ok {
+		return el.Value.(*retainedEntry), true
+	}
+
+	return nil, false
+}
+
+// set adds or replaces the entry for a topic, marking it as the most recently updated.
+func (l *retainLedger) set(topic, owner string, size int64) {
+	l.remove(topic)
+	l.topics[topic] = l.order.PushBack(&retainedEntry{topic: topic, owner: owner, size: size})
+	l.bytes += size
+	if owner != "" {
+		u := l.owners[owner]
+		u.messages++
+		u.bytes += size
+		l.owners[owner] = u
+	}
+}
+
+// remove deletes the entry for a topic, if tracked.
+func (l *retainLedger) remove(topic string) {
+	el, ok := l.topics[topic]
+	if !ok {
+		return
+	}
+
+	e := l.order.Remove(el).(*retainedEntry)
+	delete(l.topics, topic)
+	l.bytes -= e.size
+	if e.owner != "" {
+		u := l.owners[e.owner]
+		u.messages--
+		u.bytes -= e.size
+		if u.messages > 0 {
+			l.owners[e.owner] = u
+		} else {
+			delete(l.owners, e.owner)
+		}
+	}
+}
+
+// retainOwner returns the user or client whose quota a retained message published by the client
+// is counted against. Messages from the inline client are not counted against any quota.
+func retainOwner(cl *Client) string {
+	if cl.Net.Inline {
+		return ""
+	}
+
+	if len(cl.Properties.Username) > 0 {
+		return string(cl.Properties.Username)
+	}
+
+	return cl.ID
+}
+
+// selectRetainQuota returns the retain quota of a client, using the default user quota as
+// selected by any hooks.
+func (s *Server) selectRetainQuota(cl *Client) RetainQuota {
+	q := s.hooks.OnSelectRetainQuota(cl, s.Options.RetainLimits.User)
+	if err := q.validate(); err != nil {
+		s.Log.Warn("ignored client retain quota", "client", cl.ID, "error", err)
+		return RetainQuota{}
+	}
+
+	return q
+}
+
+// retainMessage adds a message to a topic, and if a persistent store is provided,
+// adds the message to the store to be reloaded if necessary. It returns ErrQuotaExceeded
+// if the message was rejected by the retain limits.
+func (s *Server) retainMessage(cl *Client, pk packets.Packet) error {
+	if s.Options.Capabilities.RetainAvailable == 0 || pk.Ignore {
+		return nil
+	}
+
+	out := pk.Copy(false)
+	var quota RetainQuota
+	if len(out.Payload) > 0 && retainOwner(cl) != "" {
+		quota = s.selectRetainQuota(cl)
+	}
+
+	s.retained.Lock()
+	var evicted []string
+	if len(out.Payload) > 0 {
+		var reason string
+		evicted, reason = s.admitRetained(retainOwner(cl), out, quota, true)
+		if reason != "" {
+			s.retained.Unlock()
+			return s.rejectRetained(cl, pk, reason)
+		}
+		s.retained.set(out.TopicName, retainOwner(cl), int64(len(out.Payload)))
+	} else {
+		s.retained.remove(out.TopicName)
+	}
+
+	r := s.Topics.RetainMessage(out)
+	s.retained.Unlock()
+
+	for _, topic := range evicted {
+		s.hooks.OnRetainedExpired(topic)
+	}
+
+	s.hooks.OnRetainMessage(cl, pk, r)
+	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+	return nil
+}
+
+// checkRetained checks a retained message against the retain limits without retaining it,
+// such as when a delayed retained message is accepted. Space which could be made by evicting
+// messages is counted as free, as it is only made when the message is retained. It returns
+// ErrQuotaExceeded if the message would be rejected.
+func (s *Server) checkRetained(cl *Client, pk packets.Packet) error {
+	if s.Options.Capabilities.RetainAvailable == 0 || pk.Ignore || len(pk.Payload) == 0 {
+		return nil
+	}
+
+	var quota RetainQuota
+	if retainOwner(cl) != "" {
+		quota = s.selectRetainQuota(cl)
+	}
+
+	s.retained.Lock()
+	_, reason := s.admitRetained(retainOwner(cl), pk, quota, false)
+	s.retained.Unlock()
+	if reason != "" {
+		return s.rejectRetained(cl, pk, reason)
+	}
+
+	return nil
+}
+
+// retainRefusable returns true if a publish whose retained message was refused by the retain
+// limits can be rejected with a reason code, which is only possible for inline clients and for
+// v5 clients publishing with qos > 0. Other publishes are delivered without being retained.
+func retainRefusable(cl *Client, pk packets.Packet) bool {
+	return cl.Net.Inline || (pk.FixedHeader.Qos > 0 && cl.Properties.ProtocolVersion == 5)
+}
+
+// rejectRetained records a retained message rejected by the retain limits.
+func (s *Server) rejectRetained(cl *Client, pk packets.Packet, reason string) error {
+	atomic.AddInt64(&s.Info.RetainedRejected, 1)
+	s.Log.Warn("retained message rejected", "client", cl.ID, "listener", cl.Net.Listener, "topic", pk.TopicName, "reason", reason)
+	return packets.ErrQuotaExceeded
+}
+
+// admitRetained checks a retained message from an owner against the retain limits, evicting
+// the least recently updated messages to make space if the policy allows and evict is true.
+// It returns the topics of any evicted messages, or the reason the message was rejected.
+// The retained ledger must be locked.
+func (s *Server) admitRetained(owner string, pk packets.Packet, q RetainQuota, evict bool) (evicted []string, reason string) {
+	limits := s.Options.RetainLimits
+	size := int64(len(pk.Payload))
+	if limits.MaxPayload > 0 && size > limits.MaxPayload {
+		return nil, "payload too large"
+	}
+
+	count, bytes := int64(s.retained.Len()), s.retained.bytes
+	existing, replaces := s.retained.get(pk.TopicName)
+	if replaces { // the message replaces the existing message of the topic.
+		count--
+		bytes -= existing.size
+	}
+
+	if owner != "" {
+		u := s.retained.owners[owner]
+		if replaces && existing.owner == owner {
+			u.messages--
+			u.bytes -= existing.size
+		}
+
+		if (q.Messages > 0 && u.messages+1 > q.Messages) || (q.Bytes > 0 && u.bytes+size > q.Bytes) {
+			return nil, "user quota exceeded"
+		}
+	}
+
+	full := func() bool {
+		return (limits.MaxMessages > 0 && count+1 > limits.MaxMessages) ||
+			(limits.MaxBytes > 0 && bytes+size > limits.MaxBytes)
+	}
+
+	if !full() {
+		return nil, ""
+	}
+
+	if limits.Policy != RetainEvictOldest || (limits.MaxBytes > 0 && size > limits.MaxBytes) {
+		return nil, "store full"
+	}
+
+	if !evict {
+		return nil, ""
+	}
+
+	for el := s.retained.order.Front(); el != nil && full(); el = el.Next() {
+		if e := el.Value.(*retainedEntry); e.topic != pk.TopicName {
+			evicted = append(evicted, e.topic)
+			count--
+			bytes -= e.size
+		}
+	}
+
+	for _, topic := range evicted {
+		s.retained.remove(topic)
+		s.Topics.RetainMessage(packets.Packet{TopicName: topic})
+		atomic.AddInt64(&s.Info.RetainedEvicted, 1)
+		s.Log.Debug("evicted retained message", "topic", topic)
+	}
+
+	return evicted, ""
+}
@@ -0,0 +1,325 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+type retainQuotaHook struct {
+	HookBase
+	q       *RetainQuota
+	expired []string
+}
+
+func (h *retainQuotaHook) ID() string {
+	return "retain-quota"
+}
+
+func (h *retainQuotaHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnSelectRetainQuota, OnRetainedExpired}, []byte{b})
+}
+
+func (h *retainQuotaHook) OnSelectRetainQuota(cl *Client, q RetainQuota) RetainQuota {
+	if h.q != nil {
+		return *h.q
+	}
+	return q
+}
+
+func (h *retainQuotaHook) OnRetainedExpired(filter string) {
+	h.expired = append(h.expired, filter)
+}
+
+// retainTestPacket returns a retained publish packet.
+func retainTestPacket(topic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+	}
+}
+
+func TestRetainLimitsValidate(t *testing.T) {
+	require.NoError(t, RetainLimits{}.validate())
+	require.NoError(t, RetainLimits{MaxMessages: 10, MaxBytes: 1024, Policy: RetainEvictOldest}.validate())
+	require.ErrorIs(t, RetainLimits{Policy: "random"}.validate(), ErrRetainLimitsInvalid)
+	require.ErrorIs(t, RetainLimits{MaxPayload: -1}.validate(), ErrRetainLimitsInvalid)
+	require.ErrorIs(t, RetainLimits{User: RetainQuota{Bytes: -1}}.validate(), ErrRetainLimitsInvalid)
+}
+
+func TestServerServeRetainLimitsInvalid(t *testing.T) {
+	s := New(&Options{Logger: logger, RetainLimits: RetainLimits{Policy: "random"}})
+	defer s.Close()
+	require.ErrorIs(t, s.Serve(), ErrRetainLimitsInvalid)
+}
+
+func TestRetainLedger(t *testing.T) {
+	l := newRetainLedger()
+	l.set("a", "zen", 10)
+	l.set("b", "zen", 5)
+	l.set("c", "", 1)
+	require.Equal(t, 3, l.Len())
+	require.Equal(t, int64(16), l.bytes)
+	require.Equal(t, retainUsage{messages: 2, bytes: 15}, l.owners["zen"])
+
+	l.set("a", "mochi", 3) // replaced by another owner.
+	require.Equal(t, int64(9), l.bytes)
+	require.Equal(t, retainUsage{messages: 1, bytes: 5}, l.owners["zen"])
+	require.Equal(t, retainUsage{messages: 1, bytes: 3}, l.owners["mochi"])
+	require.Equal(t, "a", l.order.Back().Value.(*retainedEntry).topic) // most recently updated.
+
+	l.remove("b")
+	l.remove("b")
+	require.Equal(t, 2, l.Len())
+	require.NotContains(t, l.owners, "zen")
+	_, ok := l.get("b")
+	require.False(t, ok)
+}
+
+func TestServerRetainMessageMaxPayload(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.RetainLimits = RetainLimits{MaxPayload: 4}
+	cl, _, _ := newTestClient()
+
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("a/b", "1234")))
+	require.ErrorIs(t, s.retainMessage(cl, retainTestPacket("a/b", "12345")), packets.ErrQuotaExceeded)
+	pk, ok := s.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("1234"), pk.Payload)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedRejected))
+}
+
+func TestServerRetainMessageReject(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.RetainLimits = RetainLimits{MaxMessages: 2, MaxBytes: 10}
+	cl, _, _ := newTestClient()
+
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("a", "1")))
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("b", "2")))
+	require.ErrorIs(t, s.retainMessage(cl, retainTestPacket("c", "3")), packets.ErrQuotaExceeded)
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("b", "22222"))) // replacing does not add a message.
+	require.ErrorIs(t, s.retainMessage(cl, retainTestPacket("b", "2222222222")), packets.ErrQuotaExceeded)
+
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("a", ""))) // clearing always succeeds.
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("c", "3")))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.RetainedRejected))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.RetainedEvicted))
+}
+
+func TestServerRetainMessageEvictOldest(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(retainQuotaHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	s.Options.RetainLimits = RetainLimits{MaxMessages: 3, MaxBytes: 6, Policy: RetainEvictOldest}
+	cl, _, _ := newTestClient()
+
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("a", "1")))
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("b", "2")))
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("c", "3")))
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("a", "11"))) // a is now the most recently updated.
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("d", "4")))
+	require.Equal(t, []string{"b"}, hook.expired)
+
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("e", "5555"))) // over the byte limit.
+	require.Equal(t, []string{"b", "c", "a"}, hook.expired)
+	require.ErrorIs(t, s.retainMessage(cl, retainTestPacket("f", "6666666")), packets.ErrQuotaExceeded)
+
+	_, ok := s.Topics.Retained.Get("a")
+	require.False(t, ok)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(3), atomic.LoadInt64(&s.Info.RetainedEvicted))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedRejected))
+}
+
+func TestServerRetainMessageUserQuota(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+	hook := new(retainQuotaHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	s.Options.RetainLimits = RetainLimits{User: RetainQuota{Messages: 1}}
+
+	cl, _, _ := newTestClient()
+	cl.Properties.Username = []byte("device")
+	cl2, _, _ := newTestClient()
+	cl2.ID = "other"
+	cl2.Properties.Username = []byte("device") // counted against the same user.
+
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("a", "1")))
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("a", "2")))
+	require.ErrorIs(t, s.retainMessage(cl2, retainTestPacket("b", "1")), packets.ErrQuotaExceeded)
+	require.NoError(t, s.retainMessage(cl2, retainTestPacket("a", "3")))
+
+	require.NoError(t, s.retainMessage(s.inlineClient, retainTestPacket("c", "1"))) // not counted.
+	require.NoError(t, s.retainMessage(s.inlineClient, retainTestPacket("d", "1")))
+
+	hook.q = &RetainQuota{Messages: 5, Bytes: 2}
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("b", "1")))
+	require.ErrorIs(t, s.retainMessage(cl, retainTestPacket("e", "1")), packets.ErrQuotaExceeded)
+}
+
+func TestServerProcessPublishRetainRejected(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.RetainLimits = RetainLimits{MaxPayload: 1}
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	pk := retainTestPacket("a/b", "hello")
+	pk.FixedHeader.Qos = 1
+	pk.PacketID = 7
+	pk.ProtocolVersion = 5
+
+	go func() {
+		require.NoError(t, s.processPublish(cl, pk))
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte{packets.Puback << 4}, buf[:1])
+	require.Equal(t, []byte{0, 7, packets.ErrQuotaExceeded.Code}, buf[2:5])
+	_, ok := s.Topics.Retained.Get("a/b")
+	require.False(t, ok)
+	require.False(t, cl.Closed())
+}
+
+func TestServerProcessPublishRetainRejectedV3(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+	s.Options.RetainLimits = RetainLimits{MaxPayload: 1}
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 4
+	s.Clients.Add(cl)
+
+	got := make(chan packets.Packet, 2)
+	require.NoError(t, s.Subscribe("a/#", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	go func() {
+		for qos := byte(0); qos < 2; qos++ {
+			pk := retainTestPacket("a/b", "hello")
+			pk.FixedHeader.Qos = qos
+			pk.PacketID = uint16(qos)
+			require.NoError(t, s.processPublish(cl, pk))
+		}
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte{packets.Puback << 4, 2, 0, 1}, buf) // acknowledged without a reason code.
+	for i := 0; i < 2; i++ {
+		pk := <-got
+		require.Equal(t, "hello", string(pk.Payload))
+		require.False(t, pk.FixedHeader.Retain)
+	}
+
+	_, ok := s.Topics.Retained.Get("a/b")
+	require.False(t, ok)
+	require.False(t, cl.Closed())
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.RetainedRejected))
+}
+
+func TestServerProcessPublishDelayedRetainRejected(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.RetainLimits = RetainLimits{MaxPayload: 1}
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	pk := retainTestPacket("$delayed/10/a/b", "hello")
+	pk.FixedHeader.Qos = 1
+	pk.PacketID = 7
+	pk.ProtocolVersion = 5
+
+	go func() {
+		require.NoError(t, s.processPublish(cl, pk))
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte{packets.Puback << 4}, buf[:1])
+	require.Equal(t, []byte{0, 7, packets.ErrQuotaExceeded.Code}, buf[2:5])
+	require.Empty(t, s.DelayedMessages())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedRejected))
+}
+
+func TestServerDelayedRetainUserQuota(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.RetainLimits = RetainLimits{User: RetainQuota{Messages: 1}}
+
+	cl, _, _ := newTestClient()
+	cl.Properties.Username = []byte("device")
+	s.Clients.Add(cl)
+
+	s.delayPublish(cl, retainTestPacket("a", "1"), 1)
+	msgs := s.DelayedMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, "device", msgs[0].Owner)
+
+	require.NoError(t, s.checkRetained(cl, retainTestPacket("a", "1")))
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("b", "1")))
+	require.ErrorIs(t, s.checkRetained(cl, retainTestPacket("a", "1")), packets.ErrQuotaExceeded)
+
+	s.Clients.Delete(cl.ID) // the quota still applies once the publishing client has gone.
+	s.sendDelayedMessages(msgs[0].Due)
+	require.Empty(t, s.DelayedMessages())
+	_, ok := s.Topics.Retained.Get("a")
+	require.False(t, ok)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.RetainedRejected))
+}
+
+func TestServerDelayedClient(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+
+	cl := s.delayedClient(DelayedMessage{Client: "cl1", Owner: "device"})
+	require.False(t, cl.Net.Inline)
+	require.Equal(t, "device", retainOwner(cl))
+
+	cl = s.delayedClient(DelayedMessage{Client: "cl1", Owner: "cl1"})
+	require.Equal(t, "cl1", retainOwner(cl))
+
+	cl = s.delayedClient(DelayedMessage{Client: "named-inline"})
+	require.Equal(t, "", retainOwner(cl))
+
+	require.Equal(t, s.inlineClient, s.delayedClient(DelayedMessage{Client: InlineClientId}))
+}
+
+func TestServerLoadRetainedLimits(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.RetainLimits = RetainLimits{MaxMessages: 2}
+	s.loadRetained([]storage.Message{
+		{ID: "a", TopicName: "a", Payload: []byte("1"), FixedHeader: packets.FixedHeader{Retain: true}},
+		{ID: "b", TopicName: "b", Payload: []byte("2"), FixedHeader: packets.FixedHeader{Retain: true}},
+	})
+
+	cl, _, _ := newTestClient()
+	require.ErrorIs(t, s.retainMessage(cl, retainTestPacket("c", "3")), packets.ErrQuotaExceeded)
+
+	s.Topics.Retained.Add("a", packets.Packet{TopicName: "a", Created: 1})
+	s.Options.Capabilities.MaximumMessageExpiryInterval = 1
+	s.clearExpiredRetainedMessages(10)
+	require.Equal(t, 0, s.retained.Len())
+	require.NoError(t, s.retainMessage(cl, retainTestPacket("c", "3")))
+}
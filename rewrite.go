@@ -0,0 +1,338 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	RewriteAll       = "all"       // the rule rewrites both publish topics and subscription filters
+	RewritePublish   = "publish"   // the rule rewrites publish topics only
+	RewriteSubscribe = "subscribe" // the rule rewrites subscribe and unsubscribe filters only
+)
+
+// ErrTopicRewriteInvalid indicates that a topic rewrite rule could not be compiled.
+var ErrTopicRewriteInvalid = errors.New("invalid topic rewrite rule")
+
+// rewriteRef matches $n capture references in a rewrite destination.
+var rewriteRef = regexp.MustCompile(`\$([0-9]+)`)
+
+// TopicRewrite is a rule which rewrites the topics of inbound publishes, and the filters of
+// subscribes and unsubscribes, before they are checked and processed. Rules are applied in
+// order, and only the first matching rule is applied.
+type TopicRewrite struct {
+	Action string `yaml:"action" json:"action"` // publish, subscribe, or all if empty
+	Source string `yaml:"source" json:"source"` // a topic filter; each + or # level is captured as $1, $2...
+	Regex  string `yaml:"regex" json:"regex"`   // a regular expression matched against the topic instead of source, with groups as $1, $2...
+	Dest   string `yaml:"dest" json:"dest"`     // the rewritten topic, with $n replaced by the nth capture
+}
+
+// rewriteRule is a compiled topic rewrite rule.
+type rewriteRule struct {
+	publish   bool           // the rule applies to publish topics
+	subscribe bool           // the rule applies to subscription filters
+	source    []string       // the levels of the source filter, if not a regex rule
+	re        *regexp.Regexp // the regular expression, if a regex rule
+	dest      string         // the destination template
+}
+
+// topicRewrites is a compiled set of topic rewrite rules. A nil *topicRewrites rewrites nothing.
+type topicRewrites struct {
+	rules []rewriteRule
+}
+
+// newTopicRewrites compiles a set of topic rewrite rules, returning nil if there are none.
+func newTopicRewrites(v []TopicRewrite) (*topicRewrites, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	x := &topicRewrites{
+		rules: make([]rewriteRule, 0, len(v)),
+	}
+
+	for i, r := range v {
+		rule := rewriteRule{dest: r.Dest}
+		switch strings.ToLower(r.Action) {
+		case "", RewriteAll:
+			rule.publish, rule.subscribe = true, true
+		case RewritePublish:
+			rule.publish = true
+		case RewriteSubscribe:
+			rule.subscribe = true
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q; %w", i, r.Action, ErrTopicRewriteInvalid)
+		}
+
+		switch {
+		case r.Dest == "":
+			return nil, fmt.Errorf("rule %d: dest is empty; %w", i, ErrTopicRewriteInvalid)
+		case (r.Source == "") == (r.Regex == ""):
+			return nil, fmt.Errorf("rule %d: exactly one of source or regex must be set; %w", i, ErrTopicRewriteInvalid)
+		case r.Regex != "":
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v; %w", i, err, ErrTopicRewriteInvalid)
+			}
+			rule.re = re
+		case IsValidFilter(r.Source, false) && !IsSharedFilter(r.Source):
+			rule.source = strings.Split(r.Source, "/")
+		default:
+			return nil, fmt.Errorf("rule %d: invalid source filter %q; %w", i, r.Source, ErrTopicRewriteInvalid)
+		}
+
+		x.rules = append(x.rules, rule)
+	}
+
+	return x, nil
+}
+
+// apply rewrites a topic or filter if it matches the rule. For source rules, origins holds
+// the index of the level in name which each level of the result was copied from, or -1.
+func (r *rewriteRule) apply(name string) (out string, origins []int, ok bool) {
+	if r.re != nil {
+		m := r.re.FindStringSubmatchIndex(name)
+		if m == nil {
+			return "", nil, false
+		}
+		return string(r.re.ExpandString(nil, r.dest, name, m)), nil, true
+	}
+
+	levels := strings.Split(name, "/")
+	var captures [][2]int // level ranges of each wildcard capture
+	multi := false
+	for i, s := range r.source {
+		if i >= len(levels) {
+			return "", nil, false
+		}
+
+		switch s {
+		case "#":
+			captures = append(captures, [2]int{i, len(levels)})
+			multi = true
+		case "+":
+			captures = append(captures, [2]int{i, i + 1})
+		default:
+			if levels[i] != s {
+				return "", nil, false
+			}
+		}
+	}
+
+	if !multi && len(levels) != len(r.source) {
+		return "", nil, false
+	}
+
+	capture := func(ref string) (string, bool) {
+		n, err := strconv.Atoi(ref)
+		if err != nil || n < 1 || n > len(captures) {
+			return "", false
+		}
+		c := captures[n-1]
+		return strings.Join(levels[c[0]:c[1]], "/"), true
+	}
+
+	var result []string
+	for _, d := range strings.Split(r.dest, "/") {
+		if m := rewriteRef.FindStringSubmatch(d); m != nil && m[0] == d {
+			if n, err := strconv.Atoi(m[1]); err == nil && n >= 1 && n <= len(captures) {
+				for j := captures[n-1][0]; j < captures[n-1][1]; j++ {
+					result = append(result, levels[j])
+					origins = append(origins, j)
+				}
+				continue
+			}
+		}
+
+		d = rewriteRef.ReplaceAllStringFunc(d, func(ref string) string {
+			v, _ := capture(ref[1:])
+			return v
+		})
+		for _, v := range strings.Split(d, "/") {
+			result = append(result, v)
+			origins = append(origins, -1)
+		}
+	}
+
+	return strings.Join(result, "/"), origins, true
+}
+
+// topic returns a publish topic rewritten by the first matching publish rule. The topic is
+// returned unchanged if no rule matches, or the rewritten topic would not be valid.
+func (x *topicRewrites) topic(topic string) string {
+	if x == nil || topic == "" {
+		return topic
+	}
+
+	for i := range x.rules {
+		r := &x.rules[i]
+		if !r.publish {
+			continue
+		}
+
+		out, _, ok := r.apply(topic)
+		if !ok {
+			continue
+		}
+
+		if out == "" || !IsValidFilter(out, true) {
+			return topic
+		}
+		return out
+	}
+
+	return topic
+}
+
+// filter returns a subscription filter rewritten by the first matching subscribe rule, and a
+// template for mapping the topics of messages delivered to the rewritten filter back to the
+// filter the client subscribed with. The filter of a shared subscription is rewritten without
+// the share prefix. The filter is returned unchanged if no rule matches, or if the rewritten
+// filter would be invalid or drops wildcard levels which delivered topics can't be mapped from.
+func (x *topicRewrites) filter(filter string) (string, string) {
+	if x == nil {
+		return filter, ""
+	}
+
+	prefix, inner := splitShareFilter(filter)
+	for i := range x.rules {
+		r := &x.rules[i]
+		if !r.subscribe {
+			continue
+		}
+
+		out, origins, ok := r.apply(inner)
+		if !ok {
+			continue
+		}
+
+		if !IsValidFilter(out, false) || IsSharedFilter(out) {
+			return filter, ""
+		}
+
+		tmpl, ok := rewriteTemplate(inner, out, origins)
+		if !ok {
+			return filter, ""
+		}
+
+		return prefix + out, tmpl
+	}
+
+	return filter, ""
+}
+
+// rewriteTemplate returns the original filter with each wildcard level replaced by its kind
+// and the position of the wildcard in the rewritten filter which it became, e.g. a/+2/b/+1.
+// If origins is nil, the wildcards of both filters must correspond in order.
+func rewriteTemplate(original, rewritten string, origins []int) (string, bool) {
+	levels := strings.Split(original, "/")
+	tmpl := make([]string, len(levels))
+	copy(tmpl, levels)
+
+	var wild []int // the level of each wildcard in the original filter
+	for i, v := range levels {
+		if v == "+" || v == "#" {
+			wild = append(wild, i)
+		}
+	}
+
+	mapped := make([]bool, len(levels))
+	n := 0
+	for k, v := range strings.Split(rewritten, "/") {
+		if v != "+" && v != "#" {
+			continue
+		}
+
+		src := -1
+		if origins != nil && k < len(origins) {
+			src = origins[k]
+		} else if origins == nil && n < len(wild) {
+			src = wild[n]
+		}
+
+		n++
+		if src < 0 || levels[src] != v {
+			return "", false
+		}
+
+		tmpl[src] = v + strconv.Itoa(n)
+		mapped[src] = true
+	}
+
+	for _, i := range wild {
+		if !mapped[i] {
+			return "", false
+		}
+	}
+
+	return strings.Join(tmpl, "/"), true
+}
+
+// rewriteOutbound maps a topic matched by a rewritten subscription filter back to the layout
+// of the filter the client subscribed with, using the template of the subscription.
+func rewriteOutbound(topic, filter, tmpl string) string {
+	_, filter = splitShareFilter(filter)
+	levels := strings.Split(topic, "/")
+
+	var captures []string
+	for i, v := range strings.Split(filter, "/") {
+		if v == "#" {
+			if i > len(levels) {
+				return topic
+			}
+			captures = append(captures, strings.Join(levels[min(i, len(levels)):], "/"))
+			break
+		}
+
+		if i >= len(levels) {
+			return topic
+		}
+
+		if v == "+" {
+			captures = append(captures, levels[i])
+		}
+	}
+
+	out := make([]string, 0, len(levels))
+	for _, v := range strings.Split(tmpl, "/") {
+		if len(v) > 1 && (v[0] == '+' || v[0] == '#') {
+			n, err := strconv.Atoi(v[1:])
+			if err != nil || n < 1 || n > len(captures) {
+				return topic
+			}
+
+			if v[0] == '#' && captures[n-1] == "" {
+				continue // the multi-level wildcard matched the parent level.
+			}
+
+			out = append(out, captures[n-1])
+			continue
+		}
+
+		out = append(out, v)
+	}
+
+	return strings.Join(out, "/")
+}
+
+// splitShareFilter splits a shared subscription filter into the share prefix, including the
+// trailing separator, and the filter. Other filters are returned with an empty prefix.
+func splitShareFilter(filter string) (prefix, inner string) {
+	if !IsSharedFilter(filter) {
+		return "", filter
+	}
+
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 {
+		return "", filter
+	}
+
+	return parts[0] + "/" + parts[1] + "/", parts[2]
+}
@@ -0,0 +1,231 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/client"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+func TestNewTopicRewrites(t *testing.T) {
+	x, err := newTopicRewrites(nil)
+	require.NoError(t, err)
+	require.Nil(t, x)
+
+	x, err = newTopicRewrites([]TopicRewrite{
+		{Source: "a/+", Dest: "b/$1"},
+		{Action: "Publish", Regex: `^c/(\w+)$`, Dest: "d/$1"},
+		{Action: RewriteSubscribe, Source: "e/#", Dest: "f/$1"},
+	})
+	require.NoError(t, err)
+	require.Len(t, x.rules, 3)
+	require.True(t, x.rules[0].publish && x.rules[0].subscribe)
+	require.True(t, x.rules[1].publish && !x.rules[1].subscribe)
+	require.True(t, !x.rules[2].publish && x.rules[2].subscribe)
+
+	tt := []TopicRewrite{
+		{Action: "both", Source: "a", Dest: "b"},
+		{Source: "a"},
+		{Dest: "b"},
+		{Source: "a", Regex: "a", Dest: "b"},
+		{Regex: "(", Dest: "b"},
+		{Source: "a/#/b", Dest: "b"},
+		{Source: "$share/g/a", Dest: "b"},
+	}
+	for _, r := range tt {
+		_, err := newTopicRewrites([]TopicRewrite{r})
+		require.ErrorIs(t, err, ErrTopicRewriteInvalid)
+	}
+}
+
+func TestTopicRewritesTopic(t *testing.T) {
+	var x *topicRewrites
+	require.Equal(t, "a/b", x.topic("a/b"))
+
+	x, err := newTopicRewrites([]TopicRewrite{
+		{Action: RewriteSubscribe, Source: "legacy/#", Dest: "sub/$1"},
+		{Source: "legacy/+/temp", Dest: "devices/$1/temperature"},
+		{Source: "legacy/+/+/state", Dest: "devices/$2/$1"},
+		{Source: "old/#", Dest: "new/$1"},
+		{Regex: `^raw/(\w+)-(\w+)$`, Dest: "parsed/${2}/${1}"},
+		{Source: "bad/+", Dest: "$SYS/$1"},
+		{Source: "bad/+", Dest: "never/$1"},
+	})
+	require.NoError(t, err)
+
+	tt := []struct {
+		in  string
+		out string
+	}{
+		{in: "legacy/abc/temp", out: "devices/abc/temperature"},
+		{in: "legacy/abc/temp/x", out: "legacy/abc/temp/x"},
+		{in: "legacy/abc/def/state", out: "devices/def/abc"},
+		{in: "old/a/b/c", out: "new/a/b/c"},
+		{in: "old", out: "old"},
+		{in: "raw/dev-1", out: "parsed/1/dev"},
+		{in: "bad/x", out: "bad/x"}, // first match wins, and its result is invalid
+		{in: "other/x", out: "other/x"},
+		{in: "", out: ""},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.out, x.topic(tx.in), tx.in)
+	}
+}
+
+func TestTopicRewritesFilter(t *testing.T) {
+	var x *topicRewrites
+	f, tmpl := x.filter("a/b")
+	require.Equal(t, "a/b", f)
+	require.Equal(t, "", tmpl)
+
+	x, err := newTopicRewrites([]TopicRewrite{
+		{Action: RewritePublish, Source: "legacy/#", Dest: "pub/$1"},
+		{Source: "legacy/+/temp", Dest: "devices/$1/temperature"},
+		{Source: "legacy/+/+/state", Dest: "devices/$2/$1"},
+		{Source: "old/#", Dest: "new/$1"},
+		{Source: "drop/+/+", Dest: "kept/$1"},
+		{Source: "inline/+", Dest: "in-$1"},
+		{Regex: `^raw/(.+)$`, Dest: "parsed/$1"},
+	})
+	require.NoError(t, err)
+
+	tt := []struct {
+		in   string
+		out  string
+		tmpl string
+	}{
+		{in: "legacy/abc/temp", out: "devices/abc/temperature", tmpl: "legacy/abc/temp"},
+		{in: "legacy/+/temp", out: "devices/+/temperature", tmpl: "legacy/+1/temp"},
+		{in: "legacy/+/+/state", out: "devices/+/+", tmpl: "legacy/+2/+1/state"},
+		{in: "old/#", out: "new/#", tmpl: "old/#1"},
+		{in: "old/+/x/#", out: "new/+/x/#", tmpl: "old/+1/x/#2"},
+		{in: "$share/g/legacy/+/temp", out: "$share/g/devices/+/temperature", tmpl: "legacy/+1/temp"},
+		{in: "drop/+/+", out: "drop/+/+"}, // a wildcard is dropped, so topics can't be mapped back
+		{in: "drop/a/+", out: "drop/a/+"}, // as above
+		{in: "drop/+/a", out: "kept/+", tmpl: "drop/+1/a"},
+		{in: "inline/+", out: "inline/+"}, // the result is an invalid filter
+		{in: "raw/a/+/#", out: "parsed/a/+/#", tmpl: "raw/a/+1/#2"},
+		{in: "other/#", out: "other/#"},
+	}
+
+	for _, tx := range tt {
+		f, tmpl := x.filter(tx.in)
+		require.Equal(t, tx.out, f, tx.in)
+		require.Equal(t, tx.tmpl, tmpl, tx.in)
+	}
+}
+
+func TestRewriteOutbound(t *testing.T) {
+	tt := []struct {
+		topic  string
+		filter string
+		tmpl   string
+		out    string
+	}{
+		{topic: "devices/abc/temperature", filter: "devices/abc/temperature", tmpl: "legacy/abc/temp", out: "legacy/abc/temp"},
+		{topic: "devices/abc/temperature", filter: "devices/+/temperature", tmpl: "legacy/+1/temp", out: "legacy/abc/temp"},
+		{topic: "devices/def/abc", filter: "devices/+/+", tmpl: "legacy/+2/+1/state", out: "legacy/abc/def/state"},
+		{topic: "new/a/b/c", filter: "new/#", tmpl: "old/#1", out: "old/a/b/c"},
+		{topic: "new", filter: "new/#", tmpl: "old/#1", out: "old"},
+		{topic: "devices/abc/temperature", filter: "$share/g/devices/+/temperature", tmpl: "legacy/+1/temp", out: "legacy/abc/temp"},
+		{topic: "devices/abc/temperature", filter: "devices/+/temperature", tmpl: "legacy/+2/temp", out: "devices/abc/temperature"},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.out, rewriteOutbound(tx.topic, tx.filter, tx.tmpl), tx.topic)
+	}
+}
+
+func TestServerServeTopicRewritesInvalid(t *testing.T) {
+	s := New(&Options{
+		Logger:        logger,
+		TopicRewrites: []TopicRewrite{{Source: "a/+"}},
+	})
+	defer s.Close()
+	require.ErrorIs(t, s.Serve(), ErrTopicRewriteInvalid)
+}
+
+func TestServerTopicRewrites(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+		TopicRewrites: []TopicRewrite{
+			{Source: "legacy/+/temp", Dest: "devices/$1/temperature"},
+		},
+	})
+	require.NoError(t, s.AddHook(new(UsernameHook), nil)) // only topics beneath devices/ are allowed
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	connect := func(id string) *client.Client {
+		c := client.New(&client.Options{
+			ClientID:        id,
+			Username:        "devices",
+			ProtocolVersion: 5,
+			Clean:           true,
+			Logger:          logger,
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				return l.DialContext(ctx, "")
+			},
+		})
+		require.NoError(t, c.Connect(context.Background()))
+		return c
+	}
+
+	legacy := connect("legacy")
+	defer legacy.Disconnect()
+	modern := connect("modern")
+	defer modern.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	legacyGot := make(chan packets.Packet, 1)
+	_, err := legacy.Subscribe(ctx, func(c *client.Client, pk packets.Packet) {
+		legacyGot <- pk
+	}, packets.Subscription{Filter: "legacy/+/temp", Qos: 1})
+	require.NoError(t, err) // allowed, as the acl is checked against the rewritten filter
+
+	cl, ok := s.Clients.Get("legacy")
+	require.True(t, ok)
+	sub, ok := cl.State.Subscriptions.Get("devices/+/temperature")
+	require.True(t, ok)
+	require.Equal(t, "legacy/+1/temp", sub.RewriteTemplate)
+
+	modernGot := make(chan packets.Packet, 1)
+	_, err = modern.Subscribe(ctx, func(c *client.Client, pk packets.Packet) {
+		modernGot <- pk
+	}, packets.Subscription{Filter: "devices/+/temperature", Qos: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, legacy.Publish(ctx, "legacy/abc/temp", []byte("21"), 1, false))
+	for _, ch := range []chan packets.Packet{legacyGot, modernGot} {
+		select {
+		case pk := <-ch:
+			require.Equal(t, []byte("21"), pk.Payload)
+			if ch == legacyGot {
+				require.Equal(t, "legacy/abc/temp", pk.TopicName)
+			} else {
+				require.Equal(t, "devices/abc/temperature", pk.TopicName)
+			}
+		case <-ctx.Done():
+			t.Fatal("message not received")
+		}
+	}
+
+	_, err = legacy.Unsubscribe(ctx, "legacy/+/temp")
+	require.NoError(t, err)
+	_, ok = cl.State.Subscriptions.Get("devices/+/temperature")
+	require.False(t, ok)
+}
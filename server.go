@@ -22,6 +22,7 @@ import (
 	"github.com/xyzj/mqtt-server/hooks/storage"
 	"github.com/xyzj/mqtt-server/listeners"
 	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/mqtt-server/spool"
 	"github.com/xyzj/mqtt-server/system"
 )
 
@@ -40,6 +41,7 @@ var (
 	ErrConnectionClosed       = errors.New("connection not open")                                      // connection is closed
 	ErrInlineClientNotEnabled = errors.New("please set Options.InlineClient=true to use this feature") // inline client is not enabled by default
 	ErrOptionsUnreadable      = errors.New("unable to read options from bytes")
+	ErrDelayedWillNotFound    = errors.New("delayed will not found") // a delayed will does not exist or has already been sent
 )
 
 // Capabilities indicates the capabilities and features provided by the server.
@@ -60,6 +62,7 @@ type Capabilities struct {
 	RetainAvailable              byte            `yaml:"retain_available" json:"retain_available"`                 // support of retain messages
 	WildcardSubAvailable         byte            `yaml:"wildcard_sub_available" json:"wildcard_sub_available"`     // support of wildcard subscriptions
 	SubIDAvailable               byte            `yaml:"sub_id_available" json:"sub_id_available"`                 // support of subscription identifiers
+	ResponseInformation          string          `yaml:"response_information" json:"response_information"`         // response topic prefix template returned to v5 clients requesting response information, eg. resp/{clientid}/
 }
 
 // NewDefaultServerCapabilities defines the default features and capabilities provided by the server.
@@ -128,6 +131,55 @@ type Options struct {
 	// Enable Inline client to allow direct subscribing and publishing from the parent codebase,
 	// with negligible performance difference (disabled by default to prevent confusion in statistics).
 	InlineClient bool `yaml:"inline_client" json:"inline_client"`
+
+	// TopicRewrites specifies rules which rewrite inbound publish topics and subscription filters
+	// before they are checked and processed, such as to migrate clients from a legacy topic layout.
+	TopicRewrites []TopicRewrite `yaml:"topic_rewrites" json:"topic_rewrites"`
+
+	// AutoSubscriptions specifies subscriptions which are added on behalf of every client when
+	// its session is established, as if the client had subscribed to them.
+	AutoSubscriptions []AutoSubscription `yaml:"auto_subscriptions" json:"auto_subscriptions"`
+
+	// RateLimit specifies the publish rate limit applied to each client. Hooks such as the auth
+	// ledger can select a different limit for a client when its session is established.
+	RateLimit RateLimit `yaml:"rate_limit" json:"rate_limit"`
+
+	// ListenerRateLimits specifies publish rate limits for the clients of specific listeners,
+	// keyed on listener id, which are used instead of RateLimit.
+	ListenerRateLimits map[string]RateLimit `yaml:"listener_rate_limits" json:"listener_rate_limits"`
+
+	// MemoryBudget specifies limits on the bytes of messages held in client outbound queues,
+	// inflight messages and retained messages, over which backpressure is applied to publishers
+	// and load is shed.
+	MemoryBudget MemoryBudget `yaml:"memory_budget" json:"memory_budget"`
+
+	// SlowSubscribers specifies how subscribers which cannot keep up with their messages are
+	// detected, and whether they are logged, reported on a $SYS topic, or disconnected.
+	SlowSubscribers SlowSubscribers `yaml:"slow_subscribers" json:"slow_subscribers"`
+
+	// OutboundQueue specifies what happens when the queue of messages waiting to be written to
+	// a client is full, and which messages are written ahead of others.
+	OutboundQueue OutboundQueue `yaml:"outbound_queue" json:"outbound_queue"`
+
+	// Spool specifies a directory in which the qos messages of persistent sessions are queued
+	// on disk when the client has no inflight quota left, instead of being dropped.
+	Spool Spool `yaml:"spool" json:"spool"`
+
+	// OfflineQueue specifies the qos 0 messages buffered for each persistent session while its
+	// client is disconnected. Hooks such as the auth ledger can select a queue for each client.
+	OfflineQueue OfflineQueue `yaml:"offline_queue" json:"offline_queue"`
+
+	// ListenerOfflineQueues specifies offline queues for the clients of specific listeners,
+	// keyed on listener id, which are used instead of OfflineQueue.
+	ListenerOfflineQueues map[string]OfflineQueue `yaml:"listener_offline_queues" json:"listener_offline_queues"`
+
+	// RetainLimits specifies limits on the number and size of the retained messages published
+	// by clients, and whether older messages are evicted to make space for new ones.
+	RetainLimits RetainLimits `yaml:"retain_limits" json:"retain_limits"`
+
+	// History specifies topic filters for which the last messages of each matching topic are
+	// kept, so that subscribers can ask to have them replayed when they subscribe.
+	History []HistoryTopic `yaml:"history" json:"history"`
 }
 
 // Server is an MQTT broker server. It should be created with server.New()
@@ -143,6 +195,14 @@ type Server struct {
 	Log          *slog.Logger         // minimal no-alloc logger
 	hooks        *Hooks               // hooks contains hooks for extra functionality such as auth and persistent storage
 	inlineClient *Client              // inlineClient is a special client used for inline subscriptions and inline Publish
+	deliveries   *deliveries          // qos deliveries of named inline client publishes awaiting acknowledgement
+	inlineSubID  int64                // the last identifier generated for an inline subscription
+	requests     *requests            // inline requests awaiting a response
+	rewrites     *topicRewrites       // compiled topic rewrite rules, if any
+	memory       *memoryState         // the memory usage level of the memory budget
+	spool        *spool.Spool         // the disk backed overflow queues of persistent sessions, if enabled
+	retained     *retainLedger        // the accounting of retained messages for the retain limits
+	history      *topicHistory        // the recent messages of topics matching the history filters
 }
 
 // loop contains interval tickers for the system events loop.
@@ -153,6 +213,10 @@ type loop struct {
 	retainedExpiry *time.Ticker     // interval ticker for cleaning retained messages
 	willDelaySend  *time.Ticker     // interval ticker for sending Will Messages with a delay
 	willDelayed    *packets.Packets // activate LWT packets which will be sent after a delay
+	delayedSend    *time.Ticker     // interval ticker for publishing delayed messages
+	delayed        *delayedMessages // delayed messages which will be published when due
+	memoryCheck    *time.Ticker     // interval ticker for checking memory usage against the memory budget
+	slowCheck      *time.Ticker     // interval ticker for checking for slow subscribers at the end of each window
 }
 
 // ops contains server values which can be propagated to other structs.
@@ -177,6 +241,13 @@ func New(opts *Options) *Server {
 		Clients:   NewClients(),
 		Topics:    NewTopicsIndex(),
 		Listeners: listeners.New(),
+		deliveries: &deliveries{
+			internal: map[deliveryKey]*delivery{},
+		},
+		requests: &requests{
+			pending:   map[string]chan packets.Packet{},
+			listening: map[string]bool{},
+		},
 		loop: &loop{
 			sysTopics:      time.NewTicker(time.Second * time.Duration(opts.SysTopicResendInterval)),
 			clientExpiry:   time.NewTicker(time.Second),
@@ -184,8 +255,15 @@ func New(opts *Options) *Server {
 			retainedExpiry: time.NewTicker(time.Second),
 			willDelaySend:  time.NewTicker(time.Second),
 			willDelayed:    packets.NewPackets(),
+			delayedSend:    time.NewTicker(time.Second),
+			delayed:        newDelayedMessages(),
+			memoryCheck:    time.NewTicker(memoryCheckInterval),
+			slowCheck:      time.NewTicker(time.Second * time.Duration(opts.SlowSubscribers.Window)),
 		},
-		Options: opts,
+		memory:   newMemoryState(),
+		retained: newRetainLedger(),
+		history:  newTopicHistory(),
+		Options:  opts,
 		Info: &system.Info{
 			Version: Version,
 			Started: time.Now().Unix(),
@@ -220,6 +298,10 @@ func (o *Options) ensureDefaults() {
 		o.SysTopicResendInterval = defaultSysTopicInterval
 	}
 
+	if o.SlowSubscribers.Window <= 0 {
+		o.SlowSubscribers.Window = defaultSlowSubscriberWindow
+	}
+
 	if o.ClientNetWriteBufferSize == 0 {
 		o.ClientNetWriteBufferSize = 1024 * 2
 	}
@@ -316,6 +398,8 @@ func (s *Server) AddListenersFromConfig(configs []listeners.Config) error {
 			l = listeners.NewHTTPHealthCheck(conf)
 		case listeners.TypeSysInfo:
 			l = listeners.NewHTTPStats(conf, s.Info)
+		case listeners.TypeMemory:
+			l = listeners.NewMemory(conf)
 		case listeners.TypeMock:
 			l = listeners.NewMockListener(conf.ID, conf.Address)
 		default:
@@ -335,6 +419,40 @@ func (s *Server) Serve() error {
 	s.Log.Info("mochi mqtt starting", "version", Version)
 	defer s.Log.Info("mochi mqtt server started")
 
+	rewrites, err := newTopicRewrites(s.Options.TopicRewrites)
+	if err != nil {
+		return err
+	}
+	s.rewrites = rewrites
+
+	if err := s.Options.validateRateLimits(); err != nil {
+		return err
+	}
+
+	if err := s.Options.SlowSubscribers.validate(); err != nil {
+		return err
+	}
+
+	if err := s.Options.OutboundQueue.validate(); err != nil {
+		return err
+	}
+
+	if err := s.Options.Spool.validate(); err != nil {
+		return err
+	}
+
+	if err := s.Options.validateOfflineQueues(); err != nil {
+		return err
+	}
+
+	if err := s.Options.RetainLimits.validate(); err != nil {
+		return err
+	}
+
+	if err := s.Options.validateHistory(); err != nil {
+		return err
+	}
+
 	if len(s.Options.Listeners) > 0 {
 		err := s.AddListenersFromConfig(s.Options.Listeners)
 		if err != nil {
@@ -355,6 +473,8 @@ func (s *Server) Serve() error {
 		StoredRetainedMessages,
 		StoredSubscriptions,
 		StoredSysInfo,
+		StoredDelayedMessages,
+		StoredDelayedWills,
 	) {
 		err := s.readStore()
 		if err != nil {
@@ -362,6 +482,10 @@ func (s *Server) Serve() error {
 		}
 	}
 
+	if err := s.openSpool(); err != nil {
+		return err
+	}
+
 	go s.eventLoop()                            // spin up event loop for issuing $SYS values and closing server.
 	s.Listeners.ServeAll(s.EstablishConnection) // start listening on all listeners.
 	s.publishSysTopics()                        // begin publishing $SYS system values.
@@ -386,10 +510,19 @@ func (s *Server) eventLoop() {
 			s.clearExpiredClients(time.Now().Unix())
 		case <-s.loop.retainedExpiry.C:
 			s.clearExpiredRetainedMessages(time.Now().Unix())
+			s.history.clearExpired(time.Now().Unix())
 		case <-s.loop.willDelaySend.C:
 			s.sendDelayedLWT(time.Now().Unix())
+		case <-s.loop.delayedSend.C:
+			s.sendDelayedMessages(time.Now().Unix())
 		case <-s.loop.inflightExpiry.C:
 			s.clearExpiredInflights(time.Now().Unix())
+		case <-s.loop.memoryCheck.C:
+			if s.Options.MemoryBudget.enabled() {
+				s.checkMemory()
+			}
+		case <-s.loop.slowCheck.C:
+			s.checkSlowSubscribers(time.Now())
 		}
 	}
 }
@@ -415,7 +548,8 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	}
 
 	cl.ParseConnect(listener, pk)
-	if atomic.LoadInt64(&s.Info.ClientsConnected) >= s.Options.Capabilities.MaximumClients {
+	if atomic.LoadInt64(&s.Info.ClientsConnected) >= s.Options.Capabilities.MaximumClients ||
+		s.memory.Level() == memoryHard {
 		if cl.Properties.ProtocolVersion < 5 {
 			s.SendConnack(cl, packets.ErrServerUnavailable, false, nil)
 		} else {
@@ -461,16 +595,25 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 		return fmt.Errorf("ack connection packet: %w", err)
 	}
 
-	s.loop.willDelayed.Delete(cl.ID) // [MQTT-3.1.3-9]
+	s.removeDelayedWill(cl.ID) // [MQTT-3.1.3-9]
 
 	if sessionPresent {
 		err = cl.ResendInflightMessages(true)
 		if err != nil {
 			return fmt.Errorf("resend inflight: %w", err)
 		}
+
+		err = s.sendOfflineMessages(cl)
+		if err != nil {
+			return fmt.Errorf("send offline messages: %w", err)
+		}
+		s.drainSpool(cl)
 	}
 
 	s.hooks.OnSessionEstablished(cl, pk)
+	s.autoSubscribe(cl)
+	cl.State.rateLimiter = s.newClientRateLimiter(cl)
+	cl.State.offline.setLimit(s.selectOfflineQueue(cl))
 
 	err = cl.Read(s.receivePacket)
 	if err != nil {
@@ -487,6 +630,8 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	if expire && !cl.IsTakenOver() {
 		cl.ClearInflights()
 		s.UnsubscribeClient(cl)
+		s.deliveries.drop(cl.ID)
+		s.removeSpool(cl.ID)
 		s.Clients.Delete(cl.ID) // [MQTT-4.1.0-2] ![MQTT-3.1.2-23]
 	}
 
@@ -564,11 +709,13 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 		if pk.Connect.Clean || (existing.Properties.Clean && existing.Properties.ProtocolVersion < 5) { // [MQTT-3.1.2-4] [MQTT-3.1.4-4]
 			s.UnsubscribeClient(existing)
 			existing.ClearInflights()
+			s.removeSpool(existing.ID)
 			existing.State.isTakenOver.Store(true) // only set isTakenOver after unsubscribe has occurred
 			return false                           // [MQTT-3.2.2-3]
 		}
 
 		existing.State.isTakenOver.Store(true)
+		cl.State.offline = existing.State.offline // delivered after the inflight messages are resent.
 		if existing.State.Inflight.Len() > 0 {
 			cl.State.Inflight = existing.State.Inflight.Clone() // [MQTT-3.1.2-5]
 			if cl.State.Inflight.maximumReceiveQuota == 0 && cl.ops.options.Capabilities.ReceiveMaximum != 0 {
@@ -644,6 +791,13 @@ func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, prop
 		properties.AssignedClientID = cl.Properties.Props.AssignedClientID // [MQTT-3.1.3-7] [MQTT-3.2.2-16]
 	}
 
+	if cl.Properties.ProtocolVersion == 5 && (cl.Properties.Props.RequestResponseInfo == 0x1 || s.Options.Capabilities.Compatibilities.AlwaysReturnResponseInfo) {
+		if prefix := s.responseInfo(cl); prefix != "" {
+			properties.ResponseInfo = prefix // [MQTT-3.1.2-28]
+			cl.Properties.Props.ResponseInfo = prefix
+		}
+	}
+
 	if cl.Properties.Props.SessionExpiryInterval > s.Options.Capabilities.MaximumSessionExpiryInterval {
 		properties.SessionExpiryInterval = s.Options.Capabilities.MaximumSessionExpiryInterval
 		properties.SessionExpiryIntervalFlag = true
@@ -773,37 +927,11 @@ func (s *Server) Subscribe(filter string, subscriptionId int, handler InlineSubF
 		return ErrInlineClientNotEnabled
 	}
 
-	if handler == nil {
-		return packets.ErrInlineSubscriptionHandlerInvalid
-	}
-
-	if !IsValidFilter(filter, false) {
-		return packets.ErrTopicFilterInvalid
-	}
-
-	subscription := packets.Subscription{
-		Identifier: subscriptionId,
-		Filter:     filter,
-	}
-
-	pk := s.hooks.OnSubscribe(s.inlineClient, packets.Packet{ // subscribe like a normal client.
-		Origin:      s.inlineClient.ID,
-		FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
-		Filters:     packets.Subscriptions{subscription},
-	})
-
-	inlineSubscription := InlineSubscription{
-		Subscription: subscription,
-		Handler:      handler,
+	if err := s.inlineSubscribe(s.inlineClient, filter, subscriptionId, handler); err != nil {
+		return err
 	}
 
-	s.Topics.InlineSubscribe(inlineSubscription)
-	s.hooks.OnSubscribed(s.inlineClient, pk, []byte{packets.CodeSuccess.Code})
-
-	// Handling retained messages.
-	for _, pkv := range s.Topics.Messages(filter) { // [MQTT-3.8.4-4]
-		handler(s.inlineClient, inlineSubscription.Subscription, pkv)
-	}
+	s.inlineRetained(s.inlineClient, filter, subscriptionId, handler)
 	return nil
 }
 
@@ -815,24 +943,7 @@ func (s *Server) Unsubscribe(filter string, subscriptionId int) error {
 		return ErrInlineClientNotEnabled
 	}
 
-	if !IsValidFilter(filter, false) {
-		return packets.ErrTopicFilterInvalid
-	}
-
-	pk := s.hooks.OnUnsubscribe(s.inlineClient, packets.Packet{
-		Origin:      s.inlineClient.ID,
-		FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe},
-		Filters: packets.Subscriptions{
-			{
-				Identifier: subscriptionId,
-				Filter:     filter,
-			},
-		},
-	})
-
-	s.Topics.InlineUnsubscribe(subscriptionId, filter)
-	s.hooks.OnUnsubscribed(s.inlineClient, pk)
-	return nil
+	return s.inlineUnsubscribe(s.inlineClient, filter, subscriptionId)
 }
 
 // InjectPacket injects a packet into the broker as if it were sent from the specified client.
@@ -855,30 +966,47 @@ func (s *Server) InjectPacket(cl *Client, pk packets.Packet) error {
 
 // processPublish processes a Publish packet.
 func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
-	if !cl.Net.Inline && !IsValidFilter(pk.TopicName, true) {
-		return nil
+	if ok, err := s.rateLimitPublish(cl, pk); !ok {
+		return err
 	}
 
-	if atomic.LoadInt32(&cl.State.Inflight.receiveQuota) == 0 {
-		return s.DisconnectClient(cl, packets.ErrReceiveMaximum) // ~[MQTT-3.3.4-7] ~[MQTT-3.3.4-8]
+	if !s.memoryBackpressure(cl) {
+		return nil
 	}
 
-	if !cl.Net.Inline && !s.hooks.OnACLCheck(cl, pk.TopicName, true) {
-		if pk.FixedHeader.Qos == 0 {
+	return s.processPublishAcked(cl, pk, nil)
+}
+
+// processPublishAcked processes a Publish packet, tracking any qos deliveries
+// to subscribers in d if it is not nil.
+func (s *Server) processPublishAcked(cl *Client, pk packets.Packet, d *delivery) error {
+	var delay int64
+	if strings.HasPrefix(pk.TopicName, DelayedPrefix) {
+		n, topic, ok := parseDelayedTopic(pk.TopicName)
+		if !ok {
+			if cl.Net.Inline {
+				return packets.ErrTopicNameInvalid
+			}
 			return nil
 		}
+		delay, pk.TopicName = n, topic // validity and acl checks apply to the target topic.
+	}
 
-		if cl.Properties.ProtocolVersion != 5 {
-			return s.DisconnectClient(cl, packets.ErrNotAuthorized)
-		}
+	pk.TopicName = s.rewrites.topic(pk.TopicName)
 
-		ackType := packets.Puback
-		if pk.FixedHeader.Qos == 2 {
-			ackType = packets.Pubrec
+	if !cl.trusted() && !IsValidFilter(pk.TopicName, true) {
+		if cl.Net.Inline {
+			return packets.ErrTopicNameInvalid
 		}
+		return nil
+	}
 
-		ack := s.buildAck(pk.PacketID, ackType, 0, pk.Properties, packets.ErrNotAuthorized)
-		return cl.WritePacket(ack)
+	if atomic.LoadInt32(&cl.State.Inflight.receiveQuota) == 0 {
+		return s.DisconnectClient(cl, packets.ErrReceiveMaximum) // ~[MQTT-3.3.4-7] ~[MQTT-3.3.4-8]
+	}
+
+	if !cl.trusted() && !s.aclCheck(cl, pk.TopicName, true) {
+		return s.rejectPublish(cl, pk, packets.ErrNotAuthorized)
 	}
 
 	pk.Origin = cl.ID
@@ -925,14 +1053,33 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 	}
 
 	if pk.FixedHeader.Retain { // [MQTT-3.3.1-5] ![MQTT-3.3.1-8]
-		s.retainMessage(cl, pk)
+		var err error
+		if delay == 0 {
+			err = s.retainMessage(cl, pk)
+		} else {
+			err = s.checkRetained(cl, pk) // retained when published, but refused now if over a limit.
+		}
+
+		if err != nil {
+			if retainRefusable(cl, pk) {
+				return s.rejectPublish(cl, pk, packets.ErrQuotaExceeded)
+			}
+			pk.FixedHeader.Retain = false // publish the message without retaining it.
+		}
 	}
 
 	// If it's inlineClient, it can't handle PUBREC and PUBREL.
 	// When it publishes a package with a qos > 0, the server treats
 	// the package as qos=0, and the client receives it as qos=1 or 2.
 	if pk.FixedHeader.Qos == 0 || cl.Net.Inline {
-		s.publishToSubscribers(pk)
+		if delay > 0 {
+			s.delayPublish(cl, pk, delay)
+			if d != nil {
+				d.ignore() // the delivery is complete once scheduled.
+			}
+		} else {
+			s.publishToSubscribersAcked(pk, d)
+		}
 		s.hooks.OnPublished(cl, pk)
 		return nil
 	}
@@ -961,27 +1108,48 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		s.hooks.OnQosComplete(cl, ack)
 	}
 
-	s.publishToSubscribers(pk)
+	if delay > 0 {
+		s.delayPublish(cl, pk, delay)
+	} else {
+		s.publishToSubscribers(pk)
+	}
 	s.hooks.OnPublished(cl, pk)
 
 	return nil
 }
 
-// retainMessage adds a message to a topic, and if a persistent store is provided,
-// adds the message to the store to be reloaded if necessary.
-func (s *Server) retainMessage(cl *Client, pk packets.Packet) {
-	if s.Options.Capabilities.RetainAvailable == 0 || pk.Ignore {
-		return
+// rejectPublish refuses a publish packet with a reason code. The publish is acknowledged with
+// the code for v5 clients, and older clients which publish with qos > 0 are disconnected.
+func (s *Server) rejectPublish(cl *Client, pk packets.Packet, code packets.Code) error {
+	if cl.Net.Inline {
+		return code
 	}
 
-	out := pk.Copy(false)
-	r := s.Topics.RetainMessage(out)
-	s.hooks.OnRetainMessage(cl, pk, r)
-	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+	if pk.FixedHeader.Qos == 0 {
+		return nil
+	}
+
+	if cl.Properties.ProtocolVersion != 5 {
+		return s.DisconnectClient(cl, code)
+	}
+
+	ackType := packets.Puback
+	if pk.FixedHeader.Qos == 2 {
+		ackType = packets.Pubrec
+	}
+
+	ack := s.buildAck(pk.PacketID, ackType, 0, pk.Properties, code)
+	return cl.WritePacket(ack)
 }
 
 // publishToSubscribers publishes a publish packet to all subscribers with matching topic filters.
 func (s *Server) publishToSubscribers(pk packets.Packet) {
+	s.publishToSubscribersAcked(pk, nil)
+}
+
+// publishToSubscribersAcked publishes a publish packet to all subscribers with matching topic
+// filters, tracking any qos deliveries in d if it is not nil.
+func (s *Server) publishToSubscribersAcked(pk packets.Packet, d *delivery) {
 	if pk.Ignore {
 		return
 	}
@@ -997,6 +1165,8 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 		}
 	}
 
+	s.recordHistory(pk)
+
 	subscribers := s.Topics.Subscribers(pk.TopicName)
 	if len(subscribers.Shared) > 0 {
 		subscribers = s.hooks.OnSelectSubscribers(subscribers, pk)
@@ -1012,7 +1182,7 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 
 	for id, subs := range subscribers.Subscriptions {
 		if cl, ok := s.Clients.Get(id); ok {
-			_, err := s.publishToClient(cl, subs, pk)
+			_, err := s.publishToClientAcked(cl, subs, pk, d)
 			if err != nil {
 				s.Log.Debug("failed publishing packet", "error", err, "client", cl.ID, "packet", pk)
 			}
@@ -1020,15 +1190,28 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 	}
 }
 
+// publishToClient publishes a publish packet to a client with a matching subscription.
 func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packets.Packet) (packets.Packet, error) {
+	return s.publishToClientAcked(cl, sub, pk, nil)
+}
+
+// publishToClientAcked publishes a publish packet to a client with a matching subscription,
+// registering the delivery with d if it is not nil and the outbound qos is greater than 0.
+func (s *Server) publishToClientAcked(cl *Client, sub packets.Subscription, pk packets.Packet, d *delivery) (packets.Packet, error) {
 	if sub.NoLocal && pk.Origin == cl.ID {
 		return pk, nil // [MQTT-3.8.3-3]
 	}
 
 	out := pk.Copy(false)
-	if !s.hooks.OnACLCheck(cl, pk.TopicName, false) {
+	if !s.aclCheck(cl, pk.TopicName, false) {
 		return out, packets.ErrNotAuthorized
 	}
+	s.grantResponse(cl, pk)
+
+	if sub.RewriteTemplate != "" {
+		out.TopicName = rewriteOutbound(pk.TopicName, sub.Filter, sub.RewriteTemplate)
+	}
+
 	if !sub.FwdRetainedFlag && ((cl.Properties.ProtocolVersion == 5 && !sub.RetainAsPublished) || cl.Properties.ProtocolVersion < 5) { // ![MQTT-3.3.1-13] [v3 MQTT-3.3.1-9]
 		out.FixedHeader.Retain = false // [MQTT-3.3.1-12]
 	}
@@ -1049,12 +1232,36 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		out.FixedHeader.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9]
 	}
 
+	// keep the spooled messages in order with those sent directly. The lock is held until the
+	// message is inflight, but released before it is queued, which may block.
+	locked := false
+	unlock := func() {
+		if locked {
+			locked = false
+			cl.State.spoolLock.Unlock()
+		}
+	}
+	defer unlock()
+
+	if out.FixedHeader.Qos > 0 && s.spool != nil && cl.persistent() {
+		cl.State.spoolLock.Lock()
+		locked = true
+		if s.spooling(cl) || cl.State.Inflight.Len() >= int(s.Options.Capabilities.MaximumInflight) {
+			return out, s.spoolMessage(cl, out)
+		}
+	}
+
+	if out.FixedHeader.Qos == 0 && (cl.Net.Conn == nil || cl.Closed()) && s.queueOffline(cl, out) {
+		return out, nil
+	}
+
+	hard := s.memory.Level() == memoryHard
 	if cl.Properties.Props.TopicAliasMaximum > 0 {
 		var aliasExists bool
-		out.Properties.TopicAlias, aliasExists = cl.State.TopicAliases.Outbound.Set(pk.TopicName)
+		out.Properties.TopicAlias, aliasExists = cl.State.TopicAliases.Outbound.Set(out.TopicName)
 		if out.Properties.TopicAlias > 0 {
 			out.Properties.TopicAliasFlag = true
-			if aliasExists {
+			if aliasExists && !hard && !s.Options.OutboundQueue.reorders() { // the message which set the alias may be written later, or dropped.
 				out.TopicName = ""
 			}
 		}
@@ -1085,6 +1292,10 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 			cl.State.Inflight.DecreaseSendQuota()
 		}
 
+		if d != nil {
+			s.deliveries.add(cl.ID, out.PacketID, d)
+		}
+
 		if sentQuota == 0 && atomic.LoadInt32(&cl.State.Inflight.maximumSendQuota) > 0 {
 			out.Expiry = -1
 			cl.State.Inflight.Set(out)
@@ -1096,15 +1307,24 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		return out, packets.CodeDisconnect
 	}
 
-	select {
-	case cl.State.outbound <- &out:
-		atomic.AddInt32(&cl.State.outboundQty, 1)
-	default:
+	if hard && out.FixedHeader.Qos > 0 { // keep qos messages inflight while over the hard limit, to be sent later.
+		cl.State.parked.add(out.PacketID)
+		return out, nil
+	}
+
+	unlock()
+	queued := false
+	if !hard { // shed qos 0 outbound messages while over the hard limit.
+		queued = s.enqueueOutbound(cl, pk, &out, true)
+	}
+
+	if !queued {
 		atomic.AddInt64(&s.Info.MessagesDropped, 1)
 		cl.ops.hooks.OnPublishDropped(cl, pk)
 		if out.FixedHeader.Qos > 0 {
 			cl.State.Inflight.Delete(out.PacketID) // packet was dropped due to irregular circumstances, so rollback inflight.
 			cl.State.Inflight.IncreaseSendQuota()
+			s.deliveries.complete(cl.ID, out.PacketID, false)
 		}
 		return out, packets.ErrPendingClientWritesExceeded
 	}
@@ -1158,6 +1378,7 @@ func (s *Server) buildAck(packetID uint16, pkt, qos byte, properties packets.Pro
 
 // processPuback processes a Puback packet, denoting completion of a QOS 1 packet sent from the server.
 func (s *Server) processPuback(cl *Client, pk packets.Packet) error {
+	s.deliveries.complete(cl.ID, pk.PacketID, pk.ReasonCode < packets.ErrUnspecifiedError.Code)
 	if _, ok := cl.State.Inflight.Get(pk.PacketID); !ok {
 		return nil // omit, but would be packets.ErrPacketIdentifierNotFound
 	}
@@ -1167,6 +1388,7 @@ func (s *Server) processPuback(cl *Client, pk packets.Packet) error {
 		atomic.AddInt64(&s.Info.Inflight, -1)
 		s.hooks.OnQosComplete(cl, pk)
 	}
+	s.drainSpool(cl)
 
 	return nil
 }
@@ -1181,6 +1403,7 @@ func (s *Server) processPubrec(cl *Client, pk packets.Packet) error {
 		if ok := cl.State.Inflight.Delete(pk.PacketID); ok {
 			atomic.AddInt64(&s.Info.Inflight, -1)
 		}
+		s.deliveries.complete(cl.ID, pk.PacketID, false)
 		cl.ops.hooks.OnQosDropped(cl, pk)
 		return nil // as per MQTT5 Section 4.13.2 paragraph 2
 	}
@@ -1228,10 +1451,12 @@ func (s *Server) processPubcomp(cl *Client, pk packets.Packet) error {
 	// regardless of whether the pubcomp is a success or failure, we end the qos flow, delete inflight, and restore the quotas.
 	cl.State.Inflight.IncreaseReceiveQuota() // +1 RECV QUOTA
 	cl.State.Inflight.IncreaseSendQuota()    // +1 SENT QUOTA
+	s.deliveries.complete(cl.ID, pk.PacketID, pk.ReasonCode < packets.ErrUnspecifiedError.Code)
 	if ok := cl.State.Inflight.Delete(pk.PacketID); ok {
 		atomic.AddInt64(&s.Info.Inflight, -1)
 		s.hooks.OnQosComplete(cl, pk)
 	}
+	s.drainSpool(cl)
 
 	return nil
 }
@@ -1244,9 +1469,52 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 		code = packets.ErrPacketIdentifierInUse
 	}
 
+	history := s.historyRequests(cl, pk)
+	reasonCodes, filterExisted := s.subscribeFilters(cl, pk, code)
+
+	ack := packets.Packet{ // [MQTT-3.8.4-1] [MQTT-3.8.4-5]
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Suback,
+		},
+		PacketID:    pk.PacketID, // [MQTT-2.2.1-6] [MQTT-3.8.4-2]
+		ReasonCodes: reasonCodes, // [MQTT-3.8.4-6]
+		Properties: packets.Properties{
+			User: pk.Properties.User,
+		},
+	}
+
+	if code.Code >= packets.ErrUnspecifiedError.Code {
+		ack.Properties.ReasonString = code.Reason
+	}
+
+	s.hooks.OnSubscribed(cl, pk, reasonCodes)
+	err := cl.WritePacket(ack)
+	if err != nil {
+		return err
+	}
+
+	for i, sub := range pk.Filters { // [MQTT-3.3.1-9]
+		if reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			continue
+		}
+
+		s.publishRetainedToClient(cl, sub, filterExisted[i])
+		s.publishHistoryToClient(cl, sub, history[i])
+	}
+
+	return nil
+}
+
+// subscribeFilters checks and subscribes a client to the filters of a subscribe packet, returning
+// the reason code for each filter and whether the client was already subscribed to it. If code is
+// not a success code, no filters are subscribed and code is returned for each.
+func (s *Server) subscribeFilters(cl *Client, pk packets.Packet, code packets.Code) ([]byte, []bool) {
 	filterExisted := make([]bool, len(pk.Filters))
 	reasonCodes := make([]byte, len(pk.Filters))
 	for i, sub := range pk.Filters {
+		sub.Filter, sub.RewriteTemplate = s.rewrites.filter(sub.Filter)
+		pk.Filters[i] = sub
+
 		if code != packets.CodeSuccess {
 			reasonCodes[i] = code.Code // NB 3.9.3 Non-normative 0x91
 			continue
@@ -1254,7 +1522,7 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 			reasonCodes[i] = packets.ErrTopicFilterInvalid.Code
 		} else if sub.NoLocal && IsSharedFilter(sub.Filter) {
 			reasonCodes[i] = packets.ErrProtocolViolationInvalidSharedNoLocal.Code // [MQTT-3.8.3-4]
-		} else if !s.hooks.OnACLCheck(cl, sub.Filter, false) {
+		} else if !s.aclCheck(cl, sub.Filter, false) {
 			reasonCodes[i] = packets.ErrNotAuthorized.Code
 			if s.Options.Capabilities.Compatibilities.ObscureNotAuthorized {
 				reasonCodes[i] = packets.ErrUnspecifiedError.Code
@@ -1279,36 +1547,7 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 		}
 	}
 
-	ack := packets.Packet{ // [MQTT-3.8.4-1] [MQTT-3.8.4-5]
-		FixedHeader: packets.FixedHeader{
-			Type: packets.Suback,
-		},
-		PacketID:    pk.PacketID, // [MQTT-2.2.1-6] [MQTT-3.8.4-2]
-		ReasonCodes: reasonCodes, // [MQTT-3.8.4-6]
-		Properties: packets.Properties{
-			User: pk.Properties.User,
-		},
-	}
-
-	if code.Code >= packets.ErrUnspecifiedError.Code {
-		ack.Properties.ReasonString = code.Reason
-	}
-
-	s.hooks.OnSubscribed(cl, pk, reasonCodes)
-	err := cl.WritePacket(ack)
-	if err != nil {
-		return err
-	}
-
-	for i, sub := range pk.Filters { // [MQTT-3.3.1-9]
-		if reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
-			continue
-		}
-
-		s.publishRetainedToClient(cl, sub, filterExisted[i])
-	}
-
-	return nil
+	return reasonCodes, filterExisted
 }
 
 // processUnsubscribe processes an unsubscribe packet.
@@ -1326,6 +1565,9 @@ func (s *Server) processUnsubscribe(cl *Client, pk packets.Packet) error {
 			continue
 		}
 
+		sub.Filter, _ = s.rewrites.filter(sub.Filter)
+		pk.Filters[i].Filter = sub.Filter
+
 		if q := s.Topics.Unsubscribe(sub.Filter, cl.ID); q {
 			atomic.AddInt64(&s.Info.Subscriptions, -1)
 			reasonCodes[i] = packets.CodeSuccess.Code
@@ -1403,8 +1645,8 @@ func (s *Server) processDisconnect(cl *Client, pk packets.Packet) error {
 		return packets.CodeDisconnectWillMessage
 	}
 
-	s.loop.willDelayed.Delete(cl.ID) // [MQTT-3.1.3-9] [MQTT-3.1.2-8]
-	cl.Stop(packets.CodeDisconnect)  // [MQTT-3.14.4-2]
+	s.removeDelayedWill(cl.ID)      // [MQTT-3.1.3-9] [MQTT-3.1.2-8]
+	cl.Stop(packets.CodeDisconnect) // [MQTT-3.14.4-2]
 
 	return nil
 }
@@ -1456,29 +1698,41 @@ func (s *Server) publishSysTopics() {
 	atomic.StoreInt64(&s.Info.Uptime, time.Now().Unix()-atomic.LoadInt64(&s.Info.Started))
 	atomic.StoreInt64(&s.Info.ClientsTotal, int64(s.Clients.Len()))
 	atomic.StoreInt64(&s.Info.ClientsDisconnected, atomic.LoadInt64(&s.Info.ClientsTotal)-atomic.LoadInt64(&s.Info.ClientsConnected))
+	s.checkMemory()
 
 	info := s.Info.Clone()
 	topics := map[string]string{
-		SysPrefix + "/broker/version":              s.Info.Version,
-		SysPrefix + "/broker/time":                 Int64toa(info.Time),
-		SysPrefix + "/broker/uptime":               Int64toa(info.Uptime),
-		SysPrefix + "/broker/started":              Int64toa(info.Started),
-		SysPrefix + "/broker/load/bytes/received":  Int64toa(info.BytesReceived),
-		SysPrefix + "/broker/load/bytes/sent":      Int64toa(info.BytesSent),
-		SysPrefix + "/broker/clients/connected":    Int64toa(info.ClientsConnected),
-		SysPrefix + "/broker/clients/disconnected": Int64toa(info.ClientsDisconnected),
-		SysPrefix + "/broker/clients/maximum":      Int64toa(info.ClientsMaximum),
-		SysPrefix + "/broker/clients/total":        Int64toa(info.ClientsTotal),
-		SysPrefix + "/broker/packets/received":     Int64toa(info.PacketsReceived),
-		SysPrefix + "/broker/packets/sent":         Int64toa(info.PacketsSent),
-		SysPrefix + "/broker/messages/received":    Int64toa(info.MessagesReceived),
-		SysPrefix + "/broker/messages/sent":        Int64toa(info.MessagesSent),
-		SysPrefix + "/broker/messages/dropped":     Int64toa(info.MessagesDropped),
-		SysPrefix + "/broker/messages/inflight":    Int64toa(info.Inflight),
-		SysPrefix + "/broker/retained":             Int64toa(info.Retained),
-		SysPrefix + "/broker/subscriptions":        Int64toa(info.Subscriptions),
-		SysPrefix + "/broker/system/memory":        Int64toa(info.MemoryAlloc),
-		SysPrefix + "/broker/system/threads":       Int64toa(info.Threads),
+		SysPrefix + "/broker/version":                      s.Info.Version,
+		SysPrefix + "/broker/time":                         Int64toa(info.Time),
+		SysPrefix + "/broker/uptime":                       Int64toa(info.Uptime),
+		SysPrefix + "/broker/started":                      Int64toa(info.Started),
+		SysPrefix + "/broker/load/bytes/received":          Int64toa(info.BytesReceived),
+		SysPrefix + "/broker/load/bytes/sent":              Int64toa(info.BytesSent),
+		SysPrefix + "/broker/clients/connected":            Int64toa(info.ClientsConnected),
+		SysPrefix + "/broker/clients/disconnected":         Int64toa(info.ClientsDisconnected),
+		SysPrefix + "/broker/clients/maximum":              Int64toa(info.ClientsMaximum),
+		SysPrefix + "/broker/clients/total":                Int64toa(info.ClientsTotal),
+		SysPrefix + "/broker/clients/slow":                 Int64toa(info.ClientsSlow),
+		SysPrefix + "/broker/clients/slow/evicted":         Int64toa(info.SlowEvicted),
+		SysPrefix + "/broker/packets/received":             Int64toa(info.PacketsReceived),
+		SysPrefix + "/broker/packets/sent":                 Int64toa(info.PacketsSent),
+		SysPrefix + "/broker/messages/received":            Int64toa(info.MessagesReceived),
+		SysPrefix + "/broker/messages/sent":                Int64toa(info.MessagesSent),
+		SysPrefix + "/broker/messages/dropped":             Int64toa(info.MessagesDropped),
+		SysPrefix + "/broker/messages/inline/dropped":      Int64toa(info.InlineDropped),
+		SysPrefix + "/broker/messages/ratelimited":         Int64toa(info.RateLimited),
+		SysPrefix + "/broker/messages/ratelimited/dropped": Int64toa(info.RateLimitDropped),
+		SysPrefix + "/broker/messages/inflight":            Int64toa(info.Inflight),
+		SysPrefix + "/broker/retained":                     Int64toa(info.Retained),
+		SysPrefix + "/broker/retained/rejected":            Int64toa(info.RetainedRejected),
+		SysPrefix + "/broker/retained/evicted":             Int64toa(info.RetainedEvicted),
+		SysPrefix + "/broker/subscriptions":                Int64toa(info.Subscriptions),
+		SysPrefix + "/broker/system/memory":                Int64toa(info.MemoryAlloc),
+		SysPrefix + "/broker/memory/outbound":              Int64toa(info.MemoryOutbound),
+		SysPrefix + "/broker/memory/inflight":              Int64toa(info.MemoryInflight),
+		SysPrefix + "/broker/memory/retained":              Int64toa(info.MemoryRetained),
+		SysPrefix + "/broker/memory/total":                 Int64toa(info.MemoryOutbound + info.MemoryInflight + info.MemoryRetained),
+		SysPrefix + "/broker/system/threads":               Int64toa(info.Threads),
 	}
 
 	for topic, payload := range topics {
@@ -1498,6 +1752,11 @@ func (s *Server) Close() error {
 	s.Listeners.CloseAll(s.closeListenerClients)
 	s.hooks.OnStopped()
 	s.hooks.Stop()
+	if s.spool != nil {
+		if err := s.spool.Close(); err != nil {
+			s.Log.Error("failed to close spool", "error", err)
+		}
+	}
 
 	s.Log.Info("mochi mqtt server stopped")
 	return nil
@@ -1538,6 +1797,7 @@ func (s *Server) sendLWT(cl *Client) {
 		pk.Connect.WillProperties.WillDelayInterval = cl.Properties.Will.WillDelayInterval
 		pk.Expiry = time.Now().Unix() + int64(pk.Connect.WillProperties.WillDelayInterval)
 		s.loop.willDelayed.Add(cl.ID, pk)
+		s.hooks.OnDelayedWill(cl, pk)
 		return
 	}
 
@@ -1597,9 +1857,37 @@ func (s *Server) readStore() error {
 		s.Log.Debug("loaded $SYS info from store")
 	}
 
+	if s.hooks.Provides(StoredDelayedMessages) {
+		delayed, err := s.hooks.StoredDelayedMessages()
+		if err != nil {
+			return fmt.Errorf("load delayed messages; %w", err)
+		}
+		s.loadDelayed(delayed)
+		s.Log.Debug("loaded delayed messages from store", "len", len(delayed))
+	}
+
+	if s.hooks.Provides(StoredDelayedWills) {
+		wills, err := s.hooks.StoredDelayedWills()
+		if err != nil {
+			return fmt.Errorf("load delayed wills; %w", err)
+		}
+		s.loadDelayedWills(wills)
+		s.Log.Debug("loaded delayed wills from store", "len", len(wills))
+	}
+
 	return nil
 }
 
+// loadDelayedWills restores delayed will messages from the datastore. They are sent when
+// their original due time is reached, so the remaining delay is kept across restarts.
+func (s *Server) loadDelayedWills(v []storage.Message) {
+	for _, msg := range v {
+		pk := msg.ToPacket()
+		pk.Expiry = msg.Due
+		s.loop.willDelayed.Add(msg.Client, pk)
+	}
+}
+
 // loadServerInfo restores server info from the datastore.
 func (s *Server) loadServerInfo(v system.Info) {
 	if s.Options.Capabilities.Compatibilities.RestoreSysInfoOnRestart {
@@ -1614,6 +1902,12 @@ func (s *Server) loadServerInfo(v system.Info) {
 		atomic.StoreInt64(&s.Info.PacketsReceived, v.PacketsReceived)
 		atomic.StoreInt64(&s.Info.PacketsSent, v.PacketsSent)
 		atomic.StoreInt64(&s.Info.InflightDropped, v.InflightDropped)
+		atomic.StoreInt64(&s.Info.InlineDropped, v.InlineDropped)
+		atomic.StoreInt64(&s.Info.RateLimited, v.RateLimited)
+		atomic.StoreInt64(&s.Info.RateLimitDropped, v.RateLimitDropped)
+		atomic.StoreInt64(&s.Info.SlowEvicted, v.SlowEvicted)
+		atomic.StoreInt64(&s.Info.RetainedRejected, v.RetainedRejected)
+		atomic.StoreInt64(&s.Info.RetainedEvicted, v.RetainedEvicted)
 	}
 	atomic.StoreInt64(&s.Info.Retained, v.Retained)
 	atomic.StoreInt64(&s.Info.Inflight, v.Inflight)
@@ -1630,6 +1924,7 @@ func (s *Server) loadSubscriptions(v []storage.Subscription) {
 			RetainAsPublished: sub.RetainAsPublished,
 			NoLocal:           sub.NoLocal,
 			Identifier:        sub.Identifier,
+			RewriteTemplate:   sub.RewriteTemplate,
 		}
 		if s.Topics.Subscribe(sub.Client, sb) {
 			if cl, ok := s.Clients.Get(sub.Client); ok {
@@ -1670,6 +1965,7 @@ func (s *Server) loadClients(v []storage.Client) {
 			cl.ClearInflights()
 			s.UnsubscribeClient(cl)
 		} else {
+			cl.State.offline.setLimit(s.selectOfflineQueue(cl))
 			s.Clients.Add(cl)
 		}
 	}
@@ -1686,8 +1982,17 @@ func (s *Server) loadInflight(v []storage.Message) {
 
 // loadRetained restores retained messages from the datastore.
 func (s *Server) loadRetained(v []storage.Message) {
+	s.retained.Lock()
+	defer s.retained.Unlock()
 	for _, msg := range v {
-		s.Topics.RetainMessage(msg.ToPacket())
+		pk := msg.ToPacket()
+		owner := pk.Origin
+		if cl, ok := s.Clients.Get(pk.Origin); ok {
+			owner = retainOwner(cl)
+		}
+
+		s.retained.set(pk.TopicName, owner, int64(len(pk.Payload)))
+		s.Topics.RetainMessage(pk)
 	}
 }
 
@@ -1707,6 +2012,8 @@ func (s *Server) clearExpiredClients(dt int64) {
 
 		if disconnected+int64(expire) < dt {
 			s.hooks.OnClientExpired(client)
+			s.deliveries.drop(id)
+			s.removeSpool(id)
 			s.Clients.Delete(id) // [MQTT-4.1.0-2]
 		}
 	}
@@ -1723,7 +2030,10 @@ func (s *Server) clearExpiredRetainedMessages(now int64) {
 			now-pk.Created > s.Options.Capabilities.MaximumMessageExpiryInterval
 
 		if expired || enforced {
+			s.retained.Lock()
+			s.retained.remove(filter)
 			s.Topics.Retained.Delete(filter)
+			s.retained.Unlock()
 			s.hooks.OnRetainedExpired(filter)
 		}
 	}
@@ -1734,6 +2044,7 @@ func (s *Server) clearExpiredInflights(now int64) {
 	for _, client := range s.Clients.GetAll() {
 		if deleted := client.ClearExpiredInflights(now, s.Options.Capabilities.MaximumMessageExpiryInterval); len(deleted) > 0 {
 			for _, id := range deleted {
+				s.deliveries.complete(client.ID, id, false)
 				s.hooks.OnQosDropped(client, packets.Packet{PacketID: id})
 			}
 		}
@@ -1742,19 +2053,77 @@ func (s *Server) clearExpiredInflights(now int64) {
 
 // sendDelayedLWT sends any LWT messages which have reached their issue time.
 func (s *Server) sendDelayedLWT(dt int64) {
+	due := func(pk packets.Packet) bool {
+		return dt > pk.Expiry
+	}
+
 	for id, pk := range s.loop.willDelayed.GetAll() {
-		if dt > pk.Expiry {
-			s.publishToSubscribers(pk) // [MQTT-3.1.2-8]
-			if cl, ok := s.Clients.Get(id); ok {
-				if pk.FixedHeader.Retain {
-					s.retainMessage(cl, pk)
-				}
-				cl.Properties.Will = Will{} // [MQTT-3.1.2-10]
-				s.hooks.OnWillSent(cl, pk)
+		if !due(pk) {
+			continue
+		}
+
+		// take the will if it is still due, so it is not sent if it has since been cancelled or
+		// replaced by the will of a later session, nor reported as removed twice.
+		pk, ok := s.loop.willDelayed.TakeIf(id, due)
+		if !ok {
+			continue
+		}
+
+		s.publishToSubscribers(pk) // [MQTT-3.1.2-8]
+		if cl, ok := s.Clients.Get(id); ok {
+			if pk.FixedHeader.Retain {
+				s.retainMessage(cl, pk)
 			}
-			s.loop.willDelayed.Delete(id)
+			cl.Properties.Will = Will{} // [MQTT-3.1.2-10]
+			s.hooks.OnWillSent(cl, pk)
+		}
+		s.hooks.OnDelayedWillRemoved(id)
+	}
+}
+
+// DelayedWill is the will message of a disconnected client, which is held by the server
+// and sent when the will delay interval of the client has elapsed.
+type DelayedWill struct {
+	Client string         `json:"client"` // the id of the client the will message belongs to
+	Due    int64          `json:"due"`    // the time the will message is due to be sent in unixtime
+	Packet packets.Packet `json:"-"`      // the will message
+}
+
+// DelayedWills returns all pending delayed will messages, ordered by due time.
+func (s *Server) DelayedWills() []DelayedWill {
+	all := s.loop.willDelayed.GetAll()
+	v := make([]DelayedWill, 0, len(all))
+	for id, pk := range all {
+		v = append(v, DelayedWill{Client: id, Due: pk.Expiry, Packet: pk})
+	}
+
+	sort.Slice(v, func(i, j int) bool {
+		if v[i].Due == v[j].Due {
+			return v[i].Client < v[j].Client
 		}
+		return v[i].Due < v[j].Due
+	})
+	return v
+}
+
+// CancelDelayedWill cancels the pending delayed will message of a client so that it is never sent.
+func (s *Server) CancelDelayedWill(id string) error {
+	if !s.removeDelayedWill(id) {
+		return ErrDelayedWillNotFound
 	}
+
+	return nil
+}
+
+// removeDelayedWill removes the pending delayed will message of a client, returning true if
+// it existed.
+func (s *Server) removeDelayedWill(id string) bool {
+	if _, ok := s.loop.willDelayed.Take(id); !ok {
+		return false
+	}
+
+	s.hooks.OnDelayedWillRemoved(id)
+	return true
 }
 
 // Int64toa converts an int64 to a string.
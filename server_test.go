@@ -6,16 +6,19 @@ package mqtt
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"log/slog"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/xyzj/mqtt-server/client"
 	"github.com/xyzj/mqtt-server/hooks/storage"
 	"github.com/xyzj/mqtt-server/listeners"
 	"github.com/xyzj/mqtt-server/packets"
@@ -273,12 +276,13 @@ func TestServerAddListenersFromConfig(t *testing.T) {
 		{Type: listeners.TypeSysInfo, ID: "info", Address: ":1880"},
 		{Type: listeners.TypeUnix, ID: "unix", Address: "mochi.sock"},
 		{Type: listeners.TypeMock, ID: "mock", Address: "0"},
+		{Type: listeners.TypeMemory, ID: "memory"},
 		{Type: "unknown", ID: "unknown"},
 	}
 
 	err := s.AddListenersFromConfig(lc)
 	require.NoError(t, err)
-	require.Equal(t, 6, s.Listeners.Len())
+	require.Equal(t, 7, s.Listeners.Len())
 
 	tcp, _ := s.Listeners.Get("tcp")
 	require.Equal(t, "[::]:1883", tcp.Address())
@@ -297,6 +301,119 @@ func TestServerAddListenersFromConfig(t *testing.T) {
 
 	mock, _ := s.Listeners.Get("mock")
 	require.Equal(t, "0", mock.Address())
+
+	memory, _ := s.Listeners.Get("memory")
+	require.Equal(t, "memory", memory.Address())
+}
+
+// RemoteHook allows connections only from remote addresses with a given prefix.
+type RemoteHook struct {
+	HookBase
+	prefix string
+}
+
+func (h *RemoteHook) ID() string {
+	return "remote-hook"
+}
+
+func (h *RemoteHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck}, []byte{b})
+}
+
+func (h *RemoteHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	return strings.HasPrefix(cl.Net.Remote, h.prefix)
+}
+
+func (h *RemoteHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return topic != "denied"
+}
+
+// newMemoryTestServer starts a server with hooks and a memory listener, which is closed
+// when the test ends.
+func newMemoryTestServer(t *testing.T, opts *Options, hooks ...Hook) (*Server, *listeners.Memory) {
+	if opts.Logger == nil {
+		opts.Logger = logger
+	}
+
+	s := New(opts)
+	for _, hook := range hooks {
+		require.NoError(t, s.AddHook(hook, nil))
+	}
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	t.Cleanup(func() { _ = s.Close() })
+	return s, l
+}
+
+// connectMemoryTestClient connects a v5 clean session client to a memory listener, which
+// is disconnected when the test ends.
+func connectMemoryTestClient(t *testing.T, l *listeners.Memory, id, username string, handler client.MessageHandler) *client.Client {
+	c := client.New(&client.Options{
+		ClientID:        id,
+		Username:        username,
+		ProtocolVersion: 5,
+		Clean:           true,
+		Logger:          logger,
+		DefaultHandler:  handler,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return l.DialContext(ctx, "")
+		},
+	})
+	require.NoError(t, c.Connect(context.Background()))
+	t.Cleanup(func() { _ = c.Disconnect() })
+	return c
+}
+
+func TestServerMemoryListener(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	require.NoError(t, s.AddHook(&RemoteHook{prefix: "10.0.0."}, nil))
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	dial := func(remote string) *client.Client {
+		return client.New(&client.Options{
+			ClientID:        "mem-" + remote,
+			ProtocolVersion: 5,
+			Clean:           true,
+			Logger:          logger,
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				return l.DialContext(ctx, remote)
+			},
+		})
+	}
+
+	refused := dial("192.168.0.1:1000")
+	require.ErrorIs(t, refused.Connect(context.Background()), packets.Code{Code: packets.ErrBadUsernameOrPassword.Code, Reason: packets.ErrBadUsernameOrPassword.Reason})
+
+	c := dial("10.0.0.1:1000")
+	require.NoError(t, c.Connect(context.Background()))
+	defer c.Disconnect()
+
+	cl, ok := s.Clients.Get("mem-10.0.0.1:1000")
+	require.True(t, ok)
+	require.Equal(t, "mem", cl.Net.Listener)
+	require.Equal(t, "10.0.0.1:1000", cl.Net.Remote)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.ClientsConnected))
+
+	got := make(chan packets.Packet, 1)
+	_, err := c.Subscribe(context.Background(), func(c *client.Client, pk packets.Packet) {
+		got <- pk
+	}, packets.Subscription{Filter: "mem/#", Qos: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Publish(context.Background(), "mem/a", []byte("hello"), 1, false))
+	select {
+	case pk := <-got:
+		require.Equal(t, "hello", string(pk.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	require.Error(t, c.Publish(context.Background(), "denied", nil, 1, false))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.MessagesReceived))
 }
 
 func TestServerAddListenersFromConfigError(t *testing.T) {
@@ -2103,8 +2220,7 @@ func TestPublishToClientExceedClientWritesPending(t *testing.T) {
 	s.Clients.Add(cl)
 
 	for i := int32(0); i < cl.ops.options.Capabilities.MaximumClientWritesPending; i++ {
-		cl.State.outbound <- new(packets.Packet)
-		atomic.AddInt32(&cl.State.outboundQty, 1)
+		cl.State.outbound.push(new(packets.Packet), 0)
 	}
 
 	id, _ := cl.NextPacketID()
@@ -3320,6 +3436,172 @@ func TestServerSendLWTDelayed(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).RawBytes, <-recv)
 }
 
+// willStoreHook records delayed will messages like a storage hook.
+type willStoreHook struct {
+	HookBase
+	mu      sync.Mutex
+	stored  map[string]packets.Packet
+	removed []string
+}
+
+func (h *willStoreHook) ID() string {
+	return "will-store"
+}
+
+func (h *willStoreHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnDelayedWill, OnDelayedWillRemoved, StoredDelayedWills}, []byte{b})
+}
+
+func (h *willStoreHook) OnDelayedWill(cl *Client, pk packets.Packet) {
+	h.stored[cl.ID] = pk
+}
+
+func (h *willStoreHook) OnDelayedWillRemoved(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removed = append(h.removed, id)
+}
+
+func (h *willStoreHook) StoredDelayedWills() (v []storage.Message, err error) {
+	for id, pk := range h.stored {
+		v = append(v, storage.Message{
+			ID:          storage.DelayedWillKey + "_" + id,
+			Client:      id,
+			TopicName:   pk.TopicName,
+			Payload:     pk.Payload,
+			FixedHeader: pk.FixedHeader,
+			Due:         pk.Expiry,
+		})
+	}
+	return v, nil
+}
+
+func TestServerDelayedWillHooks(t *testing.T) {
+	s := newServer()
+	hook := &willStoreHook{stored: map[string]packets.Packet{}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	cl, _, _ := newTestClient()
+	cl.ID = "cl1"
+	cl.Properties.Will = Will{
+		Flag:              1,
+		TopicName:         "a/b/c",
+		Payload:           []byte("hello mochi"),
+		WillDelayInterval: 30,
+	}
+	s.Clients.Add(cl)
+
+	s.sendLWT(cl)
+	require.Contains(t, hook.stored, "cl1")
+	require.Equal(t, "a/b/c", hook.stored["cl1"].TopicName)
+	require.InDelta(t, time.Now().Unix()+30, hook.stored["cl1"].Expiry, 1)
+
+	s.sendDelayedLWT(time.Now().Unix())
+	require.Empty(t, hook.removed) // not yet due.
+
+	s.sendDelayedLWT(time.Now().Unix() + 31)
+	require.Equal(t, []string{"cl1"}, hook.removed)
+	require.Equal(t, 0, s.loop.willDelayed.Len())
+}
+
+func TestServerDelayedWills(t *testing.T) {
+	s := newServer()
+	hook := &willStoreHook{stored: map[string]packets.Packet{}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	require.Empty(t, s.DelayedWills())
+
+	s.loop.willDelayed.Add("cl2", packets.Packet{TopicName: "b", Expiry: 200})
+	s.loop.willDelayed.Add("cl1", packets.Packet{TopicName: "a", Expiry: 200})
+	s.loop.willDelayed.Add("cl3", packets.Packet{TopicName: "c", Expiry: 100})
+
+	wills := s.DelayedWills()
+	require.Len(t, wills, 3)
+	for i, id := range []string{"cl3", "cl1", "cl2"} {
+		require.Equal(t, id, wills[i].Client)
+	}
+	require.Equal(t, int64(100), wills[0].Due)
+	require.Equal(t, "c", wills[0].Packet.TopicName)
+
+	require.NoError(t, s.CancelDelayedWill("cl1"))
+	require.Equal(t, []string{"cl1"}, hook.removed)
+	require.Len(t, s.DelayedWills(), 2)
+	require.ErrorIs(t, s.CancelDelayedWill("cl1"), ErrDelayedWillNotFound)
+	require.Equal(t, []string{"cl1"}, hook.removed)
+}
+
+func TestServerCancelDelayedWillWhileSending(t *testing.T) {
+	s := newServer()
+	hook := &willStoreHook{stored: map[string]packets.Packet{}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	for i := 0; i < 100; i++ {
+		s.loop.willDelayed.Add("cl"+strconv.Itoa(i), packets.Packet{TopicName: "a/b", Expiry: 1})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.sendDelayedLWT(2)
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		_ = s.CancelDelayedWill("cl" + strconv.Itoa(i))
+	}
+	<-done
+
+	require.Equal(t, 0, s.loop.willDelayed.Len())
+	require.Len(t, hook.removed, 100) // each will is either sent or cancelled, never both.
+	seen := map[string]bool{}
+	for _, id := range hook.removed {
+		require.False(t, seen[id])
+		seen[id] = true
+	}
+}
+
+func TestServerDisconnectRemovesStoredWill(t *testing.T) {
+	s := newServer()
+	hook := &willStoreHook{stored: map[string]packets.Packet{}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	cl, _, _ := newTestClient()
+	cl.Properties.Props.SessionExpiryInterval = 30
+	cl.Properties.ProtocolVersion = 5
+	s.loop.willDelayed.Add(cl.ID, packets.Packet{TopicName: "a/b/c"})
+
+	err := s.processPacket(cl, *packets.TPacketData[packets.Disconnect].Get(packets.TDisconnectMqtt5).Packet)
+	require.NoError(t, err)
+	require.Equal(t, []string{cl.ID}, hook.removed)
+}
+
+func TestServerReadStoreDelayedWills(t *testing.T) {
+	due := time.Now().Unix() + 10
+	hook := &willStoreHook{stored: map[string]packets.Packet{
+		"cl1": {
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   "a/b/c",
+			Payload:     []byte("hello"),
+			Expiry:      due,
+		},
+	}}
+
+	s := newServer()
+	require.NoError(t, s.AddHook(hook, nil))
+	require.NoError(t, s.readStore())
+
+	wills := s.DelayedWills()
+	require.Len(t, wills, 1)
+	require.Equal(t, "cl1", wills[0].Client)
+	require.Equal(t, due, wills[0].Due) // the remaining delay is kept.
+	require.Equal(t, "a/b/c", wills[0].Packet.TopicName)
+	require.Equal(t, []byte("hello"), wills[0].Packet.Payload)
+	require.True(t, wills[0].Packet.FixedHeader.Retain)
+
+	s.sendDelayedLWT(due + 1)
+	require.Empty(t, s.DelayedWills())
+	require.Equal(t, []string{"cl1"}, hook.removed)
+}
+
 func TestServerReadStore(t *testing.T) {
 	s := newServer()
 	hook := new(modifiedHookBase)
@@ -3344,6 +3626,14 @@ func TestServerReadStore(t *testing.T) {
 	hook.failAt = 5 // sys info
 	err = s.readStore()
 	require.Error(t, err)
+
+	hook.failAt = 6 // delayed messages
+	err = s.readStore()
+	require.Error(t, err)
+
+	hook.failAt = 7 // delayed wills
+	err = s.readStore()
+	require.Error(t, err)
 }
 
 func TestServerLoadClients(t *testing.T) {
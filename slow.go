@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+const (
+	SlowSubscriberLog        = "log"        // log the slow subscriber
+	SlowSubscriberNotify     = "notify"     // log the slow subscriber and publish an event to $SYS/broker/events/slow
+	SlowSubscriberDisconnect = "disconnect" // log, publish an event, and disconnect the slow subscriber
+)
+
+const (
+	defaultSlowSubscriberWindow int64 = 10          // the default window in seconds over which subscribers are checked
+	slowSubscriberEvictTimeout        = time.Second // the time allowed for writing the disconnect packet to a slow subscriber
+)
+
+// ErrSlowSubscribersInvalid indicates that the slow subscriber options are misconfigured.
+var ErrSlowSubscribersInvalid = errors.New("invalid slow subscribers options")
+
+// SlowSubscribers configures the detection of subscribers which cannot keep up with the
+// messages sent to them. Clients are checked at the end of each window, and a client is
+// slow if it exceeds either threshold within the window. A zero threshold is disabled.
+type SlowSubscribers struct {
+	Window     int64  `yaml:"window" json:"window"`           // seconds in each window; 10 if not set
+	MaxDropped int64  `yaml:"max_dropped" json:"max_dropped"` // messages dropped due to a full outbound queue
+	MaxLatency int64  `yaml:"max_latency" json:"max_latency"` // milliseconds taken to write a single outbound message
+	Policy     string `yaml:"policy" json:"policy"`           // log, notify, or disconnect; log if empty
+}
+
+// exceeded returns true if the drops or the slowest write in nanoseconds of a window
+// exceed a threshold.
+func (o SlowSubscribers) exceeded(dropped, latency int64) bool {
+	return (o.MaxDropped > 0 && dropped > o.MaxDropped) ||
+		(o.MaxLatency > 0 && latency > o.MaxLatency*int64(time.Millisecond))
+}
+
+// validate returns an error if the slow subscriber options are misconfigured.
+func (o SlowSubscribers) validate() error {
+	if o.MaxDropped < 0 || o.MaxLatency < 0 {
+		return fmt.Errorf("negative value; %w", ErrSlowSubscribersInvalid)
+	}
+
+	switch o.Policy {
+	case "", SlowSubscriberLog, SlowSubscriberNotify, SlowSubscriberDisconnect:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q; %w", o.Policy, ErrSlowSubscribersInvalid)
+	}
+}
+
+// SlowSubscriber describes a client which was found to be a slow subscriber.
+type SlowSubscriber struct {
+	Client       string `json:"client"`        // the id of the client
+	Listener     string `json:"listener"`      // the listener the client is connected to
+	Since        int64  `json:"since"`         // the unix time the client was first found to be slow
+	Dropped      int64  `json:"dropped"`       // messages dropped in the last window
+	DroppedTotal int64  `json:"dropped_total"` // messages dropped since the client connected
+	Latency      int64  `json:"latency"`       // the slowest write in the last window, in milliseconds
+}
+
+// slowStats tracks the drops and write latency of a client's outbound messages.
+type slowStats struct {
+	dropped      int64 // messages dropped in the current window
+	droppedTotal int64 // messages dropped since the client connected
+	latency      int64 // the slowest write in the current window, in nanoseconds
+	writing      int64 // the unix nano time the current write started, or 0
+	since        int64 // the unix time the client was found to be slow, or 0 if not slow
+	lastDropped  int64 // messages dropped in the last window
+	lastLatency  int64 // the slowest write in the last window, in nanoseconds
+}
+
+// drop records a message dropped due to a full outbound queue.
+func (st *slowStats) drop() {
+	atomic.AddInt64(&st.dropped, 1)
+	atomic.AddInt64(&st.droppedTotal, 1)
+}
+
+// startWrite records the start of an outbound write.
+func (st *slowStats) startWrite(now time.Time) {
+	atomic.StoreInt64(&st.writing, now.UnixNano())
+}
+
+// endWrite records the end of an outbound write, keeping the slowest write of the window.
+func (st *slowStats) endWrite(now time.Time) {
+	d := now.UnixNano() - atomic.SwapInt64(&st.writing, 0)
+	for {
+		v := atomic.LoadInt64(&st.latency)
+		if d <= v || atomic.CompareAndSwapInt64(&st.latency, v, d) {
+			return
+		}
+	}
+}
+
+// window ends the current window, returning its drops and slowest write. A write which
+// is still in progress counts towards the slowest write, so a stalled client is found.
+func (st *slowStats) window(now time.Time) (dropped, latency int64) {
+	dropped = atomic.SwapInt64(&st.dropped, 0)
+	latency = atomic.SwapInt64(&st.latency, 0)
+	if started := atomic.LoadInt64(&st.writing); started > 0 {
+		latency = max(latency, now.UnixNano()-started)
+	}
+
+	atomic.StoreInt64(&st.lastDropped, dropped)
+	atomic.StoreInt64(&st.lastLatency, latency)
+	return
+}
+
+// SlowSubscribers returns the clients which were found to be slow in the last window,
+// ordered by client id.
+func (s *Server) SlowSubscribers() []SlowSubscriber {
+	var out []SlowSubscriber
+	for _, cl := range s.Clients.GetAll() {
+		if sub, ok := cl.slowSubscriber(); ok {
+			out = append(out, sub)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Client < out[j].Client
+	})
+
+	return out
+}
+
+// slowSubscriber returns the slow subscriber details of a client, if it is slow.
+func (cl *Client) slowSubscriber() (SlowSubscriber, bool) {
+	st := &cl.State.slow
+	since := atomic.LoadInt64(&st.since)
+	if since == 0 {
+		return SlowSubscriber{}, false
+	}
+
+	return SlowSubscriber{
+		Client:       cl.ID,
+		Listener:     cl.Net.Listener,
+		Since:        since,
+		Dropped:      atomic.LoadInt64(&st.lastDropped),
+		DroppedTotal: atomic.LoadInt64(&st.droppedTotal),
+		Latency:      atomic.LoadInt64(&st.lastLatency) / int64(time.Millisecond),
+	}, true
+}
+
+// checkSlowSubscribers ends the current window for all clients, and applies the slow
+// subscriber policy to any client which exceeded a threshold within the window.
+func (s *Server) checkSlowSubscribers(now time.Time) {
+	opts := s.Options.SlowSubscribers
+	var slow int64
+	for _, cl := range s.Clients.GetAll() {
+		dropped, latency := cl.State.slow.window(now)
+		if cl.Net.Inline || cl.Closed() || !opts.exceeded(dropped, latency) {
+			atomic.StoreInt64(&cl.State.slow.since, 0)
+			continue
+		}
+
+		slow++
+		if !atomic.CompareAndSwapInt64(&cl.State.slow.since, 0, now.Unix()) {
+			continue // the client is still slow, and has already been reported.
+		}
+
+		sub, _ := cl.slowSubscriber()
+		s.Log.Warn("slow subscriber", "client", cl.ID, "listener", cl.Net.Listener,
+			"dropped", sub.Dropped, "latency_ms", sub.Latency, "policy", opts.Policy)
+		s.hooks.OnSlowSubscriber(cl, sub)
+
+		if opts.Policy == SlowSubscriberNotify || opts.Policy == SlowSubscriberDisconnect {
+			s.publishSlowSubscriber(sub)
+		}
+
+		if opts.Policy == SlowSubscriberDisconnect {
+			atomic.AddInt64(&s.Info.SlowEvicted, 1)
+			go s.evictSlowSubscriber(cl)
+		}
+	}
+
+	atomic.StoreInt64(&s.Info.ClientsSlow, slow)
+}
+
+// publishSlowSubscriber publishes a slow subscriber event to the $SYS/broker/events/slow topic.
+func (s *Server) publishSlowSubscriber(sub SlowSubscriber) {
+	payload, err := json.Marshal(sub)
+	if err != nil {
+		s.Log.Error("failed to encode slow subscriber event", "error", err, "client", sub.Client)
+		return
+	}
+
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: SysPrefix + "/broker/events/slow",
+		Payload:   payload,
+		Created:   time.Now().Unix(),
+	})
+}
+
+// evictSlowSubscriber disconnects a slow subscriber. The connection is closed even if the
+// disconnect packet cannot be written, and the session of the client is kept as for any other
+// disconnection, so the qos messages queued for a persistent session are resent on reconnect.
+func (s *Server) evictSlowSubscriber(cl *Client) {
+	if cl.Net.Conn != nil {
+		_ = cl.Net.Conn.SetWriteDeadline(time.Now().Add(slowSubscriberEvictTimeout)) // don't wait on a stalled connection.
+	}
+
+	_ = s.DisconnectClient(cl, packets.ErrPendingClientWritesExceeded)
+	cl.Stop(packets.ErrPendingClientWritesExceeded)
+}
@@ -0,0 +1,294 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+type slowSubscriberHook struct {
+	HookBase
+	sync.Mutex
+	subs []SlowSubscriber
+}
+
+func (h *slowSubscriberHook) ID() string {
+	return "slow-subscriber"
+}
+
+func (h *slowSubscriberHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnSlowSubscriber}, []byte{b})
+}
+
+func (h *slowSubscriberHook) OnSlowSubscriber(cl *Client, sub SlowSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+	h.subs = append(h.subs, sub)
+}
+
+func TestSlowSubscribersValidate(t *testing.T) {
+	require.NoError(t, SlowSubscribers{}.validate())
+	require.NoError(t, SlowSubscribers{MaxDropped: 10, Policy: SlowSubscriberNotify}.validate())
+	require.ErrorIs(t, SlowSubscribers{MaxLatency: -1}.validate(), ErrSlowSubscribersInvalid)
+	require.ErrorIs(t, SlowSubscribers{Policy: "kick"}.validate(), ErrSlowSubscribersInvalid)
+}
+
+func TestSlowSubscribersExceeded(t *testing.T) {
+	o := SlowSubscribers{MaxDropped: 2, MaxLatency: 100}
+	require.False(t, o.exceeded(2, int64(100*time.Millisecond)))
+	require.True(t, o.exceeded(3, 0))
+	require.True(t, o.exceeded(0, int64(101*time.Millisecond)))
+	require.False(t, SlowSubscribers{}.exceeded(1000, int64(time.Hour)))
+}
+
+func TestSlowStatsWindow(t *testing.T) {
+	st := new(slowStats)
+	now := time.Now()
+
+	st.drop()
+	st.drop()
+	st.startWrite(now)
+	st.endWrite(now.Add(30 * time.Millisecond))
+	st.startWrite(now)
+	st.endWrite(now.Add(10 * time.Millisecond))
+
+	dropped, latency := st.window(now)
+	require.Equal(t, int64(2), dropped)
+	require.Equal(t, int64(30*time.Millisecond), latency)
+
+	st.startWrite(now) // a stalled write counts towards the window.
+	dropped, latency = st.window(now.Add(time.Second))
+	require.Equal(t, int64(0), dropped)
+	require.Equal(t, int64(time.Second), latency)
+	require.Equal(t, int64(2), atomic.LoadInt64(&st.droppedTotal))
+}
+
+func TestServerCheckSlowSubscribers(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(slowSubscriberHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	s.Options.SlowSubscribers = SlowSubscribers{MaxDropped: 2}
+
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "tcp1"
+	s.Clients.Add(cl)
+	fast, _, _ := newTestClient()
+	fast.ID = "fast"
+	s.Clients.Add(fast)
+
+	for i := 0; i < 3; i++ {
+		cl.State.slow.drop()
+	}
+	fast.State.slow.drop()
+
+	now := time.Now()
+	s.checkSlowSubscribers(now)
+	require.Equal(t, []SlowSubscriber{{
+		Client:       "mochi",
+		Listener:     "tcp1",
+		Since:        now.Unix(),
+		Dropped:      3,
+		DroppedTotal: 3,
+	}}, s.SlowSubscribers())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.ClientsSlow))
+	require.Len(t, hook.subs, 1)
+
+	for i := 0; i < 3; i++ {
+		cl.State.slow.drop()
+	}
+	s.checkSlowSubscribers(now.Add(time.Second))
+	require.Len(t, s.SlowSubscribers(), 1)
+	require.Equal(t, now.Unix(), s.SlowSubscribers()[0].Since) // still slow since the first window.
+	require.Equal(t, int64(6), s.SlowSubscribers()[0].DroppedTotal)
+	require.Len(t, hook.subs, 1) // only reported when first found to be slow.
+
+	s.checkSlowSubscribers(now.Add(2 * time.Second))
+	require.Empty(t, s.SlowSubscribers())
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.ClientsSlow))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.SlowEvicted))
+}
+
+func TestServerCheckSlowSubscribersDisabled(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+	for i := 0; i < 100; i++ {
+		cl.State.slow.drop()
+	}
+
+	s.checkSlowSubscribers(time.Now())
+	require.Empty(t, s.SlowSubscribers())
+}
+
+func TestServerCheckSlowSubscribersNotify(t *testing.T) {
+	s := newServerWithInlineClient()
+	require.NoError(t, s.Serve())
+	defer s.Close()
+	s.Options.SlowSubscribers = SlowSubscribers{MaxDropped: 1, Policy: SlowSubscriberNotify}
+
+	got := make(chan packets.Packet, 1)
+	require.NoError(t, s.Subscribe(SysPrefix+"/broker/events/slow", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		got <- pk
+	}))
+
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+	cl.State.slow.drop()
+	cl.State.slow.drop()
+	s.checkSlowSubscribers(time.Now())
+
+	select {
+	case pk := <-got:
+		var sub SlowSubscriber
+		require.NoError(t, json.Unmarshal(pk.Payload, &sub))
+		require.Equal(t, "mochi", sub.Client)
+		require.Equal(t, int64(2), sub.Dropped)
+	case <-time.After(time.Second):
+		t.Fatal("slow subscriber event not published")
+	}
+
+	require.False(t, cl.Closed()) // notify does not disconnect the client.
+}
+
+func TestPublishToClientSlowDrop(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+	stallTestClient(t, cl)
+
+	pk := packets.Packet{TopicName: "a/b", Payload: []byte("hello")}
+	for i := 0; i < cl.State.outbound.capacity; i++ {
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(0), atomic.LoadInt64(&cl.State.slow.dropped))
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.ErrorIs(t, err, packets.ErrPendingClientWritesExceeded)
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.State.slow.dropped))
+
+	s.memory.set(memoryHard) // messages shed by the memory budget are not the fault of the client.
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, pk)
+	require.ErrorIs(t, err, packets.ErrPendingClientWritesExceeded)
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.State.slow.dropped))
+}
+
+func TestClientWriteLoopLatency(t *testing.T) {
+	cl, r, _ := newTestClient()
+	defer cl.Stop(nil)
+
+	cl.State.outbound.push(&packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b"}, 0)
+	time.Sleep(20 * time.Millisecond)
+	_, err := r.Read(make([]byte, 16))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&cl.State.slow.latency) >= int64(20*time.Millisecond)
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int64(0), atomic.LoadInt64(&cl.State.slow.writing))
+}
+
+func TestServerEvictSlowSubscriberKeepsSession(t *testing.T) {
+	s := New(&Options{
+		Logger:          logger,
+		InlineClient:    true,
+		SlowSubscribers: SlowSubscribers{MaxLatency: 20, Policy: SlowSubscriberDisconnect},
+	})
+	require.NoError(t, s.AddHook(new(AllowHook), nil))
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	conn, err := l.DialContext(context.Background(), "")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes) // persistent session "zen"
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4)) // connack
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte{
+		packets.Subscribe<<4 | 1<<1, 8, // Fixed header
+		0, 1, // Packet ID
+		0, 3, 'a', '/', 'b', // Topic Name
+		1, // QoS
+	})
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5)) // suback
+	require.NoError(t, err)
+
+	for _, v := range []string{"1", "2", "3"} {
+		require.NoError(t, s.Publish("a/b", []byte(v), false, 1))
+	}
+
+	cl, ok := s.Clients.Get("zen")
+	require.True(t, ok)
+	time.Sleep(40 * time.Millisecond) // the client stops reading, stalling the write of the first message.
+	s.checkSlowSubscribers(time.Now())
+
+	require.Eventually(t, cl.Closed, 2*time.Second, time.Millisecond)
+	require.ErrorIs(t, cl.StopCause(), packets.ErrPendingClientWritesExceeded)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.SlowEvicted))
+	require.Equal(t, 3, cl.State.Inflight.Len())
+
+	// reconnect and read the resent messages without acknowledging them, as the server
+	// resends all inflight messages before it reads from the client.
+	conn, err = l.DialContext(context.Background(), "")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+	require.NoError(t, err)
+	require.Equal(t, packets.Connack, readSlowTestPacket(t, conn).FixedHeader.Type)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		pk := readSlowTestPacket(t, conn)
+		require.Equal(t, packets.Publish, pk.FixedHeader.Type)
+		require.Equal(t, "a/b", pk.TopicName)
+		got = append(got, string(pk.Payload))
+	}
+	require.ElementsMatch(t, []string{"1", "2", "3"}, got)
+}
+
+// readSlowTestPacket reads a small mqtt v3.1.1 packet from a connection.
+func readSlowTestPacket(t *testing.T, conn net.Conn) packets.Packet {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	b := make([]byte, 2)
+	_, err := io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Less(t, b[1], byte(128)) // single byte remaining length
+
+	pk := packets.Packet{ProtocolVersion: 4}
+	require.NoError(t, pk.FixedHeader.Decode(b[0]))
+	pk.FixedHeader.Remaining = int(b[1])
+	body := make([]byte, b[1])
+	_, err = io.ReadFull(conn, body)
+	require.NoError(t, err)
+
+	if pk.FixedHeader.Type == packets.Publish {
+		require.NoError(t, pk.PublishDecode(body))
+	}
+
+	return pk
+}
@@ -0,0 +1,234 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyzj/mqtt-server/hooks/storage"
+	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/mqtt-server/spool"
+)
+
+// ErrSpoolInvalid indicates that the spool options are misconfigured.
+var ErrSpoolInvalid = errors.New("invalid spool options")
+
+// Spool configures the disk backed overflow queue for persistent sessions. When a client with
+// a persistent session has no inflight quota left, its qos 1 and 2 messages are written to a
+// queue on disk instead of being dropped, and are moved back to its inflight messages in order
+// as its quota frees up. A zero limit is unlimited.
+type Spool struct {
+	Dir         string `yaml:"dir" json:"dir"`                   // the directory for the queue files; the spool is disabled if empty
+	MaxBytes    int64  `yaml:"max_bytes" json:"max_bytes"`       // the maximum size of the queue of each client, in bytes
+	MaxMessages int64  `yaml:"max_messages" json:"max_messages"` // the maximum number of messages in the queue of each client
+	SegmentSize int64  `yaml:"segment_size" json:"segment_size"` // the size in bytes at which queue files are rotated; 4MB if zero
+}
+
+// validate returns an error if the spool options are misconfigured.
+func (o Spool) validate() error {
+	if o.MaxBytes < 0 || o.MaxMessages < 0 || o.SegmentSize < 0 {
+		return fmt.Errorf("negative value; %w", ErrSpoolInvalid)
+	}
+
+	return nil
+}
+
+// persistent returns true if the session of the client outlives its connection.
+func (cl *Client) persistent() bool {
+	if cl.Properties.ProtocolVersion == 5 {
+		return cl.Properties.Props.SessionExpiryInterval > 0
+	}
+
+	return !cl.Properties.Clean
+}
+
+// SpoolLen returns the number of messages in the spool of a client.
+func (s *Server) SpoolLen(client string) int {
+	if s.spool == nil {
+		return 0
+	}
+
+	if q, ok := s.spool.Get(client); ok {
+		return q.Len()
+	}
+
+	return 0
+}
+
+// openSpool opens the spool directory, discarding the queues of any clients which no
+// longer have a session.
+func (s *Server) openSpool() error {
+	if s.Options.Spool.Dir == "" {
+		return nil
+	}
+
+	sp, err := spool.Open(s.Options.Spool.Dir, s.Options.Spool.SegmentSize)
+	if err != nil {
+		return fmt.Errorf("open spool: %w", err)
+	}
+	s.spool = sp
+
+	for _, id := range sp.Clients() {
+		if _, ok := s.Clients.Get(id); !ok {
+			s.removeSpool(id)
+		}
+	}
+
+	return nil
+}
+
+// removeSpool deletes the spool of a client when its session ends.
+func (s *Server) removeSpool(id string) {
+	if s.spool == nil {
+		return
+	}
+
+	if err := s.spool.Remove(id); err != nil {
+		s.Log.Error("failed to remove spool", "error", err, "client", id)
+	}
+}
+
+// spooling returns true if the client has messages waiting in its spool.
+func (s *Server) spooling(cl *Client) bool {
+	q, ok := s.spool.Get(cl.ID)
+	return ok && q.Len() > 0
+}
+
+// spoolMessage writes an outbound qos message to the spool of a client, returning
+// ErrQuotaExceeded if the spool is full or cannot be written.
+func (s *Server) spoolMessage(cl *Client, pk packets.Packet) error {
+	data, err := storage.Message{
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Origin:      pk.Origin,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          pk.Properties.PayloadFormat,
+			PayloadFormatFlag:      pk.Properties.PayloadFormatFlag,
+			MessageExpiryInterval:  pk.Properties.MessageExpiryInterval,
+			ContentType:            pk.Properties.ContentType,
+			ResponseTopic:          pk.Properties.ResponseTopic,
+			CorrelationData:        pk.Properties.CorrelationData,
+			SubscriptionIdentifier: pk.Properties.SubscriptionIdentifier,
+			User:                   pk.Properties.User,
+		},
+	}.MarshalBinary()
+
+	var q *spool.Queue
+	if err == nil {
+		q, err = s.spool.Queue(cl.ID)
+	}
+
+	if err != nil {
+		atomic.AddInt64(&s.Info.InflightDropped, 1)
+		s.Log.Error("failed to spool message", "error", err, "client", cl.ID, "listener", cl.Net.Listener)
+		return packets.ErrQuotaExceeded
+	}
+
+	opts := s.Options.Spool
+	if (opts.MaxMessages > 0 && int64(q.Len()) >= opts.MaxMessages) ||
+		(opts.MaxBytes > 0 && q.Size()+int64(len(data)) > opts.MaxBytes) {
+		atomic.AddInt64(&s.Info.InflightDropped, 1)
+		s.Log.Warn("client spool quota reached", "client", cl.ID, "listener", cl.Net.Listener)
+		return packets.ErrQuotaExceeded
+	}
+
+	if err := q.Push(data); err != nil {
+		atomic.AddInt64(&s.Info.InflightDropped, 1)
+		s.Log.Error("failed to spool message", "error", err, "client", cl.ID, "listener", cl.Net.Listener)
+		return packets.ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// drainSpool moves messages from the spool of a client to its inflight messages, in the
+// order they were spooled, while the client has inflight quota and outbound queue space.
+func (s *Server) drainSpool(cl *Client) {
+	if s.spool == nil {
+		return
+	}
+
+	q, ok := s.spool.Get(cl.ID)
+	if !ok {
+		return
+	}
+
+	cl.State.spoolLock.Lock()
+	defer cl.State.spoolLock.Unlock()
+	for q.Len() > 0 &&
+		cl.State.Inflight.Len() < int(s.Options.Capabilities.MaximumInflight) &&
+		cl.State.outbound.Len() < cl.State.outbound.capacity {
+		if atomic.LoadInt32(&cl.State.Inflight.maximumSendQuota) > 0 && atomic.LoadInt32(&cl.State.Inflight.sendQuota) == 0 {
+			return // wait for the client to acknowledge its inflight messages.
+		}
+
+		data, err := q.Peek()
+		if err != nil {
+			s.Log.Error("failed to read spool", "error", err, "client", cl.ID)
+			return
+		}
+
+		var msg storage.Message
+		if err := msg.UnmarshalBinary(data); err != nil {
+			s.Log.Error("discarding malformed spooled message", "error", err, "client", cl.ID)
+		} else if pk := s.spooledPacket(msg); pk.Expiry > 0 && pk.Expiry < time.Now().Unix() {
+			s.Log.Debug("discarding expired spooled message", "client", cl.ID, "topic", pk.TopicName)
+		} else if !s.sendSpooled(cl, pk) {
+			return
+		}
+
+		if err := q.Pop(); err != nil {
+			s.Log.Error("failed to remove spooled message", "error", err, "client", cl.ID)
+			return
+		}
+	}
+}
+
+// spooledPacket converts a spooled message back to a publish packet, restoring its expiry.
+func (s *Server) spooledPacket(msg storage.Message) packets.Packet {
+	pk := msg.ToPacket()
+	if expiry := minimum(s.Options.Capabilities.MaximumMessageExpiryInterval,
+		int64(pk.Properties.MessageExpiryInterval)); expiry > 0 {
+		pk.Expiry = pk.Created + expiry
+	}
+
+	return pk
+}
+
+// sendSpooled adds a spooled message to the inflight messages of a client and queues it to
+// be written, returning false if it could not be sent and should stay in the spool. It never
+// waits for space in the outbound queue, as the spool is drained on the client's read loop.
+func (s *Server) sendSpooled(cl *Client, pk packets.Packet) bool {
+	i, err := cl.NextPacketID()
+	if err != nil {
+		return false
+	}
+
+	pk.PacketID = uint16(i)
+	if ok := cl.State.Inflight.Set(pk); ok {
+		atomic.AddInt64(&s.Info.Inflight, 1)
+		s.hooks.OnQosPublish(cl, pk, pk.Created, 0)
+		cl.State.Inflight.DecreaseSendQuota()
+	}
+
+	if cl.Net.Conn == nil || cl.Closed() {
+		return true // sent when the client reconnects.
+	}
+
+	if !s.enqueueOutbound(cl, pk, &pk, false) {
+		cl.State.Inflight.Delete(pk.PacketID)
+		cl.State.Inflight.IncreaseSendQuota()
+		atomic.AddInt64(&s.Info.Inflight, -1)
+		s.hooks.OnQosDropped(cl, pk) // the message stays in the spool, so remove the stored inflight copy.
+		return false
+	}
+
+	return true
+}
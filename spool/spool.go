@@ -0,0 +1,470 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+// Package spool provides a disk backed first-in first-out queue of records for each
+// client, stored in append-only segment files using only the standard library.
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultSegmentSize int64 = 4 << 20 // the default maximum size of a segment file in bytes
+
+	headerSize = 8        // the size of a record header; the record length and crc32 checksum
+	cursorFile = "cursor" // the file holding the read position of a queue
+	segmentExt = ".seg"   // the extension of segment files
+)
+
+var (
+	ErrEmpty   = errors.New("spool queue is empty") // the queue has no records
+	ErrClosed  = errors.New("spool is closed")      // the spool or queue has been closed
+	ErrCorrupt = errors.New("corrupt spool record") // a record failed its checksum
+)
+
+// Spool is a set of disk backed queues, one for each client, stored in a directory.
+type Spool struct {
+	sync.Mutex
+	dir         string            // the directory holding the queue of each client
+	segmentSize int64             // the maximum size of each segment file in bytes
+	queues      map[string]*Queue // queues keyed on client id
+	closed      bool              // true if the spool has been closed
+}
+
+// Open opens a spool in a directory, creating the directory if it does not exist, and
+// restores the queues of any records left in it. Segments are rotated when they reach
+// segmentSize bytes, or DefaultSegmentSize if segmentSize is 0 or less.
+func Open(dir string, segmentSize int64) (*Spool, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		queues:      map[string]*Queue{},
+	}
+
+	for _, e := range entries {
+		id, err := hex.DecodeString(e.Name())
+		if !e.IsDir() || err != nil {
+			continue // not a queue directory.
+		}
+
+		q, err := openQueue(filepath.Join(dir, e.Name()), segmentSize)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("open queue %q: %w", id, err)
+		}
+		s.queues[string(id)] = q
+	}
+
+	return s, nil
+}
+
+// Queue returns the queue of a client, creating it if it does not exist.
+func (s *Spool) Queue(client string) (*Queue, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	if q, ok := s.queues[client]; ok {
+		return q, nil
+	}
+
+	q := &Queue{
+		dir:         filepath.Join(s.dir, hex.EncodeToString([]byte(client))),
+		segmentSize: s.segmentSize,
+	}
+	s.queues[client] = q
+	return q, nil
+}
+
+// Get returns the queue of a client, if it exists.
+func (s *Spool) Get(client string) (*Queue, bool) {
+	s.Lock()
+	defer s.Unlock()
+	q, ok := s.queues[client]
+	return q, ok
+}
+
+// Clients returns the ids of the clients which have a queue, in order.
+func (s *Spool) Clients() []string {
+	s.Lock()
+	defer s.Unlock()
+	ids := make([]string, 0, len(s.queues))
+	for id := range s.queues {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// Remove closes the queue of a client and deletes all of its records.
+func (s *Spool) Remove(client string) error {
+	s.Lock()
+	q, ok := s.queues[client]
+	delete(s.queues, client)
+	s.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	q.close()
+	q.closed = true
+	return os.RemoveAll(q.dir)
+}
+
+// Close closes all the queues in the spool. Their records are kept on disk, and are
+// restored when the spool is next opened.
+func (s *Spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	var err error
+	for _, q := range s.queues {
+		q.Lock()
+		err = errors.Join(err, q.close())
+		q.closed = true
+		q.Unlock()
+	}
+
+	return err
+}
+
+// Queue is a disk backed first-in first-out queue of records. Records are appended to
+// the newest segment file, and read from the oldest; each segment is deleted once all of
+// its records have been read. Records are not synced to disk as they are written, so they
+// survive the process stopping but may be lost if the machine does. It is safe for
+// concurrent use.
+type Queue struct {
+	sync.Mutex
+	dir         string   // the directory holding the segment files
+	segmentSize int64    // the maximum size of each segment file in bytes
+	segments    []uint64 // the ids of the segment files, oldest first
+	w           *os.File // the newest segment, open for appending
+	wsize       int64    // the size of the newest segment
+	r           *os.File // the oldest segment, open for reading
+	roff        int64    // the offset of the next record in the oldest segment
+	count       int      // the number of records in the queue
+	size        int64    // the size of the records in the queue, excluding headers
+	closed      bool     // true if the queue has been closed
+}
+
+// openQueue restores a queue from the segment files in a directory. A record which was
+// only partly written is truncated, along with anything after it.
+func openQueue(dir string, segmentSize int64) (*Queue, error) {
+	q := &Queue{
+		dir:         dir,
+		segmentSize: segmentSize,
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok {
+			continue
+		}
+
+		if id, err := strconv.ParseUint(name, 16, 64); err == nil {
+			q.segments = append(q.segments, id)
+		}
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	seg, off := q.readCursor()
+	for len(q.segments) > 0 && q.segments[0] < seg {
+		if err := os.Remove(q.segmentPath(q.segments[0])); err != nil {
+			return nil, err
+		}
+		q.segments = q.segments[1:]
+	}
+
+	if len(q.segments) > 0 && q.segments[0] == seg {
+		q.roff = off
+	}
+
+	for i, id := range q.segments {
+		start := int64(0)
+		if i == 0 {
+			start = q.roff
+		}
+
+		count, size, end, err := scanSegment(q.segmentPath(id), start)
+		if err != nil {
+			return nil, err
+		}
+
+		q.count += count
+		q.size += size
+		if i < len(q.segments)-1 {
+			continue
+		}
+
+		if err := os.Truncate(q.segmentPath(id), end); err != nil { // drop any partly written record.
+			return nil, err
+		}
+		q.wsize = end
+	}
+
+	return q, nil
+}
+
+// scanSegment counts the valid records of a segment file from an offset, returning the
+// offset of the end of the last valid record.
+func scanSegment(path string, off int64) (count int, size, end int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	end = off
+	for {
+		data, err := readRecord(f, end)
+		if err != nil {
+			return count, size, end, nil // the end of the valid records.
+		}
+
+		count++
+		size += int64(len(data))
+		end += headerSize + int64(len(data))
+	}
+}
+
+// readRecord reads the record at an offset of a segment file.
+func readRecord(f *os.File, off int64) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, off); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[:4]))
+	if _, err := f.ReadAt(data, off+headerSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, ErrCorrupt
+	}
+
+	return data, nil
+}
+
+// segmentPath returns the path of a segment file.
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016x%s", id, segmentExt))
+}
+
+// readCursor returns the segment and offset of the next record to read, as saved by writeCursor.
+func (q *Queue) readCursor() (seg uint64, off int64) {
+	b, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if err != nil || len(b) != 16 {
+		return 0, 0
+	}
+
+	return binary.BigEndian.Uint64(b[:8]), int64(binary.BigEndian.Uint64(b[8:]))
+}
+
+// writeCursor saves the segment and offset of the next record to read.
+func (q *Queue) writeCursor() error {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], q.segments[0])
+	binary.BigEndian.PutUint64(b[8:], uint64(q.roff))
+	return os.WriteFile(filepath.Join(q.dir, cursorFile), b, 0o600)
+}
+
+// Len returns the number of records in the queue.
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.count
+}
+
+// Size returns the size in bytes of the records in the queue.
+func (q *Queue) Size() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.size
+}
+
+// Push appends a record to the queue.
+func (q *Queue) Push(data []byte) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+
+	n := int64(headerSize + len(data))
+	if q.w == nil || (q.wsize > 0 && q.wsize+n > q.segmentSize) {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	b := make([]byte, n)
+	binary.BigEndian.PutUint32(b[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(data))
+	copy(b[headerSize:], data)
+	if _, err := q.w.Write(b); err != nil {
+		return err
+	}
+
+	q.wsize += n
+	q.count++
+	q.size += int64(len(data))
+	return nil
+}
+
+// rotate opens the newest segment for appending, starting a new segment if the newest
+// segment is full or there are none.
+func (q *Queue) rotate() error {
+	if err := os.MkdirAll(q.dir, 0o700); err != nil {
+		return err
+	}
+
+	if q.w != nil {
+		if err := q.w.Close(); err != nil {
+			return err
+		}
+		q.w = nil
+	}
+
+	if len(q.segments) == 0 || q.wsize > 0 {
+		var id uint64
+		if len(q.segments) > 0 {
+			id = q.segments[len(q.segments)-1] + 1
+		}
+		q.segments = append(q.segments, id)
+		q.wsize = 0
+	}
+
+	f, err := os.OpenFile(q.segmentPath(q.segments[len(q.segments)-1]), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	q.w = f
+	return nil
+}
+
+// Peek returns the oldest record in the queue without removing it, or ErrEmpty.
+func (q *Queue) Peek() ([]byte, error) {
+	q.Lock()
+	defer q.Unlock()
+	return q.peek()
+}
+
+// peek returns the oldest record in the queue, deleting any segments which have been
+// read in full. The queue must be locked.
+func (q *Queue) peek() ([]byte, error) {
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	if q.count == 0 {
+		return nil, ErrEmpty
+	}
+
+	for {
+		if q.r == nil {
+			f, err := os.Open(q.segmentPath(q.segments[0]))
+			if err != nil {
+				return nil, err
+			}
+			q.r = f
+		}
+
+		data, err := readRecord(q.r, q.roff)
+		if err == nil || len(q.segments) == 1 {
+			return data, err
+		}
+
+		q.r.Close()
+		q.r = nil
+		if err := os.Remove(q.segmentPath(q.segments[0])); err != nil {
+			return nil, err
+		}
+		q.segments = q.segments[1:]
+		q.roff = 0
+	}
+}
+
+// Pop removes the oldest record from the queue. Once the queue is empty, all of its
+// files are deleted.
+func (q *Queue) Pop() error {
+	q.Lock()
+	defer q.Unlock()
+	data, err := q.peek()
+	if err != nil {
+		return err
+	}
+
+	q.roff += headerSize + int64(len(data))
+	q.count--
+	q.size -= int64(len(data))
+	if q.count > 0 {
+		return q.writeCursor()
+	}
+
+	if err := q.close(); err != nil {
+		return err
+	}
+
+	q.segments = nil
+	q.roff = 0
+	q.wsize = 0
+	return os.RemoveAll(q.dir)
+}
+
+// close closes the open segment files of the queue. The queue must be locked.
+func (q *Queue) close() error {
+	var err error
+	if q.r != nil {
+		err = q.r.Close()
+		q.r = nil
+	}
+
+	if q.w != nil {
+		err = errors.Join(err, q.w.Close())
+		q.w = nil
+	}
+
+	return err
+}
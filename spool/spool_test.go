@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package spool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func pushAll(t *testing.T, q *Queue, v ...string) {
+	for _, s := range v {
+		require.NoError(t, q.Push([]byte(s)))
+	}
+}
+
+func popAll(t *testing.T, q *Queue) []string {
+	var out []string
+	for {
+		data, err := q.Peek()
+		if err == ErrEmpty {
+			return out
+		}
+		require.NoError(t, err)
+		require.NoError(t, q.Pop())
+		out = append(out, string(data))
+	}
+}
+
+func TestQueuePushPeekPop(t *testing.T) {
+	sp, err := Open(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer sp.Close()
+
+	q, err := sp.Queue("zen")
+	require.NoError(t, err)
+	_, err = q.Peek()
+	require.ErrorIs(t, err, ErrEmpty)
+	require.ErrorIs(t, q.Pop(), ErrEmpty)
+
+	pushAll(t, q, "one", "two", "three")
+	require.Equal(t, 3, q.Len())
+	require.Equal(t, int64(11), q.Size())
+
+	data, err := q.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "one", string(data))
+	require.Equal(t, 3, q.Len()) // peek does not remove the record.
+
+	require.Equal(t, []string{"one", "two", "three"}, popAll(t, q))
+	require.Equal(t, 0, q.Len())
+	require.Equal(t, int64(0), q.Size())
+	require.NoDirExists(t, q.dir) // the files of an empty queue are deleted.
+
+	pushAll(t, q, "four")
+	require.Equal(t, []string{"four"}, popAll(t, q))
+}
+
+func TestQueueSegments(t *testing.T) {
+	sp, err := Open(t.TempDir(), 20)
+	require.NoError(t, err)
+	defer sp.Close()
+
+	q, err := sp.Queue("zen")
+	require.NoError(t, err)
+	pushAll(t, q, "aaaa", "bbbb", "cccc", "dddd", "eeee") // 12 bytes each, one per segment.
+	require.Len(t, q.segments, 5)
+
+	for _, v := range []string{"aaaa", "bbbb", "cccc"} {
+		data, err := q.Peek()
+		require.NoError(t, err)
+		require.Equal(t, v, string(data))
+		require.NoError(t, q.Pop())
+	}
+
+	_, err = q.Peek()
+	require.NoError(t, err)
+	require.Len(t, q.segments, 2) // read segments are deleted.
+	require.NoFileExists(t, q.segmentPath(0))
+}
+
+func TestOpenRestoresQueues(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := Open(dir, 20)
+	require.NoError(t, err)
+
+	q, err := sp.Queue("zen")
+	require.NoError(t, err)
+	pushAll(t, q, "aaaa", "bbbb", "cccc")
+	require.NoError(t, q.Pop())
+
+	q2, err := sp.Queue("mochi/1")
+	require.NoError(t, err)
+	pushAll(t, q2, "x")
+	require.NoError(t, sp.Close())
+
+	require.ErrorIs(t, q.Push([]byte("late")), ErrClosed)
+	_, err = sp.Queue("zen")
+	require.ErrorIs(t, err, ErrClosed)
+
+	sp, err = Open(dir, 20)
+	require.NoError(t, err)
+	defer sp.Close()
+	require.Equal(t, []string{"mochi/1", "zen"}, sp.Clients())
+
+	q, ok := sp.Get("zen")
+	require.True(t, ok)
+	require.Equal(t, 2, q.Len())
+	require.Equal(t, int64(8), q.Size())
+	pushAll(t, q, "dddd")
+	require.Equal(t, []string{"bbbb", "cccc", "dddd"}, popAll(t, q))
+}
+
+func TestOpenTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := Open(dir, 0)
+	require.NoError(t, err)
+
+	q, err := sp.Queue("zen")
+	require.NoError(t, err)
+	pushAll(t, q, "one", "two")
+	path := q.segmentPath(0)
+	require.NoError(t, sp.Close())
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2}) // a header cut short by a crash.
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	sp, err = Open(dir, 0)
+	require.NoError(t, err)
+	defer sp.Close()
+
+	q, ok := sp.Get("zen")
+	require.True(t, ok)
+	require.Equal(t, 2, q.Len())
+	pushAll(t, q, "three")
+	require.Equal(t, []string{"one", "two", "three"}, popAll(t, q))
+}
+
+func TestReadRecordCorrupt(t *testing.T) {
+	sp, err := Open(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer sp.Close()
+
+	q, err := sp.Queue("zen")
+	require.NoError(t, err)
+	pushAll(t, q, "one")
+
+	f, err := os.OpenFile(q.segmentPath(0), os.O_RDWR, 0o600)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteAt([]byte("x"), headerSize)
+	require.NoError(t, err)
+
+	_, err = readRecord(f, 0)
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestSpoolRemove(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := Open(dir, 0)
+	require.NoError(t, err)
+	defer sp.Close()
+
+	q, err := sp.Queue("zen")
+	require.NoError(t, err)
+	pushAll(t, q, "one")
+	require.DirExists(t, q.dir)
+
+	require.NoError(t, sp.Remove("zen"))
+	require.NoError(t, sp.Remove("zen"))
+	require.NoDirExists(t, q.dir)
+	require.Empty(t, sp.Clients())
+	_, ok := sp.Get("zen")
+	require.False(t, ok)
+	require.ErrorIs(t, q.Push([]byte("two")), ErrClosed)
+}
+
+func TestOpenSkipsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "readme"), nil, 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "not-hex"), 0o700))
+
+	sp, err := Open(dir, 0)
+	require.NoError(t, err)
+	defer sp.Close()
+	require.Empty(t, sp.Clients())
+}
@@ -0,0 +1,319 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 mochi-mqtt, mochi-co
+// SPDX-FileContributor: xyzj
+
+package mqtt
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xyzj/mqtt-server/listeners"
+	"github.com/xyzj/mqtt-server/packets"
+)
+
+// newSpoolTestServer returns a server with a spool and an inflight quota of 2.
+func newSpoolTestServer(t *testing.T, opts Spool) *Server {
+	s := newServer()
+	t.Cleanup(func() { _ = s.Close() })
+	opts.Dir = t.TempDir()
+	s.Options.Spool = opts
+	s.Options.Capabilities.MaximumInflight = 2
+	require.NoError(t, s.openSpool())
+	return s
+}
+
+// publishSpoolTest publishes qos 1 messages to a client.
+func publishSpoolTest(t *testing.T, s *Server, cl *Client, payloads ...string) {
+	for _, v := range payloads {
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b", Qos: 1}, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			TopicName:   "a/b",
+			Payload:     []byte(v),
+			Created:     time.Now().Unix(),
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestSpoolValidate(t *testing.T) {
+	require.NoError(t, Spool{}.validate())
+	require.NoError(t, Spool{Dir: "spool", MaxBytes: 1 << 20, MaxMessages: 1000}.validate())
+	require.ErrorIs(t, Spool{MaxBytes: -1}.validate(), ErrSpoolInvalid)
+	require.ErrorIs(t, Spool{SegmentSize: -1}.validate(), ErrSpoolInvalid)
+}
+
+func TestServerServeSpoolInvalid(t *testing.T) {
+	s := New(&Options{Logger: logger, Spool: Spool{MaxMessages: -1}})
+	require.ErrorIs(t, s.Serve(), ErrSpoolInvalid)
+}
+
+func TestClientPersistent(t *testing.T) {
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 4
+	require.True(t, cl.persistent())
+	cl.Properties.Clean = true
+	require.False(t, cl.persistent())
+
+	cl.Properties.ProtocolVersion = 5
+	require.False(t, cl.persistent())
+	cl.Properties.Props.SessionExpiryInterval = 30
+	require.True(t, cl.persistent())
+}
+
+func TestPublishToClientSpool(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+
+	publishSpoolTest(t, s, cl, "1", "2", "3", "4")
+	require.Equal(t, 2, cl.State.Inflight.Len())
+	require.Equal(t, 2, s.SpoolLen(cl.ID))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.InflightDropped))
+
+	first, _ := cl.State.outbound.pop()
+	require.NoError(t, s.processPuback(cl, packets.Packet{PacketID: first.PacketID}))
+	require.Equal(t, 2, cl.State.Inflight.Len())
+	require.Equal(t, 1, s.SpoolLen(cl.ID))
+
+	publishSpoolTest(t, s, cl, "5") // queued behind the spooled messages, although there is inflight quota.
+	require.Equal(t, 2, s.SpoolLen(cl.ID))
+
+	var got []string
+	for cl.State.outbound.Len() > 0 || s.SpoolLen(cl.ID) > 0 {
+		pk, ok := cl.State.outbound.pop()
+		require.True(t, ok)
+		got = append(got, string(pk.Payload))
+		require.NoError(t, s.processPuback(cl, packets.Packet{PacketID: pk.PacketID}))
+	}
+	require.Equal(t, []string{"2", "3", "4", "5"}, got)
+	require.Equal(t, 0, cl.State.Inflight.Len())
+}
+
+func TestPublishToClientSpoolCleanSession(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	cl := newQueueTestClient()
+	cl.Properties.Clean = true
+	s.Clients.Add(cl)
+
+	publishSpoolTest(t, s, cl, "1", "2")
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b", Qos: 1}, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+	})
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	require.Equal(t, 0, s.SpoolLen(cl.ID))
+}
+
+func TestSpoolMessageLimits(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{MaxMessages: 2})
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b"}
+	require.NoError(t, s.spoolMessage(cl, pk))
+	require.NoError(t, s.spoolMessage(cl, pk))
+	require.ErrorIs(t, s.spoolMessage(cl, pk), packets.ErrQuotaExceeded)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.InflightDropped))
+
+	q, _ := s.spool.Get(cl.ID)
+	s.Options.Spool = Spool{MaxBytes: q.Size() + 50}
+	pk.Payload = make([]byte, 50)
+	require.ErrorIs(t, s.spoolMessage(cl, pk), packets.ErrQuotaExceeded)
+	require.Equal(t, 2, s.SpoolLen(cl.ID))
+}
+
+func TestDrainSpoolExpired(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+
+	require.NoError(t, s.spoolMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+		Payload:     []byte("old"),
+		Created:     time.Now().Unix() - 10,
+		Properties:  packets.Properties{MessageExpiryInterval: 5},
+	}))
+	require.NoError(t, s.spoolMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+		Payload:     []byte("new"),
+		Created:     time.Now().Unix(),
+	}))
+
+	s.drainSpool(cl)
+	require.Equal(t, 0, s.SpoolLen(cl.ID))
+	require.Equal(t, 1, cl.State.Inflight.Len())
+	pk, _ := cl.State.outbound.pop()
+	require.Equal(t, "new", string(pk.Payload))
+}
+
+func TestSendSpooledNotQueued(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	hook := &inflightStoreHook{stored: map[uint16]bool{}}
+	require.NoError(t, s.AddHook(hook, nil))
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+	for i := 0; i < cl.State.outbound.capacity; i++ {
+		cl.State.outbound.push(&packets.Packet{TopicName: "full"}, 0)
+	}
+
+	require.False(t, s.sendSpooled(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b"}))
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Empty(t, hook.stored) // no stale inflight message is left in the store.
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.Inflight))
+}
+
+func TestPublishToClientSpoolBlockUnlocked(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	s.Options.OutboundQueue = OutboundQueue{Policy: OutboundBlock, BlockTimeout: 60000}
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+	for i := 0; i < cl.State.outbound.capacity; i++ {
+		cl.State.outbound.push(&packets.Packet{TopicName: "full"}, 0)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b", Qos: 1}, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			TopicName:   "a/b",
+			Origin:      "pub",
+		})
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		return cl.State.Inflight.Len() == 1 // inflight, and waiting for outbound queue space.
+	}, time.Second, time.Millisecond)
+
+	// the spool can be drained while the publisher waits.
+	require.True(t, cl.State.spoolLock.TryLock())
+	cl.State.spoolLock.Unlock()
+	select {
+	case <-done:
+		t.Fatal("publish should wait for space in the outbound queue")
+	default:
+	}
+
+	_, _ = cl.State.outbound.pop()
+	require.NoError(t, <-done)
+}
+
+func TestDrainSpoolOffline(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+	cl.Stop(packets.ErrServerShuttingDown)
+
+	require.NoError(t, s.spoolMessage(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b"}))
+	s.drainSpool(cl)
+	require.Equal(t, 1, cl.State.Inflight.Len()) // kept inflight to be resent on reconnect.
+	require.Equal(t, 0, cl.State.outbound.Len())
+}
+
+func TestServerSpoolRemovedWithSession(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	cl := newQueueTestClient()
+	s.Clients.Add(cl)
+	require.NoError(t, s.spoolMessage(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b"}))
+
+	cl.Stop(packets.ErrServerShuttingDown)
+	s.Options.Capabilities.MaximumSessionExpiryInterval = 0
+	s.clearExpiredClients(time.Now().Unix() + 1)
+	require.Equal(t, 0, s.SpoolLen(cl.ID))
+	require.Empty(t, s.spool.Clients())
+}
+
+func TestServerOpenSpoolDiscardsUnknownSessions(t *testing.T) {
+	s := newSpoolTestServer(t, Spool{})
+	known := newQueueTestClient()
+	s.Clients.Add(known)
+	unknown := newQueueTestClient()
+	unknown.ID = "gone"
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b"}
+	require.NoError(t, s.spoolMessage(known, pk))
+	require.NoError(t, s.spoolMessage(unknown, pk))
+	require.NoError(t, s.spool.Close())
+
+	require.NoError(t, s.openSpool()) // as when the server restarts with its sessions restored from a store.
+	require.Equal(t, []string{"mochi"}, s.spool.Clients())
+	require.Equal(t, 1, s.SpoolLen(known.ID))
+}
+
+func TestServerSpoolDrainsOnReconnect(t *testing.T) {
+	s := New(&Options{
+		Logger:       logger,
+		InlineClient: true,
+		Spool:        Spool{Dir: t.TempDir()},
+	})
+	s.Options.Capabilities.MaximumInflight = 2
+	require.NoError(t, s.AddHook(new(AllowHook), nil))
+	l := listeners.NewMemory(listeners.Config{ID: "mem"})
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	conn, err := l.DialContext(context.Background(), "")
+	require.NoError(t, err)
+	_, err = conn.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes) // persistent session "zen"
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4)) // connack
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{
+		packets.Subscribe<<4 | 1<<1, 8, // Fixed header
+		0, 1, // Packet ID
+		0, 3, 'a', '/', 'b', // Topic Name
+		1, // QoS
+	})
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5)) // suback
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{packets.Disconnect << 4, 0})
+	require.NoError(t, err)
+
+	cl, ok := s.Clients.Get("zen")
+	require.True(t, ok)
+	require.Eventually(t, cl.Closed, time.Second, time.Millisecond)
+
+	for _, v := range []string{"1", "2", "3", "4"} {
+		require.NoError(t, s.Publish("a/b", []byte(v), false, 1))
+	}
+	require.Equal(t, 2, cl.State.Inflight.Len())
+	require.Equal(t, 2, s.SpoolLen("zen"))
+
+	conn, err = l.DialContext(context.Background(), "")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+	require.NoError(t, err)
+	require.Equal(t, packets.Connack, readSlowTestPacket(t, conn).FixedHeader.Type)
+
+	var got []string
+	for _, n := range []int{2, 2} { // the inflight messages are resent before the acks are read.
+		var ids []uint16
+		for i := 0; i < n; i++ {
+			pk := readSlowTestPacket(t, conn)
+			require.Equal(t, packets.Publish, pk.FixedHeader.Type)
+			got = append(got, string(pk.Payload))
+			ids = append(ids, pk.PacketID)
+		}
+
+		for _, id := range ids {
+			_, err = conn.Write([]byte{packets.Puback << 4, 2, byte(id >> 8), byte(id)})
+			require.NoError(t, err)
+		}
+	}
+
+	require.ElementsMatch(t, []string{"1", "2"}, got[:2]) // resent inflight messages.
+	require.Equal(t, []string{"3", "4"}, got[2:])         // then the spool, in order.
+	require.Eventually(t, func() bool {
+		return s.SpoolLen("zen") == 0
+	}, time.Second, time.Millisecond)
+}
@@ -20,16 +20,26 @@ type Info struct {
 	ClientsDisconnected int64  `json:"clients_disconnected"` // total number of persistent clients (with clean session disabled) that are registered at the broker but are currently disconnected
 	ClientsMaximum      int64  `json:"clients_maximum"`      // maximum number of active clients that have been connected
 	ClientsTotal        int64  `json:"clients_total"`        // total number of connected and disconnected clients with a persistent session currently connected and registered
+	ClientsSlow         int64  `json:"clients_slow"`         // number of clients found to be slow subscribers in the last window
 	MessagesReceived    int64  `json:"messages_received"`    // total number of publish messages received
 	MessagesSent        int64  `json:"messages_sent"`        // total number of publish messages sent
 	MessagesDropped     int64  `json:"messages_dropped"`     // total number of publish messages dropped to slow subscriber
 	Retained            int64  `json:"retained"`             // total number of retained messages active on the broker
+	RetainedRejected    int64  `json:"retained_rejected"`    // the number of retained messages rejected by the retain limits
+	RetainedEvicted     int64  `json:"retained_evicted"`     // the number of retained messages evicted to make space for newer ones
 	Inflight            int64  `json:"inflight"`             // the number of messages currently in-flight
 	InflightDropped     int64  `json:"inflight_dropped"`     // the number of inflight messages which were dropped
+	InlineDropped       int64  `json:"inline_dropped"`       // the number of messages dropped by full inline subscription channels
+	RateLimited         int64  `json:"rate_limited"`         // the number of publishes received over a client rate limit
+	RateLimitDropped    int64  `json:"rate_limit_dropped"`   // the number of publishes dropped by client rate limits
+	SlowEvicted         int64  `json:"slow_evicted"`         // the number of slow subscribers which were disconnected
 	Subscriptions       int64  `json:"subscriptions"`        // total number of subscriptions active on the broker
 	PacketsReceived     int64  `json:"packets_received"`     // the total number of publish messages received
 	PacketsSent         int64  `json:"packets_sent"`         // total number of messages of any type sent since the broker started
 	MemoryAlloc         int64  `json:"memory_alloc"`         // memory currently allocated
+	MemoryOutbound      int64  `json:"memory_outbound"`      // bytes of messages held in client outbound queues
+	MemoryInflight      int64  `json:"memory_inflight"`      // bytes of messages held as inflight messages
+	MemoryRetained      int64  `json:"memory_retained"`      // bytes of messages held as retained messages
 	Threads             int64  `json:"threads"`              // number of active goroutines, named as threads for platform ambiguity
 }
 
@@ -45,17 +55,27 @@ func (i *Info) Clone() *Info {
 		ClientsConnected:    atomic.LoadInt64(&i.ClientsConnected),
 		ClientsMaximum:      atomic.LoadInt64(&i.ClientsMaximum),
 		ClientsTotal:        atomic.LoadInt64(&i.ClientsTotal),
+		ClientsSlow:         atomic.LoadInt64(&i.ClientsSlow),
 		ClientsDisconnected: atomic.LoadInt64(&i.ClientsDisconnected),
 		MessagesReceived:    atomic.LoadInt64(&i.MessagesReceived),
 		MessagesSent:        atomic.LoadInt64(&i.MessagesSent),
 		MessagesDropped:     atomic.LoadInt64(&i.MessagesDropped),
 		Retained:            atomic.LoadInt64(&i.Retained),
+		RetainedRejected:    atomic.LoadInt64(&i.RetainedRejected),
+		RetainedEvicted:     atomic.LoadInt64(&i.RetainedEvicted),
 		Inflight:            atomic.LoadInt64(&i.Inflight),
 		InflightDropped:     atomic.LoadInt64(&i.InflightDropped),
+		InlineDropped:       atomic.LoadInt64(&i.InlineDropped),
+		RateLimited:         atomic.LoadInt64(&i.RateLimited),
+		RateLimitDropped:    atomic.LoadInt64(&i.RateLimitDropped),
+		SlowEvicted:         atomic.LoadInt64(&i.SlowEvicted),
 		Subscriptions:       atomic.LoadInt64(&i.Subscriptions),
 		PacketsReceived:     atomic.LoadInt64(&i.PacketsReceived),
 		PacketsSent:         atomic.LoadInt64(&i.PacketsSent),
 		MemoryAlloc:         atomic.LoadInt64(&i.MemoryAlloc),
+		MemoryOutbound:      atomic.LoadInt64(&i.MemoryOutbound),
+		MemoryInflight:      atomic.LoadInt64(&i.MemoryInflight),
+		MemoryRetained:      atomic.LoadInt64(&i.MemoryRetained),
 		Threads:             atomic.LoadInt64(&i.Threads),
 	}
 }
@@ -18,16 +18,26 @@ func TestClone(t *testing.T) {
 		ClientsMaximum:      7,
 		ClientsTotal:        8,
 		ClientsDisconnected: 9,
+		ClientsSlow:         27,
 		MessagesReceived:    10,
 		MessagesSent:        11,
 		MessagesDropped:     20,
 		Retained:            12,
+		RetainedRejected:    29,
+		RetainedEvicted:     30,
 		Inflight:            13,
 		InflightDropped:     14,
+		InlineDropped:       21,
+		RateLimited:         22,
+		RateLimitDropped:    23,
+		SlowEvicted:         28,
 		Subscriptions:       15,
 		PacketsReceived:     16,
 		PacketsSent:         17,
 		MemoryAlloc:         18,
+		MemoryOutbound:      24,
+		MemoryInflight:      25,
+		MemoryRetained:      26,
 		Threads:             19,
 	}
 